@@ -0,0 +1,45 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+)
+
+// runConfig implements `rpcv2-hist config print`, which dumps the effective
+// config (defaults, file, env and flags merged) with secrets redacted.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: rpcv2-hist config print [--format yaml|json] [flags]")
+	}
+	fs := config.Flags()
+	format := fs.String("format", "yaml", "output format: yaml or json")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	cfg, err := config.Load(fs)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	out := cfg.Redacted()
+
+	switch *format {
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		defer enc.Close()
+		return enc.Encode(out)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
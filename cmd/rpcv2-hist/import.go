@@ -0,0 +1,98 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/car"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
+)
+
+const importUsage = "usage: rpcv2-hist import car [--state file] [flags] archive.car..."
+
+// runImport implements `rpcv2-hist import car`, which loads Old Faithful
+// epoch archives through the ingester into the first shard's backend.
+// Progress is saved to --state, so an interrupted import picks up after
+// the last stored block.
+func runImport(args []string) error {
+	if len(args) == 0 || args[0] != "car" {
+		return errors.New(importUsage)
+	}
+	fs := config.Flags()
+	statePath := fs.String("state", "car-import.state", "file recording import progress per archive")
+	progress := fs.Duration("progress-interval", 10*time.Second, "how often to log and save progress")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(importUsage)
+	}
+	cfg, err := config.Load(fs)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	logger, err := telemetry.NewLogger(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("new logger: %w", err)
+	}
+	defer func() { _ = logger.Sync() }()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	stores, err := openBackends(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer closeBackends(stores)
+
+	// archives hold rooted blocks only
+	ing, err := ingest.New(stores[cfg.Shards[0].Backend],
+		ingest.WithLogger(logger),
+		ingest.WithCommitment(storage.CommitmentFinalized),
+		ingest.WithQueueSize(cfg.Ingest.QueueSize),
+		ingest.WithBatchLimits(cfg.Ingest.BatchRows, cfg.Ingest.BatchBytes, cfg.Ingest.BatchMaxAge),
+	)
+	if err != nil {
+		return fmt.Errorf("new ingester: %w", err)
+	}
+	im, err := car.New(ing,
+		car.WithLogger(logger),
+		car.WithStatePath(*statePath),
+		car.WithProgressInterval(*progress),
+	)
+	if err != nil {
+		return err
+	}
+
+	// the ingester outlives ctx so a signal still flushes what was read
+	ingCtx, stopIngest := context.WithCancel(context.Background())
+	ingDone := make(chan struct{})
+	go func() {
+		defer close(ingDone)
+		_ = ing.Run(ingCtx)
+	}()
+	for _, path := range fs.Args() {
+		if err = im.Import(ctx, path); err != nil {
+			err = fmt.Errorf("import %s: %w", path, err)
+			break
+		}
+	}
+	stopIngest()
+	<-ingDone
+	if serr := im.Save(); serr != nil {
+		logger.Error("save import state", zap.Error(serr))
+	}
+	return err
+}
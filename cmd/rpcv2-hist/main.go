@@ -14,47 +14,175 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/lilythecat859/rpcv2-hist/internal/api/guard"
 	"github.com/lilythecat859/rpcv2-hist/internal/api/jsonrpc"
 	"github.com/lilythecat859/rpcv2-hist/internal/api/rest"
 	"github.com/lilythecat859/rpcv2-hist/internal/config"
 	"github.com/lilythecat859/rpcv2-hist/internal/fractal"
+	"github.com/lilythecat859/rpcv2-hist/internal/health"
 	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
-	"github.com/lilythecat859/rpcv2-hist/internal/storage/clickhouse"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/backfill"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/checkpoint"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/kafka"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wal"
+	"github.com/lilythecat859/rpcv2-hist/internal/metrics"
+	"github.com/lilythecat859/rpcv2-hist/internal/ratelimit"
+	"github.com/lilythecat859/rpcv2-hist/internal/reload"
 	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
 	"github.com/oklog/run"
-	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 func main() {
-	if err := runMain(); err != nil {
+	if err := dispatch(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func runMain() error {
+func dispatch(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			return runConfig(args[1:])
+		case "import":
+			return runImport(args[1:])
+		case "migrate":
+			return runMigrate(args[1:])
+		case "serve":
+			args = args[1:]
+		}
+	}
+	return runMain(args)
+}
+
+func runMain(args []string) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	cfg, err := config.Load()
+	fs := config.Flags()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := config.Load(fs)
 	if err != nil {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-fractalRoot := fractal.NewRoot(db, logger)
+	logger, level, err := telemetry.NewLeveledLogger(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("new logger: %w", err)
+	}
+	defer func() { _ = logger.Sync() }()
+
+	stores, err := openBackends(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	primary := cfg.Shards[0].Backend
+
+	// ingestion writes through the first shard's backend.
+	ingOpts := []ingest.Option{
+		ingest.WithLogger(logger),
+		ingest.WithCommitment(ingestCommitment(cfg)),
+		ingest.WithQueueSize(cfg.Ingest.QueueSize),
+		ingest.WithDedupWindow(cfg.Ingest.DedupWindow),
+		ingest.WithBatchLimits(cfg.Ingest.BatchRows, cfg.Ingest.BatchBytes, cfg.Ingest.BatchMaxAge),
+	}
+	if wc := cfg.Ingest.WAL; wc.Dir != "" {
+		w, err := wal.Open(wc.Dir,
+			wal.WithLogger(logger),
+			wal.WithSegmentSize(wc.SegmentSize),
+			wal.WithSync(wal.SyncPolicy(wc.Sync), wc.SyncInterval),
+		)
+		if err != nil {
+			return fmt.Errorf("open ingest wal: %w", err)
+		}
+		defer w.Close()
+		ingOpts = append(ingOpts, ingest.WithWAL(w))
+	}
+	var cp *checkpoint.Checkpoint
+	if cc := cfg.Ingest.Checkpoint; cc.Path != "" {
+		if cp, err = checkpoint.Open(cc.Path, checkpoint.WithLogger(logger), checkpoint.WithSaveInterval(cc.SaveInterval)); err != nil {
+			return fmt.Errorf("open ingest checkpoint: %w", err)
+		}
+		// runs after every actor, so the final flush is included
+		defer func() {
+			if err := cp.Save(); err != nil {
+				logger.Error("save ingest checkpoint", zap.Error(err))
+			}
+		}()
+		ingOpts = append(ingOpts, ingest.WithCheckpoint(cp))
+	}
+	if cfg.Ingest.Kafka.OutputTopic != "" {
+		sink, err := kafka.NewSink(kafkaConfig(cfg))
+		if err != nil {
+			return fmt.Errorf("kafka output: %w", err)
+		}
+		defer sink.Close()
+		ingOpts = append(ingOpts, ingest.WithPublisher(sink))
+	}
+	ing, err := ingest.New(stores[primary], ingOpts...)
+	if err != nil {
+		return fmt.Errorf("new ingester: %w", err)
+	}
+
+	tj, err := tierJob(cfg, stores, logger)
+	if err != nil {
+		return err
+	}
+
+	fractalRoot := fractal.NewRoot(stores[primary], logger)
+	fractalRoot.SetShards(fractalShards(cfg, stores))
+	exports, err := exportManager(cfg, fractalRoot, logger)
+	if err != nil {
+		return err
+	}
+	telemetryCfg := telemetry.Config{
+		OTLPEndpoint:    cfg.Telemetry.OTLPEndpoint,
+		TraceSampleRate: cfg.Telemetry.TraceSampleRate,
+		MetricsListen:   cfg.Telemetry.MetricsListen,
+	}
+
+	limiter := ratelimit.New(rateLimitConfig(cfg))
+	guardCfg := guardConfig(cfg)
+
+	checker := health.NewChecker(logger,
+		health.WithTimeout(cfg.Health.Timeout),
+		health.WithIngestLag(ing, cfg.Health.MaxSlotLag),
+	)
+	checker.Register(shardCheck(fractalRoot), true)
+
+	state := &live{
+		ctx:     ctx,
+		logger:  logger,
+		level:   level,
+		limiter: limiter,
+		root:    fractalRoot,
+		primary: primary,
+		stores:  stores,
+	}
+	defer state.close()
+	checker.Register(state.caches, false)
+	reloader := reload.New(cfg, func() (*config.Config, error) { return config.Load(fs) }, state,
+		reload.WithLogger(logger),
+		reload.WithWatchFile(config.FilePath(fs)),
+	)
 
 	var g run.Group
 	// JSON-RPC server
 	{
-		rpcSrv := jsonrpc.NewServer(fractalRoot, logger)
+		rpcSrv := jsonrpc.NewServer(fractalRoot, logger,
+			jsonrpc.WithRateLimiter(limiter),
+			jsonrpc.WithGuard(guardCfg),
+			jsonrpc.WithMetrics(telemetry.NewMetrics("jsonrpc")),
+			jsonrpc.WithHealth(checker),
+		)
 		mux := http.NewServeMux()
 		mux.Handle("/", rpcSrv)
-		srv := &http.Server{
-			Addr:    cfg.JSONRPCListen,
-			Handler: telemetry.HTTPMiddleware(mux),
-		}
+		srv := guard.NewHTTPServer("jsonrpc", cfg.JSONRPCListen, telemetry.HTTPMiddleware(mux), guardCfg)
 		g.Add(func() error {
 			logger.Info("starting json-rpc", zap.String("addr", cfg.JSONRPCListen))
 			return srv.ListenAndServe()
@@ -66,11 +194,13 @@ fractalRoot := fractal.NewRoot(db, logger)
 	}
 	// REST gateway
 	{
-		restSrv := rest.NewServer(fractalRoot, logger)
-		srv := &http.Server{
-			Addr:    cfg.RESTListen,
-			Handler: telemetry.HTTPMiddleware(restSrv),
-		}
+		restSrv := rest.NewServer(fractalRoot, logger,
+			rest.WithRateLimiter(limiter),
+			rest.WithGuard(guardCfg),
+			rest.WithMetrics(telemetry.NewMetrics("rest")),
+			rest.WithExports(exports),
+		)
+		srv := guard.NewHTTPServer("rest", cfg.RESTListen, telemetry.HTTPMiddleware(restSrv), guardCfg)
 		g.Add(func() error {
 			logger.Info("starting rest", zap.String("addr", cfg.RESTListen))
 			return srv.ListenAndServe()
@@ -86,10 +216,18 @@ fractalRoot := fractal.NewRoot(db, logger)
 		if err != nil {
 			return fmt.Errorf("grpc listen: %w", err)
 		}
-		srv := grpc.NewServer(
-			grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		unary := []grpc.UnaryServerInterceptor{
+			otelgrpc.UnaryServerInterceptor(),
+			telemetry.NewMetrics("grpc").UnaryServerInterceptor(),
+		}
+		if guardCfg.MaxInFlight > 0 {
+			unary = append(unary, guard.UnaryLimitInFlight("grpc", guardCfg.MaxInFlight))
+		}
+		unary = append(unary, guard.UnaryDeadline(guardCfg))
+		srv := grpc.NewServer(append([]grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(unary...),
 			grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
-		)
+		}, guard.ServerOptions(guardCfg)...)...)
 		// register services here
 		g.Add(func() error {
 			logger.Info("starting grpc", zap.String("addr", cfg.GRPCListen))
@@ -98,6 +236,48 @@ fractalRoot := fractal.NewRoot(db, logger)
 			srv.GracefulStop()
 		})
 	}
+	// Prometheus metrics
+	{
+		// probes are served here, outside the API key and load shedding
+		srv := metrics.NewServer(telemetryCfg.MetricsAddr(), checker.Routes())
+		g.Add(func() error {
+			logger.Info("starting prometheus metrics", zap.String("addr", srv.Addr))
+			return srv.ListenAndServe()
+		}, func(err error) {
+			shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = srv.Shutdown(shutdownCtx)
+			done()
+		})
+	}
+	// Admin endpoints; unauthenticated, so loopback by default
+	if addr := cfg.Telemetry.AdminListen; addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/admin/reload", reloader)
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+			// a reload may open backends
+			WriteTimeout: time.Minute,
+		}
+		g.Add(func() error {
+			logger.Info("starting admin", zap.String("addr", srv.Addr))
+			return srv.ListenAndServe()
+		}, func(err error) {
+			shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = srv.Shutdown(shutdownCtx)
+			done()
+		})
+	}
+	// Config reload
+	{
+		reloadCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			return reloader.Run(reloadCtx)
+		}, func(err error) {
+			stop()
+		})
+	}
 	// Ingester
 	{
 		g.Add(func() error {
@@ -106,6 +286,58 @@ fractalRoot := fractal.NewRoot(db, logger)
 			cancel()
 		})
 	}
+	// Ingestion source
+	src := ingestSource(cfg, logger)
+	if src != nil {
+		srcCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			logger.Info("starting ingestion source", zap.String("source", src.Name()))
+			return src.Run(srcCtx, ing)
+		}, func(err error) {
+			stop()
+		})
+	}
+	// Ingest checkpoint and gap backfill
+	if cp != nil {
+		cpCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			return cp.Run(cpCtx)
+		}, func(err error) {
+			stop()
+		})
+	}
+	if cp != nil && cfg.Ingest.Backfill.Enabled {
+		if f := backfillFetcher(cfg, src, logger); f != nil {
+			w := backfill.New(cp, f, ing, ingestCommitment(cfg),
+				backfill.WithLogger(logger),
+				backfill.WithInterval(cfg.Ingest.Backfill.Interval),
+			)
+			bfCtx, stop := context.WithCancel(ctx)
+			g.Add(func() error {
+				return w.Run(bfCtx)
+			}, func(err error) {
+				stop()
+			})
+		}
+	}
+	// Partition tiering
+	if tj != nil {
+		tierCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			return tj.Run(tierCtx)
+		}, func(err error) {
+			stop()
+		})
+	}
+	// Export jobs
+	if exports != nil {
+		exportCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			return exports.Run(exportCtx)
+		}, func(err error) {
+			stop()
+		})
+	}
 	// Signal handler
 	{
 		g.Add(func() error {
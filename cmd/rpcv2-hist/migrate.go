@@ -0,0 +1,94 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	cbt "cloud.google.com/go/bigtable"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/bigtable"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
+)
+
+const migrateUsage = "usage: rpcv2-hist migrate bigtable --project id --instance name [--tables tx,tx-by-addr,blocks] [--state file] [flags]"
+
+// runMigrate implements `rpcv2-hist migrate bigtable`, which copies a
+// validator's BigTable ledger history into the first shard's backend.
+// Progress is saved per table to --state, so an interrupted migration
+// resumes after the last written row.
+func runMigrate(args []string) error {
+	if len(args) == 0 || args[0] != "bigtable" {
+		return errors.New(migrateUsage)
+	}
+	fs := config.Flags()
+	project := fs.String("project", "", "Google Cloud project of the BigTable instance")
+	instance := fs.String("instance", "", "BigTable instance")
+	credentials := fs.String("credentials", "", "service account key file; application default credentials when empty")
+	tables := fs.StringSlice("tables", bigtable.Tables, "tables to migrate, in order")
+	statePath := fs.String("state", "bigtable-migrate.state", "file recording migration progress per table")
+	batchRows := fs.Int("batch-rows", 10_000, "rows written per batch")
+	progress := fs.Duration("progress-interval", 10*time.Second, "how often to log and save progress")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *project == "" || *instance == "" || fs.NArg() > 0 {
+		return errors.New(migrateUsage)
+	}
+	cfg, err := config.Load(fs)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	logger, err := telemetry.NewLogger(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("new logger: %w", err)
+	}
+	defer func() { _ = logger.Sync() }()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	var opts []option.ClientOption
+	if *credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(*credentials))
+	}
+	client, err := cbt.NewClient(ctx, *project, *instance, opts...)
+	if err != nil {
+		return fmt.Errorf("bigtable client: %w", err)
+	}
+	defer client.Close()
+
+	stores, err := openBackends(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer closeBackends(stores)
+	w, ok := storage.As[storage.Writer](stores[cfg.Shards[0].Backend])
+	if !ok {
+		return fmt.Errorf("backend %s does not accept writes", cfg.Shards[0].Backend)
+	}
+
+	m, err := bigtable.New(client, w,
+		bigtable.WithLogger(logger),
+		bigtable.WithStatePath(*statePath),
+		bigtable.WithBatchRows(*batchRows),
+		bigtable.WithProgressInterval(*progress),
+	)
+	if err != nil {
+		return err
+	}
+	err = m.Run(ctx, *tables...)
+	if serr := m.Save(); serr != nil {
+		logger.Error("save migration state", zap.Error(serr))
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+	"github.com/lilythecat859/rpcv2-hist/internal/fractal"
+	"github.com/lilythecat859/rpcv2-hist/internal/health"
+	"github.com/lilythecat859/rpcv2-hist/internal/ratelimit"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// retireAfter is how long replaced backends stay open so that reads which
+// picked them up before a reload can finish.
+const retireAfter = time.Minute
+
+// live holds the state a config reload may replace. It implements
+// reload.Applier.
+type live struct {
+	ctx     context.Context
+	logger  *zap.Logger
+	level   zap.AtomicLevel
+	limiter *ratelimit.Limiter
+	root    *fractal.Root
+	primary string // backend feeding the ingester; fixed until restart
+
+	mu     sync.Mutex
+	stores map[string]storage.HistoricalStore
+}
+
+func (l *live) Prepare(old, next *config.Config) (func(), error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(next.LogLevel)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	if !reflect.DeepEqual(old.Backends[l.primary], next.Backends[l.primary]) {
+		return nil, fmt.Errorf("backend %q feeds ingestion; changing it requires a restart", l.primary)
+	}
+
+	l.mu.Lock()
+	current := l.stores
+	l.mu.Unlock()
+
+	// reuse unchanged backends, open new or changed ones.
+	stores := make(map[string]storage.HistoricalStore, len(next.Backends))
+	opened := make(map[string]storage.HistoricalStore)
+	for name, b := range next.Backends {
+		if st, ok := current[name]; ok && reflect.DeepEqual(old.Backends[name], b) {
+			stores[name] = st
+			continue
+		}
+		st, err := openBackend(l.ctx, next, name, l.logger)
+		if err != nil {
+			closeBackends(opened)
+			return nil, err
+		}
+		stores[name] = st
+		opened[name] = st
+	}
+	retired := make(map[string]storage.HistoricalStore)
+	for name, st := range current {
+		if stores[name] != st {
+			retired[name] = st
+		}
+	}
+
+	return func() {
+		l.level.SetLevel(lvl)
+		l.limiter.Update(rateLimitConfig(next))
+		l.mu.Lock()
+		l.stores = stores
+		l.mu.Unlock()
+		l.root.SetShards(fractalShards(next, stores))
+		if len(retired) > 0 {
+			time.AfterFunc(retireAfter, func() { closeBackends(retired) })
+		}
+	}, nil
+}
+
+// close releases the backends that are live at shutdown.
+func (l *live) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	closeBackends(l.stores)
+}
+
+// caches reports the in-memory caches of the live backends, one component
+// per backend that keeps one.
+func (l *live) caches(ctx context.Context) []health.Component {
+	l.mu.Lock()
+	names := make([]string, 0, len(l.stores))
+	srcs := make(map[string]health.CacheSource)
+	for name, st := range l.stores {
+		for st != nil {
+			if src, ok := st.(health.CacheSource); ok {
+				names = append(names, name)
+				srcs[name] = src
+				break
+			}
+			u, ok := st.(storage.Unwrapper)
+			if !ok {
+				break
+			}
+			st = u.Unwrap()
+		}
+	}
+	l.mu.Unlock()
+	sort.Strings(names)
+	out := make([]health.Component, len(names))
+	for i, name := range names {
+		out[i] = health.CacheComponent("cache-"+name, srcs[name])
+	}
+	return out
+}
@@ -0,0 +1,284 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/api/guard"
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+	"github.com/lilythecat859/rpcv2-hist/internal/export"
+	"github.com/lilythecat859/rpcv2-hist/internal/factory"
+	"github.com/lilythecat859/rpcv2-hist/internal/fractal"
+	"github.com/lilythecat859/rpcv2-hist/internal/health"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/geyser"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/kafka"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/rpcpoll"
+	"github.com/lilythecat859/rpcv2-hist/internal/objstore"
+	"github.com/lilythecat859/rpcv2-hist/internal/ratelimit"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage/clickhouse"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage/instrument"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage/parquet"
+	"github.com/lilythecat859/rpcv2-hist/internal/tier"
+)
+
+func clickhouseConfig(c config.ClickHouseConfig) clickhouse.Config {
+	return clickhouse.Config{
+		Addr:            c.Addr,
+		Database:        c.Database,
+		User:            c.User,
+		Password:        c.Password,
+		AsyncInsert:     c.AsyncInsert,
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: c.ConnMaxLifetime,
+	}
+}
+
+// openBackends connects every configured backend and wraps it in the
+// instrumented store. On error, backends already opened are closed.
+func openBackends(ctx context.Context, cfg *config.Config, logger *zap.Logger) (map[string]storage.HistoricalStore, error) {
+	stores := make(map[string]storage.HistoricalStore, len(cfg.Backends))
+	for name := range cfg.Backends {
+		st, err := openBackend(ctx, cfg, name, logger)
+		if err != nil {
+			closeBackends(stores)
+			return nil, err
+		}
+		stores[name] = st
+	}
+	return stores, nil
+}
+
+func openBackend(ctx context.Context, cfg *config.Config, name string, logger *zap.Logger) (storage.HistoricalStore, error) {
+	b := cfg.Backends[name]
+	var backendCfg any
+	switch storage.StoreKind(b.Kind) {
+	case storage.StoreClickHouse:
+		backendCfg = clickhouseConfig(b.ClickHouse)
+	case storage.StoreParquet:
+		backendCfg = parquet.Config{Dir: b.Parquet.Dir}
+	}
+	db, err := factory.NewBackend(ctx, storage.StoreKind(b.Kind), backendCfg)
+	if err != nil {
+		return nil, fmt.Errorf("open backend %s: %w", name, err)
+	}
+	return instrument.New(db, b.Kind,
+		instrument.WithLogger(logger.With(zap.String("backend", name))),
+		instrument.WithSlowThreshold(cfg.Telemetry.SlowQueryThreshold),
+	), nil
+}
+
+func closeBackends(stores map[string]storage.HistoricalStore) {
+	for _, s := range stores {
+		_ = s.Close()
+	}
+}
+
+// fractalShards maps shards to their backends. Shards of a tiered backend
+// also read from its archive, through one store so they still share it.
+func fractalShards(cfg *config.Config, stores map[string]storage.HistoricalStore) []fractal.Shard {
+	shards := make([]fractal.Shard, 0, len(cfg.Shards))
+	var tiered storage.HistoricalStore
+	for _, sh := range cfg.Shards {
+		st := stores[sh.Backend]
+		if cfg.Tier.Backend != "" && sh.Backend == cfg.Tier.Backend {
+			if tiered == nil {
+				tiered = tier.NewStore(st, stores[cfg.Tier.Archive])
+			}
+			st = tiered
+		}
+		shards = append(shards, fractal.Shard{ID: sh.ID, Store: st})
+	}
+	return shards
+}
+
+// tierJob builds the job moving old partitions of Tier.Backend into
+// Tier.Archive, or nil when tiering is off.
+func tierJob(cfg *config.Config, stores map[string]storage.HistoricalStore, logger *zap.Logger) (*tier.Job, error) {
+	if cfg.Tier.Backend == "" {
+		return nil, nil
+	}
+	src, ok := storage.As[storage.Partitioner](stores[cfg.Tier.Backend])
+	if !ok {
+		return nil, fmt.Errorf("tier: backend %s has no partitions", cfg.Tier.Backend)
+	}
+	archive := cfg.Backends[cfg.Tier.Archive].Parquet
+	bucket, err := newBucket(archive.ObjectStore, logger)
+	if err != nil {
+		return nil, fmt.Errorf("tier: %w", err)
+	}
+	return tier.New(src, archive.Dir, bucket,
+		tier.WithLogger(logger),
+		tier.WithRetention(cfg.Tier.Retention),
+		tier.WithInterval(cfg.Tier.Interval),
+	), nil
+}
+
+// newBucket connects to the S3 bucket o describes.
+func newBucket(o config.ObjectStoreConfig, logger *zap.Logger) (*objstore.S3, error) {
+	opts := []objstore.Option{objstore.WithLogger(logger), objstore.WithPartSize(o.PartSize)}
+	if o.MaxRetries > 0 {
+		opts = append(opts, objstore.WithRetries(o.MaxRetries, 0))
+	}
+	return objstore.NewS3(objstore.S3Config{
+		Endpoint:  o.Endpoint,
+		Bucket:    o.Bucket,
+		Prefix:    o.Prefix,
+		Region:    o.Region,
+		AccessKey: o.AccessKey,
+		SecretKey: o.SecretKey,
+		Insecure:  o.Insecure,
+	}, opts...)
+}
+
+// exportManager runs export jobs against root, or is nil when exports are
+// disabled.
+func exportManager(cfg *config.Config, root *fractal.Root, logger *zap.Logger) (*export.Manager, error) {
+	e := cfg.Export
+	if e.Dir == "" {
+		return nil, nil
+	}
+	opts := []export.Option{
+		export.WithLogger(logger),
+		export.WithWorkers(e.Workers),
+		export.WithQueueSize(e.QueueSize),
+		export.WithMaxRows(e.MaxRows),
+		export.WithTimeout(e.Timeout),
+		export.WithRetention(e.Retention),
+	}
+	if e.ObjectStore.Bucket != "" {
+		bucket, err := newBucket(e.ObjectStore, logger)
+		if err != nil {
+			return nil, fmt.Errorf("export: %w", err)
+		}
+		opts = append(opts, export.WithBucket(bucket))
+	}
+	return export.New(root, e.Dir, opts...)
+}
+
+// shardCheck pings every current shard, so shards added by a reload are
+// covered without re-registering.
+func shardCheck(root *fractal.Root) health.CheckFunc {
+	return func(ctx context.Context) []health.Component {
+		shards := root.Shards()
+		out := make([]health.Component, len(shards))
+		for i, sh := range shards {
+			out[i] = health.PingComponent(ctx, fmt.Sprintf("shard-%d", sh.ID), sh.Store)
+		}
+		return out
+	}
+}
+
+// ingestSource builds the configured block feed, or nil when there is none.
+func ingestSource(cfg *config.Config, logger *zap.Logger) ingest.Source {
+	switch cfg.Ingest.Source {
+	case "geyser":
+		g := cfg.Ingest.Geyser
+		return geyser.New(geyser.Config{
+			Endpoint:   g.Endpoint,
+			XToken:     g.XToken,
+			Insecure:   g.Insecure,
+			Commitment: storage.Commitment(g.Commitment),
+			FromSlot:   g.FromSlot,
+			MinBackoff: g.MinBackoff,
+			MaxBackoff: g.MaxBackoff,
+		}, geyser.WithLogger(logger))
+	case "rpc":
+		r := cfg.Ingest.RPC
+		return rpcpoll.New(rpcpoll.Config{
+			Endpoint:     r.Endpoint,
+			Commitment:   storage.Commitment(r.Commitment),
+			FromSlot:     r.FromSlot,
+			Concurrency:  r.Concurrency,
+			PollInterval: r.PollInterval,
+			MaxRetries:   r.MaxRetries,
+			MinBackoff:   r.MinBackoff,
+			MaxBackoff:   r.MaxBackoff,
+		}, rpcpoll.WithLogger(logger))
+	case "kafka":
+		return kafka.New(kafkaConfig(cfg), kafka.WithLogger(logger))
+	}
+	return nil
+}
+
+func kafkaConfig(cfg *config.Config) kafka.Config {
+	k := cfg.Ingest.Kafka
+	return kafka.Config{
+		Brokers:        k.Brokers,
+		Topic:          k.Topic,
+		Group:          k.Group,
+		Commitment:     storage.Commitment(k.Commitment),
+		OutputTopic:    k.OutputTopic,
+		CommitInterval: k.CommitInterval,
+		TLS:            k.TLS,
+		User:           k.User,
+		Password:       k.Password,
+	}
+}
+
+// backfillFetcher is what missing slots are refetched from: the source
+// itself when it can fetch single blocks, otherwise Ingest.Backfill.Endpoint.
+func backfillFetcher(cfg *config.Config, src ingest.Source, logger *zap.Logger) ingest.Fetcher {
+	if f, ok := src.(ingest.Fetcher); ok {
+		return f
+	}
+	if cfg.Ingest.Backfill.Endpoint == "" {
+		return nil
+	}
+	c := ingestCommitment(cfg)
+	if c == storage.CommitmentProcessed {
+		c = storage.CommitmentConfirmed // getBlock does not serve processed
+	}
+	return rpcpoll.New(rpcpoll.Config{
+		Endpoint:   cfg.Ingest.Backfill.Endpoint,
+		Commitment: c,
+	}, rpcpoll.WithLogger(logger))
+}
+
+// ingestCommitment is the level the configured source delivers blocks at.
+func ingestCommitment(cfg *config.Config) storage.Commitment {
+	switch cfg.Ingest.Source {
+	case "geyser":
+		return storage.Commitment(cfg.Ingest.Geyser.Commitment)
+	case "rpc":
+		return storage.Commitment(cfg.Ingest.RPC.Commitment)
+	case "kafka":
+		return storage.Commitment(cfg.Ingest.Kafka.Commitment)
+	}
+	return storage.CommitmentConfirmed
+}
+
+func rateLimitConfig(cfg *config.Config) ratelimit.Config {
+	return ratelimit.Config{
+		Enabled:           cfg.RateLimit.Enabled,
+		RequestsPerSecond: cfg.RateLimit.RequestsPerSecond,
+		Burst:             cfg.RateLimit.Burst,
+		APIKeyHeader:      cfg.RateLimit.APIKeyHeader,
+		APIKeys:           cfg.Auth.APIKeys,
+		MethodCosts:       cfg.RateLimit.MethodCosts,
+		IdleTTL:           cfg.RateLimit.IdleTTL,
+	}
+}
+
+func guardConfig(cfg *config.Config) guard.Config {
+	return guard.Config{
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		MaxBodyBytes:      cfg.HTTP.MaxBodyBytes,
+		MaxInFlight:       cfg.HTTP.MaxInFlight,
+		DefaultDeadline:   cfg.HTTP.DefaultDeadline,
+		MethodDeadlines:   cfg.HTTP.MethodDeadlines,
+		APIKeyHeader:      cfg.Auth.APIKeyHeader,
+		APIKeys:           cfg.Auth.APIKeys,
+		MaxRecvMsgBytes:   cfg.HTTP.GRPCMaxRecvMsgBytes,
+	}
+}
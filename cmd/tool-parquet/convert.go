@@ -0,0 +1,283 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/car"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+)
+
+const convertUsage = "usage: tool-parquet convert --root dir [--format jsonl|car|clickhouse] [--jobs n] input..."
+
+// readers read the blocks of an input file, in order, for each format:
+//
+//	jsonl       getBlock results, one per line, each with a top-level slot
+//	car         Old Faithful epoch archives
+//	clickhouse  the blocks table exported with FORMAT JSONEachRow
+var readers = map[string]func(io.ReadSeeker, func(*model.Block) error) error{
+	"jsonl":      readJSONL,
+	"car":        car.Blocks,
+	"clickhouse": readClickHouse,
+}
+
+// runConvert implements `tool-parquet convert`, which adds the blocks of
+// every input, with the transaction and address rows derived from them,
+// to the dataset under --root. Inputs, typically one per day or epoch,
+// are converted --jobs at a time, each staged on its own and registered
+// once complete; a directory stands for the files in it.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	root := fs.String("root", "", "root of the dataset")
+	format := fs.String("format", "jsonl", "input format: jsonl, car or clickhouse")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "inputs converted in parallel")
+	batch := fs.Int("batch", 256, "blocks written at a time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	read := readers[*format]
+	if *root == "" || read == nil || fs.NArg() == 0 {
+		return errors.New(convertUsage)
+	}
+	inputs, err := expandInputs(fs.Args())
+	if err != nil {
+		return err
+	}
+	logger := newLogger()
+	defer func() { _ = logger.Sync() }()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, max(*jobs, 1))
+	for _, in := range inputs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := convert(ctx, *root, in, read, *batch, logger); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("convert %s: %w", in, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// expandInputs replaces directories with the regular files in them.
+func expandInputs(args []string) ([]string, error) {
+	var out []string
+	for _, a := range args {
+		fi, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			out = append(out, a)
+			continue
+		}
+		entries, err := os.ReadDir(a)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				out = append(out, filepath.Join(a, e.Name()))
+			}
+		}
+	}
+	return out, nil
+}
+
+// convert writes one input to a staging dataset and registers it.
+func convert(ctx context.Context, root, in string, read func(io.ReadSeeker, func(*model.Block) error) error, batch int, logger *zap.Logger) error {
+	start := time.Now()
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(filepath.Join(root, parquet.StagingDir), 0o755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(filepath.Join(root, parquet.StagingDir), "convert-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	w, err := parquet.NewWriter(staging, parquet.WithLogger(logger))
+	if err != nil {
+		return err
+	}
+
+	var (
+		blocks     []model.Block
+		nBlocks    int
+		nTxs       int
+		txs        []model.Transaction
+		sigs       []model.SignatureRow
+		flushBatch = func() error {
+			err := errors.Join(w.WriteBlocks(blocks), w.WriteTransactions(txs), w.WriteSignatures(sigs))
+			blocks, txs, sigs = blocks[:0], txs[:0], sigs[:0]
+			return err
+		}
+	)
+	err = read(f, func(blk *model.Block) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// like the ingester, keep a block whose payload cannot be decoded
+		t, s, err := ingest.Derive(blk)
+		if err != nil {
+			logger.Error("derive rows", zap.String("input", in), zap.Uint64("slot", blk.Slot), zap.Error(err))
+		}
+		blocks, txs, sigs = append(blocks, *blk), append(txs, t...), append(sigs, s...)
+		nBlocks++
+		nTxs += len(t)
+		if len(blocks) < batch {
+			return nil
+		}
+		return flushBatch()
+	})
+	if err == nil {
+		err = flushBatch()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := parquet.Register(root, staging); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	logger.Info("converted",
+		zap.String("input", in),
+		zap.Int("blocks", nBlocks),
+		zap.Int("transactions", nTxs),
+		zap.Duration("took", time.Since(start)),
+	)
+	return nil
+}
+
+// readJSONL reads getBlock results, one JSON value per line.
+func readJSONL(r io.ReadSeeker, fn func(*model.Block) error) error {
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		var v struct {
+			Slot *uint64 `json:"slot"`
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if v.Slot == nil {
+			return fmt.Errorf("line %d: no slot", n)
+		}
+		blk, err := ingest.DecodeBlock(*v.Slot, raw)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+}
+
+// chUint is a ClickHouse 64-bit integer, which JSONEachRow quotes unless
+// output_format_json_quote_64bit_integers is off.
+type chUint uint64
+
+func (u *chUint) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	*u = chUint(n)
+	return err
+}
+
+type chInt int64
+
+func (i *chInt) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = chInt(n)
+	return err
+}
+
+// readClickHouse reads rows of the blocks table, such as the output of
+// SELECT * FROM blocks FINAL FORMAT JSONEachRow. Rows at a commitment
+// other than finalized are skipped.
+func readClickHouse(r io.ReadSeeker, fn func(*model.Block) error) error {
+	dec := json.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	for n := 1; ; n++ {
+		var row struct {
+			Slot       chUint `json:"slot"`
+			Blockhash  string `json:"blockhash"`
+			ParentSlot chUint `json:"parent_slot"`
+			BlockTime  chInt  `json:"block_time"`
+			Height     chUint `json:"height"`
+			Commitment string `json:"commitment"`
+			Raw        string `json:"raw"`
+		}
+		if err := dec.Decode(&row); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("row %d: %w", n, err)
+		}
+		if row.Commitment != "" && row.Commitment != "finalized" {
+			continue
+		}
+		err := fn(&model.Block{
+			Slot: uint64(row.Slot),
+			// FixedString(44) pads shorter hashes with NULs
+			Blockhash:  strings.TrimRight(row.Blockhash, "\x00"),
+			ParentSlot: uint64(row.ParentSlot),
+			BlockTime:  int64(row.BlockTime),
+			Height:     uint64(row.Height),
+			Raw:        []byte(row.Raw),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
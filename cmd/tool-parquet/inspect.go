@@ -0,0 +1,70 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+)
+
+const inspectUsage = "usage: tool-parquet inspect [--json] file.parquet..."
+
+// runInspect implements `tool-parquet inspect`, which prints what the
+// footers of Parquet files record, without reading their rows.
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(inspectUsage)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	for _, path := range fs.Args() {
+		st, err := parquet.Inspect(path)
+		if err != nil {
+			return fmt.Errorf("inspect %s: %w", path, err)
+		}
+		if *asJSON {
+			err = enc.Encode(st)
+		} else {
+			err = printStats(os.Stdout, st)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printStats(out io.Writer, st *parquet.FileStats) error {
+	fmt.Fprintf(out, "%s: %d rows, %d bytes, %d row groups\n", st.Path, st.Rows, st.Bytes, len(st.RowGroups))
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, c := range st.Columns {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Name, c.Type)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for i, g := range st.RowGroups {
+		fmt.Fprintf(out, "  row group %d: %d rows, %d bytes uncompressed\n", i, g.Rows, g.Bytes)
+		fmt.Fprintf(tw, "    column\tbytes\tuncompressed\tnulls\tmin\tmax\n")
+		for _, c := range g.Columns {
+			fmt.Fprintf(tw, "    %s\t%d\t%d\t%d\t%s\t%s\n", c.Path, c.CompressedBytes, c.UncompressedBytes, c.Nulls, c.Min, c.Max)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
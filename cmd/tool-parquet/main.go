@@ -1,72 +1,54 @@
 //go:build !cgo
 // +build !cgo
 
+// Command tool-parquet builds and maintains Parquet datasets: the archive
+// layout of internal/parquet.
 package main
 
 import (
-	"context"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"path/filepath"
-	"time"
 
 	"go.uber.org/zap"
-
-	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
 )
 
-var (
-	inDir  = flag.String("in", "", "input directory with JSON block files")
-	outDir = flag.String("out", "", "output directory for .parquet")
-	day    = flag.String("day", "", "YYYY-MM-DD to process")
-)
+const usage = `usage: tool-parquet <command> [flags] [args]
+
+commands:
+  convert   convert JSONL, CAR or ClickHouse exports into a dataset
+  inspect   print the schema, row groups and statistics of Parquet files
+  merge     merge the small files of each partition of a dataset
+  validate  check a dataset's files, slot continuity and parent links`
 
 func main() {
-	flag.Parse()
-	if *inDir == "" || *outDir == "" || *day == "" {
-		flag.Usage()
+	if err := dispatch(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
 		os.Exit(1)
 	}
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-
-	t, err := time.Parse("2006-01-02", *day)
-	if err != nil {
-		log.Fatalf("bad day: %v", err)
-	}
-	start := t.Unix()
-	end := t.Add(24 * time.Hour).Unix()
-
-	pattern := filepath.Join(*inDir, fmt.Sprintf("%d_*.json", start))
-	files, err := filepath.Glob(pattern)
-	if err != nil {
-		log.Fatalf("glob: %v", err)
-	}
-	if len(files) == 0 {
-		log.Fatalf("no files match %s", pattern)
-	}
+}
 
-var blocks []model.Block
-	for _, f := range files {
-		if err := loadBlocks(f, &blocks); err != nil {
-			logger.Error("load", zap.String("file", f), zap.Error(err))
-		}
+func dispatch(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
 	}
-	out := filepath.Join(*outDir, fmt.Sprintf("blocks_%s.parquet", *day))
-	w := parquet.NewWriter(out, parquet.WithLogger(logger))
-	if err := w.WriteBlocks(blocks); err != nil {
-		log.Fatalf("write: %v", err)
+	switch args[0] {
+	case "convert":
+		return runConvert(args[1:])
+	case "inspect":
+		return runInspect(args[1:])
+	case "merge":
+		return runMerge(args[1:])
+	case "validate":
+		return runValidate(args[1:])
 	}
-	fmt.Println(out)
+	return errors.New(usage)
 }
 
-func loadBlocks(path string, dst *[]model.Block) error {
-	f, err := os.Open(path)
+func newLogger() *zap.Logger {
+	logger, err := zap.NewProduction()
 	if err != nil {
-		return err
+		return zap.NewNop()
 	}
-	defer f.Close()
-	return json.NewDecoder(f).Decode(dst)
-}
\ No newline at end of file
+	return logger
+}
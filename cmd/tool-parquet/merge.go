@@ -0,0 +1,49 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+)
+
+const mergeUsage = "usage: tool-parquet merge --root dir [--small bytes] [--jobs n]"
+
+// runMerge implements `tool-parquet merge`, which rewrites the small files
+// of each partition into fewer, larger ones. Nothing else may write to the
+// dataset meanwhile.
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	root := fs.String("root", "", "root of the dataset")
+	small := fs.Int64("small", 128<<20, "merge files smaller than this many bytes")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "partitions merged in parallel")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *root == "" || fs.NArg() > 0 {
+		return errors.New(mergeUsage)
+	}
+	logger := newLogger()
+	defer func() { _ = logger.Sync() }()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	start := time.Now()
+	n, err := parquet.Merge(ctx, *root, *small, *jobs, parquet.WithLogger(logger))
+	logger.Info("merged files", zap.String("root", *root), zap.Int("files", n), zap.Duration("took", time.Since(start)))
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+)
+
+const validateUsage = "usage: tool-parquet validate --root dir [--jobs n]"
+
+// runValidate implements `tool-parquet validate`, which prints every
+// problem found in a dataset and fails if there is any.
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	root := fs.String("root", "", "root of the dataset")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "days read in parallel")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *root == "" || fs.NArg() > 0 {
+		return errors.New(validateUsage)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	issues, err := parquet.Validate(ctx, *root, *jobs)
+	if err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+	for _, i := range issues {
+		fmt.Println(i)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issues in %s", len(issues), *root)
+	}
+	return nil
+}
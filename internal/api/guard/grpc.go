@@ -0,0 +1,51 @@
+package guard
+
+import (
+	"context"
+	"path"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// ServerOptions applies the connection and message size limits of cfg to a
+// gRPC server, leaving gRPC's defaults for those unset. MaxInFlight is
+// enforced by UnaryLimitInFlight.
+func ServerOptions(cfg Config) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if cfg.ReadHeaderTimeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(cfg.ReadHeaderTimeout))
+	}
+	if cfg.MaxRecvMsgBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(cfg.MaxRecvMsgBytes))
+	}
+	if cfg.IdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: cfg.IdleTimeout}))
+	}
+	return opts
+}
+
+// UnaryDeadline bounds each unary gRPC call by its method's deadline. The
+// method name is the last element of the full gRPC method path.
+func UnaryDeadline(cfg Config) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := cfg.WithDeadline(ctx, path.Base(info.FullMethod))
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// UnaryLimitInFlight sheds unary calls with ResourceExhausted once max are
+// already being served across all connections.
+func UnaryLimitInFlight(name string, max int) grpc.UnaryServerInterceptor {
+	l := newLimiter(name, max)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !l.acquire() {
+			return nil, status.Error(codes.ResourceExhausted, "server overloaded")
+		}
+		defer l.release()
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,152 @@
+package guard
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_inflight_requests",
+		Help: "Requests currently being served per listener",
+	}, []string{"listener"})
+
+	shed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_shed_requests_total",
+		Help: "Requests rejected because the listener was at capacity",
+	}, []string{"listener"})
+)
+
+// Config bounds request size, concurrency and duration for a listener.
+type Config struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxBodyBytes      int64
+	MaxInFlight       int
+	DefaultDeadline   time.Duration
+	MethodDeadlines   map[string]time.Duration
+	APIKeyHeader      string
+	APIKeys           []string // empty disables API-key auth
+	MaxRecvMsgBytes   int      // gRPC only; MaxBodyBytes applies to HTTP
+}
+
+// NewHTTPServer returns an http.Server with slow-loris and body limits
+// applied and handler wrapped in the in-flight limiter.
+func NewHTTPServer(name, addr string, h http.Handler, cfg Config) *http.Server {
+	if cfg.MaxBodyBytes > 0 {
+		h = MaxBytes(cfg.MaxBodyBytes, h)
+	}
+	if len(cfg.APIKeys) > 0 {
+		h = RequireAPIKey(cfg.APIKeyHeader, cfg.APIKeys, h)
+	}
+	if cfg.MaxInFlight > 0 {
+		h = LimitInFlight(name, cfg.MaxInFlight, h)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    1 << 16,
+	}
+}
+
+// MaxBytes caps the request body; reads past n fail with *http.MaxBytesError.
+func MaxBytes(n int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAPIKey rejects requests whose header does not carry one of keys.
+func RequireAPIKey(header string, keys []string, next http.Handler) http.Handler {
+	allowed := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		allowed[k] = struct{}{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := allowed[r.Header.Get(header)]; !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitInFlight sheds requests with 503 once max are already being served.
+func LimitInFlight(name string, max int, next http.Handler) http.Handler {
+	l := newLimiter(name, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limiter counts a listener's requests in flight and sheds past max.
+type limiter struct {
+	sem      chan struct{}
+	gauge    prometheus.Gauge
+	rejected prometheus.Counter
+}
+
+func newLimiter(name string, max int) *limiter {
+	return &limiter{
+		sem:      make(chan struct{}, max),
+		gauge:    inFlight.WithLabelValues(name),
+		rejected: shed.WithLabelValues(name),
+	}
+}
+
+func (l *limiter) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		l.gauge.Inc()
+		return true
+	default:
+		l.rejected.Inc()
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	l.gauge.Dec()
+	<-l.sem
+}
+
+// Deadline returns the configured query deadline for method, falling back to
+// the default. Zero means no deadline.
+func (c Config) Deadline(method string) time.Duration {
+	for m, d := range c.MethodDeadlines {
+		if strings.EqualFold(m, method) {
+			return d
+		}
+	}
+	return c.DefaultDeadline
+}
+
+// WithDeadline derives a context bounded by the method's deadline.
+func (c Config) WithDeadline(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if d := c.Deadline(method); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,167 @@
+package guard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaxBytes(t *testing.T) {
+	h := MaxBytes(8, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345678")))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// rejected up front by its length
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456789")))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// or once read past the limit when the length is unknown
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("123456789")))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestLimitInFlight(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := LimitInFlight("test", 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- rec.Code
+	}()
+	<-entered
+	require.Equal(t, 1.0, testutil.ToFloat64(inFlight.WithLabelValues("test")))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+	require.Equal(t, 1.0, testutil.ToFloat64(shed.WithLabelValues("test")))
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-done)
+	require.Equal(t, 0.0, testutil.ToFloat64(inFlight.WithLabelValues("test")))
+}
+
+func TestDeadline(t *testing.T) {
+	cfg := Config{
+		DefaultDeadline: 10 * time.Second,
+		MethodDeadlines: map[string]time.Duration{"getblock": 3 * time.Second, "getexport": 0},
+	}
+	require.Equal(t, 3*time.Second, cfg.Deadline("getBlock"))
+	require.Equal(t, 10*time.Second, cfg.Deadline("getTransaction"))
+	require.Zero(t, cfg.Deadline("getExport"))
+
+	ctx, cancel := cfg.WithDeadline(context.Background(), "getBlock")
+	defer cancel()
+	dl, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(3*time.Second), dl, time.Second)
+
+	ctx, cancel = cfg.WithDeadline(context.Background(), "getExport")
+	defer cancel()
+	_, ok = ctx.Deadline()
+	require.False(t, ok)
+}
+
+func TestUnaryDeadline(t *testing.T) {
+	cfg := Config{MethodDeadlines: map[string]time.Duration{"getblock": time.Second}}
+	var deadline bool
+	_, err := UnaryDeadline(cfg)(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/rpcv2.Historical/GetBlock"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, deadline = ctx.Deadline()
+			return nil, nil
+		})
+	require.NoError(t, err)
+	require.True(t, deadline)
+}
+
+func TestUnaryLimitInFlight(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	limit := UnaryLimitInFlight("grpc-test", 1)
+	info := &grpc.UnaryServerInfo{FullMethod: "/rpcv2.Historical/GetBlock"}
+
+	done := make(chan error)
+	go func() {
+		_, err := limit(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			entered <- struct{}{}
+			<-release
+			return nil, nil
+		})
+		done <- err
+	}()
+	<-entered
+
+	_, err := limit(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		t.Fatal("handler ran past the limit")
+		return nil, nil
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, 1.0, testutil.ToFloat64(shed.WithLabelValues("grpc-test")))
+
+	close(release)
+	require.NoError(t, <-done)
+	require.Equal(t, 0.0, testutil.ToFloat64(inFlight.WithLabelValues("grpc-test")))
+}
+
+func TestServerOptions(t *testing.T) {
+	require.Empty(t, ServerOptions(Config{MaxBodyBytes: 64 << 10}), "unset limits keep gRPC's defaults")
+	require.Len(t, ServerOptions(Config{
+		ReadHeaderTimeout: time.Second,
+		IdleTimeout:       time.Minute,
+		MaxRecvMsgBytes:   4 << 20,
+	}), 3)
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	srv := NewHTTPServer("auth", "", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), Config{
+		APIKeyHeader: "X-API-Key",
+		APIKeys:      []string{"k1", "k2"},
+	})
+	for key, want := range map[string]int{
+		"":   http.StatusUnauthorized,
+		"k3": http.StatusUnauthorized,
+		"k2": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		require.Equal(t, want, rec.Code, "key %q", key)
+	}
+
+	// without keys every request passes
+	rec := httptest.NewRecorder()
+	NewHTTPServer("open", "", http.NotFoundHandler(), Config{}).Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -1,11 +1,34 @@
 package jsonrpc
 
 import (
+	"strings"
+
 	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
 )
 
-var metrics = telemetry.NewMetrics()
+// methods maps lower-cased method names to their canonical spelling so
+// arbitrary client input never becomes a metric label.
+var methods = map[string]string{
+	"getblock":                "getBlock",
+	"gettransaction":          "getTransaction",
+	"getsignaturesforaddress": "getSignaturesForAddress",
+	"getblockswithlimit":      "getBlocksWithLimit",
+	"getblocktime":            "getBlockTime",
+	"gethealth":               "getHealth",
+}
+
+// WithMetrics records requests into m, which carries the backend label.
+func WithMetrics(m *telemetry.Metrics) Option {
+	return func(s *Server) { s.metrics = m }
+}
+
+func methodLabel(method string) string {
+	if m, ok := methods[strings.ToLower(method)]; ok {
+		return m
+	}
+	return "unknown"
+}
 
-func record(method string, status string, dur float64) {
-	metrics.RecordRequest(method, status, dur)
-}
\ No newline at end of file
+func (s *Server) record(method string, status string, dur float64, size int) {
+	s.metrics.RecordRequest(method, status, dur, size)
+}
@@ -3,7 +3,10 @@ package jsonrpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,9 +16,13 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
+	"github.com/lilythecat859/rpcv2-hist/internal/api/guard"
 	"github.com/lilythecat859/rpcv2-hist/internal/fractal"
+	"github.com/lilythecat859/rpcv2-hist/internal/health"
 	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/ratelimit"
 	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
 )
 
 const (
@@ -24,9 +31,30 @@ const (
 )
 
 type Server struct {
-	root   *fractal.Root
-	log    *zap.Logger
-	tracer trace.Tracer
+	root    *fractal.Root
+	log     *zap.Logger
+	tracer  trace.Tracer
+	limiter *ratelimit.Limiter
+	guard   guard.Config
+	metrics *telemetry.Metrics
+	health  *health.Checker
+}
+
+type Option func(*Server)
+
+// WithRateLimiter enforces per-client, method-weighted quotas.
+func WithRateLimiter(l *ratelimit.Limiter) Option {
+	return func(s *Server) { s.limiter = l }
+}
+
+// WithHealth answers getHealth from the checker's ingest lag.
+func WithHealth(h *health.Checker) Option {
+	return func(s *Server) { s.health = h }
+}
+
+// WithGuard applies per-method query deadlines from cfg.
+func WithGuard(cfg guard.Config) Option {
+	return func(s *Server) { s.guard = cfg }
 }
 
 type request struct {
@@ -44,21 +72,28 @@ type response struct {
 }
 
 type rpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 var (
-	errInvalidRequest = &rpcError{-32600, "Invalid request"}
-	errMethodNotFound = &rpcError{-32601, "Method not found"}
-	errInternal       = &rpcError{-32603, "Internal error"}
+	errInvalidRequest = &rpcError{Code: -32600, Message: "Invalid request"}
+	errMethodNotFound = &rpcError{Code: -32601, Message: "Method not found"}
+	errInternal       = &rpcError{Code: -32603, Message: "Internal error"}
+	errRateLimited    = &rpcError{Code: -32005, Message: "Too many requests"}
+	errTimeout        = &rpcError{Code: -32603, Message: "Request timed out"}
 )
 
-func NewServer(root *fractal.Root, log *zap.Logger) http.Handler {
+func NewServer(root *fractal.Root, log *zap.Logger, opts ...Option) http.Handler {
 	s := &Server{
-		root:   root,
-		log:    log,
-		tracer: otel.Tracer("jsonrpc"),
+		root:    root,
+		log:     log,
+		tracer:  otel.Tracer("jsonrpc"),
+		metrics: telemetry.NewMetrics("jsonrpc"),
+	}
+	for _, o := range opts {
+		o(s)
 	}
 	r := mux.NewRouter()
 	r.Handle("/", s).Methods("POST")
@@ -70,12 +105,38 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, span := s.tracer.Start(r.Context(), "JSON-RPC", trace.WithAttributes(attribute.String("method", r.Method)))
 	defer span.End()
 
+	rec := telemetry.NewStatusRecorder(w)
+	w = rec
+	method, status := "invalid", "ok"
+	defer func() {
+		s.record(method, status, time.Since(start).Seconds(), rec.Bytes)
+	}()
+
 	var req request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status = strconv.Itoa(errInvalidRequest.Code)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
 		s.writeError(w, errInvalidRequest, nil)
 		return
 	}
 	span.SetAttributes(attribute.String("rpc.method", req.Method))
+	method = methodLabel(req.Method)
+
+	if s.limiter != nil && !s.limiter.Allow(s.limiter.Key(r), req.Method) {
+		status = strconv.Itoa(errRateLimited.Code)
+		ratelimit.SetRetryAfter(w, s.limiter.RetryAfter(req.Method))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(response{Jsonrpc: version, ID: req.ID, Error: errRateLimited})
+		return
+	}
+
+	ctx, cancel := s.guard.WithDeadline(ctx, req.Method)
+	defer cancel()
 
 	var result interface{}
 	var rpcErr *rpcError
@@ -90,9 +151,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		result, rpcErr = s.handleGetBlocksWithLimit(ctx, req.Params)
 	case "getblocktime":
 		result, rpcErr = s.handleGetBlockTime(ctx, req.Params)
+	case "gethealth":
+		result, rpcErr = s.handleGetHealth()
 	default:
 		rpcErr = errMethodNotFound
 	}
+	if rpcErr == errInternal && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		rpcErr = errTimeout
+	}
 
 resp := response{
 		Jsonrpc: version,
@@ -100,6 +166,7 @@ resp := response{
 	}
 	if rpcErr != nil {
 		resp.Error = rpcErr
+		status = strconv.Itoa(rpcErr.Code)
 	} else {
 		resp.Result = result
 	}
@@ -213,6 +280,23 @@ func (s *Server) handleGetBlockTime(ctx context.Context, params json.RawMessage)
 	return t.Unix(), nil
 }
 
+// handleGetHealth follows Solana's getHealth: "ok", or -32005 with the
+// number of slots the node is behind.
+func (s *Server) handleGetHealth() (interface{}, *rpcError) {
+	if s.health == nil {
+		return "ok", nil
+	}
+	behind, unhealthy := s.health.SlotsBehind()
+	if !unhealthy {
+		return "ok", nil
+	}
+	return nil, &rpcError{
+		Code:    -32005,
+		Message: fmt.Sprintf("Node is behind by %d slots", behind),
+		Data:    map[string]uint64{"numSlotsBehind": behind},
+	}
+}
+
 func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(v)
@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/export"
+)
+
+// maxExportRequest bounds the body of an export submission.
+const maxExportRequest = 1 << 16
+
+func (s *Server) handleSubmitExport(w http.ResponseWriter, r *http.Request) {
+	var req export.Request
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxExportRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := s.exports.Submit(req)
+	switch {
+	case errors.Is(err, export.ErrBusy):
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", "/exports/"+j.ID)
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+func (s *Server) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	j, err := s.exports.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func (s *Server) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rc, j, err := s.exports.Open(r.Context(), id)
+	switch {
+	case errors.Is(err, export.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, export.ErrNotDone):
+		http.Error(w, "export is "+string(j.Status), http.StatusConflict)
+		return
+	case err != nil:
+		s.log.Warn("open export", zap.String("id", id), zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	// results take longer to send than the server's write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	name := j.ID + "." + string(j.Request.Format)
+	w.Header().Set("Content-Type", j.Request.Format.ContentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if f, ok := rc.(*os.File); ok {
+		http.ServeContent(w, r, name, *j.Finished, f)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(j.Bytes, 10))
+	if _, err := io.Copy(w, rc); err != nil {
+		s.log.Warn("download export", zap.String("id", id), zap.Error(err))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -1,16 +0,0 @@
-package rest
-
-import (
-	"net/http"
-
-	"github.com/lilythecat859/rpcv2-hist/internal/health"
-)
-
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	health.NewHandler(s.root, s.log).ServeHTTP(w, r)
-}
-
-func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
-	// same as health for now
-	s.handleHealth(w, r)
-}
\ No newline at end of file
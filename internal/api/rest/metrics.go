@@ -4,8 +4,7 @@ import (
 	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
 )
 
-var metrics = telemetry.NewMetrics()
-
-func record(method string, status string, dur float64) {
-	metrics.RecordRequest(method, status, dur)
-}
\ No newline at end of file
+// WithMetrics records requests into m, which carries the backend label.
+func WithMetrics(m *telemetry.Metrics) Option {
+	return func(s *Server) { s.metrics = m }
+}
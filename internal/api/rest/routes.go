@@ -11,7 +11,5 @@ func (s *Server) Routes() http.Handler {
 	r.HandleFunc("/block/{slot}", s.handleGetBlock).Methods("GET")
 	r.HandleFunc("/tx/{signature}", s.handleGetTx).Methods("GET")
 	r.HandleFunc("/sigs/{address}", s.handleGetSigs).Methods("GET")
-	r.HandleFunc("/health", s.handleHealth).Methods("GET")
-	r.HandleFunc("/ready", s.handleReady).Methods("GET")
 	return r
 }
\ No newline at end of file
@@ -3,6 +3,7 @@ package rest
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -12,29 +13,82 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
+	"github.com/lilythecat859/rpcv2-hist/internal/api/guard"
+	"github.com/lilythecat859/rpcv2-hist/internal/export"
 	"github.com/lilythecat859/rpcv2-hist/internal/fractal"
+	"github.com/lilythecat859/rpcv2-hist/internal/ratelimit"
 	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	"github.com/lilythecat859/rpcv2-hist/internal/telemetry"
 )
 
 type Server struct {
-	root   *fractal.Root
-	log    *zap.Logger
-	tracer trace.Tracer
+	root    *fractal.Root
+	log     *zap.Logger
+	tracer  trace.Tracer
+	limiter *ratelimit.Limiter
+	guard   guard.Config
+	metrics *telemetry.Metrics
+	exports *export.Manager
 }
 
-func NewServer(root *fractal.Root, log *zap.Logger) http.Handler {
+type Option func(*Server)
+
+// WithRateLimiter enforces per-client quotas, costing each route like its
+// JSON-RPC equivalent.
+func WithRateLimiter(l *ratelimit.Limiter) Option {
+	return func(s *Server) { s.limiter = l }
+}
+
+// WithGuard applies per-method query deadlines from cfg.
+func WithGuard(cfg guard.Config) Option {
+	return func(s *Server) { s.guard = cfg }
+}
+
+// WithExports serves export jobs from m under /exports.
+func WithExports(m *export.Manager) Option {
+	return func(s *Server) { s.exports = m }
+}
+
+func NewServer(root *fractal.Root, log *zap.Logger, opts ...Option) http.Handler {
 	s := &Server{
-		root:   root,
-		log:    log,
-		tracer: otel.Tracer("rest"),
+		root:    root,
+		log:     log,
+		tracer:  otel.Tracer("rest"),
+		metrics: telemetry.NewMetrics("rest"),
+	}
+	for _, o := range opts {
+		o(s)
 	}
 	r := mux.NewRouter()
-	r.HandleFunc("/block/{slot}", s.handleGetBlock).Methods("GET")
-	r.HandleFunc("/tx/{signature}", s.handleGetTx).Methods("GET")
-	r.HandleFunc("/sigs/{address}", s.handleGetSigs).Methods("GET")
+	r.Handle("/block/{slot}", s.route("getBlock", s.handleGetBlock)).Methods("GET")
+	r.Handle("/tx/{signature}", s.route("getTransaction", s.handleGetTx)).Methods("GET")
+	r.Handle("/sigs/{address}", s.route("getSignaturesForAddress", s.handleGetSigs)).Methods("GET")
+	if s.exports != nil {
+		r.Handle("/exports", s.route("submitExport", s.handleSubmitExport)).Methods("POST")
+		r.Handle("/exports/{id}", s.route("getExport", s.handleGetExport)).Methods("GET")
+		r.Handle("/exports/{id}/download", s.stream("downloadExport", http.HandlerFunc(s.handleDownloadExport))).Methods("GET")
+	}
 	return r
 }
 
+func (s *Server) route(method string, h http.HandlerFunc) http.Handler {
+	var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := s.guard.WithDeadline(r.Context(), method)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	})
+	return s.stream(method, next)
+}
+
+// stream is route without the query deadline, for responses as long as
+// the client takes to read them.
+func (s *Server) stream(method string, next http.Handler) http.Handler {
+	if s.limiter != nil {
+		next = s.limiter.Middleware(method, next)
+	}
+	return s.metrics.Instrument(method, next)
+}
+
 func (s *Server) handleGetBlock(w http.ResponseWriter, r *http.Request) {
 	ctx, span := s.tracer.Start(r.Context(), "REST GetBlock")
 	defer span.End()
@@ -52,7 +106,7 @@ func (s *Server) handleGetBlock(w http.ResponseWriter, r *http.Request) {
 	blk, err := s.root.GetBlock(ctx, slot, commit)
 	if err != nil {
 		s.log.Warn("getBlock", zap.Uint64("slot", slot), zap.Error(err))
-		http.Error(w, "not found", http.StatusNotFound)
+		s.fail(w, ctx, http.StatusNotFound, "not found")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -71,7 +125,7 @@ func (s *Server) handleGetTx(w http.ResponseWriter, r *http.Request) {
 	tx, err := s.root.GetTransaction(ctx, sig, commit)
 	if err != nil {
 		s.log.Warn("getTx", zap.String("sig", sig), zap.Error(err))
-		http.Error(w, "not found", http.StatusNotFound)
+		s.fail(w, ctx, http.StatusNotFound, "not found")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -97,9 +151,18 @@ func (s *Server) handleGetSigs(w http.ResponseWriter, r *http.Request) {
 	sigs, err := s.root.GetSignaturesForAddress(ctx, addr, opts)
 	if err != nil {
 		s.log.Warn("getSigs", zap.String("addr", addr), zap.Error(err))
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		s.fail(w, ctx, http.StatusInternalServerError, "internal error")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(sigs)
-}
\ No newline at end of file
+}
+
+// fail reports 504 when the request's query deadline expired, else code.
+func (s *Server) fail(w http.ResponseWriter, ctx context.Context, code int, msg string) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		http.Error(w, "request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, msg, code)
+}
@@ -1,10 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -14,6 +20,16 @@ type Config struct {
 	RESTListen    string
 	GRPCListen    string
 	ClickHouse    ClickHouseConfig
+	Backends      map[string]BackendConfig
+	Shards        []ShardConfig
+	Auth          AuthConfig
+	RateLimit     RateLimitConfig
+	HTTP          HTTPConfig
+	Telemetry     TelemetryConfig
+	Health        HealthConfig
+	Ingest        IngestConfig
+	Tier          TierConfig
+	Export        ExportConfig
 }
 
 type ClickHouseConfig struct {
@@ -27,17 +43,254 @@ type ClickHouseConfig struct {
 	ConnMaxLifetime time.Duration
 }
 
-func Load() (*Config, error) {
+// BackendConfig names a storage backend that shards can reference.
+type BackendConfig struct {
+	Kind       string // clickhouse or parquet
+	ClickHouse ClickHouseConfig
+	Parquet    ParquetConfig
+}
+
+// ParquetConfig serves the Parquet dataset under Dir. ObjectStore is where
+// tiering uploads the files it adds.
+type ParquetConfig struct {
+	Dir         string
+	ObjectStore ObjectStoreConfig
+}
+
+// ObjectStoreConfig locates an S3-compatible bucket.
+type ObjectStoreConfig struct {
+	Endpoint   string // host[:port]
+	Bucket     string
+	Prefix     string
+	Region     string
+	AccessKey  string
+	SecretKey  string
+	Insecure   bool // plain HTTP
+	PartSize   int64
+	MaxRetries int
+}
+
+// ShardConfig maps a fractal shard to a named backend.
+type ShardConfig struct {
+	ID      uint32
+	Backend string
+}
+
+type AuthConfig struct {
+	APIKeyHeader string
+	APIKeys      []string // empty disables API-key auth
+}
+
+type RateLimitConfig struct {
+	Enabled           bool
+	RequestsPerSecond float64
+	Burst             float64
+	APIKeyHeader      string
+	MethodCosts       map[string]float64
+	IdleTTL           time.Duration
+}
+
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxBodyBytes      int64
+	MaxInFlight       int
+	DefaultDeadline   time.Duration
+	MethodDeadlines   map[string]time.Duration
+	// GRPCMaxRecvMsgBytes caps a gRPC request message; MaxBodyBytes is
+	// sized for JSON and REST bodies.
+	GRPCMaxRecvMsgBytes int
+}
+
+type TelemetryConfig struct {
+	OTLPEndpoint    string
+	TraceSampleRate float64
+	MetricsListen   string
+	// AdminListen serves /admin/reload, which takes no API key; keep it on
+	// loopback. "" disables it.
+	AdminListen string
+	// SlowQueryThreshold logs backend queries at least this slow; 0 disables.
+	SlowQueryThreshold time.Duration
+}
+
+type HealthConfig struct {
+	// MaxSlotLag is how far ingestion may trail the newest enqueued slot
+	// before readiness and getHealth fail.
+	MaxSlotLag uint64
+	Timeout    time.Duration
+}
+
+// IngestConfig selects where new blocks come from; an empty Source runs
+// the ingester without a feed.
+type IngestConfig struct {
+	Source string // "", geyser, rpc, kafka
+	Geyser GeyserConfig
+	RPC    RPCPollConfig
+	Kafka  KafkaConfig
+
+	// QueueSize bounds blocks waiting to be batched; sources block when full.
+	QueueSize int
+	// DedupWindow is how many recent blocks are remembered to drop resends.
+	DedupWindow int
+	BatchRows   int
+	BatchBytes  int
+	BatchMaxAge time.Duration
+	WAL         WALConfig
+	Checkpoint  CheckpointConfig
+	Backfill    BackfillConfig
+}
+
+// CheckpointConfig persists which slots were ingested; an empty Path
+// disables it and gap backfill with it.
+type CheckpointConfig struct {
+	Path         string
+	SaveInterval time.Duration
+}
+
+// BackfillConfig refetches slots missing from the checkpoint's parent-slot
+// chain.
+type BackfillConfig struct {
+	Enabled  bool
+	Interval time.Duration
+	// Endpoint is a JSON-RPC node to refetch from when the source cannot
+	// fetch single blocks (geyser); the rpc source fetches itself.
+	Endpoint string
+}
+
+// WALConfig logs accepted blocks to disk until the store commits them; an
+// empty Dir disables the log.
+type WALConfig struct {
+	Dir          string
+	Sync         string // always, interval, none
+	SyncInterval time.Duration
+	SegmentSize  int64
+}
+
+type GeyserConfig struct {
+	Endpoint   string
+	XToken     string
+	Insecure   bool
+	Commitment string
+	FromSlot   uint64
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// RPCPollConfig follows an upstream JSON-RPC node with getBlocks/getBlock.
+type RPCPollConfig struct {
+	Endpoint     string
+	Commitment   string // confirmed or finalized; getBlocks rejects processed
+	FromSlot     uint64
+	Concurrency  int
+	PollInterval time.Duration
+	MaxRetries   int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+// KafkaConfig consumes getBlock results from Topic when Source is kafka.
+// OutputTopic, with any source, republishes stored rows.
+type KafkaConfig struct {
+	Brokers        []string
+	Topic          string
+	Group          string
+	Commitment     string
+	OutputTopic    string
+	CommitInterval time.Duration
+	TLS            bool
+	User           string // SASL/PLAIN when set
+	Password       string
+}
+
+// TierConfig moves partitions of the ClickHouse backend Backend whose
+// blocks are all older than Retention into the Parquet backend Archive,
+// which then serves them for Backend's shards. An empty Backend disables
+// tiering.
+type TierConfig struct {
+	Backend   string
+	Archive   string
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+// ExportConfig runs export jobs, Workers at a time, against the first
+// shard, writing results under Dir and keeping them for Retention. An
+// empty Dir disables exports. With an ObjectStore Bucket, results are
+// uploaded there and Dir only holds those being written.
+type ExportConfig struct {
+	Dir         string
+	Workers     int
+	QueueSize   int
+	MaxRows     int64 // jobs matching more transactions fail
+	Timeout     time.Duration
+	Retention   time.Duration
+	ObjectStore ObjectStoreConfig
+}
+
+// DefaultBackend is the backend name built from the top-level ClickHouse
+// section when no Backends are configured.
+const DefaultBackend = "default"
+
+// Flags returns the command-line flags Load understands.
+func Flags() *pflag.FlagSet {
+	fs := pflag.NewFlagSet("rpcv2-hist", pflag.ContinueOnError)
+	fs.StringP("config", "c", "", "path to YAML or TOML config file (env RPCV2_CONFIG)")
+	fs.String("log-level", "", "log level")
+	fs.String("jsonrpc-listen", "", "JSON-RPC listen address")
+	fs.String("rest-listen", "", "REST listen address")
+	fs.String("grpc-listen", "", "gRPC listen address")
+	fs.String("metrics-listen", "", "Prometheus listen address")
+	return fs
+}
+
+var flagKeys = map[string]string{
+	"log-level":      "LogLevel",
+	"jsonrpc-listen": "JSONRPCListen",
+	"rest-listen":    "RESTListen",
+	"grpc-listen":    "GRPCListen",
+	"metrics-listen": "Telemetry.MetricsListen",
+}
+
+// Load merges defaults, the config file, RPCV2_* environment variables and
+// flags, in increasing order of precedence. fs may be nil.
+func Load(fs *pflag.FlagSet) (*Config, error) {
 	v := viper.New()
 	v.SetEnvPrefix("RPCV2")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
+	if err := bindEnv(v, reflect.TypeOf(Config{}), ""); err != nil {
+		return nil, fmt.Errorf("bind env: %w", err)
+	}
 
 	setDefaults(v)
 
+	if fs != nil {
+		for name, key := range flagKeys {
+			if f := fs.Lookup(name); f != nil && f.Changed {
+				if err := v.BindPFlag(key, f); err != nil {
+					return nil, fmt.Errorf("bind flag %s: %w", name, err)
+				}
+			}
+		}
+	}
+
+	if path := FilePath(fs); path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+
 	var cfg Config
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("resolve secrets: %w", err)
+	}
+	cfg.applyBackendDefaults()
 
 	if err := cfg.validate(); err != nil {
 		return nil, fmt.Errorf("validate: %w", err)
@@ -45,6 +298,17 @@ func Load() (*Config, error) {
 	return &cfg, nil
 }
 
+// FilePath returns the config file named by the --config flag or
+// RPCV2_CONFIG, or "" when there is none.
+func FilePath(fs *pflag.FlagSet) string {
+	if fs != nil {
+		if f := fs.Lookup("config"); f != nil && f.Changed {
+			return f.Value.String()
+		}
+	}
+	return os.Getenv("RPCV2_CONFIG")
+}
+
 func setDefaults(v *viper.Viper) {
 	v.SetDefault("LogLevel", "info")
 	v.SetDefault("JSONRPCListen", "0.0.0.0:8899")
@@ -59,16 +323,247 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("ClickHouse.MaxOpenConns", 32)
 	v.SetDefault("ClickHouse.MaxIdleConns", 16)
 	v.SetDefault("ClickHouse.ConnMaxLifetime", 30*time.Minute)
+
+	v.SetDefault("Auth.APIKeyHeader", "X-API-Key")
+	v.SetDefault("Auth.APIKeys", []string{})
+
+	v.SetDefault("RateLimit.Enabled", true)
+	v.SetDefault("RateLimit.RequestsPerSecond", 100.0)
+	v.SetDefault("RateLimit.Burst", 200.0)
+	v.SetDefault("RateLimit.APIKeyHeader", "X-API-Key")
+	v.SetDefault("RateLimit.IdleTTL", 10*time.Minute)
+
+	v.SetDefault("HTTP.ReadHeaderTimeout", 5*time.Second)
+	v.SetDefault("HTTP.ReadTimeout", 10*time.Second)
+	v.SetDefault("HTTP.WriteTimeout", 30*time.Second)
+	v.SetDefault("HTTP.IdleTimeout", 120*time.Second)
+	v.SetDefault("HTTP.MaxBodyBytes", 64*1024)
+	v.SetDefault("HTTP.MaxInFlight", 1024)
+	v.SetDefault("HTTP.GRPCMaxRecvMsgBytes", 4<<20)
+	v.SetDefault("HTTP.DefaultDeadline", 10*time.Second)
+	v.SetDefault("HTTP.MethodDeadlines", map[string]time.Duration{
+		"getSignaturesForAddress": 15 * time.Second,
+		"getBlocksWithLimit":      15 * time.Second,
+		"getBlockTime":            2 * time.Second,
+	})
+
+	v.SetDefault("Telemetry.OTLPEndpoint", "127.0.0.1:4317")
+	v.SetDefault("Telemetry.TraceSampleRate", 0.01)
+	v.SetDefault("Telemetry.MetricsListen", "0.0.0.0:9091")
+	v.SetDefault("Telemetry.AdminListen", "127.0.0.1:9092")
+	v.SetDefault("Telemetry.SlowQueryThreshold", 500*time.Millisecond)
+
+	v.SetDefault("Health.MaxSlotLag", 128)
+	v.SetDefault("Health.Timeout", 2*time.Second)
+
+	v.SetDefault("Ingest.Source", "")
+	v.SetDefault("Ingest.QueueSize", 1024)
+	v.SetDefault("Ingest.DedupWindow", 4096)
+	v.SetDefault("Ingest.BatchRows", 100_000)
+	v.SetDefault("Ingest.BatchBytes", 64<<20)
+	v.SetDefault("Ingest.BatchMaxAge", time.Second)
+	v.SetDefault("Ingest.WAL.Sync", "interval")
+	v.SetDefault("Ingest.WAL.SyncInterval", time.Second)
+	v.SetDefault("Ingest.WAL.SegmentSize", 64<<20)
+	v.SetDefault("Ingest.Checkpoint.SaveInterval", 5*time.Second)
+	v.SetDefault("Ingest.Backfill.Interval", 10*time.Second)
+	v.SetDefault("Ingest.Geyser.Commitment", "confirmed")
+	v.SetDefault("Ingest.Geyser.MinBackoff", 500*time.Millisecond)
+	v.SetDefault("Ingest.Geyser.MaxBackoff", 30*time.Second)
+	v.SetDefault("Ingest.RPC.Commitment", "confirmed")
+	v.SetDefault("Ingest.RPC.Concurrency", 8)
+	v.SetDefault("Ingest.RPC.PollInterval", 400*time.Millisecond)
+	v.SetDefault("Ingest.RPC.MaxRetries", 10)
+	v.SetDefault("Ingest.RPC.MinBackoff", 200*time.Millisecond)
+	v.SetDefault("Ingest.RPC.MaxBackoff", 10*time.Second)
+	v.SetDefault("Ingest.Kafka.Commitment", "finalized")
+	v.SetDefault("Ingest.Kafka.CommitInterval", time.Second)
+
+	v.SetDefault("Tier.Retention", 30*24*time.Hour)
+	v.SetDefault("Tier.Interval", time.Hour)
+
+	v.SetDefault("Export.Workers", 2)
+	v.SetDefault("Export.QueueSize", 16)
+	v.SetDefault("Export.MaxRows", 10_000_000)
+	v.SetDefault("Export.Timeout", time.Hour)
+	v.SetDefault("Export.Retention", 24*time.Hour)
 }
 
+// applyBackendDefaults keeps single-backend deployments working with only the
+// top-level ClickHouse section set. Viper lower-cases map keys, so shard
+// references are lower-cased to match.
+func (c *Config) applyBackendDefaults() {
+	for i := range c.Shards {
+		c.Shards[i].Backend = strings.ToLower(c.Shards[i].Backend)
+	}
+	c.Tier.Backend = strings.ToLower(c.Tier.Backend)
+	c.Tier.Archive = strings.ToLower(c.Tier.Archive)
+	if len(c.Backends) == 0 {
+		c.Backends = map[string]BackendConfig{
+			DefaultBackend: {Kind: "clickhouse", ClickHouse: c.ClickHouse},
+		}
+	}
+	if len(c.Shards) == 0 {
+		c.Shards = []ShardConfig{{ID: 0, Backend: DefaultBackend}}
+	}
+}
+
+// validate checks the config without touching the network.
 func (c *Config) validate() error {
-	for _, addr := range []string{c.JSONRPCListen, c.RESTListen, c.GRPCListen} {
-		if _, err := net.Listen("tcp", addr); err == nil {
-			continue
+	var errs []error
+	for name, addr := range map[string]string{
+		"JSONRPCListen":           c.JSONRPCListen,
+		"RESTListen":              c.RESTListen,
+		"GRPCListen":              c.GRPCListen,
+		"Telemetry.MetricsListen": c.Telemetry.MetricsListen,
+	} {
+		if err := validateListenAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
 		}
-		if _, _, err := net.SplitHostPort(addr); err != nil {
-			return fmt.Errorf("invalid addr %q: %w", addr, err)
+	}
+	if addr := c.Telemetry.AdminListen; addr != "" {
+		if err := validateListenAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("Telemetry.AdminListen: %w", err))
+		}
+	}
+
+	for name, b := range c.Backends {
+		switch b.Kind {
+		case "clickhouse":
+			if b.ClickHouse.Addr == "" {
+				errs = append(errs, fmt.Errorf("Backends.%s.ClickHouse.Addr: required", name))
+			}
+		case "parquet":
+			if b.Parquet.Dir == "" {
+				errs = append(errs, fmt.Errorf("Backends.%s.Parquet.Dir: required", name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("Backends.%s.Kind: unknown backend %q", name, b.Kind))
 		}
 	}
+	seen := make(map[uint32]bool, len(c.Shards))
+	for _, sh := range c.Shards {
+		if seen[sh.ID] {
+			errs = append(errs, fmt.Errorf("Shards: duplicate id %d", sh.ID))
+		}
+		seen[sh.ID] = true
+		if _, ok := c.Backends[sh.Backend]; !ok {
+			errs = append(errs, fmt.Errorf("Shards.%d.Backend: unknown backend %q", sh.ID, sh.Backend))
+		}
+	}
+
+	if t := c.Tier; t.Backend != "" {
+		if c.Backends[t.Backend].Kind != "clickhouse" {
+			errs = append(errs, fmt.Errorf("Tier.Backend: %q is not a clickhouse backend", t.Backend))
+		}
+		if a := c.Backends[t.Archive]; a.Kind != "parquet" {
+			errs = append(errs, fmt.Errorf("Tier.Archive: %q is not a parquet backend", t.Archive))
+		} else if a.Parquet.ObjectStore.Endpoint == "" || a.Parquet.ObjectStore.Bucket == "" {
+			errs = append(errs, fmt.Errorf("Backends.%s.Parquet.ObjectStore: Endpoint and Bucket required for tiering", t.Archive))
+		}
+		if t.Retention <= 0 {
+			errs = append(errs, errors.New("Tier.Retention: must be positive"))
+		}
+	}
+
+	if e := c.Export; e.Dir != "" {
+		if e.Workers <= 0 || e.QueueSize <= 0 || e.MaxRows <= 0 {
+			errs = append(errs, errors.New("Export: Workers, QueueSize and MaxRows must be positive"))
+		}
+		if e.Timeout <= 0 || e.Retention <= 0 {
+			errs = append(errs, errors.New("Export: Timeout and Retention must be positive"))
+		}
+		if e.ObjectStore.Bucket != "" && e.ObjectStore.Endpoint == "" {
+			errs = append(errs, errors.New("Export.ObjectStore.Endpoint: required with a Bucket"))
+		}
+	}
+
+	if c.RateLimit.RequestsPerSecond < 0 || c.RateLimit.Burst < 0 {
+		errs = append(errs, errors.New("RateLimit: rates must not be negative"))
+	}
+	if c.HTTP.MaxBodyBytes < 0 || c.HTTP.MaxInFlight < 0 || c.HTTP.GRPCMaxRecvMsgBytes < 0 {
+		errs = append(errs, errors.New("HTTP: limits must not be negative"))
+	}
+	switch c.Ingest.Source {
+	case "":
+	case "geyser":
+		if c.Ingest.Geyser.Endpoint == "" {
+			errs = append(errs, errors.New("Ingest.Geyser.Endpoint: required"))
+		}
+		if err := validateCommitment(c.Ingest.Geyser.Commitment); err != nil {
+			errs = append(errs, fmt.Errorf("Ingest.Geyser.Commitment: %w", err))
+		}
+	case "rpc":
+		if c.Ingest.RPC.Endpoint == "" {
+			errs = append(errs, errors.New("Ingest.RPC.Endpoint: required"))
+		}
+		if c.Ingest.RPC.Commitment == "processed" {
+			errs = append(errs, errors.New("Ingest.RPC.Commitment: getBlocks does not support processed"))
+		} else if err := validateCommitment(c.Ingest.RPC.Commitment); err != nil {
+			errs = append(errs, fmt.Errorf("Ingest.RPC.Commitment: %w", err))
+		}
+	case "kafka":
+		if c.Ingest.Kafka.Topic == "" || c.Ingest.Kafka.Group == "" {
+			errs = append(errs, errors.New("Ingest.Kafka: Topic and Group required"))
+		}
+		// no slot updates arrive to promote lower levels by
+		if c.Ingest.Kafka.Commitment != "finalized" {
+			errs = append(errs, errors.New("Ingest.Kafka.Commitment: the topic must carry finalized blocks"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Ingest.Source: unknown source %q", c.Ingest.Source))
+	}
+	if c.Ingest.Source != "" && len(c.Shards) > 0 {
+		// ingestion writes through the first shard's backend
+		if name := c.Shards[0].Backend; c.Backends[name].Kind == "parquet" {
+			errs = append(errs, fmt.Errorf("Shards.0.Backend: %q is a read-only parquet backend and cannot take ingestion", name))
+		}
+	}
+	if (c.Ingest.Source == "kafka" || c.Ingest.Kafka.OutputTopic != "") && len(c.Ingest.Kafka.Brokers) == 0 {
+		errs = append(errs, errors.New("Ingest.Kafka.Brokers: required"))
+	}
+	if c.Ingest.QueueSize < 0 || c.Ingest.DedupWindow < 0 || c.Ingest.BatchRows < 0 || c.Ingest.BatchBytes < 0 {
+		errs = append(errs, errors.New("Ingest: limits must not be negative"))
+	}
+	if c.Ingest.WAL.Dir != "" {
+		switch c.Ingest.WAL.Sync {
+		case "always", "interval", "none":
+		default:
+			errs = append(errs, fmt.Errorf("Ingest.WAL.Sync: unknown policy %q", c.Ingest.WAL.Sync))
+		}
+		if c.Ingest.WAL.SegmentSize <= 0 {
+			errs = append(errs, errors.New("Ingest.WAL.SegmentSize: must be positive"))
+		}
+	}
+	if c.Ingest.Backfill.Enabled {
+		if c.Ingest.Checkpoint.Path == "" {
+			errs = append(errs, errors.New("Ingest.Backfill: requires Ingest.Checkpoint.Path"))
+		}
+		if c.Ingest.Source != "rpc" && c.Ingest.Backfill.Endpoint == "" {
+			errs = append(errs, errors.New("Ingest.Backfill.Endpoint: required unless Ingest.Source is rpc"))
+		}
+	}
+	if r := c.Telemetry.TraceSampleRate; r < 0 || r > 1 {
+		errs = append(errs, fmt.Errorf("Telemetry.TraceSampleRate: %v not in [0,1]", r))
+	}
+	return errors.Join(errs...)
+}
+
+func validateCommitment(c string) error {
+	switch c {
+	case "processed", "confirmed", "finalized":
+		return nil
+	}
+	return fmt.Errorf("unknown commitment %q", c)
+}
+
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q: %w", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFileEnvAndFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpcv2.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+loglevel: debug
+clickhouse:
+  password: hunter2
+backends:
+  hot:
+    kind: clickhouse
+    clickhouse:
+      addr: 127.0.0.1:9000
+shards:
+  - id: 0
+    backend: Hot
+http:
+  methoddeadlines:
+    getBlock: 3s
+`), 0o600))
+	t.Setenv("RPCV2_RESTLISTEN", "127.0.0.1:18080")
+
+	fs := Flags()
+	require.NoError(t, fs.Parse([]string{"--config", path, "--grpc-listen", "127.0.0.1:19090"}))
+	cfg, err := Load(fs)
+	require.NoError(t, err)
+
+	require.Equal(t, "debug", cfg.LogLevel)
+	require.Equal(t, "127.0.0.1:18080", cfg.RESTListen)
+	require.Equal(t, "127.0.0.1:19090", cfg.GRPCListen)
+	require.Equal(t, "hot", cfg.Shards[0].Backend)
+	require.Equal(t, 3*time.Second, cfg.HTTP.MethodDeadlines["getblock"])
+
+	red := cfg.Redacted()
+	require.Equal(t, redacted, red.ClickHouse.Password)
+	require.Equal(t, "hunter2", cfg.ClickHouse.Password)
+}
+
+func TestValidateDoesNotBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	cfg := Config{
+		JSONRPCListen: ln.Addr().String(), // in use, but only parsed
+		RESTListen:    "0.0.0.0:8080",
+		GRPCListen:    "0.0.0.0:9090",
+		Telemetry:     TelemetryConfig{MetricsListen: "0.0.0.0:9091"},
+	}
+	cfg.applyBackendDefaults()
+	cfg.Backends[DefaultBackend] = BackendConfig{Kind: "clickhouse", ClickHouse: ClickHouseConfig{Addr: "x:9000"}}
+	require.NoError(t, cfg.validate())
+
+	cfg.RESTListen = "no-port"
+	cfg.Shards = append(cfg.Shards, ShardConfig{ID: 0, Backend: "missing"})
+	cfg.Backends["archive"] = BackendConfig{Kind: "parquet", Parquet: ParquetConfig{Dir: "/archive"}}
+	cfg.Backends["pg"] = BackendConfig{Kind: "postgres"}
+	cfg.Tier = TierConfig{Backend: DefaultBackend, Archive: "archive", Retention: time.Hour}
+	cfg.Export = ExportConfig{Dir: "/exports", Workers: 1, QueueSize: 1, MaxRows: 1, Timeout: time.Hour, Retention: time.Hour,
+		ObjectStore: ObjectStoreConfig{Bucket: "exports"}}
+	err = cfg.validate()
+	require.ErrorContains(t, err, "RESTListen")
+	require.ErrorContains(t, err, "duplicate id 0")
+	require.ErrorContains(t, err, `unknown backend "missing"`)
+	require.ErrorContains(t, err, `Backends.pg.Kind: unknown backend "postgres"`)
+	require.ErrorContains(t, err, "Backends.archive.Parquet.ObjectStore")
+	require.ErrorContains(t, err, "Export.ObjectStore.Endpoint")
+
+	delete(cfg.Backends, "pg")
+	cfg.Shards = []ShardConfig{{ID: 0, Backend: "archive"}}
+	cfg.Ingest.Source, cfg.Ingest.RPC = "rpc", RPCPollConfig{Endpoint: "http://node:8899", Commitment: "confirmed"}
+	require.ErrorContains(t, cfg.validate(), `"archive" is a read-only parquet backend`)
+}
+
+func TestLoadEnvWithoutDefault(t *testing.T) {
+	t.Setenv("RPCV2_INGEST_SOURCE", "kafka")
+	t.Setenv("RPCV2_INGEST_KAFKA_BROKERS", "k1:9092,k2:9092")
+	t.Setenv("RPCV2_INGEST_KAFKA_TOPIC", "blocks")
+	t.Setenv("RPCV2_INGEST_KAFKA_GROUP", "rpcv2-hist")
+	t.Setenv("RPCV2_INGEST_WAL_DIR", "/var/lib/rpcv2-hist/wal")
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"k1:9092", "k2:9092"}, cfg.Ingest.Kafka.Brokers)
+	require.Equal(t, "blocks", cfg.Ingest.Kafka.Topic)
+	require.Equal(t, "rpcv2-hist", cfg.Ingest.Kafka.Group)
+	require.Equal(t, "/var/lib/rpcv2-hist/wal", cfg.Ingest.WAL.Dir)
+	require.Equal(t, "finalized", cfg.Ingest.Kafka.Commitment)
+
+	// nothing on the topic would ever promote confirmed blocks
+	t.Setenv("RPCV2_INGEST_KAFKA_COMMITMENT", "confirmed")
+	_, err = Load(nil)
+	require.ErrorContains(t, err, "Ingest.Kafka.Commitment")
+}
+
+func TestLoadResolvesSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "ch_password")
+	require.NoError(t, os.WriteFile(secret, []byte("s3cret\n"), 0o600))
+	t.Setenv("RPCV2_CLICKHOUSE_PASSWORD", "file://"+secret)
+	t.Setenv("RPCV2_AUTH_APIKEYS", "env://API_KEY")
+	t.Setenv("API_KEY", "k1")
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", cfg.ClickHouse.Password)
+	require.Equal(t, "s3cret", cfg.Backends[DefaultBackend].ClickHouse.Password)
+	require.Equal(t, []string{"k1"}, cfg.Auth.APIKeys)
+
+	t.Setenv("RPCV2_CLICKHOUSE_PASSWORD", "env://MISSING")
+	_, err = Load(nil)
+	require.ErrorContains(t, err, "ClickHouse.Password")
+}
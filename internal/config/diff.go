@@ -0,0 +1,33 @@
+package config
+
+import (
+	"reflect"
+)
+
+// reloadable lists the top-level sections that can change without a restart.
+var reloadable = map[string]bool{
+	"LogLevel":   true,
+	"ClickHouse": true, // only feeds the default backend
+	"Backends":   true,
+	"Shards":     true,
+	"RateLimit":  true,
+}
+
+// Diff returns the top-level sections that differ between a and b, split
+// into those a reload can apply and those that need a restart.
+func Diff(a, b *Config) (hot, cold []string) {
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+		name := t.Field(i).Name
+		if reloadable[name] {
+			hot = append(hot, name)
+		} else {
+			cold = append(cold, name)
+		}
+	}
+	return hot, cold
+}
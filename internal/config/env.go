@@ -0,0 +1,29 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/spf13/viper"
+)
+
+// bindEnv binds every leaf key of t to its RPCV2_* variable. AutomaticEnv
+// alone only reaches keys viper already knows from defaults or the file.
+func bindEnv(v *viper.Viper, t reflect.Type, prefix string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Name
+		if prefix != "" {
+			key = prefix + "." + f.Name
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type.PkgPath() == t.PkgPath() {
+			if err := bindEnv(v, f.Type, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := v.BindEnv(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package config
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c with credentials replaced, safe to print or log.
+func (c Config) Redacted() Config {
+	c.ClickHouse = c.ClickHouse.redacted()
+
+	backends := make(map[string]BackendConfig, len(c.Backends))
+	for name, b := range c.Backends {
+		b.ClickHouse = b.ClickHouse.redacted()
+		if b.Parquet.ObjectStore.SecretKey != "" {
+			b.Parquet.ObjectStore.SecretKey = redacted
+		}
+		backends[name] = b
+	}
+	c.Backends = backends
+	if c.Export.ObjectStore.SecretKey != "" {
+		c.Export.ObjectStore.SecretKey = redacted
+	}
+
+	keys := make([]string, len(c.Auth.APIKeys))
+	for i := range keys {
+		keys[i] = redacted
+	}
+	c.Auth.APIKeys = keys
+
+	if c.Ingest.Geyser.XToken != "" {
+		c.Ingest.Geyser.XToken = redacted
+	}
+	if c.Ingest.Kafka.Password != "" {
+		c.Ingest.Kafka.Password = redacted
+	}
+	return c
+}
+
+func (c ClickHouseConfig) redacted() ClickHouseConfig {
+	if c.Password != "" {
+		c.Password = redacted
+	}
+	return c
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	fileScheme = "file://"
+	envScheme  = "env://"
+)
+
+// ResolveSecret dereferences a config value of the form file:///path (file
+// contents, trailing newline trimmed) or env://NAME (another env var). Other
+// values are returned unchanged.
+func ResolveSecret(val string) (string, error) {
+	switch {
+	case strings.HasPrefix(val, fileScheme):
+		path := strings.TrimPrefix(val, fileScheme)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read secret: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(val, envScheme):
+		name := strings.TrimPrefix(val, envScheme)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret env %s not set", name)
+		}
+		return s, nil
+	}
+	return val, nil
+}
+
+// resolveSecrets replaces every string in c that references a secret. It
+// runs on each Load, so reloads pick up rotated secrets.
+func (c *Config) resolveSecrets() error {
+	return resolveValue(reflect.ValueOf(c).Elem(), "")
+}
+
+func resolveValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := ResolveSecret(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(s)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := resolveValue(v.Field(i), join(path, t.Field(i).Name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s.%d", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// map values are not addressable; resolve a copy and store it back.
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := resolveValue(elem, join(path, fmt.Sprint(iter.Key()))); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+	return nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,442 @@
+// Package export runs bulk exports of transaction history as background
+// jobs, whose results are downloaded once they are done.
+package export
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/objstore"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+var (
+	jobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_export_jobs_total",
+		Help: "Export jobs by outcome: done, failed or rejected",
+	}, []string{"status"})
+
+	rowsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_export_rows_total",
+		Help: "Transactions written to export results",
+	})
+)
+
+var (
+	// ErrBusy is returned when the queue of jobs is full.
+	ErrBusy = errors.New("export queue is full")
+	// ErrNotFound is returned for jobs that do not exist or have expired.
+	ErrNotFound = errors.New("export not found")
+	// ErrNotDone is returned when downloading a job that has not finished.
+	ErrNotDone = errors.New("export is not done")
+)
+
+// keyPrefix is where results go in object storage.
+const keyPrefix = "exports/"
+
+type Format string
+
+const (
+	FormatParquet Format = "parquet"
+	FormatNDJSON  Format = "ndjson"
+)
+
+// ContentType is the media type of results in the format.
+func (f Format) ContentType() string {
+	if f == FormatParquet {
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+// Request selects the transactions of an export. Zero bounds are open;
+// times are Unix seconds.
+type Request struct {
+	Format   Format `json:"format"`
+	FromSlot uint64 `json:"fromSlot,omitempty"`
+	ToSlot   uint64 `json:"toSlot,omitempty"`
+	FromTime int64  `json:"fromTime,omitempty"`
+	ToTime   int64  `json:"toTime,omitempty"`
+	Address  string `json:"address,omitempty"`
+}
+
+// Validate fills in the default format and checks the bounds.
+func (r *Request) Validate() error {
+	switch r.Format {
+	case "":
+		r.Format = FormatNDJSON
+	case FormatParquet, FormatNDJSON:
+	default:
+		return fmt.Errorf("format %q is not parquet or ndjson", r.Format)
+	}
+	if r.ToSlot != 0 && r.ToSlot < r.FromSlot {
+		return errors.New("toSlot is below fromSlot")
+	}
+	if r.ToTime != 0 && r.ToTime < r.FromTime {
+		return errors.New("toTime is before fromTime")
+	}
+	return nil
+}
+
+func (r Request) query() storage.ExportQuery {
+	return storage.ExportQuery{
+		FromSlot: r.FromSlot,
+		ToSlot:   r.ToSlot,
+		FromTime: r.FromTime,
+		ToTime:   r.ToTime,
+		Address:  r.Address,
+	}
+}
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is an export and its progress.
+type Job struct {
+	ID       string     `json:"id"`
+	Status   Status     `json:"status"`
+	Request  Request    `json:"request"`
+	Rows     int64      `json:"rows"`
+	Bytes    int64      `json:"bytes,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+
+	path string // result on local disk, if not in the bucket
+	key  string // result in the bucket
+}
+
+// Manager queues export jobs and runs a bounded number at a time. Jobs are
+// held in memory only: results of jobs from before a restart are removed
+// from the local directory, and should be expired from the bucket by a
+// lifecycle rule on keyPrefix.
+type Manager struct {
+	src       storage.Exporter
+	dir       string
+	bucket    objstore.Bucket
+	logger    *zap.Logger
+	workers   int
+	maxRows   int64
+	timeout   time.Duration
+	retention time.Duration
+	now       func() time.Time
+
+	queue chan *Job
+	mu    sync.Mutex
+	jobs  map[string]*Job
+}
+
+type Option func(*Manager)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(m *Manager) { m.logger = l }
+}
+
+// WithBucket stores results in b rather than the local directory, which
+// then only holds results being written.
+func WithBucket(b objstore.Bucket) Option {
+	return func(m *Manager) { m.bucket = b }
+}
+
+// WithWorkers sets how many jobs run at a time.
+func WithWorkers(n int) Option {
+	return func(m *Manager) {
+		if n > 0 {
+			m.workers = n
+		}
+	}
+}
+
+// WithQueueSize sets how many jobs may wait to run; more are rejected.
+func WithQueueSize(n int) Option {
+	return func(m *Manager) {
+		if n > 0 {
+			m.queue = make(chan *Job, n)
+		}
+	}
+}
+
+// WithMaxRows fails jobs that would export more transactions than n.
+func WithMaxRows(n int64) Option {
+	return func(m *Manager) {
+		if n > 0 {
+			m.maxRows = n
+		}
+	}
+}
+
+// WithTimeout fails jobs that run longer than d.
+func WithTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		if d > 0 {
+			m.timeout = d
+		}
+	}
+}
+
+// WithRetention sets how long finished jobs and their results are kept.
+func WithRetention(d time.Duration) Option {
+	return func(m *Manager) {
+		if d > 0 {
+			m.retention = d
+		}
+	}
+}
+
+// New returns a manager exporting from src and writing results under dir.
+func New(src storage.Exporter, dir string, opts ...Option) (*Manager, error) {
+	if dir == "" {
+		return nil, errors.New("export: dir required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	m := &Manager{
+		src:       src,
+		dir:       dir,
+		logger:    zap.NewNop(),
+		workers:   2,
+		maxRows:   10_000_000,
+		timeout:   time.Hour,
+		retention: 24 * time.Hour,
+		now:       time.Now,
+		queue:     make(chan *Job, 16),
+		jobs:      make(map[string]*Job),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	return m, nil
+}
+
+// resultFile matches the names export gives result files.
+var resultFile = regexp.MustCompile(`^[0-9a-f]{32}\.(ndjson|parquet)(\.tmp)?$`)
+
+// Submit queues an export of req.
+func (m *Manager) Submit(req Request) (Job, error) {
+	if err := req.Validate(); err != nil {
+		return Job{}, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Job{}, err
+	}
+	j := &Job{ID: hex.EncodeToString(id), Status: StatusQueued, Request: req, Created: m.now()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case m.queue <- j:
+	default:
+		jobsTotal.WithLabelValues("rejected").Inc()
+		return Job{}, ErrBusy
+	}
+	m.jobs[j.ID] = j
+	return *j, nil
+}
+
+// Get returns the job with id.
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return *j, nil
+}
+
+// Open reads the result of a finished job. A result on local disk is an
+// *os.File, so it can be served with ranges.
+func (m *Manager) Open(ctx context.Context, id string) (io.ReadCloser, Job, error) {
+	j, err := m.Get(id)
+	if err != nil {
+		return nil, j, err
+	}
+	if j.Status != StatusDone {
+		return nil, j, ErrNotDone
+	}
+	var rc io.ReadCloser
+	if j.key != "" {
+		rc, err = m.bucket.Open(ctx, j.key)
+	} else {
+		rc, err = os.Open(j.path)
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, objstore.ErrNotExist) {
+		return nil, j, ErrNotFound
+	}
+	return rc, j, err
+}
+
+// Run runs queued jobs and expires finished ones until ctx is done. Jobs
+// still running then fail.
+func (m *Manager) Run(ctx context.Context) error {
+	// no job refers to what an earlier process left behind; other files in
+	// the directory are not ours
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && resultFile.MatchString(e.Name()) {
+			_ = os.Remove(filepath.Join(m.dir, e.Name()))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-m.queue:
+					m.run(ctx, j)
+				}
+			}
+		}()
+	}
+	t := time.NewTicker(min(m.retention, time.Minute))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-t.C:
+			m.expire(context.WithoutCancel(ctx))
+		}
+	}
+}
+
+func (m *Manager) run(ctx context.Context, j *Job) {
+	m.mu.Lock()
+	started := m.now()
+	j.Status, j.Started = StatusRunning, &started
+	req := j.Request
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	path, key, size, err := m.export(ctx, j, req)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	finished := m.now()
+	expires := finished.Add(m.retention)
+	j.Finished, j.Expires = &finished, &expires
+	log := m.logger.With(zap.String("id", j.ID), zap.Int64("rows", j.Rows), zap.Duration("took", finished.Sub(started)))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("ran longer than %s", m.timeout)
+		}
+		j.Status, j.Error = StatusFailed, err.Error()
+		jobsTotal.WithLabelValues("failed").Inc()
+		log.Warn("export failed", zap.Error(err))
+		return
+	}
+	j.Status, j.Bytes, j.path, j.key = StatusDone, size, path, key
+	jobsTotal.WithLabelValues("done").Inc()
+	log.Info("export done", zap.Int64("bytes", size))
+}
+
+// export writes the result of j and stores it, returning where.
+func (m *Manager) export(ctx context.Context, j *Job, req Request) (path, key string, size int64, err error) {
+	name := j.ID + "." + string(req.Format)
+	path = filepath.Join(m.dir, name)
+	tmp := path + ".tmp"
+	var s sink
+	if req.Format == FormatParquet {
+		s, err = newParquetSink(tmp)
+	} else {
+		s, err = newNDJSONSink(tmp)
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+	q := req.query()
+	q.MaxRows = m.maxRows
+	err = m.src.ExportTransactions(ctx, q, func(txs []model.Transaction) error {
+		m.mu.Lock()
+		j.Rows += int64(len(txs))
+		rows := j.Rows
+		m.mu.Unlock()
+		if rows > m.maxRows {
+			return fmt.Errorf("more than %d transactions match", m.maxRows)
+		}
+		rowsTotal.Add(float64(len(txs)))
+		return s.write(txs)
+	})
+	if err != nil {
+		s.abort()
+		return "", "", 0, err
+	}
+	if size, err = s.close(); err != nil {
+		return "", "", 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", "", 0, err
+	}
+	if m.bucket == nil {
+		return path, "", size, nil
+	}
+	defer os.Remove(path)
+	obj, err := m.bucket.Upload(ctx, keyPrefix+name, path)
+	if err == nil {
+		err = objstore.Verify(ctx, m.bucket, obj)
+	}
+	if err != nil {
+		return "", "", 0, fmt.Errorf("upload: %w", err)
+	}
+	return "", obj.Key, size, nil
+}
+
+// expire forgets jobs past their retention and removes their results.
+func (m *Manager) expire(ctx context.Context) {
+	now := m.now()
+	var done []*Job
+	m.mu.Lock()
+	for id, j := range m.jobs {
+		if j.Expires != nil && now.After(*j.Expires) {
+			delete(m.jobs, id)
+			done = append(done, j)
+		}
+	}
+	m.mu.Unlock()
+	for _, j := range done {
+		var err error
+		switch {
+		case j.key != "":
+			err = m.bucket.Remove(ctx, j.key)
+		case j.path != "":
+			err = os.Remove(j.path)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			m.logger.Warn("remove export", zap.String("id", j.ID), zap.Error(err))
+		}
+	}
+}
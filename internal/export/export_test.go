@@ -0,0 +1,175 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/objstore"
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// fakeExporter holds one transaction per slot from 1 to 100.
+type fakeExporter struct {
+	block chan struct{} // if set, exports wait for it to close
+}
+
+func (f *fakeExporter) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	from, to := q.Slots()
+	var batch []model.Transaction
+	for slot := max(from, 1); slot <= min(to, 100); slot++ {
+		batch = append(batch, model.Transaction{
+			Signature: fmt.Sprint("sig", slot),
+			Slot:      slot,
+			BlockTime: int64(slot),
+			Signer:    "alice",
+			Raw:       json.RawMessage(`{"slot":` + fmt.Sprint(slot) + `}`),
+		})
+		if len(batch) == 10 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+func wait(t *testing.T, m *Manager, id string) Job {
+	var j Job
+	require.Eventually(t, func() bool {
+		var err error
+		j, err = m.Get(id)
+		require.NoError(t, err)
+		return j.Status == StatusDone || j.Status == StatusFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	return j
+}
+
+func TestManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "0123456789abcdef0123456789abcdef.parquet.tmp")
+	require.NoError(t, os.WriteFile(stale, nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644))
+	src := &fakeExporter{block: make(chan struct{})}
+	m, err := New(src, dir, WithWorkers(1), WithQueueSize(2), WithMaxRows(50))
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	_, err = m.Submit(Request{Format: "csv"})
+	require.ErrorContains(t, err, "csv")
+	_, err = m.Submit(Request{FromSlot: 10, ToSlot: 5})
+	require.Error(t, err)
+
+	// the worker takes the first job and waits, so two more fill the queue
+	small, err := m.Submit(Request{FromSlot: 11, ToSlot: 30})
+	require.NoError(t, err)
+	require.Equal(t, FormatNDJSON, small.Request.Format)
+	require.Eventually(t, func() bool {
+		j, _ := m.Get(small.ID)
+		return j.Status == StatusRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	big, err := m.Submit(Request{Format: FormatNDJSON})
+	require.NoError(t, err)
+	pq, err := m.Submit(Request{Format: FormatParquet, ToSlot: 20})
+	require.NoError(t, err)
+	_, err = m.Submit(Request{})
+	require.ErrorIs(t, err, ErrBusy)
+	_, _, err = m.Open(ctx, big.ID)
+	require.ErrorIs(t, err, ErrNotDone)
+	close(src.block)
+
+	j := wait(t, m, small.ID)
+	require.Equal(t, StatusDone, j.Status, j.Error)
+	require.EqualValues(t, 20, j.Rows)
+	rc, _, err := m.Open(ctx, small.ID)
+	require.NoError(t, err)
+	sc := bufio.NewScanner(rc)
+	var rows []map[string]any
+	for sc.Scan() {
+		var row map[string]any
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	require.NoError(t, rc.Close())
+	require.Len(t, rows, 20)
+	require.Equal(t, "sig11", rows[0]["signature"])
+	require.Equal(t, map[string]any{"slot": 11.0}, rows[0]["transaction"])
+	require.NoFileExists(t, stale)
+	require.FileExists(t, filepath.Join(dir, "notes.txt"))
+
+	j = wait(t, m, big.ID)
+	require.Equal(t, StatusFailed, j.Status)
+	require.Contains(t, j.Error, "more than 50")
+	require.NoFileExists(t, filepath.Join(dir, big.ID+".ndjson.tmp"))
+
+	j = wait(t, m, pq.ID)
+	require.Equal(t, StatusDone, j.Status, j.Error)
+	txs, err := parquet.ReadTransactions(j.path)
+	require.NoError(t, err)
+	require.Len(t, txs, 20)
+	require.Equal(t, uint64(20), txs[19].Slot)
+
+	// finished jobs expire with their results
+	m.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	m.expire(ctx)
+	_, err = m.Get(pq.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoFileExists(t, j.path)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestManagerBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, bucket := t.TempDir(), objstore.Dir(t.TempDir())
+	m, err := New(&fakeExporter{}, dir, WithBucket(bucket))
+	require.NoError(t, err)
+	go func() { _ = m.Run(ctx) }()
+
+	sub, err := m.Submit(Request{FromSlot: 91})
+	require.NoError(t, err)
+	j := wait(t, m, sub.ID)
+	require.Equal(t, StatusDone, j.Status, j.Error)
+	require.Equal(t, "exports/"+sub.ID+".ndjson", j.key)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	rc, _, err := m.Open(ctx, sub.ID)
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.EqualValues(t, len(b), j.Bytes)
+
+	m.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	m.expire(ctx)
+	_, err = bucket.Stat(ctx, j.key)
+	require.ErrorIs(t, err, objstore.ErrNotExist)
+}
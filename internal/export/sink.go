@@ -0,0 +1,99 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+)
+
+// sink writes a result file.
+type sink interface {
+	write(txs []model.Transaction) error
+	// close finishes the file and returns its size
+	close() (int64, error)
+	// abort closes and removes the file
+	abort()
+}
+
+type parquetSink struct {
+	f *parquet.TransactionFile
+}
+
+func newParquetSink(path string) (sink, error) {
+	f, err := parquet.CreateTransactionFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetSink{f: f}, nil
+}
+
+func (s *parquetSink) write(txs []model.Transaction) error { return s.f.Write(txs) }
+func (s *parquetSink) close() (int64, error)               { return s.f.Close() }
+func (s *parquetSink) abort()                              { s.f.Abort() }
+
+// ndjsonRow is a transaction as the REST API serves it, with its position
+// in the block and the transaction as the node returned it.
+type ndjsonRow struct {
+	*model.Transaction
+	Index uint64          `json:"index"`
+	Raw   json.RawMessage `json:"transaction,omitempty"`
+}
+
+type ndjsonSink struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONSink(path string) (sink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", path, err)
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	return &ndjsonSink{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (s *ndjsonSink) write(txs []model.Transaction) error {
+	for i := range txs {
+		row := ndjsonRow{Transaction: &txs[i], Index: txs[i].Index}
+		if json.Valid(txs[i].Raw) {
+			row.Raw = txs[i].Raw
+		}
+		if err := s.enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ndjsonSink) close() (int64, error) {
+	err := s.w.Flush()
+	if err == nil {
+		err = s.f.Sync()
+	}
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = s.f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.f.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *ndjsonSink) abort() {
+	_ = s.f.Close()
+	_ = os.Remove(s.f.Name())
+}
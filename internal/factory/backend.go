@@ -6,6 +6,7 @@ import (
 
 	"github.com/lilythecat859/rpcv2-hist/internal/storage"
 	"github.com/lilythecat859/rpcv2-hist/internal/storage/clickhouse"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage/parquet"
 )
 
 func NewBackend(ctx context.Context, kind storage.StoreKind, cfg any) (storage.HistoricalStore, error) {
@@ -16,6 +17,12 @@ func NewBackend(ctx context.Context, kind storage.StoreKind, cfg any) (storage.H
 			return nil, fmt.Errorf("invalid clickhouse config")
 		}
 		return clickhouse.New(ctx, c)
+	case storage.StoreParquet:
+		c, ok := cfg.(parquet.Config)
+		if !ok {
+			return nil, fmt.Errorf("invalid parquet config")
+		}
+		return parquet.New(ctx, c)
 	default:
 		return nil, fmt.Errorf("unknown backend %q", kind)
 	}
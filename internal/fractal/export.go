@@ -0,0 +1,168 @@
+package fractal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// exportBatch is how many merged transactions ExportTransactions passes at
+// a time.
+const exportBatch = 1000
+
+// ExportTransactions exports from every backend the shards use, once even
+// when several shards share it. Each backend streams in slot order, so the
+// streams are merged by slot and position in the block.
+func (r *Root) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	var (
+		exporters []storage.Exporter
+		ids       []uint32
+		seen      = make(map[storage.Exporter]bool)
+	)
+	for _, sh := range r.snapshot() {
+		e, ok := storage.As[storage.Exporter](sh.store)
+		if !ok {
+			return fmt.Errorf("shard %d has no export", sh.id)
+		}
+		if reflect.TypeOf(e).Comparable() {
+			if seen[e] {
+				continue
+			}
+			seen[e] = true
+		}
+		exporters = append(exporters, e)
+		ids = append(ids, sh.id)
+	}
+	if len(exporters) == 1 {
+		return exporters[0].ExportTransactions(ctx, q, fn)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	streams := make([]*exportStream, len(exporters))
+	for i, e := range exporters {
+		st := &exportStream{
+			id:      ids[i],
+			batches: make(chan []model.Transaction),
+			done:    make(chan struct{}),
+		}
+		streams[i] = st
+		wg.Add(1)
+		go func(e storage.Exporter) {
+			defer wg.Done()
+			defer close(st.batches)
+			st.err = e.ExportTransactions(ctx, q, st.send(ctx))
+		}(e)
+	}
+
+	active := streams[:0]
+	for _, st := range streams {
+		more, err := st.next(ctx)
+		if err != nil {
+			return err
+		}
+		if more {
+			active = append(active, st)
+		}
+	}
+	out := make([]model.Transaction, 0, exportBatch)
+	for len(active) > 0 {
+		first := 0
+		for i := 1; i < len(active); i++ {
+			if active[i].before(active[first]) {
+				first = i
+			}
+		}
+		st := active[first]
+		out = append(out, st.cur[st.pos])
+		st.pos++
+		more, err := st.next(ctx)
+		if err != nil {
+			return err
+		}
+		if !more {
+			active = append(active[:first], active[first+1:]...)
+		}
+		if len(out) == exportBatch {
+			if err := fn(out); err != nil {
+				return err
+			}
+			out = make([]model.Transaction, 0, exportBatch)
+		}
+	}
+	if len(out) > 0 {
+		return fn(out)
+	}
+	return nil
+}
+
+// exportStream hands one shard's batches to the merge. The shard's export
+// waits on done before returning from its callback, since it may reuse the
+// batch afterwards.
+type exportStream struct {
+	id      uint32
+	batches chan []model.Transaction // closed once the export returns
+	done    chan struct{}
+	err     error // of the export, set before batches is closed
+
+	cur []model.Transaction
+	pos int
+}
+
+func (st *exportStream) send(ctx context.Context) func([]model.Transaction) error {
+	return func(txs []model.Transaction) error {
+		if len(txs) == 0 {
+			return nil
+		}
+		select {
+		case st.batches <- txs:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-st.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// next makes sure st.cur[st.pos] is the stream's next transaction,
+// reporting false once the stream is exhausted.
+func (st *exportStream) next(ctx context.Context) (bool, error) {
+	if st.pos < len(st.cur) {
+		return true, nil
+	}
+	if st.cur != nil {
+		st.cur = nil
+		select {
+		case st.done <- struct{}{}:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	txs, ok := <-st.batches
+	if !ok {
+		if st.err != nil {
+			return false, fmt.Errorf("shard %d: %w", st.id, st.err)
+		}
+		return false, nil
+	}
+	st.cur, st.pos = txs, 0
+	return true, nil
+}
+
+func (st *exportStream) before(o *exportStream) bool {
+	a, b := &st.cur[st.pos], &o.cur[o.pos]
+	if a.Slot != b.Slot {
+		return a.Slot < b.Slot
+	}
+	return a.Index < b.Index
+}
@@ -0,0 +1,92 @@
+package fractal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// exporter streams its transactions in batches of two, reusing the batch.
+type exporter struct {
+	storage.HistoricalStore
+	txs []model.Transaction
+	err error
+}
+
+func (e *exporter) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	batch := make([]model.Transaction, 0, 2)
+	for _, tx := range e.txs {
+		if batch = append(batch, tx); len(batch) == 2 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	return e.err
+}
+
+func txs(pos ...[2]uint64) []model.Transaction {
+	out := make([]model.Transaction, len(pos))
+	for i, p := range pos {
+		out[i] = model.Transaction{Slot: p[0], Index: p[1]}
+	}
+	return out
+}
+
+func TestExportTransactionsMergesShards(t *testing.T) {
+	r := NewRoot(nil, zap.NewNop())
+	r.SetShards([]Shard{
+		{ID: 0, Store: &exporter{txs: txs([2]uint64{2, 0}, [2]uint64{2, 1}, [2]uint64{4, 0}, [2]uint64{6, 3})}},
+		{ID: 1, Store: &exporter{txs: txs([2]uint64{1, 0}, [2]uint64{3, 0}, [2]uint64{3, 1}, [2]uint64{5, 0}, [2]uint64{6, 1})}},
+		{ID: 2, Store: &exporter{}},
+	})
+	var got [][2]uint64
+	err := r.ExportTransactions(context.Background(), storage.ExportQuery{}, func(batch []model.Transaction) error {
+		for _, tx := range batch {
+			got = append(got, [2]uint64{tx.Slot, tx.Index})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][2]uint64{{1, 0}, {2, 0}, {2, 1}, {3, 0}, {3, 1}, {4, 0}, {5, 0}, {6, 1}, {6, 3}}, got)
+
+	// shards on one backend export it once
+	shared := &exporter{txs: txs([2]uint64{1, 0}, [2]uint64{2, 0}, [2]uint64{3, 0})}
+	r.SetShards([]Shard{{ID: 0, Store: shared}, {ID: 1, Store: shared}})
+	got = nil
+	err = r.ExportTransactions(context.Background(), storage.ExportQuery{}, func(batch []model.Transaction) error {
+		for _, tx := range batch {
+			got = append(got, [2]uint64{tx.Slot, tx.Index})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][2]uint64{{1, 0}, {2, 0}, {3, 0}}, got)
+
+	failed := errors.New("connection reset")
+	r.SetShards([]Shard{
+		{ID: 0, Store: &exporter{txs: txs([2]uint64{1, 0}, [2]uint64{2, 0}, [2]uint64{3, 0})}},
+		{ID: 1, Store: &exporter{txs: txs([2]uint64{1, 1}), err: failed}},
+	})
+	err = r.ExportTransactions(context.Background(), storage.ExportQuery{}, func([]model.Transaction) error { return nil })
+	require.ErrorIs(t, err, failed)
+	require.ErrorContains(t, err, "shard 1")
+
+	r.SetShards([]Shard{{ID: 0, Store: &exporter{}}, {ID: 1, Store: readOnly{}}})
+	err = r.ExportTransactions(context.Background(), storage.ExportQuery{}, func([]model.Transaction) error { return nil })
+	require.ErrorContains(t, err, "shard 1 has no export")
+}
+
+type readOnly struct{ storage.HistoricalStore }
@@ -2,8 +2,8 @@ package fractal
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -34,6 +34,40 @@ func NewRoot(store storage.HistoricalStore, log *zap.Logger) *Root {
 	return r
 }
 
+// Shard assigns a backend to a shard id.
+type Shard struct {
+	ID    uint32
+	Store storage.HistoricalStore
+}
+
+// SetShards replaces the shard list. Reads in flight keep the list they
+// started with.
+func (r *Root) SetShards(shards []Shard) {
+	next := make([]*shard, 0, len(shards))
+	for _, sh := range shards {
+		next = append(next, &shard{id: sh.ID, store: sh.Store})
+	}
+	r.mu.Lock()
+	r.shards = next
+	r.mu.Unlock()
+}
+
+// Shards returns the current shard list.
+func (r *Root) Shards() []Shard {
+	cur := r.snapshot()
+	out := make([]Shard, len(cur))
+	for i, sh := range cur {
+		out[i] = Shard{ID: sh.id, Store: sh.store}
+	}
+	return out
+}
+
+func (r *Root) snapshot() []*shard {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.shards
+}
+
 func (r *Root) GetBlock(ctx context.Context, slot uint64, commitment storage.Commitment) (*model.Block, error) {
 	sh := r.shardFor(slot)
 	return sh.store.GetBlock(ctx, slot, commitment)
@@ -41,7 +75,7 @@ func (r *Root) GetBlock(ctx context.Context, slot uint64, commitment storage.Com
 
 func (r *Root) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commitment storage.Commitment) ([]uint64, error) {
 	// naive: ask first shard; fractal depth can be added later.
-	return r.shards[0].store.GetBlocksWithLimit(ctx, start, limit, commitment)
+	return r.snapshot()[0].store.GetBlocksWithLimit(ctx, start, limit, commitment)
 }
 
 func (r *Root) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) {
@@ -58,7 +92,7 @@ func (r *Root) GetTransaction(ctx context.Context, signature string, commitment
 func (r *Root) GetSignaturesForAddress(ctx context.Context, addr string, opts storage.SignatureOpts) ([]model.SignatureInfo, error) {
 	// fan-out to all shards and merge; cache can be added later.
 	var out []model.SignatureInfo
-	for _, sh := range r.shards {
+	for _, sh := range r.snapshot() {
 		part, err := sh.store.GetSignaturesForAddress(ctx, addr, opts)
 		if err != nil {
 			r.log.Warn("shard query failed", zap.Uint32("shard", sh.id), zap.Error(err))
@@ -66,6 +100,10 @@ func (r *Root) GetSignaturesForAddress(ctx context.Context, addr string, opts st
 		}
 		out = append(out, part...)
 	}
+	// a partial result after the query deadline fired is not an answer.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
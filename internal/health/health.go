@@ -2,7 +2,10 @@ package health
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -10,35 +13,267 @@ import (
 	"go.uber.org/zap"
 )
 
-type Handler struct {
-	store  Pingable
-	log    *zap.Logger
-	tracer trace.Tracer
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded" // a non-critical component is down
+	StatusDown     Status = "down"
+)
+
+// Component is the health of one dependency.
+type Component struct {
+	Name    string         `json:"name"`
+	Status  Status         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Latency string         `json:"latency,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Report aggregates all components. Status is down if any critical
+// component is down, degraded if only non-critical ones are.
+type Report struct {
+	Status     Status      `json:"status"`
+	Components []Component `json:"components,omitempty"`
+}
+
+// CheckFunc reports on one or more components; a check may expand to many
+// (one per shard) since the set can change at runtime.
+type CheckFunc func(ctx context.Context) []Component
+
+type check struct {
+	fn       CheckFunc
+	critical bool
 }
 
 type Pingable interface {
 	Ping(context.Context) error
 }
 
-func NewHandler(store Pingable, log *zap.Logger) http.Handler {
-	return &Handler{
-		store:  store,
-		log:    log,
-		tracer: otel.Tracer("health"),
+// CacheSource reports on a cache a backend keeps in memory.
+type CacheSource interface {
+	CacheState() CacheState
+}
+
+// CacheState is what a cache holds and how fresh it is. Err is the last
+// failed refresh, which leaves the cache serving what it loaded before.
+type CacheState struct {
+	Entries  int
+	LoadedAt time.Time // zero until first loaded
+	Err      error
+}
+
+// LagSource reports how far ingestion trails the newest slot it has seen.
+type LagSource interface {
+	Lag() (slotsBehind uint64, latest uint64)
+}
+
+// Checker runs the registered checks for /livez, /readyz and /healthz.
+type Checker struct {
+	log     *zap.Logger
+	tracer  trace.Tracer
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks []check
+
+	lag    LagSource
+	maxLag uint64
+}
+
+type Option func(*Checker)
+
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) { c.timeout = d }
+}
+
+// WithIngestLag adds an ingester check that fails once it trails by more
+// than max slots; the same threshold drives JSON-RPC getHealth. The check
+// only degrades readiness: stored history still serves while ingest
+// catches up, and every replica lags together.
+func WithIngestLag(src LagSource, max uint64) Option {
+	return func(c *Checker) {
+		c.lag = src
+		c.maxLag = max
 	}
 }
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx, span := h.tracer.Start(r.Context(), "health")
-	defer span.End()
+func NewChecker(log *zap.Logger, opts ...Option) *Checker {
+	c := &Checker{
+		log:     log,
+		tracer:  otel.Tracer("health"),
+		timeout: 2 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.lag != nil {
+		c.Register(c.ingestCheck, false)
+	}
+	return c
+}
+
+// Register adds a check. Critical checks gate readiness.
+func (c *Checker) Register(fn CheckFunc, critical bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{fn: fn, critical: critical})
+}
+
+// Ping adapts a Pingable into a single-component check.
+func Ping(name string, p Pingable) CheckFunc {
+	return func(ctx context.Context) []Component {
+		return []Component{PingComponent(ctx, name, p)}
+	}
+}
+
+// PingComponent pings p and reports the result and latency.
+func PingComponent(ctx context.Context, name string, p Pingable) Component {
+	start := time.Now()
+	comp := Component{Name: name, Status: StatusOK}
+	if err := p.Ping(ctx); err != nil {
+		comp.Status = StatusDown
+		comp.Error = err.Error()
+	}
+	comp.Latency = time.Since(start).String()
+	return comp
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+// CacheComponent reports the state of src. A failed refresh leaves the
+// cache stale rather than empty, so register it as non-critical.
+func CacheComponent(name string, src CacheSource) Component {
+	st := src.CacheState()
+	comp := Component{
+		Name:    name,
+		Status:  StatusOK,
+		Details: map[string]any{"entries": st.Entries},
+	}
+	if !st.LoadedAt.IsZero() {
+		comp.Details["age"] = time.Since(st.LoadedAt).Round(time.Second).String()
+	}
+	if st.Err != nil {
+		comp.Status = StatusDown
+		comp.Error = st.Err.Error()
+	}
+	return comp
+}
+
+// SlotsBehind reports the ingester lag and whether it exceeds the threshold.
+func (c *Checker) SlotsBehind() (behind uint64, unhealthy bool) {
+	if c.lag == nil {
+		return 0, false
+	}
+	behind, _ = c.lag.Lag()
+	return behind, behind > c.maxLag
+}
+
+func (c *Checker) ingestCheck(ctx context.Context) []Component {
+	behind, latest := c.lag.Lag()
+	comp := Component{
+		Name:   "ingest",
+		Status: StatusOK,
+		Details: map[string]any{
+			"slotsBehind": behind,
+			"latestSlot":  latest,
+			"maxLag":      c.maxLag,
+		},
+	}
+	if behind > c.maxLag {
+		comp.Status = StatusDown
+		comp.Error = fmt.Sprintf("behind by %d slots", behind)
+	}
+	return []Component{comp}
+}
+
+// Run executes every check concurrently under the checker's timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, span := c.tracer.Start(ctx, "health")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
+	c.mu.RLock()
+	checks := c.checks
+	c.mu.RUnlock()
+
+	results := make([][]Component, len(checks))
+	var wg sync.WaitGroup
+	for i, ch := range checks {
+		wg.Add(1)
+		go func(i int, ch check) {
+			defer wg.Done()
+			results[i] = ch.fn(ctx)
+		}(i, ch)
+	}
+	wg.Wait()
+
+	rep := Report{Status: StatusOK}
+	for i, comps := range results {
+		for _, comp := range comps {
+			switch {
+			case comp.Status == StatusOK:
+			case checks[i].critical:
+				rep.Status = StatusDown
+			case rep.Status == StatusOK:
+				rep.Status = StatusDegraded
+			}
+			rep.Components = append(rep.Components, comp)
+		}
+	}
+	return rep
+}
+
+// Routes returns the probe handlers by path. Serve them outside the API
+// guards, so probes need no API key and are not shed under load.
+func (c *Checker) Routes() map[string]http.Handler {
+	return map[string]http.Handler{
+		"/livez":   http.HandlerFunc(c.Livez),
+		"/readyz":  http.HandlerFunc(c.Readyz),
+		"/healthz": http.HandlerFunc(c.Healthz),
+		// kept for probes configured before /healthz existed
+		"/health": http.HandlerFunc(c.Healthz),
+		"/ready":  http.HandlerFunc(c.Readyz),
+	}
+}
+
+// Livez reports that the process is up; it checks no dependencies so a slow
+// backend never gets the pod restarted.
+func (c *Checker) Livez(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK}, false)
+}
+
+// Readyz reports whether every critical component is healthy.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	rep := c.Run(r.Context())
+	c.logDown(rep)
+	writeReport(w, rep, false)
+}
+
+// Healthz runs the deep check; ?verbose includes the per-component report.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	rep := c.Run(r.Context())
+	c.logDown(rep)
+	_, verbose := r.URL.Query()["verbose"]
+	writeReport(w, rep, verbose)
+}
+
+func (c *Checker) logDown(rep Report) {
+	for _, comp := range rep.Components {
+		if comp.Status != StatusOK {
+			c.log.Warn("health check failed", zap.String("component", comp.Name), zap.String("error", comp.Error))
+		}
+	}
+}
+
+func writeReport(w http.ResponseWriter, rep Report, verbose bool) {
 	status := http.StatusOK
-	if err := h.store.Ping(ctx); err != nil {
-		h.log.Warn("health ping fail", zap.Error(err))
+	if rep.Status == StatusDown {
 		status = http.StatusServiceUnavailable
 	}
+	if !verbose {
+		rep.Components = nil
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-}
\ No newline at end of file
+	_ = json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type pinger struct{ err error }
+
+func (p pinger) Ping(context.Context) error { return p.err }
+
+type lag struct{ behind, latest uint64 }
+
+func (l *lag) Lag() (uint64, uint64) { return l.behind, l.latest }
+
+type cache CacheState
+
+func (c cache) CacheState() CacheState { return CacheState(c) }
+
+func get(t *testing.T, h http.HandlerFunc, target string) (int, Report) {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var rep Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rep))
+	return rec.Code, rep
+}
+
+func TestProbes(t *testing.T) {
+	c := NewChecker(zap.NewNop())
+	c.Register(Ping("store", pinger{}), true)
+	cacheErr := errors.New("manifest unreadable")
+	c.Register(func(ctx context.Context) []Component {
+		return []Component{CacheComponent("cache-archive", cache{Entries: 3, Err: cacheErr})}
+	}, false)
+
+	// a failing non-critical component degrades but stays ready
+	code, rep := get(t, c.Readyz, "/readyz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, StatusDegraded, rep.Status)
+	require.Empty(t, rep.Components)
+
+	code, rep = get(t, c.Healthz, "/healthz?verbose")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, rep.Components, 2)
+	require.Equal(t, "cache-archive", rep.Components[1].Name)
+	require.Equal(t, StatusDown, rep.Components[1].Status)
+	require.Equal(t, cacheErr.Error(), rep.Components[1].Error)
+	require.EqualValues(t, 3, rep.Components[1].Details["entries"])
+
+	c.Register(Ping("shard-1", pinger{err: errors.New("refused")}), true)
+	code, rep = get(t, c.Readyz, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, StatusDown, rep.Status)
+
+	// liveness checks nothing
+	code, rep = get(t, c.Livez, "/livez")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, StatusOK, rep.Status)
+
+	routes := c.Routes()
+	for _, path := range []string{"/livez", "/readyz", "/healthz", "/health", "/ready"} {
+		require.Contains(t, routes, path)
+	}
+}
+
+func TestIngestLag(t *testing.T) {
+	src := &lag{behind: 100, latest: 1000}
+	c := NewChecker(zap.NewNop(), WithIngestLag(src, 100))
+
+	behind, unhealthy := c.SlotsBehind()
+	require.EqualValues(t, 100, behind)
+	require.False(t, unhealthy, "the threshold itself is healthy")
+	code, _ := get(t, c.Readyz, "/readyz")
+	require.Equal(t, http.StatusOK, code)
+
+	src.behind = 101
+	_, unhealthy = c.SlotsBehind()
+	require.True(t, unhealthy)
+	code, rep := get(t, c.Readyz, "/readyz")
+	require.Equal(t, http.StatusOK, code, "lag keeps the replica in service")
+	require.Equal(t, StatusDegraded, rep.Status)
+	code, rep = get(t, c.Healthz, "/healthz?verbose")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ingest", rep.Components[0].Name)
+	require.Equal(t, StatusDown, rep.Components[0].Status)
+	require.Equal(t, "behind by 101 slots", rep.Components[0].Error)
+
+	_, unhealthy = NewChecker(zap.NewNop()).SlotsBehind()
+	require.False(t, unhealthy, "no ingester, no lag")
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := NewChecker(zap.NewNop(), WithTimeout(10*time.Millisecond))
+	c.Register(func(ctx context.Context) []Component {
+		<-ctx.Done()
+		return []Component{{Name: "slow", Status: StatusDown, Error: ctx.Err().Error()}}
+	}, true)
+	rep := c.Run(context.Background())
+	require.Equal(t, StatusDown, rep.Status)
+	require.Equal(t, context.DeadlineExceeded.Error(), rep.Components[0].Error)
+}
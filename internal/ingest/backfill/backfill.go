@@ -0,0 +1,135 @@
+// Package backfill refetches slots the checkpoint reports missing.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/checkpoint"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+var backfilled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rpcv2_hist_ingest_backfill_slots_total",
+	Help: "Missing slots refetched by the backfill worker",
+}, []string{"status"})
+
+// Worker scans the checkpoint for missing slots and walks the parent chain
+// back from each one, handing fetched blocks to the sink, until it reaches a
+// slot that is already ingested.
+type Worker struct {
+	cp         *checkpoint.Checkpoint
+	fetch      ingest.Fetcher
+	sink       ingest.Sink
+	commitment storage.Commitment
+	log        *zap.Logger
+	interval   time.Duration
+	limit      int
+
+	// enqueued but not yet committed, so not refetched on the next scan
+	sent map[uint64]struct{}
+}
+
+type Option func(*Worker)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(w *Worker) { w.log = l }
+}
+
+// WithInterval sets how often the checkpoint is scanned for gaps.
+func WithInterval(d time.Duration) Option {
+	return func(w *Worker) {
+		if d > 0 {
+			w.interval = d
+		}
+	}
+}
+
+func New(cp *checkpoint.Checkpoint, fetch ingest.Fetcher, sink ingest.Sink, c storage.Commitment, opts ...Option) *Worker {
+	w := &Worker{
+		cp:         cp,
+		fetch:      fetch,
+		sink:       sink,
+		commitment: c,
+		log:        zap.NewNop(),
+		interval:   10 * time.Second,
+		limit:      256,
+		sent:       make(map[uint64]struct{}),
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	return w
+}
+
+// Run scans for gaps every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context) error {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			w.scan(ctx)
+		}
+	}
+}
+
+func (w *Worker) scan(ctx context.Context) {
+	for slot := range w.sent {
+		if w.cp.Has(w.commitment, slot) {
+			delete(w.sent, slot)
+		}
+	}
+	for _, slot := range w.cp.Missing(w.commitment, w.limit) {
+		if ctx.Err() != nil {
+			return
+		}
+		w.walk(ctx, slot)
+	}
+}
+
+func (w *Worker) walk(ctx context.Context, slot uint64) {
+	start := slot
+	var n int
+	for {
+		if _, ok := w.sent[slot]; ok {
+			return
+		}
+		blk, err := w.fetch.FetchBlock(ctx, slot)
+		switch {
+		case errors.Is(err, ingest.ErrSlotSkipped):
+			backfilled.WithLabelValues("unavailable").Inc()
+			w.log.Warn("backfill: upstream has no block for missing slot", zap.Uint64("slot", slot))
+			w.cp.Forget(w.commitment, slot)
+			return
+		case err != nil:
+			if ctx.Err() == nil {
+				backfilled.WithLabelValues("error").Inc()
+				w.log.Error("backfill fetch", zap.Uint64("slot", slot), zap.Error(err))
+			}
+			return
+		}
+		if err := w.sink.Enqueue(ctx, blk); err != nil {
+			return
+		}
+		backfilled.WithLabelValues("ok").Inc()
+		w.sent[slot] = struct{}{}
+		n++
+
+		base, _, _ := w.cp.Range(w.commitment)
+		next := blk.ParentSlot
+		if next >= slot || next < base || w.cp.Has(w.commitment, next) {
+			break
+		}
+		slot = next
+	}
+	w.log.Info("backfilled gap", zap.Uint64("from", slot), zap.Uint64("to", start), zap.Int("blocks", n))
+}
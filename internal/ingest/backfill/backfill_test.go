@@ -0,0 +1,57 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/checkpoint"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// chain fetches blocks from a fixed slot -> parent map.
+type chain map[uint64]uint64
+
+func (ch chain) FetchBlock(_ context.Context, slot uint64) (*model.Block, error) {
+	parent, ok := ch[slot]
+	if !ok {
+		return nil, fmt.Errorf("slot %d: %w", slot, ingest.ErrSlotSkipped)
+	}
+	return &model.Block{Slot: slot, ParentSlot: parent}, nil
+}
+
+// markSink commits blocks straight into the checkpoint.
+type markSink struct {
+	cp    *checkpoint.Checkpoint
+	slots []uint64
+}
+
+func (s *markSink) Enqueue(_ context.Context, b *model.Block) error {
+	s.slots = append(s.slots, b.Slot)
+	s.cp.Mark(storage.CommitmentConfirmed, b.Slot, b.ParentSlot)
+	return nil
+}
+
+func (s *markSink) MarkSlot(uint64, storage.Commitment) {}
+
+func TestWalksParentChain(t *testing.T) {
+	cp, err := checkpoint.Open(filepath.Join(t.TempDir(), "cp"))
+	require.NoError(t, err)
+	const c = storage.CommitmentConfirmed
+	cp.Mark(c, 10, 9)
+	// outage: 11..16 were produced (13 skipped) but never ingested
+	cp.Mark(c, 17, 16)
+
+	up := chain{11: 10, 12: 11, 14: 12, 15: 14, 16: 15, 17: 16}
+	sink := &markSink{cp: cp}
+	w := New(cp, up, sink, c)
+	w.scan(context.Background())
+
+	require.Equal(t, []uint64{16, 15, 14, 12, 11}, sink.slots)
+	require.Empty(t, cp.Missing(c, 0))
+}
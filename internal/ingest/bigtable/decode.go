@@ -0,0 +1,311 @@
+package bigtable
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mr-tron/base58"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wire"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// decompress strips the u32 compression method the validator prefixes
+// every cell with: none, bzip2, gzip or zstd.
+func decompress(cell []byte) ([]byte, error) {
+	if len(cell) < 4 {
+		return nil, errors.New("cell too short")
+	}
+	method, data := binary.LittleEndian.Uint32(cell), cell[4:]
+	var r io.Reader
+	switch method {
+	case 0:
+		return data, nil
+	case 1:
+		r = bzip2.NewReader(bytes.NewReader(data))
+	case 2:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case 3:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown compression method %d", method)
+	}
+	return io.ReadAll(r)
+}
+
+// slotKey is how the blocks table keys a slot, and tx-by-addr its inverse.
+func slotKey(slot uint64) string { return fmt.Sprintf("%016x", slot) }
+
+func keySlot(key string) (uint64, error) {
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) != 8 {
+		return 0, fmt.Errorf("bad slot key %q", key)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// decodeBlock turns a blocks row, protobuf ConfirmedBlock or bincode
+// StoredConfirmedBlock, into the getBlock JSON the ingester indexes.
+func decodeBlock(key string, cell []byte, proto bool) (*model.Block, error) {
+	slot, err := keySlot(key)
+	if err != nil {
+		return nil, err
+	}
+	var rb *ingest.RawBlock
+	if proto {
+		rb, err = protoBlock(cell)
+	} else {
+		rb, err = bincodeBlock(cell)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("slot %d: %w", slot, err)
+	}
+	if rb.Transactions == nil {
+		rb.Transactions = []json.RawMessage{}
+	}
+	raw, err := json.Marshal(rb)
+	if err != nil {
+		return nil, fmt.Errorf("encode block %d: %w", slot, err)
+	}
+	return ingest.DecodeBlock(slot, raw)
+}
+
+// protoBlock reads ConfirmedBlock { previous_blockhash = 1; blockhash = 2;
+// parent_slot = 3; repeated ConfirmedTransaction transactions = 4;
+// block_time = 6; block_height = 7 }.
+func protoBlock(b []byte) (*ingest.RawBlock, error) {
+	rb := &ingest.RawBlock{}
+	err := wire.Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			rb.PreviousBlockhash = string(buf)
+		case 2:
+			rb.Blockhash = string(buf)
+		case 3:
+			rb.ParentSlot = v
+		case 4:
+			raw, err := protoTx(buf)
+			if err != nil {
+				return fmt.Errorf("tx %d: %w", len(rb.Transactions), err)
+			}
+			rb.Transactions = append(rb.Transactions, raw)
+		case 6: // UnixTimestamp { int64 timestamp = 1 }
+			return wire.Walk(buf, func(n protowire.Number, v uint64, _ []byte) error {
+				if n == 1 {
+					t := int64(v)
+					rb.BlockTime = &t
+				}
+				return nil
+			})
+		case 7: // BlockHeight { uint64 block_height = 1 }
+			return wire.Walk(buf, func(n protowire.Number, v uint64, _ []byte) error {
+				if n == 1 {
+					h := v
+					rb.BlockHeight = &h
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return rb, err
+}
+
+// protoTx reads ConfirmedTransaction { Transaction transaction = 1;
+// TransactionStatusMeta meta = 2 }.
+func protoTx(b []byte) (json.RawMessage, error) {
+	rt := &ingest.RawTransaction{}
+	var meta *ingest.RawMeta
+	err := wire.Walk(b, func(num protowire.Number, _ uint64, buf []byte) error {
+		var err error
+		switch num {
+		case 1:
+			rt, err = wire.DecodeProtoTransaction(buf)
+		case 2:
+			if meta, err = wire.DecodeProtoMeta(buf); err != nil {
+				err = fmt.Errorf("meta: %w", err)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rt.Meta = meta
+	return json.Marshal(rt)
+}
+
+// bincodeBlock reads the StoredConfirmedBlock older ledgers were written
+// with: hashes, parent, transactions with status, rewards and block time.
+func bincodeBlock(b []byte) (*ingest.RawBlock, error) {
+	d := wire.NewDecoder(b)
+	rb := &ingest.RawBlock{
+		PreviousBlockhash: d.Str(),
+		Blockhash:         d.Str(),
+		ParentSlot:        d.U64(),
+	}
+	n := d.Len64(1)
+	for i := 0; i < n && d.Err() == nil; i++ {
+		rt := d.Transaction()
+		if d.Byte() == 1 { // Option<StoredConfirmedBlockTransactionStatusMeta>
+			m := &ingest.RawMeta{Err: json.RawMessage("null")}
+			if d.Byte() == 1 {
+				m.Err = d.TxError()
+			}
+			m.Fee = d.U64()
+			d.Bytes(8 * d.Len64(8)) // pre_balances
+			d.Bytes(8 * d.Len64(8)) // post_balances
+			if rt != nil {
+				rt.Meta = m
+			}
+		}
+		if d.Err() != nil {
+			return nil, fmt.Errorf("tx %d: %w", i, d.Err())
+		}
+		raw, err := json.Marshal(rt)
+		if err != nil {
+			return nil, err
+		}
+		rb.Transactions = append(rb.Transactions, raw)
+	}
+	for range d.Len64(16) { // rewards: pubkey string, lamports i64
+		d.Str()
+		d.U64()
+	}
+	if d.Byte() == 1 {
+		t := int64(d.U64())
+		rb.BlockTime = &t
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// decodeTxInfo reads a tx row, bincode TransactionInfo { slot: u64, index:
+// u32, err: Option<TransactionError>, memo: Option<String> }, keyed by
+// signature.
+func decodeTxInfo(key string, cell []byte) (*model.Transaction, error) {
+	d := wire.NewDecoder(cell)
+	tx := &model.Transaction{Signature: key, Slot: d.U64(), Index: uint64(d.U32())}
+	if d.Byte() == 1 {
+		e := string(d.TxError())
+		tx.Err = &e
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// decodeTxByAddr reads a tx-by-addr row, keyed address/inverted slot: a
+// protobuf TransactionByAddr or a bincode list of entries.
+func decodeTxByAddr(key string, cell []byte, proto bool) ([]model.SignatureRow, error) {
+	i := strings.LastIndexByte(key, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("bad tx-by-addr key %q", key)
+	}
+	inv, err := keySlot(key[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	base := model.SignatureRow{Address: key[:i], Slot: ^inv}
+	if proto {
+		return protoTxByAddr(base, cell)
+	}
+	return bincodeTxByAddr(base, cell)
+}
+
+// protoTxByAddr reads TransactionByAddr { repeated TransactionByAddrInfo
+// tx_by_addrs = 1 } with { signature = 1; err = 2; index = 3; Memo memo =
+// 4; UnixTimestamp block_time = 5 }.
+func protoTxByAddr(base model.SignatureRow, b []byte) ([]model.SignatureRow, error) {
+	var rows []model.SignatureRow
+	err := wire.Walk(b, func(num protowire.Number, _ uint64, buf []byte) error {
+		if num != 1 {
+			return nil
+		}
+		row := base
+		err := wire.Walk(buf, func(n protowire.Number, v uint64, f []byte) error {
+			switch n {
+			case 1:
+				row.Signature = base58.Encode(f)
+			case 2:
+				e, err := wire.ProtoTxError(f)
+				if err != nil {
+					return err
+				}
+				s := string(e)
+				row.Err = &s
+			case 4, 5: // Memo { string memo = 1 }, UnixTimestamp { int64 timestamp = 1 }
+				return wire.Walk(f, func(k protowire.Number, v uint64, s []byte) error {
+					switch {
+					case k == 1 && n == 4:
+						m := string(s)
+						row.Memo = &m
+					case k == 1 && n == 5:
+						row.BlockTime = int64(v)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// bincodeTxByAddr reads Vec<LegacyTransactionByAddrInfo { signature: [u8;
+// 64], err: Option<TransactionError>, index: u32, memo: Option<String>,
+// block_time: Option<i64> }>.
+func bincodeTxByAddr(base model.SignatureRow, b []byte) ([]model.SignatureRow, error) {
+	d := wire.NewDecoder(b)
+	n := d.Len64(64 + 1 + 4 + 1)
+	rows := make([]model.SignatureRow, 0, n)
+	for range n {
+		row := base
+		row.Signature = base58.Encode(d.Bytes(64))
+		if d.Byte() == 1 {
+			e := string(d.TxError())
+			row.Err = &e
+		}
+		d.U32() // index
+		if d.Byte() == 1 {
+			m := d.Str()
+			row.Memo = &m
+		}
+		if d.Byte() == 1 {
+			row.BlockTime = int64(d.U64())
+		}
+		rows = append(rows, row)
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
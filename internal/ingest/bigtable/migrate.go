@@ -0,0 +1,296 @@
+// Package bigtable migrates the ledger history a Solana validator writes to
+// Google BigTable: the blocks, tx and tx-by-addr tables.
+package bigtable
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cbt "cloud.google.com/go/bigtable"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// Tables lists the migrated tables in the order Run takes them by default:
+// the block-derived rows are written last, so the complete transaction and
+// address rows replace the partial ones the tx and tx-by-addr tables give.
+var Tables = []string{"tx", "tx-by-addr", "blocks"}
+
+// family is the column family every table stores its cells in; the
+// qualifier is "proto" or "bin" for the encoding.
+const family = "x"
+
+// Progress is how far a table has been migrated. Key is the last row key
+// written, so a run resumes after it.
+type Progress struct {
+	Key     string `json:"key"`
+	Rows    uint64 `json:"rows"`
+	Skipped uint64 `json:"skipped"`
+	Done    bool   `json:"done"`
+}
+
+// Migrator copies BigTable rows into a store, checkpointing the last row
+// key of every written batch.
+type Migrator struct {
+	client    *cbt.Client
+	w         storage.Writer
+	log       *zap.Logger
+	statePath string
+	batchRows int
+	every     time.Duration
+
+	mu    sync.Mutex
+	state map[string]*Progress
+}
+
+type Option func(*Migrator)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(m *Migrator) { m.log = l }
+}
+
+// WithStatePath persists progress to path; without it every run starts
+// from the first row.
+func WithStatePath(path string) Option {
+	return func(m *Migrator) { m.statePath = path }
+}
+
+// WithBatchRows sets how many rows are written per batch.
+func WithBatchRows(n int) Option {
+	return func(m *Migrator) {
+		if n > 0 {
+			m.batchRows = n
+		}
+	}
+}
+
+// WithProgressInterval sets how often progress is logged and saved.
+func WithProgressInterval(d time.Duration) Option {
+	return func(m *Migrator) {
+		if d > 0 {
+			m.every = d
+		}
+	}
+}
+
+// New loads saved progress, if any.
+func New(client *cbt.Client, w storage.Writer, opts ...Option) (*Migrator, error) {
+	m := &Migrator{
+		client:    client,
+		w:         w,
+		log:       zap.NewNop(),
+		batchRows: 10_000,
+		every:     10 * time.Second,
+		state:     make(map[string]*Progress),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	if m.statePath == "" {
+		return m, nil
+	}
+	b, err := os.ReadFile(m.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read migration state: %w", err)
+	}
+	if err := json.Unmarshal(b, &m.state); err != nil {
+		return nil, fmt.Errorf("decode migration state %s: %w", m.statePath, err)
+	}
+	return m, nil
+}
+
+// Save writes progress to the state path.
+func (m *Migrator) Save() error {
+	if m.statePath == "" {
+		return nil
+	}
+	m.mu.Lock()
+	b, err := json.MarshalIndent(m.state, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := m.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("save migration state: %w", err)
+	}
+	if err := os.Rename(tmp, m.statePath); err != nil {
+		return fmt.Errorf("save migration state: %w", err)
+	}
+	return nil
+}
+
+// Run migrates tables in order, skipping those already done.
+func (m *Migrator) Run(ctx context.Context, tables ...string) error {
+	for _, t := range tables {
+		switch t {
+		case "blocks", "tx", "tx-by-addr":
+		default:
+			return fmt.Errorf("unknown table %q", t)
+		}
+	}
+	for _, t := range tables {
+		if err := m.migrate(ctx, t); err != nil {
+			return fmt.Errorf("migrate %s: %w", t, err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) migrate(ctx context.Context, table string) error {
+	m.mu.Lock()
+	p := m.state[table]
+	if p == nil {
+		p = &Progress{}
+		m.state[table] = p
+	}
+	resume := *p
+	m.mu.Unlock()
+	if resume.Done {
+		m.log.Info("table already migrated", zap.String("table", table))
+		return nil
+	}
+	rr := cbt.InfiniteRange("")
+	if resume.Key != "" {
+		rr = cbt.InfiniteRange(resume.Key + "\x00") // the first key after it
+		m.log.Info("resuming table", zap.String("table", table), zap.String("after", resume.Key))
+	}
+
+	b := storage.Batch{Commitment: storage.CommitmentFinalized}
+	var (
+		rows, skipped uint64
+		lastKey       string
+		werr          error
+	)
+	start, last := time.Now(), time.Now()
+	flush := func() error {
+		if len(b.Blocks)+len(b.Transactions)+len(b.Signatures) > 0 {
+			if err := m.w.WriteBatch(ctx, b); err != nil {
+				return fmt.Errorf("write batch ending at %q: %w", lastKey, err)
+			}
+		}
+		m.mu.Lock()
+		p.Key = lastKey
+		p.Rows += rows
+		p.Skipped += skipped
+		m.mu.Unlock()
+		rows, skipped = 0, 0
+		b.Blocks, b.Transactions, b.Signatures = nil, nil, nil
+		return nil
+	}
+	err := m.client.Open(table).ReadRows(ctx, rr, func(r cbt.Row) bool {
+		if err := m.add(&b, table, r); err != nil {
+			skipped++
+			m.log.Warn("skipping undecodable row", zap.String("table", table), zap.String("key", r.Key()), zap.Error(err))
+		} else {
+			rows++
+		}
+		lastKey = r.Key()
+		if len(b.Blocks)+len(b.Transactions)+len(b.Signatures) < m.batchRows {
+			return true
+		}
+		if werr = flush(); werr != nil {
+			return false
+		}
+		if time.Since(last) >= m.every {
+			last = time.Now()
+			m.mu.Lock()
+			m.log.Info("migration progress", zap.String("table", table), zap.String("key", p.Key), zap.Uint64("rows", p.Rows),
+				zap.Float64("rows_per_sec", float64(p.Rows-resume.Rows)/time.Since(start).Seconds()))
+			m.mu.Unlock()
+			if err := m.Save(); err != nil {
+				m.log.Warn("save migration state", zap.Error(err))
+			}
+		}
+		return true
+	}, cbt.RowFilter(cbt.ChainFilters(cbt.FamilyFilter(family), cbt.LatestNFilter(1))))
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("read rows: %w", err)
+	}
+	if lastKey != "" {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	p.Done = true
+	m.log.Info("table migrated", zap.String("table", table), zap.Uint64("rows", p.Rows), zap.Uint64("skipped", p.Skipped), zap.Duration("took", time.Since(start)))
+	m.mu.Unlock()
+	return m.Save()
+}
+
+// add decodes row r of table into b.
+func (m *Migrator) add(b *storage.Batch, table string, r cbt.Row) error {
+	cell, proto, err := rowCell(r)
+	if err != nil {
+		return err
+	}
+	switch table {
+	case "blocks":
+		blk, err := decodeBlock(r.Key(), cell, proto)
+		if err != nil {
+			return err
+		}
+		txs, sigs, err := ingest.Derive(blk)
+		if err != nil {
+			return err
+		}
+		blk.TxSigs = make([]string, len(txs))
+		for i, tx := range txs {
+			blk.TxSigs[i] = tx.Signature
+		}
+		b.Blocks = append(b.Blocks, *blk)
+		b.Transactions = append(b.Transactions, txs...)
+		b.Signatures = append(b.Signatures, sigs...)
+	case "tx":
+		if proto {
+			return errors.New("unexpected protobuf tx cell")
+		}
+		tx, err := decodeTxInfo(r.Key(), cell)
+		if err != nil {
+			return err
+		}
+		b.Transactions = append(b.Transactions, *tx)
+	case "tx-by-addr":
+		sigs, err := decodeTxByAddr(r.Key(), cell, proto)
+		if err != nil {
+			return err
+		}
+		b.Signatures = append(b.Signatures, sigs...)
+	}
+	return nil
+}
+
+// rowCell returns the decompressed cell of r and whether it is protobuf
+// rather than bincode.
+func rowCell(r cbt.Row) ([]byte, bool, error) {
+	var bin []byte
+	for _, it := range r[family] {
+		switch strings.TrimPrefix(it.Column, family+":") {
+		case "proto":
+			data, err := decompress(it.Value)
+			return data, true, err
+		case "bin":
+			bin = it.Value
+		}
+	}
+	if bin == nil {
+		return nil, false, errors.New("no proto or bin cell")
+	}
+	data, err := decompress(bin)
+	return data, false, err
+}
@@ -0,0 +1,206 @@
+package bigtable
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	cbt "cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/mr-tron/base58"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type writer struct {
+	mu      sync.Mutex
+	failAt  int // batch number that fails, 0 for none
+	batches []storage.Batch
+}
+
+func (w *writer) WriteBatch(_ context.Context, b storage.Batch) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failAt > 0 && len(w.batches)+1 == w.failAt {
+		return errors.New("store unavailable")
+	}
+	w.batches = append(w.batches, b)
+	return nil
+}
+
+func key(seed byte) []byte { return bytes.Repeat([]byte{seed}, 32) }
+
+func sig(seed byte) []byte { return bytes.Repeat([]byte{seed}, 64) }
+
+func cell(method uint32, data []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, method), data...)
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return cell(2, buf.Bytes())
+}
+
+func protoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func protoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// protoBlockCell is a ConfirmedBlock with one transaction by signer.
+func protoBlockCell(parent uint64, signer byte) []byte {
+	var ix []byte
+	ix = protoVarint(ix, 1, 1)
+	ix = protoBytes(ix, 2, []byte{0})
+	ix = protoBytes(ix, 3, []byte("hi"))
+	var msg []byte
+	msg = protoBytes(msg, 2, key(signer))
+	msg = protoBytes(msg, 2, key(0xee))
+	msg = protoBytes(msg, 4, ix)
+	var tx []byte
+	tx = protoBytes(tx, 1, sig(signer))
+	tx = protoBytes(tx, 2, msg)
+	var meta []byte
+	meta = protoVarint(meta, 2, 5000)
+	meta = protoVarint(meta, 16, 150)
+	var ct []byte
+	ct = protoBytes(ct, 1, tx)
+	ct = protoBytes(ct, 2, meta)
+
+	var b []byte
+	b = protoBytes(b, 1, []byte("prev"))
+	b = protoBytes(b, 2, []byte("hash"))
+	b = protoVarint(b, 3, parent)
+	b = protoBytes(b, 4, ct)
+	b = protoBytes(b, 6, protoVarint(nil, 1, 1700000000))
+	return b
+}
+
+// bincodeBlockCell is a StoredConfirmedBlock with one failed legacy
+// transaction by signer.
+func bincodeBlockCell(parent uint64, signer byte) []byte {
+	str := func(b []byte, s string) []byte {
+		return append(binary.LittleEndian.AppendUint64(b, uint64(len(s))), s...)
+	}
+	b := str(nil, "prev")
+	b = str(b, "hash")
+	b = binary.LittleEndian.AppendUint64(b, parent)
+	b = binary.LittleEndian.AppendUint64(b, 1)
+	b = append(b, 1)
+	b = append(b, sig(signer)...)
+	b = append(b, 1, 0, 0, 1)
+	b = append(b, key(signer)...)
+	b = append(b, key(0xbb)...)
+	b = append(b, 0)
+	b = append(b, 1, 1)                           // Some(meta), Some(err)
+	b = binary.LittleEndian.AppendUint32(b, 8)    // InstructionError
+	b = append(b, 0)                              // instruction 0
+	b = binary.LittleEndian.AppendUint32(b, 25)   // Custom
+	b = binary.LittleEndian.AppendUint32(b, 1)    // code
+	b = binary.LittleEndian.AppendUint64(b, 5000) // fee
+	b = binary.LittleEndian.AppendUint64(b, 0)    // pre_balances
+	b = binary.LittleEndian.AppendUint64(b, 0)    // post_balances
+	b = binary.LittleEndian.AppendUint64(b, 0)    // rewards
+	b = append(b, 1)                              // Some(block_time)
+	return binary.LittleEndian.AppendUint64(b, 1700000001)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	admin, err := cbt.NewAdminClient(ctx, "proj", "inst", option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	client, err := cbt.NewClient(ctx, "proj", "inst", option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	put := func(table, row, column string, value []byte) {
+		mut := cbt.NewMutation()
+		mut.Set(family, column, cbt.Now(), value)
+		require.NoError(t, client.Open(table).Apply(ctx, row, mut))
+	}
+	for _, table := range Tables {
+		require.NoError(t, admin.CreateTable(ctx, table))
+		require.NoError(t, admin.CreateColumnFamily(ctx, table, family))
+	}
+
+	// TransactionInfo: slot 10, index 0, no error, no memo
+	info := binary.LittleEndian.AppendUint64(nil, 10)
+	info = append(info, 0, 0, 0, 0, 0, 0)
+	put("tx", base58.Encode(sig(0xc1)), "bin", cell(0, info))
+
+	var entry []byte
+	entry = protoBytes(entry, 1, sig(0xc1))
+	entry = protoBytes(entry, 4, protoBytes(nil, 1, []byte("note")))
+	entry = protoBytes(entry, 5, protoVarint(nil, 1, 1700000000))
+	put("tx-by-addr", base58.Encode(key(0xc1))+"/"+slotKey(^uint64(10)), "proto", gzipped(t, protoBytes(nil, 1, entry)))
+
+	put("blocks", slotKey(10), "proto", gzipped(t, protoBlockCell(9, 0xc1)))
+	put("blocks", slotKey(11), "bin", cell(0, bincodeBlockCell(10, 0xc2)))
+	put("blocks", slotKey(12), "bin", cell(0, []byte("junk")))
+
+	// the first run stops when the store fails on slot 11
+	statePath := filepath.Join(t.TempDir(), "migrate.state")
+	w := &writer{failAt: 4}
+	m, err := New(client, w, WithStatePath(statePath), WithBatchRows(1))
+	require.NoError(t, err)
+	require.Error(t, m.Run(ctx, Tables...))
+	require.NoError(t, m.Save())
+	require.Len(t, w.batches, 3)
+
+	tx := w.batches[0].Transactions[0]
+	require.Equal(t, base58.Encode(sig(0xc1)), tx.Signature)
+	require.Equal(t, uint64(10), tx.Slot)
+	require.Nil(t, tx.Err)
+
+	row := w.batches[1].Signatures[0]
+	require.Equal(t, base58.Encode(key(0xc1)), row.Address)
+	require.Equal(t, uint64(10), row.Slot)
+	require.Equal(t, "note", *row.Memo)
+	require.Equal(t, int64(1700000000), row.BlockTime)
+
+	b := w.batches[2]
+	require.Equal(t, storage.CommitmentFinalized, b.Commitment)
+	require.Equal(t, uint64(10), b.Blocks[0].Slot)
+	require.Equal(t, uint64(9), b.Blocks[0].ParentSlot)
+	require.Equal(t, []string{base58.Encode(sig(0xc1))}, b.Blocks[0].TxSigs)
+	require.Equal(t, uint64(5000), b.Transactions[0].Fee)
+	require.Equal(t, uint64(150), b.Transactions[0].ComputeUnits)
+	require.Equal(t, base58.Encode(key(0xc1)), b.Transactions[0].Signer)
+	require.Len(t, b.Signatures, 2)
+
+	// the second run resumes after slot 10 and skips the bad row
+	w = &writer{}
+	m, err = New(client, w, WithStatePath(statePath), WithBatchRows(1))
+	require.NoError(t, err)
+	require.NoError(t, m.Run(ctx, Tables...))
+	require.Len(t, w.batches, 1)
+	b = w.batches[0]
+	require.Equal(t, uint64(11), b.Blocks[0].Slot)
+	require.Equal(t, int64(1700000001), b.Blocks[0].BlockTime)
+	require.Equal(t, uint64(5000), b.Transactions[0].Fee)
+	require.NotNil(t, b.Transactions[0].Err)
+	require.Equal(t, Progress{Key: slotKey(12), Rows: 2, Skipped: 1, Done: true}, *m.state["blocks"])
+}
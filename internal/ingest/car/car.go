@@ -0,0 +1,180 @@
+// Package car imports Old Faithful epoch archives: CAR files of IPLD
+// blocks, entries and transactions, one archive per epoch.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// maxSection bounds a single CAR section; Old Faithful splits large
+// payloads into DataFrames well below this.
+const maxSection = 32 << 20
+
+// v2Pragma starts a CARv2 file; the CARv1 payload follows at DataOffset.
+var v2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// Reader reads the sections of a CARv1 stream, or the CARv1 payload of a
+// CARv2 file.
+type Reader struct {
+	r   io.ReadSeeker
+	br  *bufio.Reader
+	off int64 // file offset of the next section
+	end int64 // end of the payload; 0 when unknown
+}
+
+// NewReader reads the header of the archive in r.
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	cr := &Reader{r: r, br: bufio.NewReaderSize(r, 1<<20)}
+	pragma, err := cr.br.Peek(len(v2Pragma))
+	if err == nil && bytes.Equal(pragma, v2Pragma) {
+		var hdr [40]byte // characteristics, data offset, data size, index offset
+		if _, err := cr.br.Discard(len(v2Pragma)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(cr.br, hdr[:]); err != nil {
+			return nil, fmt.Errorf("car v2 header: %w", err)
+		}
+		base := int64(binary.LittleEndian.Uint64(hdr[16:]))
+		cr.end = base + int64(binary.LittleEndian.Uint64(hdr[24:]))
+		if err := cr.SeekSection(base); err != nil {
+			return nil, err
+		}
+	}
+	n, err := cr.uvarint()
+	if err != nil {
+		return nil, fmt.Errorf("car header: %w", err)
+	}
+	if n == 0 || n > maxSection {
+		return nil, fmt.Errorf("car header: bad length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cr.br, buf); err != nil {
+		return nil, fmt.Errorf("car header: %w", err)
+	}
+	cr.off += int64(n)
+	v, err := decodeCBOR(buf)
+	if err != nil {
+		return nil, fmt.Errorf("car header: %w", err)
+	}
+	hdr, _ := v.(map[string]any)
+	if ver, _ := hdr["version"].(uint64); ver != 1 {
+		return nil, fmt.Errorf("car header: unsupported version %v", hdr["version"])
+	}
+	return cr, nil
+}
+
+// Offset is the file offset of the next section.
+func (r *Reader) Offset() int64 { return r.off }
+
+// SeekSection moves to off, which must be a section boundary from Offset.
+func (r *Reader) SeekSection(off int64) error {
+	if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+		return fmt.Errorf("car seek: %w", err)
+	}
+	r.br.Reset(r.r)
+	r.off = off
+	return nil
+}
+
+// Next returns the CID and data of the next section, or io.EOF.
+func (r *Reader) Next() (cid link, data []byte, err error) {
+	if r.end > 0 && r.off >= r.end {
+		return "", nil, io.EOF
+	}
+	start := r.off
+	n, err := r.uvarint()
+	if err != nil {
+		if errors.Is(err, io.EOF) && r.off == start {
+			return "", nil, io.EOF
+		}
+		return "", nil, fmt.Errorf("car section at %d: %w", start, err)
+	}
+	if n == 0 || n > maxSection {
+		return "", nil, fmt.Errorf("car section at %d: bad length %d", start, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.br, buf); err != nil {
+		return "", nil, fmt.Errorf("car section at %d: %w", start, io.ErrUnexpectedEOF)
+	}
+	r.off += int64(n)
+	cl, err := cidLen(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("car section at %d: %w", start, err)
+	}
+	return link(buf[:cl]), buf[cl:], nil
+}
+
+func (r *Reader) uvarint() (uint64, error) {
+	var x uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		c, err := r.br.ReadByte()
+		if err != nil {
+			if i > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.off++
+		x |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, errors.New("varint overflows uint64")
+}
+
+// cidLen is the length of the binary CID at the start of b: a bare sha256
+// multihash for CIDv0, otherwise version, codec and multihash.
+func cidLen(b []byte) (int, error) {
+	if len(b) >= 34 && b[0] == 0x12 && b[1] == 0x20 {
+		return 34, nil
+	}
+	n := 0
+	for range 3 { // version, codec, hash function
+		_, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return 0, errors.New("malformed cid")
+		}
+		n += m
+	}
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 || uint64(len(b)-n-m) < size {
+		return 0, errors.New("malformed cid")
+	}
+	return n + m + int(size), nil
+}
+
+// Blocks reads the archive in r and calls fn with each block in turn,
+// stopping at the first error fn returns.
+func Blocks(r io.ReadSeeker, fn func(*model.Block) error) error {
+	cr, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	asm := newAssembler()
+	for {
+		cid, data, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		blk, err := asm.add(cid, data)
+		if err != nil {
+			return fmt.Errorf("at offset %d: %w", cr.Offset(), err)
+		}
+		if blk != nil {
+			if err := fn(blk); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package car
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mr-tron/base58"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// cborHead and the enc* helpers write the DAG-CBOR subset the archive uses.
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n < 1<<32:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+func encUint(n uint64) []byte { return cborHead(0, n) }
+
+func encBytes(b []byte) []byte { return append(cborHead(2, uint64(len(b))), b...) }
+
+func encList(items ...[]byte) []byte {
+	out := cborHead(4, uint64(len(items)))
+	for _, it := range items {
+		out = append(out, it...)
+	}
+	return out
+}
+
+func encLink(cid []byte) []byte {
+	return append(cborHead(6, 42), encBytes(append([]byte{0}, cid...))...)
+}
+
+// cidOf builds a CIDv1 dag-cbor sha256 CID for data.
+func cidOf(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return append([]byte{0x01, 0x71, 0x12, 0x20}, sum[:]...)
+}
+
+type carWriter struct{ buf bytes.Buffer }
+
+func newCarWriter() *carWriter {
+	w := &carWriter{}
+	hdr := append(cborHead(5, 2), append([]byte{0x65}, "roots"...)...)
+	hdr = append(hdr, encList()...)
+	hdr = append(hdr, append([]byte{0x67}, "version"...)...)
+	hdr = append(hdr, encUint(1)...)
+	w.buf.Write(binary.AppendUvarint(nil, uint64(len(hdr))))
+	w.buf.Write(hdr)
+	return w
+}
+
+func (w *carWriter) node(data []byte) []byte {
+	cid := cidOf(data)
+	w.buf.Write(binary.AppendUvarint(nil, uint64(len(cid)+len(data))))
+	w.buf.Write(cid)
+	w.buf.Write(data)
+	return cid
+}
+
+func key(seed byte) []byte { return bytes.Repeat([]byte{seed}, 32) }
+
+// wireTx is a legacy transaction from signer with a memo instruction.
+func wireTx(sig, signer byte) []byte {
+	memo, _ := base58.Decode("MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr")
+	b := []byte{1}
+	b = append(b, bytes.Repeat([]byte{sig}, 64)...)
+	b = append(b, 1, 0, 1) // header
+	b = append(b, 2)
+	b = append(b, key(signer)...)
+	b = append(b, memo...)
+	b = append(b, key(0xbb)...) // recent blockhash
+	b = append(b, 1, 1, 1, 0, 2, 'h', 'i')
+	return b
+}
+
+func frameNode(data []byte) []byte {
+	return encList(encUint(kindDataFrame), encUint(0), encUint(0), encUint(1), encBytes(data))
+}
+
+func txNodeBytes(slot uint64, data, meta []byte) []byte {
+	return encList(encUint(kindTransaction), frameNode(data), frameNode(meta), encUint(slot))
+}
+
+func writeBlock(w *carWriter, slot, parent uint64, hash byte, txs ...[]byte) {
+	var links [][]byte
+	for _, tx := range txs {
+		links = append(links, encLink(w.node(tx)))
+	}
+	entry := w.node(encList(encUint(kindEntry), encUint(12), encBytes(key(hash)), encList(links...)))
+	meta := encList(encUint(parent), encUint(1700000000+slot), encUint(slot-1))
+	w.node(encList(encUint(kindBlock), encUint(slot), encList(), encList(encLink(entry)), meta, encList()))
+}
+
+type ackSink struct {
+	mu     sync.Mutex
+	blocks []*model.Block
+	hold   bool // keep acks instead of running them
+	held   []func()
+}
+
+func (s *ackSink) Enqueue(ctx context.Context, b *model.Block) error {
+	return s.EnqueueAck(ctx, b, nil)
+}
+
+func (s *ackSink) EnqueueAck(_ context.Context, b *model.Block, ack func()) error {
+	s.mu.Lock()
+	s.blocks = append(s.blocks, b)
+	hold := s.hold
+	if hold {
+		s.held = append(s.held, ack)
+	}
+	s.mu.Unlock()
+	if !hold {
+		ack()
+	}
+	return nil
+}
+
+func (s *ackSink) MarkSlot(uint64, storage.Commitment) {}
+
+func TestImportArchive(t *testing.T) {
+	var meta []byte // protobuf: fee 5000, 150 compute units
+	meta = protowire.AppendTag(meta, 2, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 5000)
+	meta = protowire.AppendTag(meta, 16, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 150)
+	enc, _ := zstd.NewWriter(nil)
+	meta = enc.EncodeAll(meta, nil)
+
+	// bincode: Err(InstructionError(0, Custom(1))), fee 5000
+	failed := binary.LittleEndian.AppendUint32(nil, 1)
+	failed = binary.LittleEndian.AppendUint32(failed, 8)
+	failed = append(failed, 0)
+	failed = binary.LittleEndian.AppendUint32(failed, 25)
+	failed = binary.LittleEndian.AppendUint32(failed, 1)
+	failed = binary.LittleEndian.AppendUint64(failed, 5000)
+
+	w := newCarWriter()
+	writeBlock(w, 10, 9, 0xa0, txNodeBytes(10, wireTx(1, 0xc1), meta))
+	writeBlock(w, 11, 10, 0xa1, txNodeBytes(11, wireTx(2, 0xc2), failed), txNodeBytes(11, wireTx(3, 0xc3), meta))
+	w.node(encList(encUint(kindSubset), encUint(10), encUint(11), encList()))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "epoch-0.car")
+	require.NoError(t, os.WriteFile(path, w.buf.Bytes(), 0o644))
+	statePath := filepath.Join(dir, "import.state")
+
+	// first run stores only slot 10 before it is interrupted
+	sink := &ackSink{hold: true}
+	im, err := New(sink, WithStatePath(statePath))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- im.Import(ctx, path) }()
+	require.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.held) == 2
+	}, time.Second, time.Millisecond)
+	sink.held[0]()
+	cancel()
+	require.ErrorIs(t, <-errc, context.Canceled)
+	require.NoError(t, im.Save())
+
+	blk := sink.blocks[0]
+	require.Equal(t, uint64(9), blk.ParentSlot)
+	require.Equal(t, base58.Encode(key(0xa0)), blk.Blockhash)
+	require.Equal(t, int64(1700000010), blk.BlockTime)
+	var rb ingest.RawBlock
+	require.NoError(t, json.Unmarshal(blk.Raw, &rb))
+	require.Len(t, rb.Transactions, 1)
+	var rt ingest.RawTransaction
+	require.NoError(t, json.Unmarshal(rb.Transactions[0], &rt))
+	require.Equal(t, base58.Encode(bytes.Repeat([]byte{1}, 64)), rt.Transaction.Signatures[0])
+	require.Equal(t, base58.Encode(key(0xc1)), rt.Transaction.Message.AccountKeys[0])
+	require.Equal(t, base58.Encode([]byte("hi")), rt.Transaction.Message.Instructions[0].Data)
+	require.Equal(t, uint64(5000), rt.Meta.Fee)
+	require.Equal(t, uint64(150), *rt.Meta.ComputeUnitsConsumed)
+	require.JSONEq(t, "null", string(rt.Meta.Err))
+
+	// the second run resumes after slot 10
+	sink = &ackSink{}
+	im, err = New(sink, WithStatePath(statePath))
+	require.NoError(t, err)
+	require.NoError(t, im.Import(context.Background(), path))
+	require.Len(t, sink.blocks, 1)
+	blk = sink.blocks[0]
+	require.Equal(t, uint64(11), blk.Slot)
+	require.NoError(t, json.Unmarshal(blk.Raw, &rb))
+	require.Len(t, rb.Transactions, 2)
+	require.NoError(t, json.Unmarshal(rb.Transactions[0], &rt))
+	require.Equal(t, uint64(5000), rt.Meta.Fee)
+	require.JSONEq(t, `{"InstructionError":[0,{"Custom":1}]}`, string(rt.Meta.Err))
+
+	// and a finished archive is skipped
+	require.NoError(t, im.Import(context.Background(), path))
+	require.Len(t, sink.blocks, 1)
+}
@@ -0,0 +1,147 @@
+package car
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// link is a CID reference, tag 42 in DAG-CBOR; it holds the binary CID.
+type link string
+
+// decodeCBOR decodes the DAG-CBOR subset Old Faithful writes. Values come
+// back as uint64, int64, []byte, string, []any, map[string]any, link, bool
+// or nil.
+func decodeCBOR(b []byte) (any, error) {
+	v, n, err := cborValue(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(b) {
+		return nil, fmt.Errorf("cbor: %d trailing bytes", len(b)-n)
+	}
+	return v, nil
+}
+
+var errShort = errors.New("cbor: unexpected end of data")
+
+const maxDepth = 32
+
+func cborValue(b []byte, depth int) (any, int, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("cbor: nesting too deep")
+	}
+	if len(b) == 0 {
+		return nil, 0, errShort
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	arg, n, err := cborArg(b, info)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch major {
+	case 0:
+		return arg, n, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if uint64(len(b)-n) < arg {
+			return nil, 0, errShort
+		}
+		s := b[n : n+int(arg)]
+		if major == 3 {
+			return string(s), n + int(arg), nil
+		}
+		return s, n + int(arg), nil
+	case 4:
+		if arg > uint64(len(b)) { // each item takes at least a byte
+			return nil, 0, errShort
+		}
+		arr := make([]any, arg)
+		for i := range arr {
+			v, m, err := cborValue(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr[i] = v
+			n += m
+		}
+		return arr, n, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, 0, errShort
+		}
+		m := make(map[string]any, arg)
+		for range arg {
+			k, kn, err := cborValue(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += kn
+			v, vn, err := cborValue(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += vn
+			if ks, ok := k.(string); ok {
+				m[ks] = v
+			}
+		}
+		return m, n, nil
+	case 6:
+		v, m, err := cborValue(b[n:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if arg == 42 {
+			raw, ok := v.([]byte)
+			if !ok || len(raw) == 0 || raw[0] != 0 {
+				return nil, 0, errors.New("cbor: malformed CID link")
+			}
+			return link(raw[1:]), n + m, nil
+		}
+		return v, n + m, nil
+	default: // 7: simple values and floats
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+		return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+func cborArg(b []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24:
+		if len(b) < 2 {
+			return 0, 0, errShort
+		}
+		return uint64(b[1]), 2, nil
+	case info == 25:
+		if len(b) < 3 {
+			return 0, 0, errShort
+		}
+		return uint64(binary.BigEndian.Uint16(b[1:])), 3, nil
+	case info == 26:
+		if len(b) < 5 {
+			return 0, 0, errShort
+		}
+		return uint64(binary.BigEndian.Uint32(b[1:])), 5, nil
+	case info == 27:
+		if len(b) < 9 {
+			return 0, 0, errShort
+		}
+		return binary.BigEndian.Uint64(b[1:]), 9, nil
+	}
+	return 0, 0, fmt.Errorf("cbor: indefinite or reserved length %d", info)
+}
@@ -0,0 +1,250 @@
+package car
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+)
+
+// Progress is how far an archive has been stored. Offset is the section
+// after the last stored block, so an import resumes there.
+type Progress struct {
+	Offset int64  `json:"offset"`
+	Slot   uint64 `json:"slot"`
+	Done   bool   `json:"done"`
+}
+
+// Importer feeds archives through an ingester and records, per archive,
+// how far the store has caught up.
+type Importer struct {
+	sink      ingest.AckSink
+	log       *zap.Logger
+	statePath string
+	every     time.Duration
+
+	mu    sync.Mutex
+	state map[string]*Progress // by absolute archive path
+}
+
+type Option func(*Importer)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(im *Importer) { im.log = l }
+}
+
+// WithStatePath persists progress to path; without it imports always start
+// from the beginning.
+func WithStatePath(path string) Option {
+	return func(im *Importer) { im.statePath = path }
+}
+
+// WithProgressInterval sets how often progress is logged and saved.
+func WithProgressInterval(d time.Duration) Option {
+	return func(im *Importer) {
+		if d > 0 {
+			im.every = d
+		}
+	}
+}
+
+// New loads saved progress, if any.
+func New(sink ingest.AckSink, opts ...Option) (*Importer, error) {
+	im := &Importer{
+		sink:  sink,
+		log:   zap.NewNop(),
+		every: 10 * time.Second,
+		state: make(map[string]*Progress),
+	}
+	for _, o := range opts {
+		o(im)
+	}
+	if im.statePath == "" {
+		return im, nil
+	}
+	b, err := os.ReadFile(im.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return im, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read import state: %w", err)
+	}
+	if err := json.Unmarshal(b, &im.state); err != nil {
+		return nil, fmt.Errorf("decode import state %s: %w", im.statePath, err)
+	}
+	return im, nil
+}
+
+// Save writes progress to the state path.
+func (im *Importer) Save() error {
+	if im.statePath == "" {
+		return nil
+	}
+	im.mu.Lock()
+	b, err := json.MarshalIndent(im.state, "", "  ")
+	im.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := im.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("save import state: %w", err)
+	}
+	if err := os.Rename(tmp, im.statePath); err != nil {
+		return fmt.Errorf("save import state: %w", err)
+	}
+	return nil
+}
+
+// Import streams the archive at path into the sink, resuming after the
+// last block stored by an earlier run. It returns once every block is
+// stored, or when ctx is done; blocks still unstored then are picked up by
+// the next run.
+func (im *Importer) Import(ctx context.Context, path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	im.mu.Lock()
+	p := im.state[abs]
+	if p == nil {
+		p = &Progress{}
+		im.state[abs] = p
+	}
+	resume := *p
+	im.mu.Unlock()
+	if resume.Done {
+		im.log.Info("archive already imported", zap.String("path", abs))
+		return nil
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", abs, err)
+	}
+	if resume.Offset > r.Offset() {
+		if err := r.SeekSection(resume.Offset); err != nil {
+			return err
+		}
+		im.log.Info("resuming archive", zap.String("path", abs), zap.Int64("offset", resume.Offset), zap.Uint64("slot", resume.Slot))
+	}
+
+	tr := &tracker{p: p, mu: &im.mu, done: make(chan struct{}, 1)}
+	asm := newAssembler()
+	var blocks int
+	start, last := time.Now(), time.Now()
+	for {
+		cid, data, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", abs, err)
+		}
+		blk, err := asm.add(cid, data)
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", abs, r.Offset(), err)
+		}
+		if blk == nil {
+			continue
+		}
+		blocks++
+		if err := im.sink.EnqueueAck(ctx, blk, tr.add(r.Offset(), blk.Slot)); err != nil {
+			return err
+		}
+		if time.Since(last) >= im.every {
+			last = time.Now()
+			im.log.Info("import progress",
+				zap.String("path", abs),
+				zap.Uint64("slot", blk.Slot),
+				zap.Int("blocks", blocks),
+				zap.Int("transactions", asm.txCount),
+				zap.Float64("percent", 100*float64(r.Offset())/float64(max(st.Size(), 1))),
+				zap.Float64("blocks_per_sec", float64(blocks)/time.Since(start).Seconds()),
+			)
+			if err := im.Save(); err != nil {
+				im.log.Warn("save import state", zap.Error(err))
+			}
+		}
+	}
+	if asm.noMeta > 0 {
+		im.log.Warn("transactions imported without metadata", zap.String("path", abs), zap.Int("count", asm.noMeta))
+	}
+
+	// wait for the store to catch up before calling the archive done
+	for !tr.drained() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tr.done:
+		}
+	}
+	im.mu.Lock()
+	p.Done = true
+	im.mu.Unlock()
+	im.log.Info("archive imported", zap.String("path", abs), zap.Int("blocks", blocks), zap.Int("transactions", asm.txCount), zap.Duration("took", time.Since(start)))
+	return im.Save()
+}
+
+// tracker moves an archive's progress past blocks once they and every
+// block before them are stored.
+type tracker struct {
+	mu      *sync.Mutex
+	p       *Progress
+	pending []pendingBlock
+	done    chan struct{}
+}
+
+type pendingBlock struct {
+	offset int64
+	slot   uint64
+	stored bool
+}
+
+func (t *tracker) add(offset int64, slot uint64) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, pendingBlock{offset: offset, slot: slot})
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for i := range t.pending {
+			if t.pending[i].offset == offset {
+				t.pending[i].stored = true
+				break
+			}
+		}
+		for len(t.pending) > 0 && t.pending[0].stored {
+			t.p.Offset, t.p.Slot = t.pending[0].offset, t.pending[0].slot
+			t.pending = t.pending[1:]
+		}
+		select {
+		case t.done <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracker) drained() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending) == 0
+}
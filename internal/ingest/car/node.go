@@ -0,0 +1,297 @@
+package car
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mr-tron/base58"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wire"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// Old Faithful node kinds; every node is a DAG-CBOR list starting with one.
+const (
+	kindTransaction = 0
+	kindEntry       = 1
+	kindBlock       = 2
+	kindSubset      = 3
+	kindEpoch       = 4
+	kindRewards     = 5
+	kindDataFrame   = 6
+)
+
+// frame is a DataFrame: a payload, or its first part when next links the
+// rest.
+type frame struct {
+	data []byte
+	next []link
+}
+
+type txNode struct {
+	data frame
+	meta frame
+	slot uint64
+}
+
+type entryNode struct {
+	hash []byte
+	txs  []link
+}
+
+// assembler collects the nodes of each block, which the archive writes
+// before the block itself, and turns a block node into a model.Block.
+type assembler struct {
+	txs     map[link]*txNode
+	entries map[link]*entryNode
+	frames  map[link]*frame
+
+	prevSlot uint64
+	prevHash string
+
+	txCount int
+	noMeta  int // transactions whose metadata could not be decoded
+}
+
+func newAssembler() *assembler {
+	a := &assembler{}
+	a.reset()
+	return a
+}
+
+func (a *assembler) reset() {
+	a.txs = make(map[link]*txNode)
+	a.entries = make(map[link]*entryNode)
+	a.frames = make(map[link]*frame)
+}
+
+// add decodes one section. It returns the block when the section completes
+// one, and nil otherwise.
+func (a *assembler) add(cid link, data []byte) (*model.Block, error) {
+	v, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := v.([]any)
+	if !ok || len(node) == 0 {
+		return nil, errors.New("node is not a list")
+	}
+	kind, ok := node[0].(uint64)
+	if !ok {
+		return nil, errors.New("node has no kind")
+	}
+	switch kind {
+	case kindTransaction:
+		tx, err := decodeTx(node)
+		if err != nil {
+			return nil, fmt.Errorf("transaction: %w", err)
+		}
+		a.txs[cid] = tx
+	case kindEntry:
+		if len(node) < 4 {
+			return nil, errors.New("entry: short node")
+		}
+		hash, _ := node[2].([]byte)
+		txs, err := links(node[3])
+		if err != nil {
+			return nil, fmt.Errorf("entry: %w", err)
+		}
+		a.entries[cid] = &entryNode{hash: hash, txs: txs}
+	case kindDataFrame:
+		f, err := decodeFrame(node)
+		if err != nil {
+			return nil, fmt.Errorf("dataframe: %w", err)
+		}
+		a.frames[cid] = f
+	case kindBlock:
+		blk, err := a.block(node)
+		if err != nil {
+			return nil, fmt.Errorf("block: %w", err)
+		}
+		a.reset()
+		return blk, nil
+	case kindSubset, kindEpoch, kindRewards:
+	default:
+		return nil, fmt.Errorf("unknown node kind %d", kind)
+	}
+	return nil, nil
+}
+
+// block assembles [kind, slot, shredding, entries, meta, rewards] into the
+// getBlock JSON the ingester indexes; meta is [parent_slot, blocktime,
+// block_height?].
+func (a *assembler) block(node []any) (*model.Block, error) {
+	if len(node) < 5 {
+		return nil, errors.New("short node")
+	}
+	slot, ok := node[1].(uint64)
+	if !ok {
+		return nil, errors.New("no slot")
+	}
+	entries, err := links(node[3])
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := node[4].([]any)
+	if len(meta) < 2 {
+		return nil, fmt.Errorf("slot %d: no slot meta", slot)
+	}
+	parent, _ := meta[0].(uint64)
+	rb := ingest.RawBlock{ParentSlot: parent}
+	if t, ok := toInt64(meta[1]); ok {
+		rb.BlockTime = &t
+	}
+	if len(meta) > 2 {
+		if h, ok := meta[2].(uint64); ok {
+			rb.BlockHeight = &h
+		}
+	}
+	if parent == a.prevSlot && a.prevHash != "" {
+		rb.PreviousBlockhash = a.prevHash
+	}
+
+	for _, el := range entries {
+		e := a.entries[el]
+		if e == nil {
+			return nil, fmt.Errorf("slot %d: entry not in archive", slot)
+		}
+		rb.Blockhash = base58.Encode(e.hash) // the last entry's hash
+		for _, tl := range e.txs {
+			t := a.txs[tl]
+			if t == nil {
+				return nil, fmt.Errorf("slot %d: transaction not in archive", slot)
+			}
+			raw, err := a.transaction(t)
+			if err != nil {
+				return nil, fmt.Errorf("slot %d tx %d: %w", slot, len(rb.Transactions), err)
+			}
+			rb.Transactions = append(rb.Transactions, raw)
+		}
+	}
+	if rb.Transactions == nil {
+		rb.Transactions = []json.RawMessage{}
+	}
+	raw, err := json.Marshal(rb)
+	if err != nil {
+		return nil, fmt.Errorf("encode block %d: %w", slot, err)
+	}
+	a.prevSlot, a.prevHash = slot, rb.Blockhash
+	a.txCount += len(rb.Transactions)
+	return ingest.DecodeBlock(slot, raw)
+}
+
+func (a *assembler) transaction(t *txNode) (json.RawMessage, error) {
+	data, err := a.payload(&t.data, 0)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := wire.DecodeTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+	if metaRaw, err := a.payload(&t.meta, 0); err == nil && len(metaRaw) > 0 {
+		rt.Meta, err = wire.DecodeMeta(metaRaw)
+		if err != nil {
+			a.noMeta++
+		}
+	} else {
+		a.noMeta++
+	}
+	return json.Marshal(rt)
+}
+
+// payload joins a DataFrame with the frames it links to.
+func (a *assembler) payload(f *frame, depth int) ([]byte, error) {
+	if len(f.next) == 0 {
+		return f.data, nil
+	}
+	if depth > maxDepth {
+		return nil, errors.New("dataframe chain too long")
+	}
+	out := append([]byte(nil), f.data...)
+	for _, l := range f.next {
+		nf := a.frames[l]
+		if nf == nil {
+			return nil, errors.New("dataframe not in archive")
+		}
+		rest, err := a.payload(nf, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rest...)
+	}
+	return out, nil
+}
+
+// decodeTx reads [kind, data, metadata, slot, index?].
+func decodeTx(node []any) (*txNode, error) {
+	if len(node) < 4 {
+		return nil, errors.New("short node")
+	}
+	tx := &txNode{}
+	slot, ok := node[3].(uint64)
+	if !ok {
+		return nil, errors.New("no slot")
+	}
+	tx.slot = slot
+	for i, dst := range []*frame{&tx.data, &tx.meta} {
+		fn, ok := node[1+i].([]any)
+		if !ok {
+			return nil, errors.New("missing dataframe")
+		}
+		f, err := decodeFrame(fn)
+		if err != nil {
+			return nil, err
+		}
+		*dst = *f
+	}
+	return tx, nil
+}
+
+// decodeFrame reads [kind, hash?, index?, total?, data, next?].
+func decodeFrame(node []any) (*frame, error) {
+	if len(node) < 5 {
+		return nil, errors.New("short dataframe")
+	}
+	data, ok := node[4].([]byte)
+	if !ok {
+		return nil, errors.New("dataframe without data")
+	}
+	f := &frame{data: data}
+	if len(node) > 5 && node[5] != nil {
+		next, err := links(node[5])
+		if err != nil {
+			return nil, err
+		}
+		f.next = next
+	}
+	return f, nil
+}
+
+func links(v any) ([]link, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("expected a list of links")
+	}
+	out := make([]link, len(arr))
+	for i, x := range arr {
+		l, ok := x.(link)
+		if !ok {
+			return nil, errors.New("expected a link")
+		}
+		out[i] = l
+	}
+	return out, nil
+}
+
+func toInt64(v any) (int64, bool) {
+	switch x := v.(type) {
+	case uint64:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return 0, false
+}
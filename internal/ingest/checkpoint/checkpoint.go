@@ -0,0 +1,383 @@
+// Package checkpoint records which slots have been ingested at each
+// commitment level and which are known to be missing.
+package checkpoint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+const (
+	pageBits  = 4096
+	pageWords = pageBits / 64
+	magic     = "RHCP"
+	version   = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	highWater = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_ingest_checkpoint_slot",
+		Help: "Highest slot ingested per commitment level",
+	}, []string{"commitment"})
+
+	missingSlots = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_ingest_missing_slots",
+		Help: "Slots referenced as a parent but not ingested, per commitment level",
+	}, []string{"commitment"})
+)
+
+// Checkpoint keeps a slot bitmap per commitment level. Skipped slots never
+// get a block, so a gap is found through the parent-slot chain instead of
+// holes in the bitmap: a block whose parent is not in the bitmap puts the
+// parent on the missing list until it is ingested.
+type Checkpoint struct {
+	path     string
+	log      *zap.Logger
+	interval time.Duration
+
+	mu     sync.Mutex
+	levels map[storage.Commitment]*level
+	dirty  bool
+}
+
+type level struct {
+	base    uint64 // lowest slot ingested; older parents are not tracked
+	hwm     uint64
+	pages   map[uint64]*[pageWords]uint64
+	missing map[uint64]struct{}
+}
+
+func newLevel() *level {
+	return &level{
+		pages:   make(map[uint64]*[pageWords]uint64),
+		missing: make(map[uint64]struct{}),
+	}
+}
+
+func (l *level) has(slot uint64) bool {
+	p := l.pages[slot/pageBits]
+	return p != nil && p[slot%pageBits/64]&(1<<(slot%64)) != 0
+}
+
+func (l *level) set(slot uint64) bool {
+	p := l.pages[slot/pageBits]
+	if p == nil {
+		p = new([pageWords]uint64)
+		l.pages[slot/pageBits] = p
+	}
+	w, bit := &p[slot%pageBits/64], uint64(1)<<(slot%64)
+	if *w&bit != 0 {
+		return false
+	}
+	*w |= bit
+	return true
+}
+
+type Option func(*Checkpoint)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(c *Checkpoint) { c.log = l }
+}
+
+// WithSaveInterval sets how often Run persists changes.
+func WithSaveInterval(d time.Duration) Option {
+	return func(c *Checkpoint) { c.interval = d }
+}
+
+// Open loads the checkpoint at path, starting empty if it does not exist.
+func Open(path string, opts ...Option) (*Checkpoint, error) {
+	c := &Checkpoint{
+		path:     path,
+		log:      zap.NewNop(),
+		interval: 5 * time.Second,
+		levels:   make(map[storage.Commitment]*level),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return c, nil
+	case err != nil:
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	if err := c.decode(b); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	for cm, l := range c.levels {
+		highWater.WithLabelValues(string(cm)).Set(float64(l.hwm))
+		missingSlots.WithLabelValues(string(cm)).Set(float64(len(l.missing)))
+	}
+	return c, nil
+}
+
+// Mark records that the block at slot, built on parent, was ingested at
+// commitment cm.
+func (c *Checkpoint) Mark(cm storage.Commitment, slot, parent uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.levels[cm]
+	if l == nil {
+		l = newLevel()
+		l.base = slot
+		c.levels[cm] = l
+	}
+	if !l.set(slot) {
+		return
+	}
+	c.dirty = true
+	l.base = min(l.base, slot)
+	if slot > l.hwm {
+		l.hwm = slot
+		highWater.WithLabelValues(string(cm)).Set(float64(slot))
+	}
+	delete(l.missing, slot)
+	if parent < slot && parent >= l.base && !l.has(parent) {
+		l.missing[parent] = struct{}{}
+	}
+	missingSlots.WithLabelValues(string(cm)).Set(float64(len(l.missing)))
+}
+
+// Unmark removes slot from cm, for blocks rolled back from an abandoned
+// fork.
+func (c *Checkpoint) Unmark(cm storage.Commitment, slot uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.levels[cm]
+	if l == nil || !l.has(slot) {
+		return
+	}
+	l.pages[slot/pageBits][slot%pageBits/64] &^= 1 << (slot % 64)
+	c.dirty = true
+}
+
+// Forget drops slot from the missing list without marking it, for slots
+// the upstream no longer has.
+func (c *Checkpoint) Forget(cm storage.Commitment, slot uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.levels[cm]
+	if l == nil {
+		return
+	}
+	if _, ok := l.missing[slot]; ok {
+		delete(l.missing, slot)
+		c.dirty = true
+		missingSlots.WithLabelValues(string(cm)).Set(float64(len(l.missing)))
+	}
+}
+
+// Has reports whether slot was ingested at cm.
+func (c *Checkpoint) Has(cm storage.Commitment, slot uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.levels[cm]
+	return l != nil && l.has(slot)
+}
+
+// Range returns the lowest and highest slot ingested at cm.
+func (c *Checkpoint) Range(cm storage.Commitment) (base, hwm uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := c.levels[cm]
+	if l == nil {
+		return 0, 0, false
+	}
+	return l.base, l.hwm, true
+}
+
+// Missing returns up to limit missing slots at cm, newest first.
+func (c *Checkpoint) Missing(cm storage.Commitment, limit int) []uint64 {
+	c.mu.Lock()
+	l := c.levels[cm]
+	var out []uint64
+	if l != nil {
+		out = make([]uint64, 0, len(l.missing))
+		for s := range l.missing {
+			out = append(out, s)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i] > out[j] })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// Run saves the checkpoint every save interval until ctx is done. Callers
+// Save once more after the ingester has stopped.
+func (c *Checkpoint) Run(ctx context.Context) error {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := c.Save(); err != nil {
+				c.log.Error("save checkpoint", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Save writes the checkpoint if it changed, atomically replacing the file.
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	b := c.encode()
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err := writeAtomic(c.path, b); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func writeAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The file is magic, version, then per level: name, base, high-water mark,
+// the non-empty bitmap pages and the missing slots; a crc32c of everything
+// before it ends the file. Integers are little endian.
+func (c *Checkpoint) encode() []byte {
+	var buf bytes.Buffer
+	put := func(v any) { _ = binary.Write(&buf, binary.LittleEndian, v) }
+	buf.WriteString(magic)
+	put(uint32(version))
+	put(uint32(len(c.levels)))
+	names := make([]string, 0, len(c.levels))
+	for cm := range c.levels {
+		names = append(names, string(cm))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := c.levels[storage.Commitment(name)]
+		put(uint8(len(name)))
+		buf.WriteString(name)
+		put(l.base)
+		put(l.hwm)
+		put(uint32(len(l.pages)))
+		for idx, p := range l.pages {
+			put(idx)
+			put(p[:])
+		}
+		put(uint32(len(l.missing)))
+		for s := range l.missing {
+			put(s)
+		}
+	}
+	put(crc32.Checksum(buf.Bytes(), crcTable))
+	return buf.Bytes()
+}
+
+func (c *Checkpoint) decode(b []byte) error {
+	if len(b) < len(magic)+12 || string(b[:len(magic)]) != magic {
+		return errors.New("not a checkpoint file")
+	}
+	body, sum := b[:len(b)-4], binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return errors.New("checksum mismatch")
+	}
+	r := bufio.NewReader(bytes.NewReader(body[len(magic):]))
+	var err error
+	get := func(v any) {
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, v)
+		}
+	}
+	var ver, n uint32
+	get(&ver)
+	if err == nil && ver != version {
+		return fmt.Errorf("unsupported version %d", ver)
+	}
+	get(&n)
+	for ; n > 0 && err == nil; n-- {
+		var nameLen uint8
+		get(&nameLen)
+		name := make([]byte, nameLen)
+		if err == nil {
+			_, err = io.ReadFull(r, name)
+		}
+		l := newLevel()
+		get(&l.base)
+		get(&l.hwm)
+		var pages, missing uint32
+		get(&pages)
+		for ; pages > 0 && err == nil; pages-- {
+			var idx uint64
+			p := new([pageWords]uint64)
+			get(&idx)
+			get(p[:])
+			l.pages[idx] = p
+		}
+		get(&missing)
+		for ; missing > 0 && err == nil; missing-- {
+			var s uint64
+			get(&s)
+			l.missing[s] = struct{}{}
+		}
+		c.levels[storage.Commitment(name)] = l
+	}
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
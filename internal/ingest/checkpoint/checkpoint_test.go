@@ -0,0 +1,40 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+func TestMarkFindsGapsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	cp, err := Open(path)
+	require.NoError(t, err)
+
+	const c = storage.CommitmentConfirmed
+	cp.Mark(c, 100, 99) // first block: its parent predates the checkpoint
+	cp.Mark(c, 101, 100)
+	cp.Mark(c, 103, 101) // 102 skipped, not missing
+	cp.Mark(c, 9000, 8998)
+	require.Empty(t, cp.Missing(storage.CommitmentFinalized, 0))
+	require.Equal(t, []uint64{8998}, cp.Missing(c, 0))
+
+	cp.Mark(c, 8998, 8990)
+	require.Equal(t, []uint64{8990}, cp.Missing(c, 0))
+	require.NoError(t, cp.Save())
+
+	cp, err = Open(path)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{8990}, cp.Missing(c, 0))
+	require.True(t, cp.Has(c, 8998))
+	require.False(t, cp.Has(c, 102))
+	base, hwm, ok := cp.Range(c)
+	require.True(t, ok)
+	require.Equal(t, []uint64{100, 9000}, []uint64{base, hwm})
+
+	cp.Forget(c, 8990)
+	require.Empty(t, cp.Missing(c, 0))
+}
@@ -0,0 +1,218 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mr-tron/base58"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// Block.Raw holds a getBlock result in "json" encoding with full
+// transaction details, whatever the source; RawBlock and RawTransaction are
+// the parts of it the ingester indexes.
+type RawBlock struct {
+	Blockhash         string            `json:"blockhash"`
+	PreviousBlockhash string            `json:"previousBlockhash"`
+	ParentSlot        uint64            `json:"parentSlot"`
+	BlockTime         *int64            `json:"blockTime"`
+	BlockHeight       *uint64           `json:"blockHeight"`
+	Transactions      []json.RawMessage `json:"transactions"`
+}
+
+type RawTransaction struct {
+	Transaction struct {
+		Signatures []string   `json:"signatures"`
+		Message    RawMessage `json:"message"`
+	} `json:"transaction"`
+	Meta    *RawMeta        `json:"meta"`
+	Version json.RawMessage `json:"version,omitempty"` // "legacy" or 0
+}
+
+type RawMessage struct {
+	Header              *RawHeader              `json:"header,omitempty"`
+	AccountKeys         []string                `json:"accountKeys"`
+	RecentBlockhash     string                  `json:"recentBlockhash,omitempty"`
+	Instructions        []RawInstruction        `json:"instructions"`
+	AddressTableLookups []RawAddressTableLookup `json:"addressTableLookups,omitempty"`
+}
+
+type RawHeader struct {
+	NumRequiredSignatures       int `json:"numRequiredSignatures"`
+	NumReadonlySignedAccounts   int `json:"numReadonlySignedAccounts"`
+	NumReadonlyUnsignedAccounts int `json:"numReadonlyUnsignedAccounts"`
+}
+
+type RawInstruction struct {
+	ProgramIDIndex int    `json:"programIdIndex"`
+	Accounts       []int  `json:"accounts"`
+	Data           string `json:"data"` // base58
+	StackHeight    *int   `json:"stackHeight,omitempty"`
+}
+
+type RawAddressTableLookup struct {
+	AccountKey      string `json:"accountKey"`
+	WritableIndexes []int  `json:"writableIndexes"`
+	ReadonlyIndexes []int  `json:"readonlyIndexes"`
+}
+
+// RawMeta is the status metadata of a transaction. Sources that only carry
+// the status and fee leave the rest out.
+type RawMeta struct {
+	Err                  json.RawMessage        `json:"err"`
+	Status               json.RawMessage        `json:"status,omitempty"`
+	Fee                  uint64                 `json:"fee"`
+	PreBalances          []uint64               `json:"preBalances,omitempty"`
+	PostBalances         []uint64               `json:"postBalances,omitempty"`
+	InnerInstructions    []RawInnerInstructions `json:"innerInstructions,omitempty"`
+	LogMessages          []string               `json:"logMessages,omitempty"`
+	PreTokenBalances     []RawTokenBalance      `json:"preTokenBalances,omitempty"`
+	PostTokenBalances    []RawTokenBalance      `json:"postTokenBalances,omitempty"`
+	ComputeUnitsConsumed *uint64                `json:"computeUnitsConsumed,omitempty"`
+	LoadedAddresses      *RawLoadedAddresses    `json:"loadedAddresses,omitempty"`
+}
+
+// RawInnerInstructions are the instructions invoked by top-level
+// instruction Index.
+type RawInnerInstructions struct {
+	Index        int              `json:"index"`
+	Instructions []RawInstruction `json:"instructions"`
+}
+
+type RawTokenBalance struct {
+	AccountIndex  int            `json:"accountIndex"`
+	Mint          string         `json:"mint"`
+	Owner         string         `json:"owner,omitempty"`
+	ProgramID     string         `json:"programId,omitempty"`
+	UITokenAmount RawTokenAmount `json:"uiTokenAmount"`
+}
+
+type RawTokenAmount struct {
+	Amount         string   `json:"amount"`
+	Decimals       int      `json:"decimals"`
+	UIAmount       *float64 `json:"uiAmount"`
+	UIAmountString string   `json:"uiAmountString"`
+}
+
+// RawLoadedAddresses lists the accounts a v0 transaction loaded from
+// address lookup tables.
+type RawLoadedAddresses struct {
+	Writable []string `json:"writable"`
+	Readonly []string `json:"readonly"`
+}
+
+// DecodeBlock parses the header of a raw block; transactions are derived
+// later by the ingester.
+func DecodeBlock(slot uint64, raw json.RawMessage) (*model.Block, error) {
+	var rb RawBlock
+	if err := json.Unmarshal(raw, &rb); err != nil {
+		return nil, fmt.Errorf("decode block %d: %w", slot, err)
+	}
+	blk := &model.Block{
+		Slot:       slot,
+		Blockhash:  rb.Blockhash,
+		ParentSlot: rb.ParentSlot,
+		Raw:        raw,
+	}
+	if rb.BlockTime != nil {
+		blk.BlockTime = *rb.BlockTime
+	}
+	if rb.BlockHeight != nil {
+		blk.Height = *rb.BlockHeight
+	}
+	return blk, nil
+}
+
+var memoPrograms = map[string]bool{
+	"MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr": true, // spl-memo v2
+	"Memo1UhkJRfHyvLMcVucJwxXeuD728EqVDDwQDxFMNo": true, // spl-memo v1
+}
+
+// Derive builds the transaction rows of blk and one address index row per
+// distinct account a transaction references, static keys and those loaded
+// from lookup tables alike.
+func Derive(blk *model.Block) ([]model.Transaction, []model.SignatureRow, error) {
+	var rb RawBlock
+	if err := json.Unmarshal(blk.Raw, &rb); err != nil {
+		return nil, nil, fmt.Errorf("decode block %d: %w", blk.Slot, err)
+	}
+	txs := make([]model.Transaction, 0, len(rb.Transactions))
+	var sigs []model.SignatureRow
+	for i, raw := range rb.Transactions {
+		var rt RawTransaction
+		if err := json.Unmarshal(raw, &rt); err != nil {
+			return nil, nil, fmt.Errorf("decode tx %d of block %d: %w", i, blk.Slot, err)
+		}
+		if len(rt.Transaction.Signatures) == 0 {
+			continue
+		}
+		msg := rt.Transaction.Message
+		tx := model.Transaction{
+			Signature: rt.Transaction.Signatures[0],
+			Slot:      blk.Slot,
+			Index:     uint64(i),
+			BlockTime: blk.BlockTime,
+			Raw:       raw,
+		}
+		if len(msg.AccountKeys) > 0 {
+			tx.Signer = msg.AccountKeys[0]
+		}
+
+		keys := msg.AccountKeys
+		if m := rt.Meta; m != nil {
+			tx.Fee = m.Fee
+			if m.ComputeUnitsConsumed != nil {
+				tx.ComputeUnits = *m.ComputeUnitsConsumed
+			}
+			if len(m.Err) > 0 && string(m.Err) != "null" {
+				e := string(m.Err)
+				tx.Err = &e
+			}
+			if la := m.LoadedAddresses; la != nil {
+				keys = append(append(append([]string(nil), keys...), la.Writable...), la.Readonly...)
+			}
+		}
+		txs = append(txs, tx)
+
+		memo := extractMemo(msg)
+		seen := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			sigs = append(sigs, model.SignatureRow{
+				Address:   k,
+				Signature: tx.Signature,
+				Slot:      tx.Slot,
+				BlockTime: tx.BlockTime,
+				Err:       tx.Err,
+				Memo:      memo,
+			})
+		}
+	}
+	return txs, sigs, nil
+}
+
+// extractMemo formats top-level memo instructions the way the validator's
+// transaction status service does: "[len] text", joined by "; ".
+func extractMemo(msg RawMessage) *string {
+	var memos []string
+	for _, ix := range msg.Instructions {
+		if ix.ProgramIDIndex < 0 || ix.ProgramIDIndex >= len(msg.AccountKeys) || !memoPrograms[msg.AccountKeys[ix.ProgramIDIndex]] {
+			continue
+		}
+		data, err := base58.Decode(ix.Data)
+		if err != nil {
+			continue
+		}
+		memos = append(memos, fmt.Sprintf("[%d] %s", len(data), data))
+	}
+	if len(memos) == 0 {
+		return nil
+	}
+	m := strings.Join(memos, "; ")
+	return &m
+}
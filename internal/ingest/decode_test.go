@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"testing"
+
+	"github.com/mr-tron/base58"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveRows(t *testing.T) {
+	memo := base58.Encode([]byte("gm"))
+	raw := []byte(`{
+		"blockhash": "bh", "parentSlot": 41, "blockTime": 1700000000, "blockHeight": 7,
+		"transactions": [
+			{
+				"transaction": {
+					"signatures": ["sigA"],
+					"message": {
+						"accountKeys": ["payer", "dest", "MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr"],
+						"instructions": [{"programIdIndex": 2, "accounts": [], "data": "` + memo + `"}]
+					}
+				},
+				"meta": {
+					"err": null, "fee": 5000, "computeUnitsConsumed": 300,
+					"loadedAddresses": {"writable": ["altW"], "readonly": ["altR", "dest"]}
+				}
+			},
+			{
+				"transaction": {"signatures": ["sigB"], "message": {"accountKeys": ["payer"]}},
+				"meta": {"err": {"InstructionError": [0, "Custom"]}, "fee": 5000}
+			}
+		]
+	}`)
+	blk, err := DecodeBlock(42, raw)
+	require.NoError(t, err)
+	require.Equal(t, "bh", blk.Blockhash)
+	require.Equal(t, uint64(7), blk.Height)
+
+	txs, sigs, err := Derive(blk)
+	require.NoError(t, err)
+	require.Len(t, txs, 2)
+	require.Equal(t, "payer", txs[0].Signer)
+	require.Equal(t, uint64(300), txs[0].ComputeUnits)
+	require.Nil(t, txs[0].Err)
+	require.Equal(t, uint64(1), txs[1].Index)
+	require.NotNil(t, txs[1].Err)
+
+	var addrs []string
+	for _, s := range sigs {
+		if s.Signature == "sigA" {
+			addrs = append(addrs, s.Address)
+			require.Equal(t, "[2] gm", *s.Memo)
+		}
+	}
+	require.Equal(t, []string{"payer", "dest", "MemoSq4gqABAXKb96qnH8TysNcWxMyWCqXgDLGmfcHr", "altW", "altR"}, addrs)
+	require.Len(t, sigs, 6)
+}
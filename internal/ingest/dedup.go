@@ -0,0 +1,53 @@
+package ingest
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var duplicates = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "rpcv2_hist_ingest_duplicates_total",
+	Help: "Blocks dropped because the same block was enqueued recently",
+})
+
+// dedup remembers the most recently enqueued blocks, so a source that
+// resends slots after a reconnect does not write them again. The store
+// still dedupes anything that gets past it.
+type dedup struct {
+	mu   sync.Mutex
+	seen map[uint64]string // slot -> blockhash
+	ring []uint64          // insertion order, for eviction
+	next int
+}
+
+func newDedup(n int) *dedup {
+	return &dedup{seen: make(map[uint64]string, n), ring: make([]uint64, 0, n)}
+}
+
+// has reports whether the block at slot with hash was enqueued recently.
+// A different blockhash for the same slot is not a duplicate.
+func (d *dedup) has(slot uint64, hash string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.seen[slot]
+	return ok && h == hash
+}
+
+func (d *dedup) add(slot uint64, hash string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[slot]; ok {
+		d.seen[slot] = hash
+		return
+	}
+	if len(d.ring) < cap(d.ring) {
+		d.ring = append(d.ring, slot)
+	} else {
+		delete(d.seen, d.ring[d.next])
+		d.ring[d.next] = slot
+		d.next = (d.next + 1) % len(d.ring)
+	}
+	d.seen[slot] = hash
+}
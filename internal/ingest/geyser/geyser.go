@@ -0,0 +1,220 @@
+// Package geyser ingests blocks from a Yellowstone (Geyser gRPC) stream.
+package geyser
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type Config struct {
+	Endpoint string
+	XToken   string // sent as the x-token header
+	Insecure bool   // plaintext instead of TLS
+	// Commitment blocks are streamed at; slot updates arrive for all levels.
+	Commitment storage.Commitment
+	// FromSlot replays from this slot on the first subscribe; 0 starts at the tip.
+	FromSlot   uint64
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type Source struct {
+	cfg  Config
+	log  *zap.Logger
+	last uint64 // last block slot handed to the sink
+}
+
+type Option func(*Source)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Source) { s.log = l }
+}
+
+func New(cfg Config, opts ...Option) *Source {
+	if cfg.Commitment == "" {
+		cfg.Commitment = storage.CommitmentConfirmed
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	s := &Source{cfg: cfg, log: zap.NewNop()}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func (s *Source) Name() string { return "geyser" }
+
+var subscribeDesc = grpc.StreamDesc{
+	StreamName:    "Subscribe",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Run subscribes and feeds sink until ctx is done. A dropped stream is
+// resubscribed from the slot after the last delivered block, backing off
+// exponentially while the endpoint keeps failing.
+func (s *Source) Run(ctx context.Context, sink ingest.Sink) error {
+	creds := credentials.NewTLS(&tls.Config{})
+	if s.cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(s.cfg.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("geyser dial %s: %w", s.cfg.Endpoint, err)
+	}
+	defer conn.Close()
+
+	backoff := s.cfg.MinBackoff
+	for {
+		start := time.Now()
+		err := s.subscribe(ctx, conn, sink)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > s.cfg.MaxBackoff {
+			backoff = s.cfg.MinBackoff // the stream was healthy for a while
+		}
+		ingest.SourceReconnects.WithLabelValues(s.Name()).Inc()
+		s.log.Warn("geyser stream ended, resubscribing",
+			zap.Error(err),
+			zap.Uint64("fromSlot", s.resumeSlot()),
+			zap.Duration("backoff", backoff),
+		)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+	}
+}
+
+func (s *Source) resumeSlot() uint64 {
+	if s.last > 0 {
+		return s.last + 1
+	}
+	return s.cfg.FromSlot
+}
+
+func (s *Source) subscribe(ctx context.Context, conn *grpc.ClientConn, sink ingest.Sink) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.cfg.XToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-token", s.cfg.XToken)
+	}
+	stream, err := conn.NewStream(ctx, &subscribeDesc, subscribeMethod, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	req := &subscribeRequest{commitment: level(s.cfg.Commitment), fromSlot: s.resumeSlot()}
+	if err := stream.SendMsg(req); err != nil {
+		return fmt.Errorf("send subscribe: %w", err)
+	}
+
+	for {
+		var u update
+		if err := stream.RecvMsg(&u); err != nil {
+			return fmt.Errorf("recv: %w", err)
+		}
+		switch {
+		case u.block != nil:
+			blk, err := toModel(u.block)
+			if err != nil {
+				// resubscribing would only replay it; skip past it instead
+				s.log.Warn("skipping undecodable block", zap.Uint64("slot", u.block.slot), zap.Error(err))
+				ingest.SourceUpdates.WithLabelValues(s.Name(), "invalid").Inc()
+				s.last = max(s.last, u.block.slot)
+				continue
+			}
+			ingest.SourceUpdates.WithLabelValues(s.Name(), "block").Inc()
+			if err := sink.Enqueue(ctx, blk); err != nil {
+				return err
+			}
+			s.last = blk.Slot
+		case u.slot != nil:
+			ingest.SourceUpdates.WithLabelValues(s.Name(), "slot").Inc()
+			if c, ok := commitment(u.slot.status); ok {
+				sink.MarkSlot(u.slot.slot, c)
+			}
+		case u.ping:
+			// answer so proxies in front of the server keep the stream open
+			if err := stream.SendMsg(&subscribeRequest{ping: 1}); err != nil {
+				return fmt.Errorf("send ping: %w", err)
+			}
+		}
+	}
+}
+
+func level(c storage.Commitment) int {
+	switch c {
+	case storage.CommitmentProcessed:
+		return levelProcessed
+	case storage.CommitmentFinalized:
+		return levelFinalized
+	default:
+		return levelConfirmed
+	}
+}
+
+// commitment maps a SlotStatus; intermediate statuses (first shred, dead,
+// ...) are not commitment levels.
+func commitment(status int) (storage.Commitment, bool) {
+	switch status {
+	case levelProcessed:
+		return storage.CommitmentProcessed, true
+	case levelConfirmed:
+		return storage.CommitmentConfirmed, true
+	case levelFinalized:
+		return storage.CommitmentFinalized, true
+	}
+	return "", false
+}
+
+// toModel re-encodes a block update as the getBlock JSON the ingester
+// indexes, so Geyser and RPC blocks are stored alike.
+func toModel(b *blockUpdate) (*model.Block, error) {
+	rb := ingest.RawBlock{
+		Blockhash:         b.blockhash,
+		PreviousBlockhash: b.parentHash,
+		ParentSlot:        b.parentSlot,
+		BlockTime:         &b.blockTime,
+		BlockHeight:       &b.height,
+		Transactions:      make([]json.RawMessage, 0, len(b.txs)),
+	}
+	sort.Slice(b.txs, func(i, j int) bool { return b.txs[i].index < b.txs[j].index })
+	for _, t := range b.txs {
+		if t.tx == nil {
+			return nil, fmt.Errorf("tx %d has no transaction", t.index)
+		}
+		t.tx.Meta = t.meta
+		raw, err := json.Marshal(t.tx)
+		if err != nil {
+			return nil, fmt.Errorf("encode tx: %w", err)
+		}
+		rb.Transactions = append(rb.Transactions, raw)
+	}
+	raw, err := json.Marshal(rb)
+	if err != nil {
+		return nil, fmt.Errorf("encode block %d: %w", b.slot, err)
+	}
+	return ingest.DecodeBlock(b.slot, raw)
+}
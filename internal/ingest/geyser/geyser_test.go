@@ -0,0 +1,255 @@
+package geyser
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-tron/base58"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wire"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// fakeRequest is the server-side view of SubscribeRequest.
+type fakeRequest struct {
+	commitment uint64
+	fromSlot   uint64
+	ping       bool
+}
+
+func (r *fakeRequest) marshal() ([]byte, error) { return nil, errors.New("unused") }
+
+func (r *fakeRequest) unmarshal(b []byte) error {
+	return wire.Walk(b, func(num protowire.Number, v uint64, _ []byte) error {
+		switch num {
+		case 6:
+			r.commitment = v
+		case 9:
+			r.ping = true
+		case 11:
+			r.fromSlot = v
+		}
+		return nil
+	})
+}
+
+// fakeUpdate encodes a SubscribeUpdate carrying a block or a slot status.
+type fakeUpdate struct {
+	block  uint64
+	slot   uint64
+	status uint64
+	ping   bool
+}
+
+func (u *fakeUpdate) unmarshal([]byte) error { return errors.New("unused") }
+
+func (u *fakeUpdate) marshal() ([]byte, error) {
+	var b []byte
+	switch {
+	case u.ping:
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, nil)
+	case u.block > 0:
+		bytesField := func(b []byte, num protowire.Number, v []byte) []byte {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, v)
+		}
+		varintField := func(b []byte, num protowire.Number, v uint64) []byte {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			return protowire.AppendVarint(b, v)
+		}
+		var msg []byte
+		msg = bytesField(msg, 1, varintField(varintField(nil, 1, 2), 3, 1)) // header
+		msg = bytesField(msg, 2, []byte{9, 9})
+		msg = bytesField(msg, 2, []byte{8, 8})
+		msg = bytesField(msg, 3, []byte{7})
+		var txn []byte
+		txn = bytesField(txn, 1, []byte{1, 2, 3})
+		txn = bytesField(txn, 1, []byte{4, 5, 6})
+		txn = bytesField(txn, 2, msg)
+		// Err(InstructionError(0, Custom(1)))
+		txErr := binary.LittleEndian.AppendUint32(nil, 8)
+		txErr = append(txErr, 0)
+		txErr = binary.LittleEndian.AppendUint32(txErr, 25)
+		txErr = binary.LittleEndian.AppendUint32(txErr, 1)
+		var meta []byte
+		meta = bytesField(meta, 1, bytesField(nil, 1, txErr))
+		meta = varintField(meta, 2, 5000)
+		meta = bytesField(meta, 3, protowire.AppendVarint(protowire.AppendVarint(nil, 100), 200))
+		meta = bytesField(meta, 6, []byte("Program log: hi"))
+		var tx []byte
+		tx = bytesField(tx, 1, []byte{1, 2, 3})
+		tx = bytesField(tx, 3, txn)
+		tx = bytesField(tx, 4, meta)
+
+		var blk []byte
+		blk = protowire.AppendTag(blk, 1, protowire.VarintType)
+		blk = protowire.AppendVarint(blk, u.block)
+		blk = protowire.AppendTag(blk, 2, protowire.BytesType)
+		blk = protowire.AppendString(blk, "hash")
+		blk = protowire.AppendTag(blk, 4, protowire.BytesType)
+		blk = protowire.AppendBytes(blk, tx)
+		blk = protowire.AppendTag(blk, 7, protowire.VarintType)
+		blk = protowire.AppendVarint(blk, u.block-1)
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, blk)
+	default:
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.VarintType)
+		s = protowire.AppendVarint(s, u.slot)
+		s = protowire.AppendTag(s, 3, protowire.VarintType)
+		s = protowire.AppendVarint(s, u.status)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return b, nil
+}
+
+// fakeServer serves one scripted session per subscribe.
+type fakeServer struct {
+	mu       sync.Mutex
+	requests []fakeRequest
+	tokens   []string
+	sessions [][]fakeUpdate
+}
+
+func (f *fakeServer) subscribe(_ any, stream grpc.ServerStream) error {
+	var req fakeRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.mu.Lock()
+	n := len(f.requests)
+	f.requests = append(f.requests, req)
+	f.tokens = append(f.tokens, md.Get("x-token")...)
+	var script []fakeUpdate
+	if n < len(f.sessions) {
+		script = f.sessions[n]
+	}
+	f.mu.Unlock()
+
+	for i := range script {
+		if err := stream.SendMsg(&script[i]); err != nil {
+			return err
+		}
+		if script[i].ping {
+			var pong fakeRequest
+			if err := stream.RecvMsg(&pong); err != nil || !pong.ping {
+				return errors.New("expected ping reply")
+			}
+		}
+	}
+	if n+1 < len(f.sessions) {
+		return errors.New("dropped") // force a reconnect
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+type fakeSink struct {
+	mu     sync.Mutex
+	blocks []*model.Block
+	marks  map[storage.Commitment]uint64
+}
+
+func (s *fakeSink) Enqueue(_ context.Context, b *model.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = append(s.blocks, b)
+	return nil
+}
+
+func (s *fakeSink) MarkSlot(slot uint64, c storage.Commitment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marks[c] = slot
+}
+
+func (s *fakeSink) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.blocks) == 2 && s.marks[storage.CommitmentFinalized] > 0
+}
+
+func TestSourceResubscribesFromLastSlot(t *testing.T) {
+	fake := &fakeServer{sessions: [][]fakeUpdate{
+		{{block: 10}, {slot: 10, status: levelConfirmed}, {ping: true}},
+		{{block: 11}, {slot: 10, status: levelFinalized}},
+	}}
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "geyser.Geyser",
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Subscribe",
+			Handler:       fake.subscribe,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, fake)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	src := New(Config{
+		Endpoint:   ln.Addr().String(),
+		XToken:     "secret",
+		Insecure:   true,
+		Commitment: storage.CommitmentFinalized,
+		FromSlot:   10,
+		MinBackoff: 10 * time.Millisecond,
+	})
+	sink := &fakeSink{marks: map[storage.Commitment]uint64{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- src.Run(ctx, sink) }()
+
+	require.Eventually(t, sink.done, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Len(t, fake.requests, 2)
+	require.Equal(t, uint64(levelFinalized), fake.requests[0].commitment)
+	require.Equal(t, uint64(10), fake.requests[0].fromSlot)
+	require.Equal(t, uint64(11), fake.requests[1].fromSlot)
+	require.Equal(t, []string{"secret", "secret"}, fake.tokens)
+
+	blk := sink.blocks[0]
+	require.Equal(t, uint64(10), blk.Slot)
+	require.Equal(t, uint64(9), blk.ParentSlot)
+	require.Equal(t, "hash", blk.Blockhash)
+	var rb ingest.RawBlock
+	require.NoError(t, json.Unmarshal(blk.Raw, &rb))
+	require.Len(t, rb.Transactions, 1)
+	var tx ingest.RawTransaction
+	require.NoError(t, json.Unmarshal(rb.Transactions[0], &tx))
+	require.Equal(t, []string{base58.Encode([]byte{1, 2, 3}), base58.Encode([]byte{4, 5, 6})}, tx.Transaction.Signatures)
+	msg := tx.Transaction.Message
+	require.Equal(t, &ingest.RawHeader{NumRequiredSignatures: 2, NumReadonlyUnsignedAccounts: 1}, msg.Header)
+	require.Equal(t, []string{base58.Encode([]byte{9, 9}), base58.Encode([]byte{8, 8})}, msg.AccountKeys)
+	require.Equal(t, base58.Encode([]byte{7}), msg.RecentBlockhash)
+	require.Equal(t, uint64(5000), tx.Meta.Fee)
+	require.Equal(t, []uint64{100, 200}, tx.Meta.PreBalances)
+	require.Equal(t, []string{"Program log: hi"}, tx.Meta.LogMessages)
+	require.JSONEq(t, `{"InstructionError":[0,{"Custom":1}]}`, string(tx.Meta.Err))
+	require.JSONEq(t, `{"Err":{"InstructionError":[0,{"Custom":1}]}}`, string(tx.Meta.Status))
+	require.Equal(t, uint64(11), sink.blocks[1].Slot)
+	require.Equal(t, uint64(10), sink.marks[storage.CommitmentConfirmed])
+	require.Equal(t, uint64(10), sink.marks[storage.CommitmentFinalized])
+}
@@ -0,0 +1,229 @@
+package geyser
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wire"
+)
+
+// The Yellowstone protos pull in the whole solana-storage schema, so the
+// handful of fields we need are encoded by hand. Field numbers follow
+// yellowstone-grpc-proto geyser.proto and solana-storage.proto.
+
+const subscribeMethod = "/geyser.Geyser/Subscribe"
+
+// filterName tags our filters; the server echoes it in SubscribeUpdate.filters.
+const filterName = "rpcv2-hist"
+
+// Yellowstone CommitmentLevel and SlotStatus share the first three values.
+const (
+	levelProcessed = 0
+	levelConfirmed = 1
+	levelFinalized = 2
+)
+
+// wireMessage is implemented by every type the codec carries.
+type wireMessage interface {
+	marshal() ([]byte, error)
+	unmarshal([]byte) error
+}
+
+// codec registers as "proto" so the content-type matches a protobuf server.
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("geyser codec: cannot marshal %T", v)
+	}
+	return m.marshal()
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("geyser codec: cannot unmarshal %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+// subscribeRequest is SubscribeRequest restricted to block and slot filters.
+type subscribeRequest struct {
+	commitment int
+	fromSlot   uint64 // 0 = from the tip
+	ping       int32  // non-zero sends only a ping
+}
+
+func (r *subscribeRequest) marshal() ([]byte, error) {
+	var b []byte
+	if r.ping != 0 {
+		// SubscribeRequestPing ping = 9 { int32 id = 1 }
+		var p []byte
+		p = protowire.AppendTag(p, 1, protowire.VarintType)
+		p = protowire.AppendVarint(p, uint64(r.ping))
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		return protowire.AppendBytes(b, p), nil
+	}
+
+	// map<string, SubscribeRequestFilterSlots> slots = 2
+	b = appendMapEntry(b, 2, filterName, nil)
+
+	// map<string, SubscribeRequestFilterBlocks> blocks = 4
+	// { bool include_transactions = 2 }
+	var blk []byte
+	blk = protowire.AppendTag(blk, 2, protowire.VarintType)
+	blk = protowire.AppendVarint(blk, 1)
+	b = appendMapEntry(b, 4, filterName, blk)
+
+	// optional CommitmentLevel commitment = 6
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.commitment))
+
+	// optional uint64 from_slot = 11
+	if r.fromSlot > 0 {
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, r.fromSlot)
+	}
+	return b, nil
+}
+
+func (r *subscribeRequest) unmarshal([]byte) error {
+	return errors.New("geyser: subscribeRequest is send-only")
+}
+
+func appendMapEntry(b []byte, field protowire.Number, key string, val []byte) []byte {
+	var e []byte
+	e = protowire.AppendTag(e, 1, protowire.BytesType)
+	e = protowire.AppendString(e, key)
+	e = protowire.AppendTag(e, 2, protowire.BytesType)
+	e = protowire.AppendBytes(e, val)
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, e)
+}
+
+// update is the subset of SubscribeUpdate we act on; exactly one of block,
+// slot or ping is set.
+type update struct {
+	block *blockUpdate
+	slot  *slotUpdate
+	ping  bool
+}
+
+type slotUpdate struct {
+	slot   uint64
+	parent uint64
+	status int
+}
+
+type blockUpdate struct {
+	slot       uint64
+	parentSlot uint64
+	blockhash  string
+	parentHash string
+	blockTime  int64
+	height     uint64
+	txs        []txInfo
+}
+
+type txInfo struct {
+	index uint64
+	tx    *ingest.RawTransaction
+	meta  *ingest.RawMeta
+}
+
+func (u *update) marshal() ([]byte, error) {
+	return nil, errors.New("geyser: update is receive-only")
+}
+
+func (u *update) unmarshal(b []byte) error {
+	*u = update{}
+	return wire.Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 3: // SubscribeUpdateSlot slot
+			u.slot = &slotUpdate{}
+			return u.slot.unmarshal(buf)
+		case 5: // SubscribeUpdateBlock block
+			u.block = &blockUpdate{}
+			return u.block.unmarshal(buf)
+		case 6: // SubscribeUpdatePing ping
+			u.ping = true
+		}
+		return nil
+	})
+}
+
+func (s *slotUpdate) unmarshal(b []byte) error {
+	return wire.Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			s.slot = v
+		case 2:
+			s.parent = v
+		case 3:
+			s.status = int(v)
+		}
+		return nil
+	})
+}
+
+func (blk *blockUpdate) unmarshal(b []byte) error {
+	return wire.Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			blk.slot = v
+		case 2:
+			blk.blockhash = string(buf)
+		case 4:
+			var tx txInfo
+			if err := tx.unmarshal(buf); err != nil {
+				return fmt.Errorf("transaction: %w", err)
+			}
+			blk.txs = append(blk.txs, tx)
+		case 5: // UnixTimestamp { int64 timestamp = 1 }
+			return wire.Walk(buf, func(n protowire.Number, v uint64, _ []byte) error {
+				if n == 1 {
+					blk.blockTime = int64(v)
+				}
+				return nil
+			})
+		case 6: // BlockHeight { uint64 block_height = 1 }
+			return wire.Walk(buf, func(n protowire.Number, v uint64, _ []byte) error {
+				if n == 1 {
+					blk.height = v
+				}
+				return nil
+			})
+		case 7:
+			blk.parentSlot = v
+		case 8:
+			blk.parentHash = string(buf)
+		}
+		return nil
+	})
+}
+
+// unmarshal reads SubscribeUpdateTransactionInfo { bytes signature = 1;
+// Transaction transaction = 3; TransactionStatusMeta meta = 4; uint64
+// index = 5 }; the signature repeats the transaction's first.
+func (tx *txInfo) unmarshal(b []byte) error {
+	return wire.Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		var err error
+		switch num {
+		case 3:
+			tx.tx, err = wire.DecodeProtoTransaction(buf)
+		case 4:
+			if tx.meta, err = wire.DecodeProtoMeta(buf); err != nil {
+				err = fmt.Errorf("meta: %w", err)
+			}
+		case 5:
+			tx.index = v
+		}
+		return err
+	})
+}
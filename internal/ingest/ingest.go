@@ -2,124 +2,559 @@ package ingest
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/apache/arrow/go/v15/arrow"
-	"github.com/apache/arrow/go/v15/arrow/array"
-	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/checkpoint"
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wal"
 	"github.com/lilythecat859/rpcv2-hist/internal/model"
 	"github.com/lilythecat859/rpcv2-hist/internal/storage"
 )
 
 type Ingester struct {
-	store  storage.HistoricalStore
-	log    *zap.Logger
-	tick   time.Duration
-	queue  chan *batch
-	wg     sync.WaitGroup
-	ctx    context.Context
-	cancel context.CancelFunc
+	store      storage.HistoricalStore
+	commitment storage.Commitment
+	log        *zap.Logger
+	tick       time.Duration
+	queue      chan *batch
+	room       chan struct{} // holds a token per queue slot reserved
+	wg         sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	queueSize int
+	dedupSize int
+	dedup     *dedup
+	maxRows   int
+	maxBytes  int
+	maxAge    time.Duration
+
+	wal      *wal.WAL
+	enqMu    sync.Mutex // keeps WAL order and queue order the same
+	retryMin time.Duration
+	retryMax time.Duration
+
+	checkpoint *checkpoint.Checkpoint
+	publisher  Publisher
+
+	// commitment promotion; owned by the loop goroutine
+	promoter  storage.Promoter
+	unsettled map[uint64]slotState
+	late      []uint64 // backfilled slots below the finalized tip
+	settled   map[storage.Commitment]uint64
+
+	latest  atomic.Uint64 // highest slot enqueued
+	flushed atomic.Uint64 // highest slot committed to the store
+
+	processed, confirmed, finalized atomic.Uint64
 }
 
 type batch struct {
 	blocks []model.Block
 	txs    []model.Transaction
-	sigs   []sigRow
+	sigs   []model.SignatureRow
+	bytes  int
+	lsn    uint64   // highest WAL record in the batch
+	acks   []func() // run once the batch is stored
+}
+
+func (b *batch) rows() int { return len(b.blocks) + len(b.txs) + len(b.sigs) }
+
+func (b *batch) add(o *batch) {
+	b.blocks = append(b.blocks, o.blocks...)
+	b.txs = append(b.txs, o.txs...)
+	b.sigs = append(b.sigs, o.sigs...)
+	b.bytes += o.bytes
+	b.lsn = max(b.lsn, o.lsn)
+	b.acks = append(b.acks, o.acks...)
 }
 
-type sigRow struct {
-	address   string
-	signature string
-	slot      uint64
+// Publisher receives the rows of every batch after it is stored.
+type Publisher interface {
+	Publish(ctx context.Context, b storage.Batch) error
 }
 
+// ErrQueueFull is returned by TryEnqueue when the ingester is saturated.
+var ErrQueueFull = errors.New("ingest queue full")
+
+var (
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_ingest_queue_depth",
+		Help: "Blocks waiting in the ingest queue",
+	})
+
+	enqueueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_enqueue_rejected_total",
+		Help: "Blocks rejected because the ingest queue was full",
+	})
+
+	flushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpcv2_hist_ingest_flush_duration_seconds",
+		Help:    "Time to write one ingest batch",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5 ms .. 10 s
+	}, []string{"reason", "status"})
+
+	flushRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_flush_retries_total",
+		Help: "Failed ingest batch writes that were retried",
+	})
+
+	walReplayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_wal_replayed_total",
+		Help: "Blocks replayed from the write-ahead log at startup",
+	})
+
+	publishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_publish_errors_total",
+		Help: "Stored batches that could not be republished",
+	})
+
+	flushRows = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rpcv2_hist_ingest_flush_rows",
+		Help:    "Rows written per ingest batch",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 8), // 16 .. 262144
+	})
+)
+
 type Option func(*Ingester)
 
 func WithLogger(l *zap.Logger) Option {
 	return func(i *Ingester) { i.log = l }
 }
 
+// WithCommitment sets the commitment level ingested rows are stored under.
+func WithCommitment(c storage.Commitment) Option {
+	return func(i *Ingester) { i.commitment = c }
+}
+
+// WithQueueSize bounds how many blocks may wait to be batched. Zero keeps
+// the default.
+func WithQueueSize(n int) Option {
+	return func(i *Ingester) {
+		if n > 0 {
+			i.queueSize = n
+		}
+	}
+}
+
+// WithDedupWindow sets how many recently enqueued blocks are remembered to
+// drop resent ones. Zero keeps the default.
+func WithDedupWindow(n int) Option {
+	return func(i *Ingester) {
+		if n > 0 {
+			i.dedupSize = n
+		}
+	}
+}
+
+// WithBatchLimits flushes once a batch holds maxRows rows or maxBytes of raw
+// payload, or its oldest block has waited maxAge. Zero keeps a default.
+func WithBatchLimits(maxRows, maxBytes int, maxAge time.Duration) Option {
+	return func(i *Ingester) {
+		if maxRows > 0 {
+			i.maxRows = maxRows
+		}
+		if maxBytes > 0 {
+			i.maxBytes = maxBytes
+		}
+		if maxAge > 0 {
+			i.maxAge = maxAge
+		}
+	}
+}
+
+// WithWAL logs every enqueued block to w before it is queued and replays
+// what the store has not committed when Run starts.
+func WithWAL(w *wal.WAL) Option {
+	return func(i *Ingester) { i.wal = w }
+}
+
+// WithCheckpoint marks every committed block in cp.
+func WithCheckpoint(cp *checkpoint.Checkpoint) Option {
+	return func(i *Ingester) { i.checkpoint = cp }
+}
+
+// WithPublisher republishes the rows of every stored batch to p. Publishing
+// is best effort: a failure is logged and does not fail the flush.
+func WithPublisher(p Publisher) Option {
+	return func(i *Ingester) { i.publisher = p }
+}
+
+// WithRetry sets the backoff between attempts to write a failed batch.
+func WithRetry(min, max time.Duration) Option {
+	return func(i *Ingester) {
+		i.retryMin, i.retryMax = min, max
+	}
+}
+
 func New(store storage.HistoricalStore, opts ...Option) (*Ingester, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	ing := &Ingester{
-		store:  store,
-		log:    zap.NewNop(),
-		tick:   400 * time.Millisecond,
-		queue:  make(chan *batch, 1024),
-		ctx:    ctx,
-		cancel: cancel,
+		store:      store,
+		commitment: storage.CommitmentConfirmed,
+		log:        zap.NewNop(),
+		tick:       400 * time.Millisecond,
+		queueSize:  1024,
+		dedupSize:  4096,
+		maxRows:    100_000,
+		maxBytes:   64 << 20,
+		maxAge:     time.Second,
+		retryMin:   100 * time.Millisecond,
+		retryMax:   30 * time.Second,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 	for _, o := range opts {
 		o(ing)
 	}
+	ing.queue = make(chan *batch, ing.queueSize)
+	ing.room = make(chan struct{}, ing.queueSize)
+	ing.dedup = newDedup(ing.dedupSize)
+	ing.promoter, _ = storage.As[storage.Promoter](store)
+	ing.unsettled = make(map[uint64]slotState)
+	ing.settled = make(map[storage.Commitment]uint64)
+	ing.tick = min(ing.tick, ing.maxAge)
 	return ing, nil
 }
 
+// Run batches queued blocks until ctx is done, then flushes what is queued.
+// It fails if the WAL cannot be replayed: the records past the failure are
+// kept for an operator rather than truncated by later batches.
 func (i *Ingester) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
 	i.wg.Add(1)
-	go i.loop()
-	<-ctx.Done()
+	go func() { errc <- i.loop() }()
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
 	i.cancel()
 	i.wg.Wait()
-	return nil
+	return err
 }
 
-func (i *Ingester) loop() {
+func (i *Ingester) loop() error {
 	defer i.wg.Done()
 	ticker := time.NewTicker(i.tick)
 	defer ticker.Stop()
+
+	pending := &batch{}
+	var oldest time.Time
+	if i.wal != nil {
+		var err error
+		if pending, err = i.replay(); err != nil {
+			return fmt.Errorf("wal replay: %w", err)
+		}
+		oldest = time.Now()
+	}
 	for {
 		select {
 		case <-i.ctx.Done():
-			return
+			// enqueuers check the context under enqMu, so none queue after this
+			i.enqMu.Lock()
+			for len(i.queue) > 0 {
+				pending.add(<-i.queue)
+				<-i.room
+			}
+			i.enqMu.Unlock()
+			queueDepth.Set(0)
+			i.flushPending(pending, "shutdown")
+			return nil
 		case b := <-i.queue:
-			if err := i.flush(b); err != nil {
-				i.log.Error("flush batch", zap.Error(err))
+			<-i.room
+			queueDepth.Set(float64(len(i.queue)))
+			if pending.rows() == 0 {
+				oldest = time.Now()
+			}
+			pending.add(b)
+			switch {
+			case pending.rows() >= i.maxRows:
+				pending = i.flushPending(pending, "rows")
+			case pending.bytes >= i.maxBytes:
+				pending = i.flushPending(pending, "bytes")
 			}
 		case <-ticker.C:
+			if pending.rows() > 0 && time.Since(oldest) >= i.maxAge {
+				pending = i.flushPending(pending, "age")
+			}
+			i.settle()
+		}
+	}
+}
+
+// replay feeds blocks the WAL still holds through the normal batching path
+// and returns the partial batch left over. Stopping part way is not an error;
+// the rest is replayed on the next start.
+func (i *Ingester) replay() (*batch, error) {
+	pending := &batch{}
+	var n int
+	err := i.wal.Replay(func(lsn uint64, blk *model.Block) error {
+		b := i.newBatch(blk)
+		b.lsn = lsn
+		storeMax(&i.latest, blk.Slot)
+		i.dedup.add(blk.Slot, blk.Blockhash)
+		pending.add(b)
+		n++
+		if pending.rows() >= i.maxRows || pending.bytes >= i.maxBytes {
+			pending = i.flushPending(pending, "replay")
+		}
+		return i.ctx.Err()
+	})
+	walReplayed.Add(float64(n))
+	if err != nil && i.ctx.Err() == nil {
+		i.log.Error("wal replay", zap.Int("blocks", n), zap.Error(err))
+		return nil, err
+	}
+	if n > 0 {
+		i.log.Info("wal replayed", zap.Int("blocks", n))
+	}
+	return pending, nil
+}
+
+// flushPending writes b, retrying with exponential backoff until it succeeds
+// or the ingester stops, and returns an empty batch to accumulate into. A
+// batch given up on at shutdown stays in the WAL for the next start.
+func (i *Ingester) flushPending(b *batch, reason string) *batch {
+	if b.rows() == 0 {
+		return b
+	}
+	backoff := i.retryMin
+	for {
+		start := time.Now()
+		err := i.flush(b)
+		if err == nil {
+			flushDuration.WithLabelValues(reason, "ok").Observe(time.Since(start).Seconds())
+			break
+		}
+		flushDuration.WithLabelValues(reason, "error").Observe(time.Since(start).Seconds())
+		i.log.Error("flush batch", zap.String("reason", reason), zap.Int("blocks", len(b.blocks)), zap.Duration("retryIn", backoff), zap.Error(err))
+		if i.ctx.Err() != nil {
+			break
+		}
+		flushRetries.Inc()
+		select {
+		case <-i.ctx.Done():
+		case <-time.After(backoff):
 		}
+		backoff = min(backoff*2, i.retryMax)
 	}
+	flushRows.Observe(float64(b.rows()))
+	return &batch{}
 }
 
+// EnqueueBlock queues block, waiting while the queue is full until the
+// ingester stops.
 func (i *Ingester) EnqueueBlock(block *model.Block) {
-	i.queue <- &batch{blocks: []model.Block{*block}}
+	_ = i.Enqueue(i.ctx, block)
+}
+
+// Enqueue queues block, waiting while the queue is full. It returns ctx's
+// error if ctx ends first. A block enqueued recently is dropped.
+func (i *Ingester) Enqueue(ctx context.Context, block *model.Block) error {
+	return i.EnqueueAck(ctx, block, nil)
+}
+
+// EnqueueAck is Enqueue, calling ack once block is stored. A dropped
+// duplicate is acked at once since the earlier copy is already on its way.
+func (i *Ingester) EnqueueAck(ctx context.Context, block *model.Block, ack func()) error {
+	b := i.newBatch(block)
+	if ack != nil {
+		b.acks = []func(){ack}
+	}
+	i.enqMu.Lock()
+	defer i.enqMu.Unlock()
+	if i.duplicate(block) {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	select {
+	case i.room <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.ctx.Done():
+		return fmt.Errorf("ingester stopped: %w", i.ctx.Err())
+	}
+	if err := i.stopped(); err != nil {
+		return err
+	}
+	if err := i.logBatch(b, block); err != nil {
+		<-i.room
+		return err
+	}
+	i.queue <- b
+	i.enqueued(block)
+	return nil
+}
+
+// TryEnqueue queues block without waiting and returns ErrQueueFull when
+// there is no room.
+func (i *Ingester) TryEnqueue(block *model.Block) error {
+	// a held lock means another enqueuer is waiting for room
+	if !i.enqMu.TryLock() {
+		enqueueRejected.Inc()
+		return ErrQueueFull
+	}
+	defer i.enqMu.Unlock()
+	if i.duplicate(block) {
+		return nil
+	}
+	select {
+	case i.room <- struct{}{}:
+	default:
+		enqueueRejected.Inc()
+		return ErrQueueFull
+	}
+	if err := i.stopped(); err != nil {
+		return err
+	}
+	b := i.newBatch(block)
+	if err := i.logBatch(b, block); err != nil {
+		<-i.room
+		return err
+	}
+	i.queue <- b
+	i.enqueued(block)
+	return nil
+}
+
+// stopped releases the slot a caller reserved if the ingester has stopped;
+// the loop has drained the queue for the last time by then.
+func (i *Ingester) stopped() error {
+	if err := i.ctx.Err(); err != nil {
+		<-i.room
+		return fmt.Errorf("ingester stopped: %w", err)
+	}
+	return nil
+}
+
+// logBatch appends block to the WAL, if any. Callers reserve a queue slot
+// first: a block logged but never queued would have its record truncated
+// once a later batch is stored, and be lost.
+func (i *Ingester) logBatch(b *batch, block *model.Block) error {
+	if i.wal == nil {
+		return nil
+	}
+	lsn, err := i.wal.Append(block)
+	if err != nil {
+		return fmt.Errorf("wal append: %w", err)
+	}
+	b.lsn = lsn
+	return nil
+}
+
+func (i *Ingester) duplicate(block *model.Block) bool {
+	if i.dedup.has(block.Slot, block.Blockhash) {
+		duplicates.Inc()
+		return true
+	}
+	return false
+}
+
+func (i *Ingester) enqueued(block *model.Block) {
+	i.dedup.add(block.Slot, block.Blockhash)
+	storeMax(&i.latest, block.Slot)
+	queueDepth.Set(float64(len(i.queue)))
+}
+
+// newBatch derives the transaction and address index rows of block. A block
+// whose payload cannot be decoded is still stored so the slot is not lost.
+func (i *Ingester) newBatch(block *model.Block) *batch {
+	b := &batch{blocks: []model.Block{*block}, bytes: len(block.Raw)}
+	txs, sigs, err := Derive(block)
+	if err != nil {
+		i.log.Error("derive rows", zap.Uint64("slot", block.Slot), zap.Error(err))
+		return b
+	}
+	b.txs, b.sigs = txs, sigs
+	for _, tx := range txs {
+		b.bytes += len(tx.Raw)
+	}
+	b.blocks[0].TxSigs = make([]string, len(txs))
+	for n, tx := range txs {
+		b.blocks[0].TxSigs[n] = tx.Signature
+	}
+	return b
+}
+
+// Lag reports how many slots the store trails the newest enqueued slot.
+func (i *Ingester) Lag() (slotsBehind uint64, latest uint64) {
+	latest = i.latest.Load()
+	flushed := i.flushed.Load()
+	if flushed >= latest {
+		return 0, latest
+	}
+	return latest - flushed, latest
 }
 
 func (i *Ingester) flush(b *batch) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	return i.storeBulk(ctx, b)
+	if err := i.storeBulk(ctx, b); err != nil {
+		return err
+	}
+	for _, blk := range b.blocks {
+		storeMax(&i.flushed, blk.Slot)
+		if i.checkpoint != nil {
+			i.checkpoint.Mark(i.commitment, blk.Slot, blk.ParentSlot)
+		}
+	}
+	i.track(b.blocks)
+	if i.publisher != nil {
+		if err := i.publisher.Publish(ctx, b.storageBatch(i.commitment)); err != nil {
+			publishErrors.Inc()
+			i.log.Warn("publish batch", zap.Int("blocks", len(b.blocks)), zap.Error(err))
+		}
+	}
+	for _, ack := range b.acks {
+		ack()
+	}
+	if i.wal != nil && b.lsn > 0 {
+		if err := i.wal.Truncate(b.lsn); err != nil {
+			i.log.Warn("wal truncate", zap.Error(err))
+		}
+	}
+	return nil
 }
 
-func (i *Ingester) storeBulk(ctx context.Context, b *batch) error {
-	pool := memory.NewGoAllocator()
-	defer pool.AssertSize(0)
-
-	const maxRows = 1 << 20
-	bldBlocks := array.NewStructBuilder(pool, arrow.StructOf(
-		arrow.Field{Name: "slot", Type: arrow.PrimitiveTypes.Uint64},
-		arrow.Field{Name: "blockhash", Type: arrow.BinaryTypes.String},
-		arrow.Field{Name: "parent_slot", Type: arrow.PrimitiveTypes.Uint64},
-		arrow.Field{Name: "block_time", Type: arrow.PrimitiveTypes.Int64},
-		arrow.Field{Name: "height", Type: arrow.PrimitiveTypes.Uint64},
-		arrow.Field{Name: "raw", Type: arrow.BinaryTypes.Binary},
-	))
-	defer bldBlocks.Release()
+// storeMax raises v to slot if slot is higher and reports whether it did.
+func storeMax(v *atomic.Uint64, slot uint64) bool {
+	for {
+		cur := v.Load()
+		if slot <= cur {
+			return false
+		}
+		if v.CompareAndSwap(cur, slot) {
+			return true
+		}
+	}
+}
 
-	for _, blk := range b.blocks {
-		bldBlocks.Append(true)
-		bldBlocks.FieldBuilder(0).(*array.Uint64Builder).Append(blk.Slot)
-		bldBlocks.FieldBuilder(1).(*array.StringBuilder).Append(blk.Blockhash)
-		bldBlocks.FieldBuilder(2).(*array.Uint64Builder).Append(blk.ParentSlot)
-		bldBlocks.FieldBuilder(3).(*array.Int64Builder).Append(blk.BlockTime)
-		bldBlocks.FieldBuilder(4).(*array.Uint64Builder).Append(blk.Height)
-		bldBlocks.FieldBuilder(5).(*array.BinaryBuilder).Append(blk.Raw)
+func (i *Ingester) storeBulk(ctx context.Context, b *batch) error {
+	w, ok := storage.As[storage.Writer](i.store)
+	if !ok {
+		return errors.New("store does not accept writes")
+	}
+	if err := w.WriteBatch(ctx, b.storageBatch(i.commitment)); err != nil {
+		return fmt.Errorf("write batch: %w", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (b *batch) storageBatch(c storage.Commitment) storage.Batch {
+	return storage.Batch{
+		Commitment:   c,
+		Blocks:       b.blocks,
+		Transactions: b.txs,
+		Signatures:   b.sigs,
+	}
+}
@@ -0,0 +1,222 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest/wal"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type memStore struct {
+	storage.HistoricalStore
+
+	mu      sync.Mutex
+	batches []storage.Batch
+	fail    int // fail this many writes first
+	ops     map[string][]uint64
+}
+
+func (m *memStore) WriteBatch(_ context.Context, b storage.Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail > 0 {
+		m.fail--
+		return errors.New("backend down")
+	}
+	m.batches = append(m.batches, b)
+	return nil
+}
+
+func (m *memStore) Promote(_ context.Context, slots []uint64, from, to storage.Commitment) error {
+	m.record(string(from)+">"+string(to), slots)
+	return nil
+}
+
+func (m *memStore) Rollback(_ context.Context, slots []uint64, c storage.Commitment) error {
+	m.record("rollback "+string(c), slots)
+	return nil
+}
+
+func (m *memStore) record(op string, slots []uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[string][]uint64)
+	}
+	m.ops[op] = append(m.ops[op], slots...)
+	sort.Slice(m.ops[op], func(a, b int) bool { return m.ops[op][a] < m.ops[op][b] })
+}
+
+func (m *memStore) sizes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]int, len(m.batches))
+	for i, b := range m.batches {
+		out[i] = len(b.Blocks)
+	}
+	return out
+}
+
+func block(slot uint64) *model.Block {
+	return &model.Block{Slot: slot, Raw: []byte(`{"transactions":[]}`)}
+}
+
+func TestTryEnqueueBackpressure(t *testing.T) {
+	ing, err := New(&memStore{}, WithQueueSize(2))
+	require.NoError(t, err)
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.NoError(t, ing.TryEnqueue(block(2)))
+	require.ErrorIs(t, ing.TryEnqueue(block(3)), ErrQueueFull)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ing.Enqueue(ctx, block(3)), context.DeadlineExceeded)
+}
+
+func TestDropsRecentDuplicates(t *testing.T) {
+	ing, err := New(&memStore{}, WithDedupWindow(2))
+	require.NoError(t, err)
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.Len(t, ing.queue, 1)
+
+	forked := block(1)
+	forked.Blockhash = "other"
+	require.NoError(t, ing.TryEnqueue(forked))
+	require.NoError(t, ing.TryEnqueue(block(2)))
+	require.NoError(t, ing.TryEnqueue(block(3))) // evicts slot 1
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.Len(t, ing.queue, 5)
+}
+
+func TestBatchFlushesOnRowsAndAge(t *testing.T) {
+	store := &memStore{}
+	ing, err := New(store, WithBatchLimits(3, 0, 50*time.Millisecond))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ing.Run(ctx) }()
+
+	for slot := uint64(1); slot <= 4; slot++ {
+		require.NoError(t, ing.Enqueue(ctx, block(slot)))
+	}
+	// three blocks hit the row limit; the fourth waits for the age limit
+	require.Eventually(t, func() bool { return len(store.sizes()) == 2 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, []int{3, 1}, store.sizes())
+
+	require.Eventually(t, func() bool {
+		behind, latest := ing.Lag()
+		return behind == 0 && latest == 4
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, ing.Enqueue(ctx, block(5)))
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, []int{3, 1, 1}, store.sizes(), "shutdown flushes what is queued")
+}
+
+func TestWALReplayAndRetry(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.Open(dir)
+	require.NoError(t, err)
+	// accepted before a crash, never flushed
+	ing, err := New(&memStore{}, WithWAL(w), WithQueueSize(2))
+	require.NoError(t, err)
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.NoError(t, ing.TryEnqueue(block(2)))
+	// refused for want of room, so never logged
+	require.ErrorIs(t, ing.TryEnqueue(block(3)), ErrQueueFull)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, ing.Enqueue(ctx, block(3)), context.DeadlineExceeded)
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open(dir)
+	require.NoError(t, err)
+	defer w.Close()
+	store := &memStore{fail: 2}
+	ing, err = New(store, WithWAL(w), WithBatchLimits(0, 0, 10*time.Millisecond), WithRetry(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ing.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return len(store.sizes()) == 1 }, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, []int{2}, store.sizes())
+}
+
+func TestRunFailsOnWALReplayError(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.Open(dir, wal.WithSegmentSize(1))
+	require.NoError(t, err)
+	ing, err := New(&memStore{}, WithWAL(w))
+	require.NoError(t, err)
+	require.NoError(t, ing.TryEnqueue(block(1)))
+	require.NoError(t, ing.TryEnqueue(block(2)))
+	require.NoError(t, w.Close())
+
+	// corrupt the sealed first segment
+	segs, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+	require.NoError(t, os.WriteFile(segs[0], []byte("garbage!"), 0o644))
+
+	w, err = wal.Open(dir, wal.WithSegmentSize(1))
+	require.NoError(t, err)
+	defer w.Close()
+	store := &memStore{}
+	ing, err = New(store, WithWAL(w))
+	require.NoError(t, err)
+	require.ErrorContains(t, ing.Run(context.Background()), "wal replay")
+	require.Empty(t, store.sizes())
+	require.ErrorContains(t, ing.Enqueue(context.Background(), block(3)), "ingester stopped")
+}
+
+func TestPromoteAndRollbackForks(t *testing.T) {
+	store := &memStore{}
+	ing, err := New(store, WithCommitment(storage.CommitmentProcessed), WithBatchLimits(0, 0, 10*time.Millisecond))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ing.Run(ctx) }()
+
+	// 102 forks off 100 and loses to 101
+	for _, b := range [][2]uint64{{100, 99}, {101, 100}, {102, 100}, {103, 101}} {
+		blk := block(b[0])
+		blk.ParentSlot = b[1]
+		require.NoError(t, ing.Enqueue(ctx, blk))
+	}
+	require.Eventually(t, func() bool {
+		behind, latest := ing.Lag()
+		return behind == 0 && latest == 103
+	}, time.Second, 5*time.Millisecond)
+
+	ing.MarkSlot(101, storage.CommitmentConfirmed)
+	ing.MarkSlot(103, storage.CommitmentFinalized)
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.ops) == 4
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Equal(t, map[string][]uint64{
+		"processed>confirmed": {100, 101},
+		"processed>finalized": {103},
+		"confirmed>finalized": {100, 101},
+		"rollback processed":  {102},
+	}, store.ops)
+}
@@ -0,0 +1,339 @@
+// Package kafka consumes blocks from and republishes ingested rows to a
+// Kafka-compatible bus.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type Config struct {
+	Brokers []string
+	// Topic carries getBlock results ("json" encoding, full transaction
+	// details), keyed by slot or with a top-level "slot" field.
+	Topic string
+	Group string
+	// Commitment the blocks on Topic were published at. The topic carries
+	// no slot updates to promote blocks by, so anything below finalized
+	// is never promoted.
+	Commitment storage.Commitment
+	// OutputTopic receives the stored transaction and address index rows.
+	OutputTopic    string
+	CommitInterval time.Duration
+	TLS            bool
+	User           string // SASL/PLAIN when set
+	Password       string
+}
+
+// Record is one message; Topic and Offset are filled in on consume.
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// Client is the part of a Kafka client the source and sink use.
+type Client interface {
+	// Poll waits for records. It may return records and an error together.
+	Poll(ctx context.Context) ([]Record, error)
+	// Commit stores the next offset to read per topic and partition.
+	Commit(ctx context.Context, offsets map[string]map[int32]int64) error
+	Produce(ctx context.Context, recs []Record) error
+	Close()
+}
+
+// Source consumes blocks from Topic as part of consumer group Group. A
+// record's offset is committed only after its block is stored, so a crash
+// redelivers whatever was not yet written.
+type Source struct {
+	cfg    Config
+	log    *zap.Logger
+	client Client
+
+	mu    sync.Mutex
+	parts map[topicPartition]*partition
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partition tracks delivered offsets so the commit point only moves past
+// records that are all stored.
+type partition struct {
+	inflight  []int64 // delivered, ascending
+	acked     map[int64]bool
+	next      int64 // offset to commit; 0 until something is stored
+	committed int64
+}
+
+func (p *partition) ack(off int64) {
+	p.acked[off] = true
+	for len(p.inflight) > 0 && p.acked[p.inflight[0]] {
+		delete(p.acked, p.inflight[0])
+		p.next = p.inflight[0] + 1
+		p.inflight = p.inflight[1:]
+	}
+}
+
+type Option func(*Source)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Source) { s.log = l }
+}
+
+func New(cfg Config, opts ...Option) *Source {
+	if cfg.Commitment == "" {
+		cfg.Commitment = storage.CommitmentFinalized
+	}
+	if cfg.CommitInterval <= 0 {
+		cfg.CommitInterval = time.Second
+	}
+	s := &Source{cfg: cfg, log: zap.NewNop(), parts: make(map[topicPartition]*partition)}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func (s *Source) Name() string { return "kafka" }
+
+// Run consumes until ctx is done, then commits what has been stored.
+func (s *Source) Run(ctx context.Context, sink ingest.Sink) error {
+	as, ok := sink.(ingest.AckSink)
+	if !ok {
+		return errors.New("kafka source needs a sink that acknowledges stored blocks")
+	}
+	if s.client == nil {
+		cl, err := dial(s.cfg, s.revoked)
+		if err != nil {
+			return err
+		}
+		s.client = cl
+	}
+	defer s.client.Close()
+
+	done := make(chan struct{})
+	defer func() { <-done }()
+	commitCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		defer close(done)
+		t := time.NewTicker(s.cfg.CommitInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-commitCtx.Done():
+				// ctx is already done; give the last commit its own deadline
+				final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				s.commit(final)
+				return
+			case <-t.C:
+				s.commit(commitCtx)
+			}
+		}
+	}()
+
+	backoff := 500 * time.Millisecond
+	for ctx.Err() == nil {
+		recs, err := s.client.Poll(ctx)
+		for _, r := range recs {
+			if err := s.deliver(ctx, as, r); err != nil {
+				return nil // only fails once ctx is done
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			ingest.SourceReconnects.WithLabelValues(s.Name()).Inc()
+			s.log.Warn("kafka poll", zap.Error(err), zap.Duration("backoff", backoff))
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = 500 * time.Millisecond
+	}
+	return nil
+}
+
+func (s *Source) deliver(ctx context.Context, sink ingest.AckSink, r Record) error {
+	ack := s.track(r)
+	slot, err := recordSlot(r)
+	if err != nil {
+		s.log.Warn("skipping undecodable record", zap.String("topic", r.Topic), zap.Int32("partition", r.Partition), zap.Int64("offset", r.Offset), zap.Error(err))
+		ingest.SourceUpdates.WithLabelValues(s.Name(), "invalid").Inc()
+		ack()
+		return nil
+	}
+	blk, err := ingest.DecodeBlock(slot, r.Value)
+	if err != nil {
+		s.log.Warn("skipping undecodable block", zap.Uint64("slot", slot), zap.Int64("offset", r.Offset), zap.Error(err))
+		ingest.SourceUpdates.WithLabelValues(s.Name(), "invalid").Inc()
+		ack()
+		return nil
+	}
+	ingest.SourceUpdates.WithLabelValues(s.Name(), "block").Inc()
+	if err := sink.EnqueueAck(ctx, blk, ack); err != nil {
+		return err
+	}
+	sink.MarkSlot(blk.Slot, s.cfg.Commitment)
+	return nil
+}
+
+// recordSlot reads the slot from a top-level "slot" field of the value,
+// or else from a decimal key.
+func recordSlot(r Record) (uint64, error) {
+	var v struct {
+		Slot *uint64 `json:"slot"`
+	}
+	if err := json.Unmarshal(r.Value, &v); err != nil {
+		return 0, err
+	}
+	if v.Slot != nil {
+		return *v.Slot, nil
+	}
+	slot, err := strconv.ParseUint(string(r.Key), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("no slot in value or key: %w", err)
+	}
+	return slot, nil
+}
+
+// track registers a delivered record and returns its ack.
+func (s *Source) track(r Record) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tp := topicPartition{r.Topic, r.Partition}
+	p := s.parts[tp]
+	if p == nil {
+		p = &partition{acked: make(map[int64]bool)}
+		s.parts[tp] = p
+	}
+	p.inflight = append(p.inflight, r.Offset)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		p.ack(r.Offset) // a revoked partition's p is no longer in parts
+	}
+}
+
+// commit stores the offsets that moved since the last commit.
+func (s *Source) commit(ctx context.Context) {
+	offsets := make(map[string]map[int32]int64)
+	s.mu.Lock()
+	for tp, p := range s.parts {
+		if p.next > p.committed {
+			if offsets[tp.topic] == nil {
+				offsets[tp.topic] = make(map[int32]int64)
+			}
+			offsets[tp.topic][tp.partition] = p.next
+		}
+	}
+	s.mu.Unlock()
+	if len(offsets) == 0 {
+		return
+	}
+	if err := s.client.Commit(ctx, offsets); err != nil {
+		s.log.Warn("kafka commit", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic, ps := range offsets {
+		for part, off := range ps {
+			if p := s.parts[topicPartition{topic, part}]; p != nil {
+				p.committed = max(p.committed, off)
+			}
+		}
+	}
+}
+
+// revoked stops tracking partitions the group took away and returns the
+// offsets to commit for them before they move; none when they were lost.
+func (s *Source) revoked(parts map[string][]int32, lost bool) map[string]map[int32]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offsets := make(map[string]map[int32]int64)
+	for topic, ps := range parts {
+		for _, part := range ps {
+			tp := topicPartition{topic, part}
+			p := s.parts[tp]
+			delete(s.parts, tp)
+			if p == nil || lost || p.next <= p.committed {
+				continue
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = make(map[int32]int64)
+			}
+			offsets[topic][part] = p.next
+		}
+	}
+	return offsets
+}
+
+// Sink republishes stored rows to the output topic as JSON, transactions
+// keyed by signature and address index rows keyed by address; the "type"
+// header tells them apart.
+type Sink struct {
+	client Client
+	topic  string
+}
+
+// NewSink connects a producer for cfg.OutputTopic.
+func NewSink(cfg Config) (*Sink, error) {
+	cl, err := dial(Config{Brokers: cfg.Brokers, TLS: cfg.TLS, User: cfg.User, Password: cfg.Password}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{client: cl, topic: cfg.OutputTopic}, nil
+}
+
+// Publish implements ingest.Publisher.
+func (s *Sink) Publish(ctx context.Context, b storage.Batch) error {
+	recs := make([]Record, 0, len(b.Transactions)+len(b.Signatures))
+	for _, tx := range b.Transactions {
+		v, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, s.record("transaction", tx.Signature, v, b.Commitment))
+	}
+	for _, row := range b.Signatures {
+		v, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, s.record("signature", row.Address, v, b.Commitment))
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return s.client.Produce(ctx, recs)
+}
+
+func (s *Sink) record(typ, key string, value []byte, c storage.Commitment) Record {
+	return Record{
+		Topic:   s.topic,
+		Key:     []byte(key),
+		Value:   value,
+		Headers: map[string]string{"type": typ, "commitment": string(c)},
+	}
+}
+
+func (s *Sink) Close() { s.client.Close() }
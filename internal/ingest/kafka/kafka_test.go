@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// broker is an in-process stand-in for a single-member consumer group.
+type broker struct {
+	mu        sync.Mutex
+	log       []Record // input topic, delivered in order
+	pos       int
+	committed map[int32]int64
+	produced  []Record
+}
+
+func (b *broker) Poll(ctx context.Context) ([]Record, error) {
+	for {
+		b.mu.Lock()
+		recs := b.log[b.pos:]
+		b.pos = len(b.log)
+		b.mu.Unlock()
+		if len(recs) > 0 {
+			return recs, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (b *broker) Commit(_ context.Context, offsets map[string]map[int32]int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for part, off := range offsets["blocks"] {
+		b.committed[part] = off
+	}
+	return nil
+}
+
+func (b *broker) Produce(_ context.Context, recs []Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produced = append(b.produced, recs...)
+	return nil
+}
+
+func (b *broker) Close() {}
+
+func (b *broker) offset(part int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[part]
+}
+
+// heldSink stores nothing until release acks what it holds.
+type heldSink struct {
+	mu   sync.Mutex
+	acks map[uint64]func()
+}
+
+func (s *heldSink) Enqueue(ctx context.Context, blk *model.Block) error {
+	return s.EnqueueAck(ctx, blk, nil)
+}
+
+func (s *heldSink) EnqueueAck(_ context.Context, blk *model.Block, ack func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[blk.Slot] = ack
+	return nil
+}
+
+func (s *heldSink) MarkSlot(uint64, storage.Commitment) {}
+
+func (s *heldSink) release(slot uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[slot]()
+}
+
+func (s *heldSink) held() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.acks)
+}
+
+func TestCommitsOnlyStoredOffsets(t *testing.T) {
+	b := &broker{committed: make(map[int32]int64)}
+	for off := int64(0); off < 3; off++ {
+		slot := 100 + off
+		b.log = append(b.log, Record{
+			Topic: "blocks", Partition: 0, Offset: off,
+			Key: []byte(fmt.Sprint(slot)), Value: []byte(`{"blockhash":"h","transactions":[]}`),
+		})
+	}
+	b.log = append(b.log, Record{Topic: "blocks", Partition: 0, Offset: 3, Value: []byte(`not json`)})
+
+	src := New(Config{Topic: "blocks", Group: "g", CommitInterval: 5 * time.Millisecond})
+	src.client = b
+	sink := &heldSink{acks: make(map[uint64]func())}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- src.Run(ctx, sink) }()
+
+	require.Eventually(t, func() bool { return sink.held() == 3 }, time.Second, time.Millisecond)
+	sink.release(101) // stored out of order: 100 still pending
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int64(0), b.offset(0))
+
+	sink.release(100)
+	require.Eventually(t, func() bool { return b.offset(0) == 2 }, time.Second, time.Millisecond)
+
+	// the undecodable record at 3 is skipped once 102 is stored
+	sink.release(102)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, int64(4), b.offset(0))
+}
+
+func TestPublishRows(t *testing.T) {
+	b := &broker{}
+	s := &Sink{client: b, topic: "rows"}
+	require.NoError(t, s.Publish(context.Background(), storage.Batch{
+		Commitment:   storage.CommitmentConfirmed,
+		Transactions: []model.Transaction{{Signature: "sig", Slot: 5}},
+		Signatures:   []model.SignatureRow{{Address: "a", Signature: "sig", Slot: 5}, {Address: "b", Signature: "sig", Slot: 5}},
+	}))
+	require.Len(t, b.produced, 3)
+	require.Equal(t, "transaction", b.produced[0].Headers["type"])
+	require.Equal(t, []byte("b"), b.produced[2].Key)
+	require.JSONEq(t, `{"address":"b","signature":"sig","slot":5,"blockTime":0}`, string(b.produced[2].Value))
+}
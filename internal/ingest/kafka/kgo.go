@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+)
+
+// kgoClient adapts a franz-go client to Client.
+type kgoClient struct {
+	cl *kgo.Client
+}
+
+// dial connects to cfg.Brokers. With a Topic and Group it joins the group
+// with auto-commit off; onRevoke returns the offsets to commit for
+// partitions leaving this member.
+func dial(cfg Config, onRevoke func(parts map[string][]int32, lost bool) map[string]map[int32]int64) (*kgoClient, error) {
+	opts := []kgo.Opt{kgo.SeedBrokers(cfg.Brokers...)}
+	if cfg.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{}))
+	}
+	if cfg.User != "" {
+		opts = append(opts, kgo.SASL(plain.Auth{User: cfg.User, Pass: cfg.Password}.AsMechanism()))
+	}
+	if cfg.Topic != "" {
+		opts = append(opts,
+			kgo.ConsumeTopics(cfg.Topic),
+			kgo.ConsumerGroup(cfg.Group),
+			kgo.DisableAutoCommit(),
+			kgo.OnPartitionsRevoked(func(ctx context.Context, cl *kgo.Client, parts map[string][]int32) {
+				if offsets := onRevoke(parts, false); len(offsets) > 0 {
+					_ = commit(ctx, cl, offsets)
+				}
+			}),
+			kgo.OnPartitionsLost(func(_ context.Context, _ *kgo.Client, parts map[string][]int32) {
+				onRevoke(parts, true)
+			}),
+		)
+	}
+	cl, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka client: %w", err)
+	}
+	return &kgoClient{cl: cl}, nil
+}
+
+func (c *kgoClient) Poll(ctx context.Context) ([]Record, error) {
+	fetches := c.cl.PollFetches(ctx)
+	if fetches.IsClientClosed() {
+		return nil, errors.New("kafka client closed")
+	}
+	var errs []error
+	fetches.EachError(func(topic string, part int32, err error) {
+		if !errors.Is(err, context.Canceled) {
+			errs = append(errs, fmt.Errorf("%s/%d: %w", topic, part, err))
+		}
+	})
+	var recs []Record
+	fetches.EachRecord(func(r *kgo.Record) {
+		rec := Record{
+			Topic:     r.Topic,
+			Partition: r.Partition,
+			Offset:    r.Offset,
+			Key:       r.Key,
+			Value:     r.Value,
+		}
+		if len(r.Headers) > 0 {
+			rec.Headers = make(map[string]string, len(r.Headers))
+			for _, h := range r.Headers {
+				rec.Headers[h.Key] = string(h.Value)
+			}
+		}
+		recs = append(recs, rec)
+	})
+	return recs, errors.Join(errs...)
+}
+
+func (c *kgoClient) Commit(ctx context.Context, offsets map[string]map[int32]int64) error {
+	return commit(ctx, c.cl, offsets)
+}
+
+func commit(ctx context.Context, cl *kgo.Client, offsets map[string]map[int32]int64) error {
+	eo := make(map[string]map[int32]kgo.EpochOffset, len(offsets))
+	for topic, ps := range offsets {
+		eo[topic] = make(map[int32]kgo.EpochOffset, len(ps))
+		for part, off := range ps {
+			eo[topic][part] = kgo.EpochOffset{Epoch: -1, Offset: off}
+		}
+	}
+	var rerr error
+	cl.CommitOffsetsSync(ctx, eo, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		if err != nil {
+			rerr = err
+			return
+		}
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+					rerr = fmt.Errorf("%s/%d: %w", t.Topic, p.Partition, err)
+					return
+				}
+			}
+		}
+	})
+	return rerr
+}
+
+func (c *kgoClient) Produce(ctx context.Context, recs []Record) error {
+	krs := make([]*kgo.Record, len(recs))
+	for i, r := range recs {
+		kr := &kgo.Record{Topic: r.Topic, Key: r.Key, Value: r.Value}
+		for k, v := range r.Headers {
+			kr.Headers = append(kr.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
+		krs[i] = kr
+	}
+	return c.cl.ProduceSync(ctx, krs...).FirstErr()
+}
+
+func (c *kgoClient) Close() { c.cl.Close() }
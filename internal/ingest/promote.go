@@ -0,0 +1,195 @@
+package ingest
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+var (
+	promotedSlots = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_promoted_slots_total",
+		Help: "Stored slots moved up to a commitment level",
+	}, []string{"commitment"})
+
+	rolledBackSlots = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_rolled_back_slots_total",
+		Help: "Stored slots deleted because their fork was abandoned",
+	})
+)
+
+// maxUnsettled bounds the blocks kept waiting for finalization, in case
+// finalized slot updates stop arriving.
+const maxUnsettled = 1 << 16
+
+// slotState is a stored block that has not finalized yet.
+type slotState struct {
+	parent uint64
+	level  storage.Commitment
+}
+
+func rank(c storage.Commitment) int {
+	switch c {
+	case storage.CommitmentProcessed:
+		return 1
+	case storage.CommitmentConfirmed:
+		return 2
+	case storage.CommitmentFinalized:
+		return 3
+	}
+	return 0
+}
+
+// track remembers blocks just written below finalized so settle can promote
+// or roll them back. A block at or below the finalized tip is a late one,
+// backfilled from confirmed history, and is finalized on the next settle.
+func (i *Ingester) track(blocks []model.Block) {
+	if i.promoter == nil || i.commitment == storage.CommitmentFinalized {
+		return
+	}
+	for _, b := range blocks {
+		i.unsettled[b.Slot] = slotState{parent: b.ParentSlot, level: i.commitment}
+		if b.Slot <= i.settled[storage.CommitmentFinalized] {
+			i.late = append(i.late, b.Slot)
+		}
+	}
+	if over := len(i.unsettled) - maxUnsettled; over > 0 {
+		slots := make([]uint64, 0, len(i.unsettled))
+		for s := range i.unsettled {
+			slots = append(slots, s)
+		}
+		sort.Slice(slots, func(a, b int) bool { return slots[a] < slots[b] })
+		for _, s := range slots[:over] {
+			delete(i.unsettled, s)
+		}
+		i.log.Warn("no finalized slot updates; dropped oldest unsettled slots",
+			zap.Int("dropped", over), zap.Uint64("below", slots[over]))
+	}
+}
+
+// settle promotes the stored chain below newly reported confirmed and
+// finalized tips, and rolls back abandoned forks once a slot finalizes.
+func (i *Ingester) settle() {
+	if i.promoter == nil || len(i.unsettled) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for len(i.late) > 0 {
+		if err := i.finalize(ctx, i.late[0]); err != nil {
+			i.log.Error("finalize backfilled slot", zap.Uint64("slot", i.late[0]), zap.Error(err))
+			return
+		}
+		i.late = i.late[1:]
+	}
+	for _, to := range []storage.Commitment{storage.CommitmentConfirmed, storage.CommitmentFinalized} {
+		tip := i.tip(to).Load()
+		if rank(to) <= rank(i.commitment) || tip <= i.settled[to] {
+			continue
+		}
+		if _, ok := i.unsettled[tip]; !ok {
+			continue // not stored yet
+		}
+		var err error
+		if to == storage.CommitmentFinalized {
+			err = i.finalize(ctx, tip)
+		} else {
+			_, err = i.promote(ctx, tip, to)
+		}
+		if err != nil {
+			i.log.Error("promote slots", zap.String("commitment", string(to)), zap.Uint64("tip", tip), zap.Error(err))
+			return
+		}
+		i.settled[to] = tip
+	}
+}
+
+// promote moves tip and its unsettled ancestors up to level to. It returns
+// the chain it walked, which ends at the first ancestor not unsettled.
+func (i *Ingester) promote(ctx context.Context, tip uint64, to storage.Commitment) (map[uint64]bool, error) {
+	chain := make(map[uint64]bool)
+	byLevel := make(map[storage.Commitment][]uint64)
+	for s := tip; ; {
+		st, ok := i.unsettled[s]
+		if !ok || chain[s] {
+			break
+		}
+		chain[s] = true
+		if rank(st.level) < rank(to) {
+			byLevel[st.level] = append(byLevel[st.level], s)
+		}
+		if st.parent >= s {
+			break
+		}
+		s = st.parent
+	}
+	for from, slots := range byLevel {
+		if err := i.promoter.Promote(ctx, slots, from, to); err != nil {
+			return nil, err
+		}
+		promotedSlots.WithLabelValues(string(to)).Add(float64(len(slots)))
+		for _, s := range slots {
+			st := i.unsettled[s]
+			if i.checkpoint != nil {
+				i.checkpoint.Mark(to, s, st.parent)
+			}
+			st.level = to
+			i.unsettled[s] = st
+		}
+	}
+	return chain, nil
+}
+
+// finalize promotes root's chain to finalized. Every other unsettled slot
+// between the bottom of that chain and root is not an ancestor of root, so
+// it is on a fork that can no longer be chosen and is rolled back.
+func (i *Ingester) finalize(ctx context.Context, root uint64) error {
+	chain, err := i.promote(ctx, root, storage.CommitmentFinalized)
+	if err != nil {
+		return err
+	}
+	// the chain ends at the parent of its lowest slot
+	bottom := root
+	for s := range chain {
+		bottom = min(bottom, s)
+	}
+	if st, ok := i.unsettled[bottom]; ok {
+		bottom = st.parent
+	}
+	dead := make(map[storage.Commitment][]uint64)
+	for s, st := range i.unsettled {
+		if s > bottom && s < root && !chain[s] {
+			dead[st.level] = append(dead[st.level], s)
+		}
+	}
+	for c, slots := range dead {
+		if err := i.promoter.Rollback(ctx, slots, c); err != nil {
+			return err
+		}
+		rolledBackSlots.Add(float64(len(slots)))
+		i.log.Info("rolled back abandoned fork", zap.String("commitment", string(c)), zap.Uint64s("slots", slots))
+		for _, s := range slots {
+			delete(i.unsettled, s)
+			if i.checkpoint == nil {
+				continue
+			}
+			for _, l := range []storage.Commitment{storage.CommitmentProcessed, storage.CommitmentConfirmed} {
+				if rank(l) >= rank(i.commitment) && rank(l) <= rank(c) {
+					i.checkpoint.Unmark(l, s)
+				}
+			}
+		}
+	}
+	for s := range chain {
+		delete(i.unsettled, s)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Package rpcpoll ingests blocks by polling an upstream Solana JSON-RPC node.
+package rpcpoll
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type Config struct {
+	Endpoint   string
+	Commitment storage.Commitment
+	// FromSlot is the first slot to fetch; 0 starts at the upstream tip.
+	FromSlot uint64
+	// Concurrency bounds in-flight getBlock calls.
+	Concurrency  int
+	PollInterval time.Duration
+	// MaxRetries bounds attempts per slot while the block is not yet available.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type Source struct {
+	cfg    Config
+	log    *zap.Logger
+	client *http.Client
+	id     atomic.Uint64
+}
+
+type Option func(*Source)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Source) { s.log = l }
+}
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Source) { s.client = c }
+}
+
+func New(cfg Config, opts ...Option) *Source {
+	if cfg.Commitment == "" {
+		cfg.Commitment = storage.CommitmentConfirmed
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 8
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 400 * time.Millisecond
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 10
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 200 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+	s := &Source{
+		cfg:    cfg,
+		log:    zap.NewNop(),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func (s *Source) Name() string { return "rpc" }
+
+// Run follows the upstream tip until ctx is done. Each round lists the
+// produced slots with getBlocks, fetches them concurrently and hands them to
+// sink in slot order; a failed round is retried from the same slot.
+func (s *Source) Run(ctx context.Context, sink ingest.Sink) error {
+	next := s.cfg.FromSlot
+	backoff := s.cfg.MinBackoff
+	for {
+		n, err := s.round(ctx, sink, next)
+		if ctx.Err() != nil {
+			return nil
+		}
+		wait := s.cfg.PollInterval
+		if err != nil {
+			ingest.SourceReconnects.WithLabelValues(s.Name()).Inc()
+			s.log.Warn("rpc poll failed", zap.Error(err), zap.Uint64("slot", next), zap.Duration("backoff", backoff))
+			wait = backoff
+			backoff = min(backoff*2, s.cfg.MaxBackoff)
+		} else {
+			backoff = s.cfg.MinBackoff
+			if n > next {
+				next = n
+				continue // behind the tip: keep going without waiting
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// round ingests produced slots from next up to the tip, at most a few
+// batches' worth, and returns the slot to continue from.
+func (s *Source) round(ctx context.Context, sink ingest.Sink, next uint64) (uint64, error) {
+	var tip uint64
+	if err := s.call(ctx, "getSlot", []any{s.commitment()}, &tip); err != nil {
+		return next, err
+	}
+	if s.cfg.Commitment != storage.CommitmentFinalized {
+		// lets the ingester promote what it stored and drop abandoned forks
+		var root uint64
+		if err := s.call(ctx, "getSlot", []any{map[string]string{"commitment": string(storage.CommitmentFinalized)}}, &root); err != nil {
+			return next, err
+		}
+		sink.MarkSlot(root, storage.CommitmentFinalized)
+	}
+	if next == 0 {
+		next = tip
+	}
+	if next > tip {
+		return next, nil
+	}
+	end := min(tip, next+uint64(s.cfg.Concurrency)*4-1)
+
+	var slots []uint64
+	if err := s.call(ctx, "getBlocks", []any{next, end, s.commitment()}, &slots); err != nil {
+		return next, err
+	}
+
+	blocks := make([]*model.Block, len(slots))
+	errs := make([]error, len(slots))
+	sem := make(chan struct{}, s.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i, slot := range slots {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, slot uint64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			blocks[i], errs[i] = s.fetch(ctx, slot)
+		}(i, slot)
+	}
+	wg.Wait()
+
+	// deliver the contiguous prefix that succeeded so a later failure does
+	// not re-send earlier blocks on retry
+	for i, blk := range blocks {
+		if errs[i] != nil {
+			return slots[i], fmt.Errorf("slot %d: %w", slots[i], errs[i])
+		}
+		if blk == nil {
+			continue // skipped
+		}
+		ingest.SourceUpdates.WithLabelValues(s.Name(), "block").Inc()
+		if err := sink.Enqueue(ctx, blk); err != nil {
+			return slots[i], err
+		}
+		sink.MarkSlot(blk.Slot, s.cfg.Commitment)
+	}
+	return end + 1, nil
+}
+
+// FetchBlock implements ingest.Fetcher.
+func (s *Source) FetchBlock(ctx context.Context, slot uint64) (*model.Block, error) {
+	blk, err := s.fetch(ctx, slot)
+	if err == nil && blk == nil {
+		return nil, fmt.Errorf("slot %d: %w", slot, ingest.ErrSlotSkipped)
+	}
+	return blk, err
+}
+
+// fetch gets one block, retrying while it is not yet available. It returns
+// nil for skipped slots.
+func (s *Source) fetch(ctx context.Context, slot uint64) (*model.Block, error) {
+	opts := map[string]any{
+		"encoding":                       "json",
+		"transactionDetails":             "full",
+		"rewards":                        false,
+		"commitment":                     string(s.cfg.Commitment),
+		"maxSupportedTransactionVersion": 0,
+	}
+	backoff := s.cfg.MinBackoff
+	for attempt := 1; ; attempt++ {
+		var raw json.RawMessage
+		err := s.call(ctx, "getBlock", []any{slot, opts}, &raw)
+		var rerr *rpcError
+		switch {
+		case err == nil:
+			if len(raw) == 0 || string(raw) == "null" {
+				return nil, nil
+			}
+			return ingest.DecodeBlock(slot, raw)
+		case errors.As(err, &rerr) && rerr.skipped():
+			return nil, nil
+		case errors.As(err, &rerr) && !rerr.retryable():
+			return nil, err
+		case attempt >= s.cfg.MaxRetries:
+			return nil, fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+	}
+}
+
+func (s *Source) commitment() map[string]string {
+	return map[string]string{"commitment": string(s.cfg.Commitment)}
+}
+
+// Solana JSON-RPC server error codes.
+const (
+	codeBlockNotAvailable          = -32004
+	codeSlotSkipped                = -32007
+	codeLongTermStorageSlotSkipped = -32009
+	codeBlockStatusNotAvailable    = -32014
+)
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message) }
+
+func (e *rpcError) skipped() bool {
+	return e.Code == codeSlotSkipped || e.Code == codeLongTermStorageSlotSkipped
+}
+
+func (e *rpcError) retryable() bool {
+	return e.Code == codeBlockNotAvailable || e.Code == codeBlockStatusNotAvailable
+}
+
+func (s *Source) call(ctx context.Context, method string, params []any, out any) error {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      s.id.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: http %d: %s", method, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: decode: %w", method, err)
+	}
+	if r.Error != nil {
+		return fmt.Errorf("%s: %w", method, r.Error)
+	}
+	if raw, ok := out.(*json.RawMessage); ok {
+		*raw = r.Result
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, out); err != nil {
+		return fmt.Errorf("%s: decode result: %w", method, err)
+	}
+	return nil
+}
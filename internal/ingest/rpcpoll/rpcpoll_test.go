@@ -0,0 +1,137 @@
+package rpcpoll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// stubRPC serves slots 10..13 where 11 is skipped and 12 is not available
+// on the first two attempts.
+type stubRPC struct {
+	mu       sync.Mutex
+	attempts map[uint64]int
+}
+
+func (s *stubRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     uint64            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := func(result any, code int) {
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		if code != 0 {
+			resp["error"] = map[string]any{"code": code, "message": "stub"}
+		} else {
+			resp["result"] = result
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+
+	switch req.Method {
+	case "getSlot":
+		reply(13, 0)
+	case "getBlocks":
+		var start, end uint64
+		_ = json.Unmarshal(req.Params[0], &start)
+		_ = json.Unmarshal(req.Params[1], &end)
+		var slots []uint64
+		for slot := start; slot <= end; slot++ {
+			if slot != 11 {
+				slots = append(slots, slot)
+			}
+		}
+		reply(slots, 0)
+	case "getBlock":
+		var slot uint64
+		_ = json.Unmarshal(req.Params[0], &slot)
+		s.mu.Lock()
+		s.attempts[slot]++
+		n := s.attempts[slot]
+		s.mu.Unlock()
+		if slot == 12 && n < 3 {
+			reply(nil, codeBlockNotAvailable)
+			return
+		}
+		reply(json.RawMessage(fmt.Sprintf(`{
+			"blockhash": "hash%d", "parentSlot": %d, "blockTime": 1700000000, "blockHeight": %d,
+			"transactions": [{
+				"transaction": {"signatures": ["sig%d"], "message": {"accountKeys": ["payer"]}},
+				"meta": {"fee": 5000, "err": {"InstructionError": [0, "Custom"]}, "computeUnitsConsumed": 150}
+			}]
+		}`, slot, slot-1, slot, slot)), 0)
+	default:
+		reply(nil, -32601)
+	}
+}
+
+type sink struct {
+	mu     sync.Mutex
+	blocks []*model.Block
+}
+
+func (s *sink) Enqueue(_ context.Context, b *model.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = append(s.blocks, b)
+	return nil
+}
+
+func (s *sink) MarkSlot(uint64, storage.Commitment) {}
+
+func (s *sink) slots() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]uint64, len(s.blocks))
+	for i, b := range s.blocks {
+		out[i] = b.Slot
+	}
+	return out
+}
+
+func TestSourceFollowsUpstream(t *testing.T) {
+	stub := &stubRPC{attempts: map[uint64]int{}}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	src := New(Config{
+		Endpoint:     ts.URL,
+		FromSlot:     10,
+		Concurrency:  2,
+		PollInterval: 10 * time.Millisecond,
+		MinBackoff:   time.Millisecond,
+	})
+	out := &sink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- src.Run(ctx, out) }()
+
+	require.Eventually(t, func() bool { return len(out.slots()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Equal(t, []uint64{10, 12, 13}, out.slots())
+	blk := out.blocks[1]
+	require.Equal(t, "hash12", blk.Blockhash)
+	require.Equal(t, uint64(11), blk.ParentSlot)
+	require.Equal(t, int64(1700000000), blk.BlockTime)
+	require.Contains(t, string(blk.Raw), `"sig12"`)
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	require.Equal(t, 3, stub.attempts[12])
+}
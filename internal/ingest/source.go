@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// Source produces blocks from an upstream feed. Run retries transient
+// failures itself and returns only when ctx is done or it cannot continue.
+type Source interface {
+	Name() string
+	Run(ctx context.Context, sink Sink) error
+}
+
+// Sink receives what a Source produces; *Ingester implements it.
+type Sink interface {
+	// Enqueue hands over block, blocking while the sink is saturated.
+	Enqueue(ctx context.Context, block *model.Block) error
+	// MarkSlot records that slot reached commitment c.
+	MarkSlot(slot uint64, c storage.Commitment)
+}
+
+// AckSink is a Sink that reports when a block is stored. Sources that keep
+// a position upstream, such as consumer offsets, advance it only on ack.
+type AckSink interface {
+	Sink
+	// EnqueueAck is Enqueue; ack runs once block has been written.
+	EnqueueAck(ctx context.Context, block *model.Block, ack func()) error
+}
+
+// Fetcher fetches single blocks by slot. Sources that can implement it; the
+// backfill worker uses it to fill gaps.
+type Fetcher interface {
+	// FetchBlock returns ErrSlotSkipped when the upstream has no block for slot.
+	FetchBlock(ctx context.Context, slot uint64) (*model.Block, error)
+}
+
+var ErrSlotSkipped = errors.New("slot skipped or not available")
+
+var (
+	SourceReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_source_reconnects_total",
+		Help: "Ingestion source reconnects",
+	}, []string{"source"})
+
+	SourceUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ingest_source_updates_total",
+		Help: "Updates received from ingestion sources",
+	}, []string{"source", "type"})
+
+	commitmentSlot = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_ingest_slot",
+		Help: "Highest slot seen per commitment level",
+	}, []string{"commitment"})
+)
+
+// MarkSlot records the highest slot seen at each commitment level; the
+// ingester promotes stored rows up to it.
+func (i *Ingester) MarkSlot(slot uint64, c storage.Commitment) {
+	if storeMax(i.tip(c), slot) {
+		commitmentSlot.WithLabelValues(string(c)).Set(float64(slot))
+	}
+}
+
+func (i *Ingester) tip(c storage.Commitment) *atomic.Uint64 {
+	switch c {
+	case storage.CommitmentConfirmed:
+		return &i.confirmed
+	case storage.CommitmentFinalized:
+		return &i.finalized
+	}
+	return &i.processed
+}
@@ -0,0 +1,400 @@
+// Package wal is a segmented write-ahead log of blocks accepted by the
+// ingester but not yet committed to the store.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// SyncPolicy says when appended records are fsynced.
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"   // every Append; survives power loss
+	SyncInterval SyncPolicy = "interval" // every sync interval
+	SyncNone     SyncPolicy = "none"     // left to the OS; survives process crashes only
+)
+
+const segmentExt = ".wal"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL appends records to numbered segment files. Every record gets a log
+// sequence number (LSN); a segment is named after the LSN of its first
+// record, so sealed segments can be dropped once the store has committed
+// everything in them.
+type WAL struct {
+	dir         string
+	log         *zap.Logger
+	segmentSize int64
+	policy      SyncPolicy
+	interval    time.Duration
+
+	mu       sync.Mutex
+	segments []uint64 // first LSN of each segment, oldest first
+	active   *os.File
+	size     int64
+	next     uint64 // LSN of the next record
+	dirty    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type Option func(*WAL)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(w *WAL) { w.log = l }
+}
+
+// WithSegmentSize rolls to a new segment once the active one reaches n bytes.
+func WithSegmentSize(n int64) Option {
+	return func(w *WAL) { w.segmentSize = n }
+}
+
+// WithSync sets the fsync policy; interval only applies to SyncInterval.
+func WithSync(p SyncPolicy, interval time.Duration) Option {
+	return func(w *WAL) {
+		w.policy = p
+		w.interval = interval
+	}
+}
+
+// Open opens or creates the log in dir, discarding a torn record at the end
+// of the last segment.
+func Open(dir string, opts ...Option) (*WAL, error) {
+	w := &WAL{
+		dir:         dir,
+		log:         zap.NewNop(),
+		segmentSize: 64 << 20,
+		policy:      SyncInterval,
+		interval:    time.Second,
+		next:        1,
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	switch w.policy {
+	case SyncAlways, SyncInterval, SyncNone:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", w.policy)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.segments = segs
+
+	if n := len(segs); n > 0 {
+		last := segs[n-1]
+		count, size, err := w.scan(last, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.next = last + count
+		if w.active, err = os.OpenFile(w.path(last), os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return nil, fmt.Errorf("open segment: %w", err)
+		}
+		w.size = size
+	} else if err := w.roll(); err != nil {
+		return nil, err
+	}
+
+	if w.policy == SyncInterval && w.interval > 0 {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Append writes blk and returns its LSN.
+func (w *WAL) Append(blk *model.Block) (uint64, error) {
+	rec := encode(blk)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active == nil {
+		return 0, errors.New("wal closed")
+	}
+	if w.size > 0 && w.size+int64(len(rec)) > w.segmentSize {
+		if err := w.roll(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.active.Write(rec); err != nil {
+		return 0, fmt.Errorf("append: %w", err)
+	}
+	w.size += int64(len(rec))
+	lsn := w.next
+	w.next++
+	w.dirty = true
+	if w.policy == SyncAlways {
+		if err := w.syncLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return lsn, nil
+}
+
+// Replay calls fn with every record still in the log, oldest first.
+// Records appended after Replay starts are not included.
+func (w *WAL) Replay(fn func(lsn uint64, blk *model.Block) error) error {
+	w.mu.Lock()
+	segs := append([]uint64(nil), w.segments...)
+	limit := w.next
+	w.mu.Unlock()
+	for _, first := range segs {
+		if _, _, err := w.scan(first, false, func(lsn uint64, blk *model.Block) error {
+			if lsn >= limit {
+				return errStop
+			}
+			return fn(lsn, blk)
+		}); err != nil {
+			if errors.Is(err, errStop) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+var errStop = errors.New("stop")
+
+// Truncate deletes sealed segments whose records all have an LSN at or
+// below committed. The active segment is kept, so a few committed records
+// may be replayed again after a restart.
+func (w *WAL) Truncate(committed uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var removed int
+	for removed+1 < len(w.segments) && w.segments[removed+1]-1 <= committed {
+		if err := os.Remove(w.path(w.segments[removed])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove segment: %w", err)
+		}
+		removed++
+	}
+	w.segments = w.segments[removed:]
+	return nil
+}
+
+// Sync flushes appended records to stable storage.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active == nil {
+		return nil
+	}
+	err := w.syncLocked()
+	if cerr := w.active.Close(); err == nil {
+		err = cerr
+	}
+	w.active = nil
+	return err
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			if err := w.Sync(); err != nil {
+				w.log.Error("wal sync", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (w *WAL) syncLocked() error {
+	if !w.dirty || w.active == nil {
+		return nil
+	}
+	if err := w.active.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// roll seals the active segment and starts a new one at the next LSN.
+func (w *WAL) roll() error {
+	if w.active != nil {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+		if err := w.active.Close(); err != nil {
+			return fmt.Errorf("close segment: %w", err)
+		}
+	}
+	f, err := os.OpenFile(w.path(w.next), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("create segment: %w", err)
+	}
+	w.active, w.size = f, 0
+	w.segments = append(w.segments, w.next)
+	return syncDir(w.dir)
+}
+
+// scan reads the segment starting at first, calling fn (if set) per record.
+// A torn or corrupt tail is cut off when repair is set and is otherwise an
+// error. It returns the number of good records and their total size.
+func (w *WAL) scan(first uint64, repair bool, fn func(uint64, *model.Block) error) (uint64, int64, error) {
+	f, err := os.Open(w.path(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("open segment: %w", err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("stat segment: %w", err)
+	}
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	var (
+		count uint64
+		off   int64
+		hdr   [8]byte
+	)
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return count, off, nil
+		}
+		var payload []byte
+		if err == nil {
+			// a corrupt length must not size the allocation
+			if n := int64(binary.LittleEndian.Uint32(hdr[:4])); n > st.Size()-off-int64(len(hdr)) {
+				err = fmt.Errorf("record length %d past end of segment", n)
+			} else {
+				payload = make([]byte, n)
+				_, err = io.ReadFull(r, payload)
+			}
+		}
+		if err == nil && crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+			err = errors.New("checksum mismatch")
+		}
+		var blk *model.Block
+		if err == nil {
+			blk, err = decode(payload)
+		}
+		if err != nil {
+			if !repair {
+				return count, off, fmt.Errorf("segment %d record %d: %w", first, count, err)
+			}
+			w.log.Warn("wal: discarding torn tail", zap.Uint64("segment", first), zap.Int64("offset", off), zap.Error(err))
+			return count, off, os.Truncate(w.path(first), off)
+		}
+		if fn != nil {
+			if err := fn(first+count, blk); err != nil {
+				return count, off, err
+			}
+		}
+		count++
+		off += int64(len(hdr) + len(payload))
+	}
+}
+
+func (w *WAL) path(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", dir, err)
+	}
+	var segs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, first)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// A record is len(4) crc32c(4) payload, little endian. The payload holds
+// the block header fields followed by the blockhash and the raw block.
+func encode(blk *model.Block) []byte {
+	n := 8 + 4*8 + 2 + len(blk.Blockhash) + len(blk.Raw)
+	b := make([]byte, 8, n)
+	b = binary.LittleEndian.AppendUint64(b, blk.Slot)
+	b = binary.LittleEndian.AppendUint64(b, blk.ParentSlot)
+	b = binary.LittleEndian.AppendUint64(b, uint64(blk.BlockTime))
+	b = binary.LittleEndian.AppendUint64(b, blk.Height)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(blk.Blockhash)))
+	b = append(b, blk.Blockhash...)
+	b = append(b, blk.Raw...)
+	payload := b[8:]
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	return b
+}
+
+func decode(p []byte) (*model.Block, error) {
+	if len(p) < 4*8+2 {
+		return nil, errors.New("short record")
+	}
+	blk := &model.Block{
+		Slot:       binary.LittleEndian.Uint64(p[0:]),
+		ParentSlot: binary.LittleEndian.Uint64(p[8:]),
+		BlockTime:  int64(binary.LittleEndian.Uint64(p[16:])),
+		Height:     binary.LittleEndian.Uint64(p[24:]),
+	}
+	hl := int(binary.LittleEndian.Uint16(p[32:]))
+	p = p[34:]
+	if len(p) < hl {
+		return nil, errors.New("short blockhash")
+	}
+	blk.Blockhash = string(p[:hl])
+	blk.Raw = p[hl:]
+	return blk, nil
+}
@@ -0,0 +1,82 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+func replayed(t *testing.T, w *WAL) []uint64 {
+	var slots []uint64
+	require.NoError(t, w.Replay(func(_ uint64, blk *model.Block) error {
+		slots = append(slots, blk.Slot)
+		return nil
+	}))
+	return slots
+}
+
+func TestReplayRepairAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(100), WithSync(SyncAlways, 0))
+	require.NoError(t, err)
+	for slot := uint64(1); slot <= 3; slot++ {
+		lsn, err := w.Append(&model.Block{Slot: slot, Blockhash: "h", Raw: make([]byte, 60)})
+		require.NoError(t, err)
+		require.Equal(t, slot, lsn)
+	}
+	require.NoError(t, w.Close())
+
+	segs, err := listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, segs, "each record fills a segment")
+
+	// simulate a crash mid-write
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000003.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{42, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = Open(dir, WithSegmentSize(100))
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, []uint64{1, 2, 3}, replayed(t, w))
+
+	lsn, err := w.Append(&model.Block{Slot: 4, Raw: []byte("{}")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lsn)
+
+	require.NoError(t, w.Truncate(2))
+	require.Equal(t, []uint64{3, 4}, replayed(t, w))
+	blk := &model.Block{}
+	require.NoError(t, w.Replay(func(_ uint64, b *model.Block) error { *blk = *b; return nil }))
+	require.Equal(t, []byte("{}"), []byte(blk.Raw))
+}
+
+func TestReplayRejectsCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(100))
+	require.NoError(t, err)
+	for slot := uint64(1); slot <= 2; slot++ {
+		_, err := w.Append(&model.Block{Slot: slot, Raw: make([]byte, 60)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// a sealed segment is not repaired, so its bad length must not be trusted
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.wal"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = Open(dir, WithSegmentSize(100))
+	require.NoError(t, err)
+	defer w.Close()
+	err = w.Replay(func(uint64, *model.Block) error { return nil })
+	require.ErrorContains(t, err, "past end of segment")
+}
@@ -0,0 +1,179 @@
+package wire
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// TransactionError and InstructionError variants in bincode order, as the
+// solana-sdk enums declare them.
+var (
+	txErrors = [...]string{
+		"AccountInUse",
+		"AccountLoadedTwice",
+		"AccountNotFound",
+		"ProgramAccountNotFound",
+		"InsufficientFundsForFee",
+		"InvalidAccountForFee",
+		"AlreadyProcessed",
+		"BlockhashNotFound",
+		"InstructionError",
+		"CallChainTooDeep",
+		"MissingSignatureForFee",
+		"InvalidAccountIndex",
+		"SignatureFailure",
+		"InvalidProgramForExecution",
+		"SanitizeFailure",
+		"ClusterMaintenance",
+		"AccountBorrowOutstanding",
+		"WouldExceedMaxBlockCostLimit",
+		"UnsupportedVersion",
+		"InvalidWritableAccount",
+		"WouldExceedMaxAccountCostLimit",
+		"WouldExceedAccountDataBlockLimit",
+		"TooManyAccountLocks",
+		"AddressLookupTableNotFound",
+		"InvalidAddressLookupTableOwner",
+		"InvalidAddressLookupTableData",
+		"InvalidAddressLookupTableIndex",
+		"InvalidRentPayingAccount",
+		"WouldExceedMaxVoteCostLimit",
+		"WouldExceedAccountDataTotalLimit",
+		"DuplicateInstruction",
+		"InsufficientFundsForRent",
+		"MaxLoadedAccountsDataSizeExceeded",
+		"InvalidLoadedAccountsDataSizeLimit",
+		"ResanitizationNeeded",
+		"ProgramExecutionTemporarilyRestricted",
+		"UnbalancedTransaction",
+		"ProgramCacheHitMaxLimit",
+		"CommitCancelled",
+	}
+	instructionErrors = [...]string{
+		"GenericError",
+		"InvalidArgument",
+		"InvalidInstructionData",
+		"InvalidAccountData",
+		"AccountDataTooSmall",
+		"InsufficientFunds",
+		"IncorrectProgramId",
+		"MissingRequiredSignature",
+		"AccountAlreadyInitialized",
+		"UninitializedAccount",
+		"UnbalancedInstruction",
+		"ModifiedProgramId",
+		"ExternalAccountLamportSpend",
+		"ExternalAccountDataModified",
+		"ReadonlyLamportChange",
+		"ReadonlyDataModified",
+		"DuplicateAccountIndex",
+		"ExecutableModified",
+		"RentEpochModified",
+		"NotEnoughAccountKeys",
+		"AccountDataSizeChanged",
+		"AccountNotExecutable",
+		"AccountBorrowFailed",
+		"AccountBorrowOutstanding",
+		"DuplicateAccountOutOfSync",
+		"Custom",
+		"InvalidError",
+		"ExecutableDataModified",
+		"ExecutableLamportChange",
+		"ExecutableAccountNotRentExempt",
+		"UnsupportedProgramId",
+		"CallDepth",
+		"MissingAccount",
+		"ReentrancyNotAllowed",
+		"MaxSeedLengthExceeded",
+		"InvalidSeeds",
+		"InvalidRealloc",
+		"ComputationalBudgetExceeded",
+		"PrivilegeEscalation",
+		"ProgramEnvironmentSetupFailure",
+		"ProgramFailedToComplete",
+		"ProgramFailedToCompile",
+		"Immutable",
+		"IncorrectAuthority",
+		"BorshIoError",
+		"AccountNotRentExempt",
+		"InvalidAccountOwner",
+		"ArithmeticOverflow",
+		"UnsupportedSysvar",
+		"IllegalOwner",
+		"MaxAccountsDataAllocationsExceeded",
+		"MaxAccountsResizeExceeded",
+		"MaxInstructionTraceLengthExceeded",
+		"BuiltinProgramsMustConsumeComputeUnits",
+	}
+)
+
+// TxError reads a bincode TransactionError as RPC JSON. A variant newer
+// than the table above is kept as base64 of its bytes; its payload, if
+// any, cannot be told apart from what follows.
+func (d *Decoder) TxError() json.RawMessage {
+	start := d.b
+	v, ok := d.txError()
+	if d.err != nil {
+		return nil
+	}
+	if !ok {
+		return base64Err(start[:len(start)-len(d.b)])
+	}
+	raw, _ := json.Marshal(v)
+	return raw
+}
+
+// txError reads a TransactionError the way serde renders it: unit variants
+// as their name, the others as an object keyed by it.
+func (d *Decoder) txError() (any, bool) {
+	n := d.U32()
+	if int(n) >= len(txErrors) {
+		return nil, false
+	}
+	name := txErrors[n]
+	switch n {
+	case 8: // InstructionError(u8, InstructionError)
+		ix := d.Byte()
+		e, ok := d.instructionError()
+		if !ok {
+			return nil, false
+		}
+		return map[string]any{name: []any{ix, e}}, true
+	case 30: // DuplicateInstruction(u8)
+		return map[string]any{name: d.Byte()}, true
+	case 31, 35: // InsufficientFundsForRent, ProgramExecutionTemporarilyRestricted
+		return map[string]any{name: map[string]any{"account_index": d.Byte()}}, true
+	}
+	return name, true
+}
+
+func (d *Decoder) instructionError() (any, bool) {
+	n := d.U32()
+	if int(n) >= len(instructionErrors) {
+		return nil, false
+	}
+	name := instructionErrors[n]
+	switch n {
+	case 25: // Custom(u32)
+		return map[string]any{name: d.U32()}, true
+	case 44: // BorshIoError(String)
+		return map[string]any{name: d.Str()}, true
+	}
+	return name, true
+}
+
+// BincodeErr turns a whole bincode TransactionError, as Geyser and the
+// protobuf archives wrap it, into RPC JSON.
+func BincodeErr(e []byte) json.RawMessage {
+	d := NewDecoder(e)
+	if v, ok := d.txError(); ok && d.err == nil && d.Len() == 0 {
+		raw, _ := json.Marshal(v)
+		return raw
+	}
+	return base64Err(e)
+}
+
+func base64Err(e []byte) json.RawMessage {
+	raw, _ := json.Marshal(base64.StdEncoding.EncodeToString(e))
+	return raw
+}
@@ -0,0 +1,513 @@
+// Package wire decodes Solana's binary encodings of transactions and their
+// status metadata into the getBlock JSON parts the ingester indexes.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mr-tron/base58"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+)
+
+var ErrTruncated = errors.New("truncated data")
+
+// Decoder reads Solana's wire and bincode encodings; the first error
+// sticks and later reads return zero values.
+type Decoder struct {
+	b   []byte
+	err error
+}
+
+func NewDecoder(b []byte) *Decoder { return &Decoder{b: b} }
+
+// Err is the first error, if any.
+func (d *Decoder) Err() error { return d.err }
+
+// Len is the number of unread bytes.
+func (d *Decoder) Len() int { return len(d.b) }
+
+func (d *Decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b = nil
+}
+
+func (d *Decoder) peek() byte {
+	if len(d.b) == 0 {
+		return 0
+	}
+	return d.b[0]
+}
+
+func (d *Decoder) Byte() byte {
+	if len(d.b) < 1 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *Decoder) Bytes(n int) []byte {
+	if n < 0 || len(d.b) < n {
+		d.fail(ErrTruncated)
+		return nil
+	}
+	out := d.b[:n]
+	d.b = d.b[n:]
+	return out
+}
+
+func (d *Decoder) U32() uint32 {
+	if b := d.Bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *Decoder) U64() uint64 {
+	if b := d.Bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// Len64 reads a bincode u64 length, checked against the bytes left given
+// each element takes at least min bytes.
+func (d *Decoder) Len64(min int) int {
+	n := d.U64()
+	if n > uint64(len(d.b)/max(min, 1)) {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+// Str reads a bincode string: a u64 length and UTF-8 bytes.
+func (d *Decoder) Str() string { return string(d.Bytes(d.Len64(1))) }
+
+// ShortVec reads a compact-u16 length.
+func (d *Decoder) ShortVec() int {
+	var n int
+	for i := 0; i < 3; i++ {
+		c := d.Byte()
+		n |= int(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return n
+		}
+	}
+	d.fail(errors.New("malformed compact-u16"))
+	return 0
+}
+
+// Transaction reads a serialized VersionedTransaction: signatures, then a
+// legacy or v0 message. Lookup table accounts come from the metadata.
+func (d *Decoder) Transaction() *ingest.RawTransaction {
+	rt := &ingest.RawTransaction{}
+	nsig := d.ShortVec()
+	for range nsig {
+		rt.Transaction.Signatures = append(rt.Transaction.Signatures, base58.Encode(d.Bytes(64)))
+	}
+	v0 := false
+	if d.peek()&0x80 != 0 {
+		if v := d.Byte() & 0x7f; v != 0 {
+			d.fail(fmt.Errorf("unsupported message version %d", v))
+			return nil
+		}
+		v0 = true
+	}
+	msg := &rt.Transaction.Message
+	if h := d.Bytes(3); h != nil {
+		msg.Header = &ingest.RawHeader{
+			NumRequiredSignatures:       int(h[0]),
+			NumReadonlySignedAccounts:   int(h[1]),
+			NumReadonlyUnsignedAccounts: int(h[2]),
+		}
+	}
+	nkeys := d.ShortVec()
+	keys := make([]string, 0, nkeys)
+	for range nkeys {
+		keys = append(keys, base58.Encode(d.Bytes(32)))
+	}
+	msg.RecentBlockhash = base58.Encode(d.Bytes(32))
+	nix := d.ShortVec()
+	for range nix {
+		ix := ingest.RawInstruction{ProgramIDIndex: int(d.Byte())}
+		ix.Accounts = indexes(d.Bytes(d.ShortVec()))
+		ix.Data = base58.Encode(d.Bytes(d.ShortVec()))
+		msg.Instructions = append(msg.Instructions, ix)
+	}
+	rt.Version = json.RawMessage(`"legacy"`)
+	if v0 {
+		rt.Version = json.RawMessage("0")
+		for range d.ShortVec() {
+			msg.AddressTableLookups = append(msg.AddressTableLookups, ingest.RawAddressTableLookup{
+				AccountKey:      base58.Encode(d.Bytes(32)),
+				WritableIndexes: indexes(d.Bytes(d.ShortVec())),
+				ReadonlyIndexes: indexes(d.Bytes(d.ShortVec())),
+			})
+		}
+	}
+	if d.err != nil {
+		return nil
+	}
+	msg.AccountKeys = keys
+	return rt
+}
+
+// indexes widens account indexes, which the wire formats pack as bytes.
+func indexes(b []byte) []int {
+	out := make([]int, len(b))
+	for i, a := range b {
+		out[i] = int(a)
+	}
+	return out
+}
+
+// DecodeTransaction parses a serialized VersionedTransaction.
+func DecodeTransaction(b []byte) (*ingest.RawTransaction, error) {
+	d := NewDecoder(b)
+	rt := d.Transaction()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return rt, nil
+}
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zstdDec   *zstd.Decoder
+)
+
+func init() {
+	var err error
+	if zstdDec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0)); err != nil {
+		panic(err)
+	}
+}
+
+// DecodeMeta reads transaction status metadata as Old Faithful archives
+// hold it: zstd-compressed protobuf TransactionStatusMeta in recent epochs,
+// bincode in early ones.
+func DecodeMeta(b []byte) (*ingest.RawMeta, error) {
+	if bytes.HasPrefix(b, zstdMagic) {
+		var err error
+		if b, err = zstdDec.DecodeAll(b, nil); err != nil {
+			return nil, fmt.Errorf("decompress metadata: %w", err)
+		}
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty metadata")
+	}
+	// protobuf field 0 does not exist, while bincode opens with the u32
+	// status variant, 0 or 1
+	if b[0] <= 1 {
+		return decodeBincodeMeta(b)
+	}
+	return DecodeProtoMeta(b)
+}
+
+// DecodeProtoTransaction reads a solana-storage Transaction { repeated
+// bytes signatures = 1; Message message = 2 }, as Geyser and BigTable hold
+// it.
+func DecodeProtoTransaction(b []byte) (*ingest.RawTransaction, error) {
+	rt := &ingest.RawTransaction{}
+	err := Walk(b, func(num protowire.Number, _ uint64, buf []byte) error {
+		switch num {
+		case 1:
+			rt.Transaction.Signatures = append(rt.Transaction.Signatures, base58.Encode(buf))
+		case 2:
+			return protoMessage(rt, buf)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// protoMessage reads Message { MessageHeader header = 1; repeated bytes
+// account_keys = 2; bytes recent_blockhash = 3; repeated
+// CompiledInstruction instructions = 4; bool versioned = 5; repeated
+// MessageAddressTableLookup address_table_lookups = 6 }.
+func protoMessage(rt *ingest.RawTransaction, b []byte) error {
+	msg := &rt.Transaction.Message
+	rt.Version = json.RawMessage(`"legacy"`)
+	return Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			h := &ingest.RawHeader{}
+			msg.Header = h
+			return Walk(buf, func(n protowire.Number, v uint64, _ []byte) error {
+				switch n {
+				case 1:
+					h.NumRequiredSignatures = int(v)
+				case 2:
+					h.NumReadonlySignedAccounts = int(v)
+				case 3:
+					h.NumReadonlyUnsignedAccounts = int(v)
+				}
+				return nil
+			})
+		case 2:
+			msg.AccountKeys = append(msg.AccountKeys, base58.Encode(buf))
+		case 3:
+			msg.RecentBlockhash = base58.Encode(buf)
+		case 4:
+			ix, err := protoInstruction(buf)
+			if err != nil {
+				return fmt.Errorf("instruction: %w", err)
+			}
+			msg.Instructions = append(msg.Instructions, ix)
+		case 5:
+			if v != 0 {
+				rt.Version = json.RawMessage("0")
+			}
+		case 6: // { bytes account_key = 1; bytes writable_indexes = 2; bytes readonly_indexes = 3 }
+			l := ingest.RawAddressTableLookup{WritableIndexes: []int{}, ReadonlyIndexes: []int{}}
+			err := Walk(buf, func(n protowire.Number, _ uint64, f []byte) error {
+				switch n {
+				case 1:
+					l.AccountKey = base58.Encode(f)
+				case 2:
+					l.WritableIndexes = indexes(f)
+				case 3:
+					l.ReadonlyIndexes = indexes(f)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("address table lookup: %w", err)
+			}
+			msg.AddressTableLookups = append(msg.AddressTableLookups, l)
+		}
+		return nil
+	})
+}
+
+// protoInstruction reads CompiledInstruction { uint32 program_id_index = 1;
+// bytes accounts = 2; bytes data = 3 }, or InnerInstruction, which adds
+// optional uint32 stack_height = 4.
+func protoInstruction(b []byte) (ingest.RawInstruction, error) {
+	ix := ingest.RawInstruction{Accounts: []int{}}
+	err := Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			ix.ProgramIDIndex = int(v)
+		case 2:
+			ix.Accounts = indexes(buf)
+		case 3:
+			ix.Data = base58.Encode(buf)
+		case 4:
+			h := int(v)
+			ix.StackHeight = &h
+		}
+		return nil
+	})
+	return ix, err
+}
+
+// DecodeProtoMeta reads a TransactionStatusMeta. Rewards and return data
+// are not kept.
+func DecodeProtoMeta(b []byte) (*ingest.RawMeta, error) {
+	m := &ingest.RawMeta{Err: json.RawMessage("null")}
+	var writable, readonly []string
+	err := Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			e, err := ProtoTxError(buf)
+			if err != nil {
+				return fmt.Errorf("err: %w", err)
+			}
+			m.Err = e
+		case 2:
+			m.Fee = v
+		case 3:
+			return appendUints(&m.PreBalances, v, buf)
+		case 4:
+			return appendUints(&m.PostBalances, v, buf)
+		case 5: // InnerInstructions { uint32 index = 1; repeated InnerInstruction instructions = 2 }
+			inner := ingest.RawInnerInstructions{Instructions: []ingest.RawInstruction{}}
+			err := Walk(buf, func(n protowire.Number, v uint64, f []byte) error {
+				switch n {
+				case 1:
+					inner.Index = int(v)
+				case 2:
+					ix, err := protoInstruction(f)
+					if err != nil {
+						return err
+					}
+					inner.Instructions = append(inner.Instructions, ix)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("inner instructions: %w", err)
+			}
+			m.InnerInstructions = append(m.InnerInstructions, inner)
+		case 6:
+			m.LogMessages = append(m.LogMessages, string(buf))
+		case 7, 8:
+			tb, err := protoTokenBalance(buf)
+			if err != nil {
+				return fmt.Errorf("token balance: %w", err)
+			}
+			if num == 7 {
+				m.PreTokenBalances = append(m.PreTokenBalances, tb)
+			} else {
+				m.PostTokenBalances = append(m.PostTokenBalances, tb)
+			}
+		case 12:
+			writable = append(writable, base58.Encode(buf))
+		case 13:
+			readonly = append(readonly, base58.Encode(buf))
+		case 16:
+			cu := v
+			m.ComputeUnitsConsumed = &cu
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(writable)+len(readonly) > 0 {
+		m.LoadedAddresses = &ingest.RawLoadedAddresses{Writable: writable, Readonly: readonly}
+	}
+	if string(m.Err) == "null" {
+		m.Status = json.RawMessage(`{"Ok":null}`)
+	} else {
+		m.Status = json.RawMessage(`{"Err":` + string(m.Err) + `}`)
+	}
+	return m, nil
+}
+
+// appendUints appends a repeated uint64 field, packed (buf) or not (v).
+func appendUints(dst *[]uint64, v uint64, buf []byte) error {
+	if buf == nil {
+		*dst = append(*dst, v)
+		return nil
+	}
+	for len(buf) > 0 {
+		x, n := protowire.ConsumeVarint(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		*dst = append(*dst, x)
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// protoTokenBalance reads TokenBalance { uint32 account_index = 1; string
+// mint = 2; UiTokenAmount ui_token_amount = 3; string owner = 4; string
+// program_id = 5 }.
+func protoTokenBalance(b []byte) (ingest.RawTokenBalance, error) {
+	var tb ingest.RawTokenBalance
+	err := Walk(b, func(num protowire.Number, v uint64, buf []byte) error {
+		switch num {
+		case 1:
+			tb.AccountIndex = int(v)
+		case 2:
+			tb.Mint = string(buf)
+		case 3: // { double ui_amount = 1; uint32 decimals = 2; string amount = 3; string ui_amount_string = 4 }
+			a := &tb.UITokenAmount
+			return Walk(buf, func(n protowire.Number, v uint64, f []byte) error {
+				switch n {
+				case 1:
+					ui := math.Float64frombits(v)
+					a.UIAmount = &ui
+				case 2:
+					a.Decimals = int(v)
+				case 3:
+					a.Amount = string(f)
+				case 4:
+					a.UIAmountString = string(f)
+				}
+				return nil
+			})
+		case 4:
+			tb.Owner = string(buf)
+		case 5:
+			tb.ProgramID = string(buf)
+		}
+		return nil
+	})
+	return tb, err
+}
+
+// ProtoTxError reads TransactionError { bytes err = 1 }, which wraps the
+// bincode error.
+func ProtoTxError(b []byte) (json.RawMessage, error) {
+	e := json.RawMessage("null")
+	err := Walk(b, func(num protowire.Number, _ uint64, buf []byte) error {
+		if num == 1 {
+			e = BincodeErr(buf)
+		}
+		return nil
+	})
+	return e, err
+}
+
+// decodeBincodeMeta reads the leading status and fee of a bincode
+// StoredTransactionStatusMeta; nothing after them is indexed.
+func decodeBincodeMeta(b []byte) (*ingest.RawMeta, error) {
+	d := NewDecoder(b)
+	m := &ingest.RawMeta{Err: json.RawMessage("null")}
+	if d.U32() == 1 {
+		m.Err = d.TxError()
+	}
+	m.Fee = d.U64()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+// Walk calls fn for every protobuf field in b with either its varint or
+// fixed value or its length-delimited payload; groups are rejected.
+func Walk(b []byte, fn func(num protowire.Number, v uint64, buf []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var (
+			v   uint64
+			buf []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = uint64(x)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			buf, n = protowire.ConsumeBytes(b)
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, typ)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(num, v, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,15 +8,25 @@ import (
 	"go.uber.org/zap"
 )
 
-func ServePrometheus(addr string, log *zap.Logger) {
+// NewServer returns the Prometheus scrape server; the caller owns its
+// lifecycle. admin mounts extra internal-only handlers by pattern.
+func NewServer(addr string, admin map[string]http.Handler) *http.Server {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
+	for pattern, h := range admin {
+		mux.Handle(pattern, h)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
 	}
+}
+
+func ServePrometheus(addr string, log *zap.Logger) {
+	srv := NewServer(addr, nil)
 	log.Info("starting prometheus metrics", zap.String("addr", addr))
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatal("metrics server failed", zap.Error(err))
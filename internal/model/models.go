@@ -37,4 +37,14 @@ type SignatureInfo struct {
 	Err       *string   `json:"err,omitempty"`
 	Memo      *string   `json:"memo,omitempty"`
 	BlockTime time.Time `json:"blockTime"`
-}
\ No newline at end of file
+}
+
+// SignatureRow is one address index entry: a transaction that touched Address.
+type SignatureRow struct {
+	Address   string  `json:"address" ch:"address"`
+	Signature string  `json:"signature" ch:"signature"`
+	Slot      uint64  `json:"slot" ch:"slot"`
+	BlockTime int64   `json:"blockTime" ch:"block_time"`
+	Err       *string `json:"err,omitempty" ch:"err"`
+	Memo      *string `json:"memo,omitempty" ch:"memo"`
+}
@@ -0,0 +1,75 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dir is a Bucket in a local directory, for tests and for archives kept on
+// a mounted volume.
+type Dir string
+
+func (d Dir) path(key string) string {
+	return filepath.Join(string(d), filepath.FromSlash(key))
+}
+
+// Upload copies the file through a temporary file, so a reader never sees
+// a partial object.
+func (d Dir) Upload(ctx context.Context, key, path string) (Object, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return Object{}, err
+	}
+	defer src.Close()
+	dst := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return Object{}, fmt.Errorf("mkdir: %w", err)
+	}
+	f, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return Object{}, err
+	}
+	obj, err := hashReader(key, io.TeeReader(src, f))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(dst+".tmp", dst)
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return Object{}, fmt.Errorf("copy %s: %w", key, err)
+	}
+	return obj, nil
+}
+
+// Stat hashes the stored file.
+func (d Dir) Stat(ctx context.Context, key string) (Object, error) {
+	obj, err := describe(key, d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return Object{}, ErrNotExist
+	}
+	return obj, err
+}
+
+func (d Dir) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (d Dir) Remove(ctx context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Package objstore copies files to object storage and checks the copies.
+package objstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNotExist is returned for keys that hold no object.
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes a stored object.
+type Object struct {
+	Key    string
+	Size   int64
+	SHA256 string // hex digest of the content
+}
+
+// Bucket stores objects under keys.
+type Bucket interface {
+	// Upload copies the file at path to key, replacing any object there,
+	// and describes the file it sent.
+	Upload(ctx context.Context, key, path string) (Object, error)
+	// Stat describes the object at key.
+	Stat(ctx context.Context, key string) (Object, error)
+	// Open reads the object at key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Remove deletes the object at key, if there is one.
+	Remove(ctx context.Context, key string) error
+}
+
+// Verify checks that the object at want.Key has the size and digest of
+// want.
+func Verify(ctx context.Context, b Bucket, want Object) error {
+	got, err := b.Stat(ctx, want.Key)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", want.Key, err)
+	}
+	if got.Size != want.Size || got.SHA256 != want.SHA256 {
+		return fmt.Errorf("%s: stored %d bytes sha256 %s, sent %d bytes sha256 %s",
+			want.Key, got.Size, got.SHA256, want.Size, want.SHA256)
+	}
+	return nil
+}
+
+// describe hashes the file at path.
+func describe(key, path string) (Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Object{}, err
+	}
+	defer f.Close()
+	return hashReader(key, f)
+}
+
+func hashReader(key string, r io.Reader) (Object, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,277 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+// S3Config locates a bucket on S3 or an S3-compatible service.
+type S3Config struct {
+	Endpoint  string // host[:port]
+	Bucket    string
+	Prefix    string // prepended to every key
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool // plain HTTP
+	// Transport replaces the default HTTP transport; for tests.
+	Transport http.RoundTripper
+}
+
+// shaMeta is the user metadata entry holding an object's SHA-256, which
+// S3 does not compute for multipart uploads.
+const shaMeta = "Sha256"
+
+// S3 uploads files in parts, each sent with its MD5 so the service rejects
+// corrupted parts, and retried on its own. The ETag of the finished object
+// is checked against the one the parts add up to.
+type S3 struct {
+	core     *minio.Core
+	bucket   string
+	prefix   string
+	logger   *zap.Logger
+	partSize int64
+	retries  int
+	backoff  time.Duration
+}
+
+type Option func(*S3)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *S3) { s.logger = l }
+}
+
+// WithPartSize sets the size of multipart upload parts, at least the 5 MiB
+// S3 allows; smaller files are sent in one request. A part is held in
+// memory while it is sent.
+func WithPartSize(n int64) Option {
+	return func(s *S3) {
+		if n >= 5<<20 {
+			s.partSize = n
+		}
+	}
+}
+
+// WithRetries sets how often a failed request is retried, waiting backoff
+// before the first retry and twice as long before each next one.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(s *S3) {
+		if n >= 0 {
+			s.retries = n
+		}
+		if backoff > 0 {
+			s.backoff = backoff
+		}
+	}
+}
+
+const maxBackoff = 30 * time.Second
+
+func NewS3(cfg S3Config, opts ...Option) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3: endpoint and bucket required")
+	}
+	core, err := minio.NewCore(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       !cfg.Insecure,
+		Region:       cfg.Region,
+		BucketLookup: minio.BucketLookupAuto,
+		Transport:    cfg.Transport,
+		// retries are ours, per part
+		MaxRetries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+	s := &S3{
+		core:     core,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		logger:   zap.NewNop(),
+		partSize: 64 << 20,
+		retries:  5,
+		backoff:  time.Second,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s, nil
+}
+
+func (s *S3) object(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *S3) Upload(ctx context.Context, key, file string) (Object, error) {
+	obj, err := describe(key, file)
+	if err != nil {
+		return Object{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return Object{}, err
+	}
+	defer f.Close()
+	opts := minio.PutObjectOptions{UserMetadata: map[string]string{shaMeta: obj.SHA256}}
+	if obj.Size <= s.partSize {
+		err = s.put(ctx, key, f, obj.Size, opts)
+	} else {
+		err = s.multipart(ctx, key, f, obj.Size, opts)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("upload %s: %w", key, err)
+	}
+	return obj, nil
+}
+
+func (s *S3) put(ctx context.Context, key string, f *os.File, size int64, opts minio.PutObjectOptions) error {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return err
+	}
+	sum := md5.Sum(buf)
+	return s.retry(ctx, key, func() error {
+		info, err := s.core.PutObject(ctx, s.bucket, s.object(key), bytes.NewReader(buf), size,
+			base64.StdEncoding.EncodeToString(sum[:]), "", opts)
+		if err != nil {
+			return err
+		}
+		return checkETag(info.ETag, hex.EncodeToString(sum[:]))
+	})
+}
+
+func (s *S3) multipart(ctx context.Context, key string, f *os.File, size int64, opts minio.PutObjectOptions) (err error) {
+	var id string
+	err = s.retry(ctx, key, func() (err error) {
+		id, err = s.core.NewMultipartUpload(ctx, s.bucket, s.object(key), opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("start multipart: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// a failed upload's parts are billed until aborted
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if aerr := s.core.AbortMultipartUpload(abortCtx, s.bucket, s.object(key), id); aerr != nil {
+			s.logger.Warn("abort multipart upload", zap.String("key", key), zap.Error(aerr))
+		}
+	}()
+
+	var (
+		parts []minio.CompletePart
+		sums  []byte
+		buf   = make([]byte, s.partSize)
+	)
+	for off, n := int64(0), 1; off < size; off, n = off+s.partSize, n+1 {
+		part := buf[:min(s.partSize, size-off)]
+		if _, err := io.ReadFull(f, part); err != nil {
+			return err
+		}
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+		var etag string
+		err := s.retry(ctx, key, func() error {
+			p, err := s.core.PutObjectPart(ctx, s.bucket, s.object(key), id, n, bytes.NewReader(part), int64(len(part)),
+				minio.PutObjectPartOptions{Md5Base64: base64.StdEncoding.EncodeToString(sum[:])})
+			if err != nil {
+				return err
+			}
+			etag = p.ETag
+			return checkETag(etag, hex.EncodeToString(sum[:]))
+		})
+		if err != nil {
+			return fmt.Errorf("part %d: %w", n, err)
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: n, ETag: etag})
+	}
+
+	// the ETag of a multipart object is the MD5 of its parts' MD5s
+	total := md5.Sum(sums)
+	want := fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), len(parts))
+	return s.retry(ctx, key, func() error {
+		info, err := s.core.CompleteMultipartUpload(ctx, s.bucket, s.object(key), id, parts, opts)
+		if err != nil {
+			return err
+		}
+		return checkETag(info.ETag, want)
+	})
+}
+
+// checkETag compares ETags, which services may return quoted.
+func checkETag(got, want string) error {
+	if got = strings.Trim(got, `"`); !strings.EqualFold(got, want) {
+		return fmt.Errorf("etag %s, want %s", got, want)
+	}
+	return nil
+}
+
+func (s *S3) retry(ctx context.Context, key string, fn func() error) error {
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || errors.Is(err, ErrNotExist) || attempt == s.retries || ctx.Err() != nil {
+			return err
+		}
+		s.logger.Warn("object store request failed, retrying",
+			zap.String("key", key), zap.Int("attempt", attempt+1), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, maxBackoff)
+	}
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	var info minio.ObjectInfo
+	err := s.retry(ctx, key, func() (err error) {
+		info, err = s.core.StatObject(ctx, s.bucket, s.object(key), minio.StatObjectOptions{})
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return ErrNotExist
+		}
+		return err
+	})
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: info.Size, SHA256: info.UserMetadata[shaMeta]}, nil
+}
+
+// Open retries the request, not the read of the body.
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := s.retry(ctx, key, func() (err error) {
+		body, _, _, err = s.core.GetObject(ctx, s.bucket, s.object(key), minio.GetObjectOptions{})
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return ErrNotExist
+		}
+		return err
+	})
+	return body, err
+}
+
+func (s *S3) Remove(ctx context.Context, key string) error {
+	return s.retry(ctx, key, func() error {
+		return s.core.RemoveObject(ctx, s.bucket, s.object(key), minio.RemoveObjectOptions{})
+	})
+}
@@ -0,0 +1,171 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 implements the requests the uploader makes, checking part MD5s,
+// and fails the first attempt at every part.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	meta    map[string]string
+	parts   map[int][]byte
+	failed  map[int]bool
+	aborted int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.parts = make(map[int][]byte)
+		f.meta[key] = r.Header.Get("X-Amz-Meta-Sha256")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>up1</UploadId></InitiateMultipartUploadResult>`, key)
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if !f.failed[n] {
+			f.failed[n] = true
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>BadDigest</Code></Error>`)
+			return
+		}
+		f.parts[n] = body
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		var req struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &req)
+		var data, sums []byte
+		for _, p := range req.Parts {
+			data = append(data, f.parts[p.PartNumber]...)
+			sum := md5.Sum(f.parts[p.PartNumber])
+			sums = append(sums, sum[:]...)
+		}
+		f.objects[key] = data
+		total := md5.Sum(sums)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"%s-%d"</ETag></CompleteMultipartUploadResult>`,
+			key, hex.EncodeToString(total[:]), len(req.Parts))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.meta[key] = r.Header.Get("X-Amz-Meta-Sha256")
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("X-Amz-Meta-Sha256", f.meta[key])
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestS3Upload(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, meta: map[string]string{}, failed: map[int]bool{}}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+	s := newTestS3(t, srv, WithPartSize(5<<20), WithRetries(2, time.Millisecond))
+
+	ctx := context.Background()
+	_, err := s.Stat(ctx, "big.parquet")
+	require.ErrorIs(t, err, ErrNotExist)
+
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "big.parquet")
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	obj, err := s.Upload(ctx, "big.parquet", path)
+	require.NoError(t, err)
+	require.Len(t, fake.parts, 3)
+	require.True(t, bytes.Equal(data, fake.objects["archive/big.parquet"]))
+	require.NoError(t, Verify(ctx, s, obj))
+
+	// parts keep failing once retries run out, and the upload is aborted
+	fake.failed = map[int]bool{}
+	_, err = newTestS3(t, srv, WithPartSize(5<<20), WithRetries(0, time.Millisecond)).Upload(ctx, "big.parquet", path)
+	require.Error(t, err)
+	require.Equal(t, 1, fake.aborted)
+
+	small := filepath.Join(t.TempDir(), "manifest.json")
+	require.NoError(t, os.WriteFile(small, []byte(`{"files":[]}`), 0o644))
+	obj, err = s.Upload(ctx, "manifest.json", small)
+	require.NoError(t, err)
+	require.NoError(t, Verify(ctx, s, obj))
+	obj.SHA256 = "0"
+	require.Error(t, Verify(ctx, s, obj))
+
+	rc, err := s.Open(ctx, "manifest.json")
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, `{"files":[]}`, string(got))
+	require.NoError(t, s.Remove(ctx, "manifest.json"))
+	_, err = s.Open(ctx, "manifest.json")
+	require.ErrorIs(t, err, ErrNotExist)
+}
+
+func newTestS3(t *testing.T, srv *httptest.Server, opts ...Option) *S3 {
+	s, err := NewS3(S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "https://"),
+		Bucket:    "bucket",
+		Prefix:    "/archive/",
+		Region:    "us-east-1",
+		AccessKey: "key",
+		SecretKey: "secret",
+		Transport: srv.Client().Transport,
+	}, opts...)
+	require.NoError(t, err)
+	return s
+}
@@ -0,0 +1,71 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// bloom is a split block bloom filter as the Parquet format specifies
+// them: 256-bit blocks, one picked by the upper half of a key's xxHash64
+// and eight bits set in it by the lower half.
+type bloom []uint32
+
+var bloomSalt = [8]uint32{
+	0x47b6137b, 0x44974d91, 0x8824ad5b, 0xa2b7289d,
+	0x705495c7, 0x2df1424b, 0x9efc4947, 0x5c6bfb31,
+}
+
+// bloomFPP is the false positive rate filters are sized for.
+const bloomFPP = 0.01
+
+func keyHash(key string) uint64 { return xxhash.Sum64String(key) }
+
+// newBloom sizes a filter for n keys, rounded up to a power of two blocks.
+func newBloom(n int) bloom {
+	bits := -8 * float64(max(n, 1)) / math.Log(1-math.Pow(bloomFPP, 1.0/8))
+	blocks := 1
+	for float64(blocks*256) < bits {
+		blocks <<= 1
+	}
+	return make(bloom, blocks*8)
+}
+
+func bloomMask(h uint64) (m [8]uint32) {
+	x := uint32(h)
+	for i, s := range bloomSalt {
+		m[i] = 1 << ((x * s) >> 27)
+	}
+	return m
+}
+
+func (b bloom) block(h uint64) bloom {
+	i := ((h >> 32) * uint64(len(b)/8)) >> 32
+	return b[i*8 : i*8+8]
+}
+
+func (b bloom) insert(h uint64) {
+	blk := b.block(h)
+	for i, m := range bloomMask(h) {
+		blk[i] |= m
+	}
+}
+
+func (b bloom) check(h uint64) bool {
+	blk := b.block(h)
+	for i, m := range bloomMask(h) {
+		if blk[i]&m == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bloom) appendTo(out []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	for _, w := range b {
+		out = binary.LittleEndian.AppendUint32(out, w)
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package parquet
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// Dataset answers point lookups from a dataset a Writer produced. The
+// sidecar index narrows a lookup to the row groups that may hold the key,
+// and only those are read.
+type Dataset struct {
+	root  string
+	files map[string]FileInfo // by path
+}
+
+// OpenDataset loads the manifest of the dataset under root.
+func OpenDataset(root string) (*Dataset, error) {
+	m, err := ReadManifest(root)
+	if err != nil {
+		return nil, fmt.Errorf("open dataset %s: %w", root, err)
+	}
+	d := &Dataset{root: root, files: make(map[string]FileInfo, len(m.Files))}
+	for _, f := range m.Files {
+		d.files[f.Path] = f
+	}
+	return d, nil
+}
+
+// Files returns the number of files in the manifest.
+func (d *Dataset) Files() int { return len(d.files) }
+
+// Block returns the block at slot, or nil.
+func (d *Dataset) Block(ctx context.Context, slot uint64) (*model.Block, error) {
+	var found *model.Block
+	err := lookup(ctx, d, blocksTable, strconv.FormatUint(slot, 10), func(b *model.Block) bool {
+		if b.Slot != slot {
+			return true
+		}
+		found = b
+		return false
+	})
+	return found, err
+}
+
+// BlockSlots returns up to limit slots from start on that hold a block, in
+// order.
+func (d *Dataset) BlockSlots(ctx context.Context, start uint64, limit int) ([]uint64, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	files := make([]FileInfo, 0, len(d.files))
+	for _, f := range d.files {
+		if f.Table == blocksTable.name && f.MaxSlot >= start {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b FileInfo) int { return cmp.Compare(a.MinSlot, b.MinSlot) })
+	var slots []uint64
+	for _, f := range files {
+		// files are read in order of their first slot, so once limit slots
+		// are known, a file starting past them holds none of the answer
+		if len(slots) >= limit && f.MinSlot > slots[limit-1] {
+			break
+		}
+		got, err := readSlots(ctx, filepath.Join(d.root, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range got {
+			if s >= start {
+				slots = append(slots, s)
+			}
+		}
+		slices.Sort(slots)
+		slots = slices.Compact(slots)
+	}
+	if len(slots) > limit {
+		slots = slots[:limit]
+	}
+	return slots, nil
+}
+
+// readSlots reads only the slot column of a blocks file.
+func readSlots(ctx context.Context, path string) ([]uint64, error) {
+	rdr, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("open parquet: %w", err)
+	}
+	defer rdr.Close()
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{BatchSize: readBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, fmt.Errorf("arrow reader: %w", err)
+	}
+	rr, err := fr.GetRecordReader(ctx, []int{0}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record reader: %w", err)
+	}
+	defer rr.Release()
+	slots := make([]uint64, 0, rdr.NumRows())
+	for rr.Next() {
+		rec := rr.Record()
+		if name := rec.Schema().Field(0).Name; name != "slot" {
+			return nil, fmt.Errorf("%s: column 0 is %q, want %q", path, name, "slot")
+		}
+		slots = append(slots, rec.Column(0).(*array.Uint64).Uint64Values()...)
+	}
+	if err := rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return slots, nil
+}
+
+// Transaction returns the transaction with signature sig, or nil.
+func (d *Dataset) Transaction(ctx context.Context, sig string) (*model.Transaction, error) {
+	var found *model.Transaction
+	err := lookup(ctx, d, txTable, sig, func(tx *model.Transaction) bool {
+		if tx.Signature != sig {
+			return true
+		}
+		found = tx
+		return false
+	})
+	return found, err
+}
+
+// Signatures returns the address index rows of addr below slot before,
+// newest first; before 0 means no bound and limit 0 no limit.
+func (d *Dataset) Signatures(ctx context.Context, addr string, before uint64, limit int) ([]model.SignatureRow, error) {
+	var rows []model.SignatureRow
+	err := lookup(ctx, d, sigTable, addr, func(r *model.SignatureRow) bool {
+		if r.Address == addr && (before == 0 || r.Slot < before) {
+			rows = append(rows, *r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(rows, func(a, b model.SignatureRow) int {
+		return cmp.Or(cmp.Compare(b.Slot, a.Slot), strings.Compare(a.Signature, b.Signature))
+	})
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// ScanSignatures feeds fn the address index rows of addr in slots [from,
+// to], unordered, until fn returns false. Unlike Signatures it holds no
+// rows itself.
+func (d *Dataset) ScanSignatures(ctx context.Context, addr string, from, to uint64, fn func(*model.SignatureRow) bool) error {
+	return lookupIn(ctx, d, sigTable, addr, from, to, func(r *model.SignatureRow) bool {
+		if r.Address != addr || r.Slot < from || r.Slot > to {
+			return true
+		}
+		return fn(r)
+	})
+}
+
+// lookup feeds fn the rows of every row group whose filter may hold key,
+// until fn returns false.
+func lookup[T any](ctx context.Context, d *Dataset, t *table[T], key string, fn func(*T) bool) error {
+	return lookupIn(ctx, d, t, key, 0, math.MaxUint64, fn)
+}
+
+// lookupIn is lookup restricted to the files overlapping slots [from, to].
+func lookupIn[T any](ctx context.Context, d *Dataset, t *table[T], key string, from, to uint64, fn func(*T) bool) error {
+	groups, err := lookupIndex(d.root, t.index, key)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(groups))
+	for path := range groups {
+		if f, ok := d.files[path]; ok && f.Table == t.name && f.MaxSlot >= from && f.MinSlot <= to {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		more, err := scanGroups(ctx, filepath.Join(d.root, filepath.FromSlash(path)), t, groups[path], fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func scanGroups[T any](ctx context.Context, path string, t *table[T], groups []int, fn func(*T) bool) (bool, error) {
+	rdr, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return false, fmt.Errorf("open parquet: %w", err)
+	}
+	defer rdr.Close()
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{BatchSize: readBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return false, fmt.Errorf("arrow reader: %w", err)
+	}
+	rr, err := fr.GetRecordReader(ctx, nil, groups)
+	if err != nil {
+		return false, fmt.Errorf("record reader: %w", err)
+	}
+	defer rr.Release()
+	for rr.Next() {
+		rec := rr.Record()
+		if err := checkColumns(rec.Schema(), t.schema); err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		if !scanRecord(rec, t, fn) {
+			return false, nil
+		}
+	}
+	if err := rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func scanRecord[T any](rec arrow.Record, t *table[T], fn func(*T) bool) bool {
+	for i := 0; i < int(rec.NumRows()); i++ {
+		row := t.read(rec, i)
+		if !fn(&row) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package parquet
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// Transactions feeds fn the transactions at slots in [from, to] with block
+// times in [fromTime, toTime], file by file in slot order, until fn returns
+// false. Files of days outside the time range are not read.
+func (d *Dataset) Transactions(ctx context.Context, from, to uint64, fromTime, toTime int64, fn func(*model.Transaction) bool) error {
+	fromDay, toDay := dayOf(fromTime), dayOf(toTime)
+	files := make([]FileInfo, 0, len(d.files))
+	for _, f := range d.files {
+		if f.Table == txTable.name && f.MaxSlot >= from && f.MinSlot <= to && f.Day >= fromDay && f.Day <= toDay {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b FileInfo) int { return cmp.Compare(a.MinSlot, b.MinSlot) })
+	for _, f := range files {
+		more, err := scanGroups(ctx, filepath.Join(d.root, filepath.FromSlash(f.Path)), txTable, nil, func(tx *model.Transaction) bool {
+			if tx.Slot < from || tx.Slot > to || tx.BlockTime < fromTime || tx.BlockTime > toTime {
+				return true
+			}
+			return fn(tx)
+		})
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// dayOf is the partition day of a block time, clamped to the years a day
+// name can spell so that unbounded ranges compare as such.
+func dayOf(t int64) string {
+	const lo, hi = -62135596800, 253402300799 // 0001-01-01, 9999-12-31
+	return time.Unix(min(max(t, lo), hi), 0).UTC().Format(time.DateOnly)
+}
+
+// TransactionFile writes transaction rows to a single Parquet file of the
+// dataset's layout, outside any dataset.
+type TransactionFile struct {
+	out     *fileOut
+	rows    []model.Transaction
+	pending int64
+}
+
+// CreateTransactionFile creates the file at path.
+func CreateTransactionFile(path string) (*TransactionFile, error) {
+	out, err := createFile(path, txSchema, "")
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionFile{out: out}, nil
+}
+
+// Write appends txs, writing a row group out whenever one is full.
+func (f *TransactionFile) Write(txs []model.Transaction) error {
+	for i := range txs {
+		f.rows = append(f.rows, txs[i])
+		f.pending += txTable.size(&txs[i])
+		if f.pending >= targetRowGroupSize {
+			if err := f.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *TransactionFile) flush() error {
+	if len(f.rows) == 0 {
+		return nil
+	}
+	err := writeGroup(f.out, txTable, f.rows)
+	clear(f.rows)
+	f.rows, f.pending = f.rows[:0], 0
+	if err != nil {
+		return fmt.Errorf("write %s: %w", f.out.tmp, err)
+	}
+	return nil
+}
+
+// Close writes out the buffered rows and finishes the file, returning its
+// size. The file is removed if that fails.
+func (f *TransactionFile) Close() (int64, error) {
+	err := f.flush()
+	if err == nil {
+		err = f.out.close()
+	}
+	if err != nil {
+		f.Abort()
+		return 0, err
+	}
+	return f.out.cw.n, nil
+}
+
+// Abort closes and removes the file.
+func (f *TransactionFile) Abort() {
+	f.out.abort()
+}
@@ -0,0 +1,134 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The sidecar index lets lookups skip files and row groups: for an indexed
+// column it keeps, per row group, a bloom filter of the column's values.
+// The filters are split into 256 shards by a byte of the value's hash, and
+// each shard is a file of its own, so a lookup reads 1/256 of the index:
+// _index/<column>/<shard as hex>. A shard is a sequence of entries, each
+// the data file path, the row group and the filter, appended as data files
+// are added; entries for files missing from the manifest are ignored.
+const indexDir = "_index"
+
+// shardOf picks bits that take no part in placing the key in a filter,
+// whose blocks come from the high 32 bits, mostly their top ones.
+func shardOf(h uint64) byte { return byte(h >> 32) }
+
+func shardPath(root, column string, shard byte) string {
+	return filepath.Join(root, indexDir, column, fmt.Sprintf("%02x", shard))
+}
+
+// indexBuilder collects the key hashes of a data file's row groups.
+type indexBuilder struct {
+	column string
+	groups [][]uint64
+}
+
+func (ib *indexBuilder) addGroup(hashes []uint64) {
+	ib.groups = append(ib.groups, hashes)
+}
+
+// write appends the file's filters to the index shards.
+func (ib *indexBuilder) write(root, path string) error {
+	var shards [256][]byte
+	for rg, hashes := range ib.groups {
+		var byShard [256][]uint64
+		for _, h := range hashes {
+			s := shardOf(h)
+			byShard[s] = append(byShard[s], h)
+		}
+		for s, hs := range byShard {
+			if len(hs) == 0 {
+				continue
+			}
+			b := newBloom(len(hs))
+			for _, h := range hs {
+				b.insert(h)
+			}
+			e := binary.AppendUvarint(shards[s], uint64(len(path)))
+			e = append(e, path...)
+			e = binary.AppendUvarint(e, uint64(rg))
+			shards[s] = b.appendTo(e)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, indexDir, ib.column), 0o755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	for s, data := range shards {
+		if len(data) == 0 {
+			continue
+		}
+		if err := appendFile(shardPath(root, ib.column, byte(s)), data); err != nil {
+			return fmt.Errorf("append index: %w", err)
+		}
+	}
+	return nil
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var errBadIndex = errors.New("corrupt index shard")
+
+// lookupIndex returns the row groups, by data file path, whose filters on
+// column may hold key.
+func lookupIndex(root, column, key string) (map[string][]int, error) {
+	h := keyHash(key)
+	data, err := os.ReadFile(shardPath(root, column, shardOf(h)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	out := make(map[string][]int)
+	for len(data) > 0 {
+		n, k := binary.Uvarint(data)
+		if k <= 0 || uint64(len(data)-k) < n {
+			return nil, errBadIndex
+		}
+		path := string(data[k : k+int(n)])
+		data = data[k+int(n):]
+		rg, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, errBadIndex
+		}
+		data = data[k:]
+		words, k := binary.Uvarint(data)
+		if k <= 0 || words == 0 || words%8 != 0 || uint64(len(data)-k) < words*4 {
+			return nil, errBadIndex
+		}
+		data = data[k:]
+		b := make(bloom, words)
+		for i := range b {
+			b[i] = binary.LittleEndian.Uint32(data[i*4:])
+		}
+		data = data[words*4:]
+		if b.check(h) {
+			out[path] = append(out[path], int(rg))
+		}
+	}
+	// a file registered twice has its entries twice
+	for path, groups := range out {
+		slices.Sort(groups)
+		out[path] = slices.Compact(groups)
+	}
+	return out, nil
+}
@@ -0,0 +1,129 @@
+package parquet
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/metadata"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+)
+
+// statLen caps how much of a string minimum or maximum is shown.
+const statLen = 64
+
+// FileStats describes a Parquet file from its footer.
+type FileStats struct {
+	Path      string          `json:"path"`
+	Bytes     int64           `json:"bytes"`
+	Rows      int64           `json:"rows"`
+	Columns   []Column        `json:"columns"`
+	RowGroups []RowGroupStats `json:"rowGroups"`
+}
+
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type RowGroupStats struct {
+	Rows    int64         `json:"rows"`
+	Bytes   int64         `json:"bytes"` // uncompressed
+	Columns []ColumnStats `json:"columns"`
+}
+
+// ColumnStats are the statistics of one column chunk. Min and Max are
+// left out for binary columns.
+type ColumnStats struct {
+	Path              string `json:"path"`
+	CompressedBytes   int64  `json:"compressedBytes"`
+	UncompressedBytes int64  `json:"uncompressedBytes"`
+	Nulls             int64  `json:"nulls"`
+	Min               string `json:"min,omitempty"`
+	Max               string `json:"max,omitempty"`
+}
+
+// Inspect reads the schema, row groups and column statistics of the
+// Parquet file at path without reading its rows.
+func Inspect(path string) (*FileStats, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	rdr, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("open parquet: %w", err)
+	}
+	defer rdr.Close()
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, fmt.Errorf("arrow reader: %w", err)
+	}
+	schema, err := fr.Schema()
+	if err != nil {
+		return nil, fmt.Errorf("read schema: %w", err)
+	}
+	st := &FileStats{Path: path, Bytes: fi.Size(), Rows: rdr.NumRows()}
+	kinds := make(map[string]string, schema.NumFields())
+	for _, f := range schema.Fields() {
+		st.Columns = append(st.Columns, Column{Name: f.Name, Type: f.Type.String()})
+		kinds[f.Name] = f.Type.Name()
+	}
+
+	md := rdr.MetaData()
+	for i := 0; i < md.NumRowGroups(); i++ {
+		rg := md.RowGroup(i)
+		g := RowGroupStats{Rows: rg.NumRows(), Bytes: rg.TotalByteSize()}
+		for c := 0; c < rg.NumColumns(); c++ {
+			cc, err := rg.ColumnChunk(c)
+			if err != nil {
+				return nil, fmt.Errorf("row group %d column %d: %w", i, c, err)
+			}
+			path := cc.PathInSchema()
+			cs := ColumnStats{
+				Path:              path.String(),
+				CompressedBytes:   cc.TotalCompressedSize(),
+				UncompressedBytes: cc.TotalUncompressedSize(),
+			}
+			if ok, err := cc.StatsSet(); err == nil && ok {
+				s, err := cc.Statistics()
+				if err != nil {
+					return nil, fmt.Errorf("row group %d column %s: %w", i, cs.Path, err)
+				}
+				cs.Nulls = s.NullCount()
+				if s.HasMinMax() && len(path) > 0 {
+					cs.Min, cs.Max = minMax(s, kinds[path[0]])
+				}
+			}
+			g.Columns = append(g.Columns, cs)
+		}
+		st.RowGroups = append(st.RowGroups, g)
+	}
+	return st, nil
+}
+
+// minMax formats the bounds of a column chunk of the given arrow type.
+// Unsigned columns are stored as INT64 and compared unsigned.
+func minMax(s metadata.TypedStatistics, kind string) (string, string) {
+	switch s := s.(type) {
+	case *metadata.Int64Statistics:
+		if kind == "uint64" {
+			return fmt.Sprint(uint64(s.Min())), fmt.Sprint(uint64(s.Max()))
+		}
+		return fmt.Sprint(s.Min()), fmt.Sprint(s.Max())
+	case *metadata.ByteArrayStatistics:
+		if kind == "binary" {
+			return "", ""
+		}
+		return truncate(string(s.Min())), truncate(string(s.Max()))
+	}
+	return "", ""
+}
+
+func truncate(s string) string {
+	if len(s) <= statLen {
+		return s
+	}
+	return s[:statLen] + "..."
+}
@@ -0,0 +1,67 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestName is the file at the dataset root listing its files.
+const ManifestName = "manifest.json"
+
+// Manifest lists the files of a dataset and the slots each holds, so a
+// reader can pick files without opening them.
+type Manifest struct {
+	Files []FileInfo `json:"files"`
+}
+
+type FileInfo struct {
+	Table   string `json:"table"`
+	Path    string `json:"path"` // relative to the dataset root
+	Epoch   uint64 `json:"epoch"`
+	Day     string `json:"day"`
+	MinSlot uint64 `json:"minSlot"`
+	MaxSlot uint64 `json:"maxSlot"`
+	Rows    int64  `json:"rows"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// ReadManifest loads the manifest of the dataset under root.
+func ReadManifest(root string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(root, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Table returns the files of table holding slots in [from, to].
+func (m *Manifest) Table(table string, from, to uint64) []FileInfo {
+	var out []FileInfo
+	for _, f := range m.Files {
+		if f.Table == table && f.MaxSlot >= from && f.MinSlot <= to {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (m *Manifest) save(root string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(root, ManifestName)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return fmt.Errorf("save manifest: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("save manifest: %w", err)
+	}
+	return nil
+}
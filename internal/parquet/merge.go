@@ -0,0 +1,137 @@
+package parquet
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// partitionKey names a table partition: the files a Writer puts in one
+// directory.
+type partitionKey struct {
+	table string
+	epoch uint64
+	day   string
+}
+
+func (k partitionKey) String() string {
+	return fmt.Sprintf("%s-%d-%s", k.table, k.epoch, k.day)
+}
+
+// Merge rewrites the files smaller than small in each table partition of
+// the dataset under root into as few files as the writer's file size
+// allows, workers partitions at a time. Each partition is staged and
+// registered in place of its old files, which are then deleted; a reader
+// still holding the old manifest fails on them until it reloads. It
+// returns how many files were merged away.
+func Merge(ctx context.Context, root string, small int64, workers int, opts ...Option) (int, error) {
+	m, err := ReadManifest(root)
+	if err != nil {
+		return 0, err
+	}
+	groups := make(map[partitionKey][]FileInfo)
+	for _, f := range m.Files {
+		if f.Bytes < small {
+			k := partitionKey{f.Table, f.Epoch, f.Day}
+			groups[k] = append(groups[k], f)
+		}
+	}
+	seq := nextSeq(m)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		merged int
+		errs   []error
+	)
+	sem := make(chan struct{}, max(workers, 1))
+	for k, files := range groups {
+		if len(files) < 2 {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return merged, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := mergeFiles(ctx, root, k, files, seq, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("merge %s: %w", k, err))
+				return
+			}
+			merged += len(files)
+		}()
+	}
+	wg.Wait()
+	return merged, errors.Join(errs...)
+}
+
+func mergeFiles(ctx context.Context, root string, k partitionKey, files []FileInfo, seq int, opts []Option) error {
+	staging := filepath.Join(root, StagingDir, "merge-"+k.String())
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	w, err := NewWriter(staging, opts...)
+	if err != nil {
+		return err
+	}
+	// staged files are named past every file under root
+	w.seq = seq
+
+	slices.SortFunc(files, func(a, b FileInfo) int { return cmp.Compare(a.MinSlot, b.MinSlot) })
+	var remove []string
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			w.Close()
+			return err
+		}
+		if err := copyFile(w, k.table, filepath.Join(root, filepath.FromSlash(f.Path))); err != nil {
+			w.Close()
+			return err
+		}
+		remove = append(remove, f.Path)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, err = register(root, staging, remove)
+	return err
+}
+
+// copyFile appends the rows of the table file at path to w.
+func copyFile(w *Writer, table, path string) error {
+	switch table {
+	case blocksTable.name:
+		rows, err := ReadBlocks(path)
+		if err != nil {
+			return err
+		}
+		return w.WriteBlocks(rows)
+	case txTable.name:
+		rows, err := ReadTransactions(path)
+		if err != nil {
+			return err
+		}
+		return w.WriteTransactions(rows)
+	case sigTable.name:
+		rows, err := ReadSignatures(path)
+		if err != nil {
+			return err
+		}
+		return w.WriteSignatures(rows)
+	}
+	return fmt.Errorf("%s: unknown table %q", path, table)
+}
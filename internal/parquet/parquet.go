@@ -1,148 +1,109 @@
 package parquet
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"time"
+	"io"
 
 	"github.com/apache/arrow/go/v15/arrow"
-	"github.com/apache/arrow/go/v15/arrow/array"
 	"github.com/apache/arrow/go/v15/arrow/memory"
 	"github.com/apache/arrow/go/v15/parquet"
 	"github.com/apache/arrow/go/v15/parquet/compress"
 	"github.com/apache/arrow/go/v15/parquet/file"
 	"github.com/apache/arrow/go/v15/parquet/pqarrow"
-	"go.uber.org/zap"
 
 	"github.com/lilythecat859/rpcv2-hist/internal/model"
 )
 
 const (
-	// 128 MB row groups
+	// 128 MB row groups, counted before compression; a table buffers at
+	// most one row group in memory
 	targetRowGroupSize = 128 * 1024 * 1024
+	// files roll over once they pass 1 GB
+	targetFileSize = 1024 * 1024 * 1024
 )
 
-type Writer struct {
-	path   string
-	logger *zap.Logger
-}
-
-type Option func(*Writer)
-
-func WithLogger(l *zap.Logger) Option {
-	return func(w *Writer) { w.logger = l }
-}
-
-// NewWriter returns a writer that flushes Arrow record batches to a parquet file.
-func NewWriter(path string, opts ...Option) *Writer {
-	w := &Writer{path: path, logger: zap.NewNop()}
-	for _, o := range opts {
-		o(w)
-	}
-	return w
-}
-
-// WriteBlocks appends blocks to a parquet file (creates if not exists).
-func (w *Writer) WriteBlocks(blocks []model.Block) error {
-	pool := memory.NewGoAllocator()
-	schema := arrow.NewSchema(
-		[]arrow.Field{
-			{Name: "slot", Type: arrow.PrimitiveTypes.Uint64, Nullable: false},
-			{Name: "blockhash", Type: arrow.BinaryTypes.String, Nullable: false},
-			{Name: "parent_slot", Type: arrow.PrimitiveTypes.Uint64, Nullable: false},
-			{Name: "block_time", Type: arrow.PrimitiveTypes.Int64, Nullable: false},
-			{Name: "height", Type: arrow.PrimitiveTypes.Uint64, Nullable: false},
-			{Name: "raw", Type: arrow.BinaryTypes.Binary, Nullable: false},
-		}, nil,
-	)
-
-	bld := array.NewRecordBuilder(pool, schema)
-	defer bld.Release()
+// readBatchRows is how many rows a reader decodes at a time.
+const readBatchRows = 64 * 1024
 
-	for _, blk := range blocks {
-		bld.Field(0).(*array.Uint64Builder).Append(blk.Slot)
-		bld.Field(1).(*array.StringBuilder).Append(blk.Blockhash)
-		bld.Field(2).(*array.Uint64Builder).Append(blk.ParentSlot)
-		bld.Field(3).(*array.Int64Builder).Append(blk.BlockTime)
-		bld.Field(4).(*array.Uint64Builder).Append(blk.Height)
-		bld.Field(5).(*array.BinaryBuilder).Append(blk.Raw)
-	}
-	rec := bld.NewRecord()
-	defer rec.Release()
-
-	// create parent dir
-	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
-		return fmt.Errorf("mkdir: %w", err)
-	}
+// SlotsPerEpoch partitions the dataset by epoch.
+const SlotsPerEpoch = 432_000
 
-// write parquet
-	fw, err := file.CreateFileWriter(w.path,
+// writerProps writes no bloom filters: arrow-go v15 cannot, so lookups
+// rely on the _index sidecar instead.
+func writerProps(schema *arrow.Schema) *parquet.WriterProperties {
+	opts := []parquet.WriterProperty{
 		parquet.WithCompression(compress.Codecs.Lz4),
-	)
-	if err != nil {
-		return fmt.Errorf("create writer: %w", err)
+		parquet.WithDictionaryDefault(false),
 	}
-	defer fw.Close()
-
-	wr, err := pqarrow.NewFileWriter(schema, fw,
-		pqarrow.WithRowGroupLength(targetRowGroupSize),
-	)
-	if err != nil {
-		return fmt.Errorf("new arrow writer: %w", err)
-	}
-	defer wr.Close()
-
-	if err := wr.Write(rec); err != nil {
-		return fmt.Errorf("write record: %w", err)
+	for _, col := range dictColumns[schema] {
+		opts = append(opts, parquet.WithDictionaryFor(col, true))
 	}
-	return nil
+	return parquet.NewWriterProperties(opts...)
 }
 
-// ReadBlocks reads a parquet file into memory.
+// ReadBlocks reads a blocks file into memory.
 func ReadBlocks(path string) ([]model.Block, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
-	defer f.Close()
+	return readRows(path, blockSchema, readBlock)
+}
+
+// ReadTransactions reads a transactions file into memory.
+func ReadTransactions(path string) ([]model.Transaction, error) {
+	return readRows(path, txSchema, readTx)
+}
 
-	rdr, err := file.OpenParquetFile(path, true)
+// ReadSignatures reads an address index file into memory.
+func ReadSignatures(path string) ([]model.SignatureRow, error) {
+	return readRows(path, sigSchema, readSig)
+}
+
+func readRows[T any](path string, schema *arrow.Schema, get func(arrow.Record, int) T) ([]T, error) {
+	rdr, err := file.OpenParquetFile(path, false)
 	if err != nil {
 		return nil, fmt.Errorf("open parquet: %w", err)
 	}
 	defer rdr.Close()
-
-	ar, err := pqarrow.NewFileReader(rdr)
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{BatchSize: readBatchRows}, memory.DefaultAllocator)
 	if err != nil {
 		return nil, fmt.Errorf("arrow reader: %w", err)
 	}
-
-	rec, err := ar.Read()
+	got, err := fr.Schema()
 	if err != nil {
-		return nil, fmt.Errorf("read: %w", err)
+		return nil, fmt.Errorf("read schema: %w", err)
 	}
-	defer rec.Release()
-
-	var out []model.Block
-	rows := int(rec.NumRows())
-	for i := 0; i < rows; i++ {
-		out = append(out, model.Block{
-			Slot:       rec.Column(0).(*array.Uint64).Value(i),
-			Blockhash:  rec.Column(1).(*array.String).Value(i),
-			ParentSlot: rec.Column(2).(*array.Uint64).Value(i),
-			BlockTime:  rec.Column(3).(*array.Int64).Value(i),
-			Height:     rec.Column(4).(*array.Uint64).Value(i),
-			Raw:        rec.Column(5).(*array.Binary).Value(i),
-		})
+	if err := checkColumns(got, schema); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rr, err := fr.GetRecordReader(context.Background(), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record reader: %w", err)
+	}
+	defer rr.Release()
+
+	out := make([]T, 0, rdr.NumRows())
+	for rr.Next() {
+		rec := rr.Record()
+		for i := 0; i < int(rec.NumRows()); i++ {
+			out = append(out, get(rec, i))
+		}
+	}
+	if err := rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read %s: %w", path, err)
 	}
 	return out, nil
 }
 
-// UploadParquet uploads a local parquet file to S3 (placeholder).
-func UploadParquet(ctx context.Context, localPath, s3Key string) error {
-	// TODO: integrate minio/aws-sdk-go-v2
+// checkColumns compares column names only: types come back from the file
+// with reader-chosen list element names and nullability.
+func checkColumns(got, want *arrow.Schema) error {
+	if got.NumFields() != want.NumFields() {
+		return fmt.Errorf("have %d columns, want %d", got.NumFields(), want.NumFields())
+	}
+	for i, f := range want.Fields() {
+		if name := got.Field(i).Name; name != f.Name {
+			return fmt.Errorf("column %d is %q, want %q", i, name, f.Name)
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,277 @@
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// readTable reads every file of table listed in the manifest under root.
+func readTable[T any](t *testing.T, root, table string, read func(string) ([]T, error)) []T {
+	m, err := ReadManifest(root)
+	require.NoError(t, err)
+	var out []T
+	for _, f := range m.Table(table, 0, ^uint64(0)) {
+		rows, err := read(filepath.Join(root, f.Path))
+		require.NoError(t, err)
+		out = append(out, rows...)
+	}
+	return out
+}
+
+func TestTransactionsRoundTrip(t *testing.T) {
+	errStr := `{"InstructionError":[0,{"Custom":1}]}`
+	txs := []model.Transaction{
+		{
+			Signature: "sig1", Slot: 10, Index: 0, BlockTime: 1700000000, Signer: "alice", Fee: 5000, ComputeUnits: 150,
+			Raw: []byte(`{"transaction":{"signatures":["sig1"],"message":{"accountKeys":["alice","bob"],"instructions":[]}},` +
+				`"meta":{"err":null,"fee":5000,"loadedAddresses":{"writable":["carol"],"readonly":[]}}}`),
+		},
+		{Signature: "sig2", Slot: 11, Index: 3, BlockTime: 1700000000, Signer: "bob", Err: &errStr, Raw: []byte(`{}`)},
+	}
+	root := t.TempDir()
+	w, err := NewWriter(root)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTransactions(txs))
+	require.NoError(t, w.Close())
+	require.Equal(t, txs, readTable(t, root, "transactions", ReadTransactions))
+	require.Equal(t, []string{"alice", "bob", "carol"}, accountKeys(txs[0].Raw))
+
+	m, err := ReadManifest(root)
+	require.NoError(t, err)
+	_, err = ReadSignatures(filepath.Join(root, m.Files[0].Path))
+	require.Error(t, err)
+}
+
+func TestSignaturesRoundTrip(t *testing.T) {
+	memo := "hello"
+	rows := []model.SignatureRow{
+		{Address: "alice", Signature: "sig1", Slot: 10, BlockTime: 1700000000, Memo: &memo},
+		{Address: "alice", Signature: "sig2", Slot: 11, BlockTime: 1700000000},
+	}
+	root := t.TempDir()
+	w, err := NewWriter(root)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteSignatures(rows))
+	require.NoError(t, w.Close())
+	require.Equal(t, rows, readTable(t, root, "signatures", ReadSignatures))
+}
+
+func TestPartitionedDataset(t *testing.T) {
+	const day = 24 * 60 * 60
+	var blocks []model.Block
+	for slot := uint64(SlotsPerEpoch - 4); slot < SlotsPerEpoch+4; slot++ {
+		bt := int64(1700000000)
+		if slot >= SlotsPerEpoch+2 {
+			bt += day
+		}
+		blocks = append(blocks, model.Block{Slot: slot, Blockhash: "hash", ParentSlot: slot - 1, BlockTime: bt, Raw: make([]byte, 100)})
+	}
+
+	root := t.TempDir()
+	w, err := NewWriter(root, WithRowGroupBytes(300), WithFileBytes(1))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteBlocks(blocks[:5]))
+	require.NoError(t, w.WriteBlocks(blocks[5:]))
+	require.NoError(t, w.Close())
+
+	m, err := ReadManifest(root)
+	require.NoError(t, err)
+	// epoch 0 rolls after three blocks, then epoch 1 splits by day
+	var got [][2]uint64
+	for _, f := range m.Files {
+		got = append(got, [2]uint64{f.MinSlot, f.MaxSlot})
+		require.FileExists(t, filepath.Join(root, f.Path))
+		require.Positive(t, f.Bytes)
+	}
+	e := uint64(SlotsPerEpoch)
+	require.Equal(t, [][2]uint64{{e - 4, e - 2}, {e - 1, e - 1}, {e, e + 1}, {e + 2, e + 3}}, got)
+	require.Equal(t, "blocks/epoch=0/day=2023-11-14/part-431996-0.parquet", m.Files[0].Path)
+	require.Equal(t, "2023-11-15", m.Files[3].Day)
+	require.Len(t, m.Table("blocks", e, e), 1)
+	require.Equal(t, blocks, readTable(t, root, "blocks", ReadBlocks))
+
+	// a second writer adds to the manifest
+	w, err = NewWriter(root)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteBlocks([]model.Block{{Slot: e + 4, BlockTime: 1700000000 + day}}))
+	require.NoError(t, w.Close())
+	m, err = ReadManifest(root)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 5)
+	tmp, err := filepath.Glob(filepath.Join(root, "blocks", "*", "*", "*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, tmp)
+	_, err = os.Stat(filepath.Join(root, ManifestName))
+	require.NoError(t, err)
+}
+
+func TestIndexedLookups(t *testing.T) {
+	var (
+		txs  []model.Transaction
+		sigs []model.SignatureRow
+	)
+	for slot := uint64(1); slot <= 200; slot++ {
+		sig := fmt.Sprintf("sig%d", slot)
+		txs = append(txs, model.Transaction{Signature: sig, Slot: slot, BlockTime: 1700000000, Raw: []byte(`{}`)})
+		// addresses arrive out of order
+		for _, addr := range []string{fmt.Sprintf("addr%d", slot%7), "hot"} {
+			sigs = append(sigs, model.SignatureRow{Address: addr, Signature: sig, Slot: slot, BlockTime: 1700000000})
+		}
+	}
+	root := t.TempDir()
+	w, err := NewWriter(root, WithRowGroupBytes(1000), WithFileBytes(10_000))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTransactions(txs))
+	require.NoError(t, w.WriteSignatures(sigs))
+	require.NoError(t, w.Close())
+
+	// signature files are sorted by address and slot
+	m, err := ReadManifest(root)
+	require.NoError(t, err)
+	for _, f := range m.Table("signatures", 0, ^uint64(0)) {
+		rows, err := ReadSignatures(filepath.Join(root, f.Path))
+		require.NoError(t, err)
+		require.True(t, slices.IsSortedFunc(rows, func(a, b model.SignatureRow) int { return sigTable.less(&a, &b) }))
+	}
+	require.Empty(t, must(filepath.Glob(filepath.Join(root, "*", "*", "*", "*.runs"))))
+
+	d, err := OpenDataset(root)
+	require.NoError(t, err)
+	tx, err := d.Transaction(context.Background(), "sig123")
+	require.NoError(t, err)
+	require.Equal(t, uint64(123), tx.Slot)
+	tx, err = d.Transaction(context.Background(), "missing")
+	require.NoError(t, err)
+	require.Nil(t, tx)
+
+	// the index leaves a handful of the row groups to read
+	groups, err := lookupIndex(root, "signature", "sig123")
+	require.NoError(t, err)
+	var total, hit int
+	for _, f := range m.Table("transactions", 0, ^uint64(0)) {
+		rdr, err := file.OpenParquetFile(filepath.Join(root, f.Path), false)
+		require.NoError(t, err)
+		total += rdr.NumRowGroups()
+		require.NoError(t, rdr.Close())
+		hit += len(groups[f.Path])
+	}
+	require.GreaterOrEqual(t, total, 10)
+	require.LessOrEqual(t, hit, 2)
+
+	rows, err := d.Signatures(context.Background(), "addr3", 100, 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{94, 87, 80}, []uint64{rows[0].Slot, rows[1].Slot, rows[2].Slot})
+	rows, err = d.Signatures(context.Background(), "hot", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, rows, 200)
+
+	var slots []uint64
+	require.NoError(t, d.ScanSignatures(context.Background(), "hot", 50, 59, func(r *model.SignatureRow) bool {
+		slots = append(slots, r.Slot)
+		return true
+	}))
+	slices.Sort(slots)
+	require.Equal(t, []uint64{50, 51, 52, 53, 54, 55, 56, 57, 58, 59}, slots)
+}
+
+func TestMergeAndValidate(t *testing.T) {
+	ctx := context.Background()
+	var (
+		blocks []model.Block
+		txs    []model.Transaction
+	)
+	for slot := uint64(100); slot < 120; slot++ {
+		blocks = append(blocks, model.Block{Slot: slot, Blockhash: "hash", ParentSlot: slot - 1, BlockTime: 1700000000, Raw: make([]byte, 100)})
+		txs = append(txs, model.Transaction{Signature: fmt.Sprint("sig", slot), Slot: slot, BlockTime: 1700000000, Raw: make([]byte, 100)})
+	}
+	root := t.TempDir()
+	w, err := NewWriter(root, WithRowGroupBytes(300), WithFileBytes(1))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteBlocks(blocks))
+	require.NoError(t, w.WriteTransactions(txs))
+	require.NoError(t, w.Close())
+	before, err := ReadManifest(root)
+	require.NoError(t, err)
+	require.Greater(t, len(before.Files), 10)
+
+	st, err := Inspect(filepath.Join(root, before.Files[0].Path))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), st.Rows)
+	require.Equal(t, "slot", st.Columns[0].Name)
+	require.Equal(t, "100", st.RowGroups[0].Columns[0].Min)
+	require.Empty(t, st.RowGroups[0].Columns[5].Max) // raw is binary
+
+	issues, err := Validate(ctx, root, 2)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	n, err := Merge(ctx, root, 1<<20, 2)
+	require.NoError(t, err)
+	require.Equal(t, len(before.Files), n)
+	m, err := ReadManifest(root)
+	require.NoError(t, err)
+	require.Len(t, m.Files, 2)
+	for _, f := range before.Files {
+		require.NoFileExists(t, filepath.Join(root, f.Path))
+	}
+	require.Equal(t, blocks, readTable(t, root, "blocks", ReadBlocks))
+	d, err := OpenDataset(root)
+	require.NoError(t, err)
+	tx, err := d.Transaction(ctx, "sig107")
+	require.NoError(t, err)
+	require.Equal(t, uint64(107), tx.Slot)
+
+	// 120 is skipped, 122 is missing and 124 is off a fork
+	staging := filepath.Join(root, StagingDir, "gaps")
+	w, err = NewWriter(staging)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteBlocks([]model.Block{
+		{Slot: 121, ParentSlot: 119, BlockTime: 1700000000},
+		{Slot: 123, ParentSlot: 122, BlockTime: 1700000000},
+		{Slot: 124, ParentSlot: 121, BlockTime: 1700000000},
+	}))
+	require.NoError(t, w.Close())
+	_, err = Register(root, staging)
+	require.NoError(t, err)
+	txFile := m.Table("transactions", 0, ^uint64(0))[0].Path
+	require.NoError(t, os.Remove(filepath.Join(root, txFile)))
+
+	issues, err = Validate(ctx, root, 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Issue{
+		{Path: txFile, Msg: "listed in the manifest but missing"},
+		{Slot: 123, Msg: "parent slot 122 is missing; the block before is 121"},
+		{Slot: 124, Msg: "parent slot 121 skips block 123"},
+	}, issues)
+}
+
+func TestBloomFalsePositives(t *testing.T) {
+	b := newBloom(10_000)
+	for i := 0; i < 10_000; i++ {
+		b.insert(keyHash(fmt.Sprint("in", i)))
+	}
+	fp := 0
+	for i := 0; i < 10_000; i++ {
+		require.True(t, b.check(keyHash(fmt.Sprint("in", i))))
+		if b.check(keyHash(fmt.Sprint("out", i))) {
+			fp++
+		}
+	}
+	require.Less(t, fp, 300)
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,126 @@
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/objstore"
+)
+
+// StagingDir is the directory under a dataset root where datasets are
+// written before Register moves them in, so they share its file system.
+const StagingDir = "_staging"
+
+// registerMu serializes manifest updates within the process.
+var registerMu sync.Mutex
+
+// Register moves the dataset under staging into the dataset under root,
+// which must be on the same file system: data files are renamed into
+// place, their index entries appended, and the manifest saved last, so
+// readers see the files only once they are indexed. Registering a file
+// again replaces its manifest entry. It returns the index shards and the
+// manifest it changed, relative to root.
+func Register(root, staging string) ([]string, error) {
+	return register(root, staging, nil)
+}
+
+// register is Register that also drops the files at remove from the
+// manifest, in the same save. Their data files are deleted afterwards;
+// their index entries stay but are ignored, as lookups only read files
+// the manifest lists.
+func register(root, staging string, remove []string) ([]string, error) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	add, err := ReadManifest(staging)
+	if err != nil {
+		return nil, fmt.Errorf("read staged manifest: %w", err)
+	}
+	m, err := ReadManifest(root)
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range add.Files {
+		dst := filepath.Join(root, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return nil, fmt.Errorf("mkdir: %w", err)
+		}
+		if err := os.Rename(filepath.Join(staging, filepath.FromSlash(f.Path)), dst); err != nil {
+			return nil, fmt.Errorf("move %s: %w", f.Path, err)
+		}
+	}
+
+	var changed []string
+	err = filepath.WalkDir(filepath.Join(staging, indexDir), func(p string, e fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return fs.SkipAll
+		}
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(staging, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := appendFile(dst, data); err != nil {
+			return err
+		}
+		changed = append(changed, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("append index: %w", err)
+	}
+
+	m.Files = slices.DeleteFunc(m.Files, func(f FileInfo) bool { return slices.Contains(remove, f.Path) })
+	for _, f := range add.Files {
+		i := slices.IndexFunc(m.Files, func(g FileInfo) bool { return g.Path == f.Path })
+		if i < 0 {
+			m.Files = append(m.Files, f)
+		} else {
+			m.Files[i] = f
+		}
+	}
+	if err := m.save(root); err != nil {
+		return nil, err
+	}
+	for _, p := range remove {
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(p))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return append(changed, ManifestName), nil
+}
+
+// Upload copies the files at paths, relative to root, to the bucket under
+// the same keys, and checks every copy against the file sent.
+func Upload(ctx context.Context, b objstore.Bucket, root string, paths []string) error {
+	for _, p := range paths {
+		obj, err := b.Upload(ctx, path.Clean(p), filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		if err := objstore.Verify(ctx, b, obj); err != nil {
+			return fmt.Errorf("verify upload: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package parquet
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/ingest"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// The schemas follow the ClickHouse tables of the same name, less the
+// commitment and version columns: archived rows are all finalized.
+var (
+	blockSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "slot", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "blockhash", Type: arrow.BinaryTypes.String},
+		{Name: "parent_slot", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "block_time", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "height", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "raw", Type: arrow.BinaryTypes.Binary},
+	}, nil)
+
+	// account_keys lists every account the transaction references, loaded
+	// addresses included, so address queries need not parse raw
+	txSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "signature", Type: arrow.BinaryTypes.String},
+		{Name: "slot", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "tx_idx", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "block_time", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "signer", Type: arrow.BinaryTypes.String},
+		{Name: "fee", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "compute_units", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "err", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "account_keys", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+		{Name: "raw", Type: arrow.BinaryTypes.Binary},
+	}, nil)
+
+	sigSchema = arrow.NewSchema([]arrow.Field{
+		{Name: "address", Type: arrow.BinaryTypes.String},
+		{Name: "signature", Type: arrow.BinaryTypes.String},
+		{Name: "slot", Type: arrow.PrimitiveTypes.Uint64},
+		{Name: "block_time", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "err", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "memo", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+)
+
+// dictColumns are the columns worth dictionary encoding: addresses repeat
+// across rows, while hashes, signatures and raw payloads do not.
+var dictColumns = map[*arrow.Schema][]string{
+	txSchema:  {"signer", "account_keys.list.element"},
+	sigSchema: {"address"},
+}
+
+// table describes how rows of one dataset table are laid out.
+type table[T any] struct {
+	name   string
+	schema *arrow.Schema
+	add    func(*array.RecordBuilder, *T)
+	read   func(arrow.Record, int) T
+	key    func(*T) (slot uint64, blockTime int64) // for partitioning
+	size   func(*T) int64                          // rough in-memory bytes
+	less   func(a, b *T) int                       // file sort order, nil for arrival order
+
+	// index names the column the sidecar index covers, if any
+	index    string
+	indexKey func(*T) string
+}
+
+var (
+	blocksTable = &table[model.Block]{
+		name:     "blocks",
+		schema:   blockSchema,
+		add:      appendBlock,
+		read:     readBlock,
+		key:      func(b *model.Block) (uint64, int64) { return b.Slot, b.BlockTime },
+		size:     func(b *model.Block) int64 { return int64(32 + len(b.Blockhash) + len(b.Raw)) },
+		index:    "slot",
+		indexKey: func(b *model.Block) string { return strconv.FormatUint(b.Slot, 10) },
+	}
+	txTable = &table[model.Transaction]{
+		name:   "transactions",
+		schema: txSchema,
+		add:    appendTx,
+		read:   readTx,
+		key:    func(tx *model.Transaction) (uint64, int64) { return tx.Slot, tx.BlockTime },
+		size: func(tx *model.Transaction) int64 {
+			// account keys come out of raw, about a third of its size
+			return int64(40 + len(tx.Signature) + len(tx.Signer) + len(deref(tx.Err)) + len(tx.Raw)*4/3)
+		},
+		index:    "signature",
+		indexKey: func(tx *model.Transaction) string { return tx.Signature },
+	}
+	// address index rows are sorted so an address's rows share few row
+	// groups
+	sigTable = &table[model.SignatureRow]{
+		name:   "signatures",
+		schema: sigSchema,
+		add:    appendSig,
+		read:   readSig,
+		key:    func(r *model.SignatureRow) (uint64, int64) { return r.Slot, r.BlockTime },
+		size: func(r *model.SignatureRow) int64 {
+			return int64(16 + len(r.Address) + len(r.Signature) + len(deref(r.Err)) + len(deref(r.Memo)))
+		},
+		less: func(a, b *model.SignatureRow) int {
+			return cmp.Or(strings.Compare(a.Address, b.Address), cmp.Compare(a.Slot, b.Slot), strings.Compare(a.Signature, b.Signature))
+		},
+		index:    "address",
+		indexKey: func(r *model.SignatureRow) string { return r.Address },
+	}
+)
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func appendBlock(bld *array.RecordBuilder, blk *model.Block) {
+	bld.Field(0).(*array.Uint64Builder).Append(blk.Slot)
+	bld.Field(1).(*array.StringBuilder).Append(blk.Blockhash)
+	bld.Field(2).(*array.Uint64Builder).Append(blk.ParentSlot)
+	bld.Field(3).(*array.Int64Builder).Append(blk.BlockTime)
+	bld.Field(4).(*array.Uint64Builder).Append(blk.Height)
+	bld.Field(5).(*array.BinaryBuilder).Append(blk.Raw)
+}
+
+func readBlock(rec arrow.Record, i int) model.Block {
+	return model.Block{
+		Slot:       rec.Column(0).(*array.Uint64).Value(i),
+		Blockhash:  rec.Column(1).(*array.String).Value(i),
+		ParentSlot: rec.Column(2).(*array.Uint64).Value(i),
+		BlockTime:  rec.Column(3).(*array.Int64).Value(i),
+		Height:     rec.Column(4).(*array.Uint64).Value(i),
+		Raw:        bytes.Clone(rec.Column(5).(*array.Binary).Value(i)),
+	}
+}
+
+func appendTx(bld *array.RecordBuilder, tx *model.Transaction) {
+	bld.Field(0).(*array.StringBuilder).Append(tx.Signature)
+	bld.Field(1).(*array.Uint64Builder).Append(tx.Slot)
+	bld.Field(2).(*array.Uint64Builder).Append(tx.Index)
+	bld.Field(3).(*array.Int64Builder).Append(tx.BlockTime)
+	bld.Field(4).(*array.StringBuilder).Append(tx.Signer)
+	bld.Field(5).(*array.Uint64Builder).Append(tx.Fee)
+	bld.Field(6).(*array.Uint64Builder).Append(tx.ComputeUnits)
+	appendOptString(bld.Field(7).(*array.StringBuilder), tx.Err)
+	keys := bld.Field(8).(*array.ListBuilder)
+	keys.Append(true)
+	kb := keys.ValueBuilder().(*array.StringBuilder)
+	for _, k := range accountKeys(tx.Raw) {
+		kb.Append(k)
+	}
+	bld.Field(9).(*array.BinaryBuilder).Append(tx.Raw)
+}
+
+func readTx(rec arrow.Record, i int) model.Transaction {
+	return model.Transaction{
+		Signature:    rec.Column(0).(*array.String).Value(i),
+		Slot:         rec.Column(1).(*array.Uint64).Value(i),
+		Index:        rec.Column(2).(*array.Uint64).Value(i),
+		BlockTime:    rec.Column(3).(*array.Int64).Value(i),
+		Signer:       rec.Column(4).(*array.String).Value(i),
+		Fee:          rec.Column(5).(*array.Uint64).Value(i),
+		ComputeUnits: rec.Column(6).(*array.Uint64).Value(i),
+		Err:          optString(rec.Column(7).(*array.String), i),
+		Raw:          bytes.Clone(rec.Column(9).(*array.Binary).Value(i)),
+	}
+}
+
+func appendSig(bld *array.RecordBuilder, row *model.SignatureRow) {
+	bld.Field(0).(*array.StringBuilder).Append(row.Address)
+	bld.Field(1).(*array.StringBuilder).Append(row.Signature)
+	bld.Field(2).(*array.Uint64Builder).Append(row.Slot)
+	bld.Field(3).(*array.Int64Builder).Append(row.BlockTime)
+	appendOptString(bld.Field(4).(*array.StringBuilder), row.Err)
+	appendOptString(bld.Field(5).(*array.StringBuilder), row.Memo)
+}
+
+func readSig(rec arrow.Record, i int) model.SignatureRow {
+	return model.SignatureRow{
+		Address:   rec.Column(0).(*array.String).Value(i),
+		Signature: rec.Column(1).(*array.String).Value(i),
+		Slot:      rec.Column(2).(*array.Uint64).Value(i),
+		BlockTime: rec.Column(3).(*array.Int64).Value(i),
+		Err:       optString(rec.Column(4).(*array.String), i),
+		Memo:      optString(rec.Column(5).(*array.String), i),
+	}
+}
+
+func appendOptString(b *array.StringBuilder, s *string) {
+	if s == nil {
+		b.AppendNull()
+		return
+	}
+	b.Append(*s)
+}
+
+func optString(a *array.String, i int) *string {
+	if a.IsNull(i) {
+		return nil
+	}
+	s := a.Value(i)
+	return &s
+}
+
+// accountKeys lists the static and loaded accounts of a raw transaction.
+func accountKeys(raw json.RawMessage) []string {
+	var rt ingest.RawTransaction
+	if len(raw) == 0 || json.Unmarshal(raw, &rt) != nil {
+		return nil
+	}
+	keys := rt.Transaction.Message.AccountKeys
+	if m := rt.Meta; m != nil && m.LoadedAddresses != nil {
+		keys = append(append(keys, m.LoadedAddresses.Writable...), m.LoadedAddresses.Readonly...)
+	}
+	return keys
+}
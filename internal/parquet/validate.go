@@ -0,0 +1,226 @@
+package parquet
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+)
+
+// Issue is a problem Validate found, with a file or at a slot.
+type Issue struct {
+	Path string `json:"path,omitempty"`
+	Slot uint64 `json:"slot,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+func (i Issue) String() string {
+	if i.Path != "" {
+		return i.Path + ": " + i.Msg
+	}
+	return fmt.Sprintf("slot %d: %s", i.Slot, i.Msg)
+}
+
+// link is a block's slot and its parent's.
+type link struct {
+	slot, parent uint64
+}
+
+// Validate checks the dataset under root, workers days at a time: every
+// file the manifest lists is readable and holds the rows it records, and
+// the blocks form one chain, the parent of each being the block stored
+// before it. A parent past that block means blocks are missing; one before
+// it means that block is not an ancestor, such as a block of an abandoned
+// fork.
+func Validate(ctx context.Context, root string, workers int) ([]Issue, error) {
+	m, err := ReadManifest(root)
+	if err != nil {
+		return nil, err
+	}
+	type dayKey struct {
+		epoch uint64
+		day   string
+	}
+	type day struct {
+		files []FileInfo
+		first uint64 // lowest slot of its files
+
+		issues     []Issue
+		links      int
+		head, tail link
+	}
+	byKey := make(map[dayKey]*day)
+	for _, f := range m.Files {
+		k := dayKey{f.Epoch, f.Day}
+		d := byKey[k]
+		if d == nil {
+			d = &day{first: f.MinSlot}
+			byKey[k] = d
+		}
+		d.files = append(d.files, f)
+		d.first = min(d.first, f.MinSlot)
+	}
+	days := make([]*day, 0, len(byKey))
+	for _, d := range byKey {
+		days = append(days, d)
+	}
+	slices.SortFunc(days, func(a, b *day) int { return cmp.Compare(a.first, b.first) })
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, max(workers, 1))
+	for _, d := range days {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var links []link
+			for _, f := range d.files {
+				got, issue, err := checkFile(ctx, root, f)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					return
+				}
+				if issue != nil {
+					d.issues = append(d.issues, *issue)
+				}
+				links = append(links, got...)
+			}
+			slices.SortFunc(links, func(a, b link) int { return cmp.Compare(a.slot, b.slot) })
+			for i := 1; i < len(links); i++ {
+				if issue := checkLink(links[i-1], links[i]); issue != nil {
+					d.issues = append(d.issues, *issue)
+				}
+			}
+			if d.links = len(links); d.links > 0 {
+				d.head, d.tail = links[0], links[len(links)-1]
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	var (
+		issues []Issue
+		prev   *day
+	)
+	for _, d := range days {
+		if prev != nil && d.links > 0 {
+			if issue := checkLink(prev.tail, d.head); issue != nil {
+				issues = append(issues, *issue)
+			}
+		}
+		issues = append(issues, d.issues...)
+		if d.links > 0 {
+			prev = d
+		}
+	}
+	return issues, nil
+}
+
+// checkFile compares a file with its manifest entry, and returns the
+// links of a blocks file. Unreadable files are issues; only a done ctx is
+// an error.
+func checkFile(ctx context.Context, root string, f FileInfo) ([]link, *Issue, error) {
+	path := filepath.Join(root, filepath.FromSlash(f.Path))
+	var (
+		links []link
+		rows  int64
+		err   error
+	)
+	if f.Table == blocksTable.name {
+		links, err = readLinks(ctx, path)
+		rows = int64(len(links))
+	} else {
+		var rdr *file.Reader
+		if rdr, err = file.OpenParquetFile(path, false); err == nil {
+			rows = rdr.NumRows()
+			rdr.Close()
+		}
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		return nil, nil, cerr
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, &Issue{Path: f.Path, Msg: "listed in the manifest but missing"}, nil
+	case err != nil:
+		return nil, &Issue{Path: f.Path, Msg: err.Error()}, nil
+	case rows != f.Rows:
+		return links, &Issue{Path: f.Path, Msg: fmt.Sprintf("holds %d rows, the manifest lists %d", rows, f.Rows)}, nil
+	}
+	return links, nil, nil
+}
+
+// checkLink checks that cur follows prev in the chain.
+func checkLink(prev, cur link) *Issue {
+	switch {
+	case cur.slot == prev.slot:
+		return &Issue{Slot: cur.slot, Msg: "stored more than once"}
+	case cur.parent >= cur.slot:
+		return &Issue{Slot: cur.slot, Msg: fmt.Sprintf("parent slot %d is not below the slot", cur.parent)}
+	case cur.parent > prev.slot:
+		return &Issue{Slot: cur.slot, Msg: fmt.Sprintf("parent slot %d is missing; the block before is %d", cur.parent, prev.slot)}
+	case cur.parent < prev.slot:
+		return &Issue{Slot: cur.slot, Msg: fmt.Sprintf("parent slot %d skips block %d", cur.parent, prev.slot)}
+	}
+	return nil
+}
+
+// readLinks reads only the slot and parent_slot columns of a blocks file.
+func readLinks(ctx context.Context, path string) ([]link, error) {
+	rdr, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("open parquet: %w", err)
+	}
+	defer rdr.Close()
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{BatchSize: readBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, fmt.Errorf("arrow reader: %w", err)
+	}
+	rr, err := fr.GetRecordReader(ctx, []int{0, 2}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("record reader: %w", err)
+	}
+	defer rr.Release()
+	links := make([]link, 0, rdr.NumRows())
+	for rr.Next() {
+		rec := rr.Record()
+		s := rec.Schema()
+		if s.Field(0).Name != "slot" || s.Field(1).Name != "parent_slot" {
+			return nil, fmt.Errorf("columns are %q and %q, want slot and parent_slot", s.Field(0).Name, s.Field(1).Name)
+		}
+		slots := rec.Column(0).(*array.Uint64).Uint64Values()
+		parents := rec.Column(1).(*array.Uint64).Uint64Values()
+		for i := range slots {
+			links = append(links, link{slots[i], parents[i]})
+		}
+	}
+	if err := rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return links, nil
+}
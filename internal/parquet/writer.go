@@ -0,0 +1,470 @@
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+)
+
+// Writer appends rows to a Hive-style partitioned dataset:
+// <table>/epoch=<n>/day=<yyyy-mm-dd>/part-<first slot>-<seq>.parquet, with
+// block time days in UTC. Every table keeps one file open, which is closed
+// when rows for another partition arrive or it reaches the target size;
+// only closed files are renamed into place, added to the sidecar index and
+// listed in the manifest.
+type Writer struct {
+	root          string
+	logger        *zap.Logger
+	rowGroupBytes int64
+	fileBytes     int64
+
+	mu       sync.Mutex
+	manifest Manifest
+	seq      int
+	blocks   *tableWriter[model.Block]
+	txs      *tableWriter[model.Transaction]
+	sigs     *tableWriter[model.SignatureRow]
+}
+
+type Option func(*Writer)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(w *Writer) { w.logger = l }
+}
+
+// WithRowGroupBytes sets how much row data is buffered before it is
+// written out as a row group.
+func WithRowGroupBytes(n int64) Option {
+	return func(w *Writer) {
+		if n > 0 {
+			w.rowGroupBytes = n
+		}
+	}
+}
+
+// WithFileBytes sets the size at which a file is closed and the next one
+// started.
+func WithFileBytes(n int64) Option {
+	return func(w *Writer) {
+		if n > 0 {
+			w.fileBytes = n
+		}
+	}
+}
+
+// NewWriter returns a writer adding to the dataset under root, and to its
+// manifest if there is one already.
+func NewWriter(root string, opts ...Option) (*Writer, error) {
+	w := &Writer{
+		root:          root,
+		logger:        zap.NewNop(),
+		rowGroupBytes: targetRowGroupSize,
+		fileBytes:     targetFileSize,
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	m, err := ReadManifest(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if m != nil {
+		w.manifest = *m
+	}
+	w.seq = nextSeq(&w.manifest)
+	w.blocks = &tableWriter[model.Block]{w: w, t: blocksTable}
+	w.txs = &tableWriter[model.Transaction]{w: w, t: txTable}
+	w.sigs = &tableWriter[model.SignatureRow]{w: w, t: sigTable}
+	return w, nil
+}
+
+// WriteBlocks appends blocks to the dataset.
+func (w *Writer) WriteBlocks(blocks []model.Block) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.blocks.write(blocks)
+}
+
+// WriteTransactions appends transaction rows to the dataset.
+func (w *Writer) WriteTransactions(txs []model.Transaction) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.txs.write(txs)
+}
+
+// WriteSignatures appends address index rows to the dataset.
+func (w *Writer) WriteSignatures(rows []model.SignatureRow) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sigs.write(rows)
+}
+
+// Close writes out and closes every open file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Join(w.blocks.close(), w.txs.close(), w.sigs.close())
+}
+
+// nextSeq is past the sequence number of every file in m, so new file
+// names never reuse those of files merged away.
+func nextSeq(m *Manifest) int {
+	seq := len(m.Files)
+	for _, f := range m.Files {
+		name := strings.TrimSuffix(path.Base(f.Path), ".parquet")
+		if n, err := strconv.Atoi(name[strings.LastIndexByte(name, '-')+1:]); err == nil {
+			seq = max(seq, n+1)
+		}
+	}
+	return seq
+}
+
+type tableWriter[T any] struct {
+	w *Writer
+	t *table[T]
+	p *part[T]
+}
+
+// part is a file being written. Rows are buffered until they fill a row
+// group; tables with a sort order write sorted row groups to a runs file
+// first, merged into the data file when it is closed.
+type part[T any] struct {
+	info    FileInfo
+	path    string
+	out     *fileOut
+	rows    []T
+	pending int64 // estimated bytes in rows
+}
+
+func (tw *tableWriter[T]) write(rows []T) error {
+	for i := range rows {
+		r := &rows[i]
+		slot, blockTime := tw.t.key(r)
+		epoch, day := slot/SlotsPerEpoch, time.Unix(blockTime, 0).UTC().Format(time.DateOnly)
+		if p := tw.p; p != nil && (p.info.Epoch != epoch || p.info.Day != day) {
+			if err := tw.close(); err != nil {
+				return err
+			}
+		}
+		if tw.p == nil {
+			if err := tw.open(epoch, day, slot); err != nil {
+				return err
+			}
+		}
+		p := tw.p
+		p.rows = append(p.rows, *r)
+		p.pending += tw.t.size(r)
+		p.info.Rows++
+		p.info.MinSlot = min(p.info.MinSlot, slot)
+		p.info.MaxSlot = max(p.info.MaxSlot, slot)
+		if p.pending < tw.w.rowGroupBytes {
+			continue
+		}
+		if err := tw.flush(); err != nil {
+			return err
+		}
+		if p.out.cw.n >= tw.w.fileBytes {
+			if err := tw.close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (tw *tableWriter[T]) open(epoch uint64, day string, slot uint64) error {
+	rel := filepath.Join(tw.t.name, fmt.Sprintf("epoch=%d", epoch), "day="+day,
+		fmt.Sprintf("part-%d-%d.parquet", slot, tw.w.seq))
+	path := filepath.Join(tw.w.root, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	var (
+		out *fileOut
+		err error
+	)
+	if tw.t.less != nil {
+		out, err = createFile(path+".runs", tw.t.schema, "")
+	} else {
+		out, err = createFile(path+".tmp", tw.t.schema, tw.t.index)
+	}
+	if err != nil {
+		return err
+	}
+	tw.w.seq++
+	tw.p = &part[T]{
+		info: FileInfo{Table: tw.t.name, Path: filepath.ToSlash(rel), Epoch: epoch, Day: day, MinSlot: slot, MaxSlot: slot},
+		path: path,
+		out:  out,
+	}
+	return nil
+}
+
+// flush writes the buffered rows out as a row group.
+func (tw *tableWriter[T]) flush() error {
+	p := tw.p
+	if len(p.rows) == 0 {
+		return nil
+	}
+	if tw.t.less != nil {
+		slices.SortFunc(p.rows, func(a, b T) int { return tw.t.less(&a, &b) })
+	}
+	err := writeGroup(p.out, tw.t, p.rows)
+	clear(p.rows)
+	p.rows, p.pending = p.rows[:0], 0
+	if err != nil {
+		return fmt.Errorf("write %s: %w", p.out.tmp, err)
+	}
+	return nil
+}
+
+// close finishes the open file, moves it into place and records it in the
+// index and manifest.
+func (tw *tableWriter[T]) close() error {
+	p := tw.p
+	if p == nil {
+		return nil
+	}
+	err := tw.flush()
+	tw.p = nil
+	if err != nil {
+		p.out.abort()
+		return err
+	}
+	if err := p.out.close(); err != nil {
+		p.out.abort()
+		return fmt.Errorf("close %s: %w", p.out.tmp, err)
+	}
+	out := p.out
+	if tw.t.less != nil {
+		var err error
+		if out, err = tw.merge(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(out.tmp, p.path); err != nil {
+		return fmt.Errorf("rename %s: %w", out.tmp, err)
+	}
+	if out.index != nil {
+		if err := out.index.write(tw.w.root, p.info.Path); err != nil {
+			return err
+		}
+	}
+	p.info.Bytes = out.cw.n
+	w := tw.w
+	w.manifest.Files = append(w.manifest.Files, p.info)
+	w.logger.Debug("wrote parquet file", zap.String("path", p.path), zap.Int64("rows", p.info.Rows), zap.Int64("bytes", p.info.Bytes))
+	return w.manifest.save(w.root)
+}
+
+// merge rewrites the sorted runs of p into one sorted data file, holding
+// a batch of rows per run in memory.
+func (tw *tableWriter[T]) merge(p *part[T]) (*fileOut, error) {
+	runs := p.out.tmp
+	defer os.Remove(runs)
+	rdr, err := file.OpenParquetFile(runs, false)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", runs, err)
+	}
+	defer rdr.Close()
+	fr, err := pqarrow.NewFileReader(rdr, pqarrow.ArrowReadProperties{BatchSize: readBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, fmt.Errorf("arrow reader: %w", err)
+	}
+	var curs []*cursor[T]
+	defer func() {
+		for _, c := range curs {
+			c.rr.Release()
+		}
+	}()
+	for rg := 0; rg < rdr.NumRowGroups(); rg++ {
+		rr, err := fr.GetRecordReader(context.Background(), nil, []int{rg})
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", runs, err)
+		}
+		curs = append(curs, &cursor[T]{rr: rr, read: tw.t.read})
+	}
+
+	out, err := createFile(p.path+".tmp", tw.t.schema, tw.t.index)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		live := slices.Clone(curs)
+		for i := 0; i < len(live); {
+			if live[i].next() {
+				i++
+				continue
+			}
+			if err := live[i].err(); err != nil {
+				return err
+			}
+			live = slices.Delete(live, i, i+1)
+		}
+		var (
+			rows    []T
+			pending int64
+		)
+		for len(live) > 0 {
+			m := 0
+			for i := 1; i < len(live); i++ {
+				if tw.t.less(&live[i].row, &live[m].row) < 0 {
+					m = i
+				}
+			}
+			rows = append(rows, live[m].row)
+			pending += tw.t.size(&live[m].row)
+			if !live[m].next() {
+				if err := live[m].err(); err != nil {
+					return err
+				}
+				live = slices.Delete(live, m, m+1)
+			}
+			if pending >= tw.w.rowGroupBytes {
+				if err := writeGroup(out, tw.t, rows); err != nil {
+					return err
+				}
+				clear(rows)
+				rows, pending = rows[:0], 0
+			}
+		}
+		if len(rows) > 0 {
+			if err := writeGroup(out, tw.t, rows); err != nil {
+				return err
+			}
+		}
+		return out.close()
+	}()
+	if err != nil {
+		out.abort()
+		return nil, fmt.Errorf("merge %s: %w", runs, err)
+	}
+	return out, nil
+}
+
+// cursor steps through the rows of a record reader.
+type cursor[T any] struct {
+	rr   pqarrow.RecordReader
+	read func(arrow.Record, int) T
+	rec  arrow.Record
+	i    int
+	row  T
+}
+
+func (c *cursor[T]) next() bool {
+	for c.rec == nil || c.i >= int(c.rec.NumRows()) {
+		if !c.rr.Next() {
+			return false
+		}
+		c.rec, c.i = c.rr.Record(), 0
+	}
+	c.row = c.read(c.rec, c.i)
+	c.i++
+	return true
+}
+
+func (c *cursor[T]) err() error {
+	if err := c.rr.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// fileOut is a parquet file being written under a temporary name.
+type fileOut struct {
+	tmp   string
+	f     *os.File
+	cw    countingWriter
+	fw    *pqarrow.FileWriter
+	bld   *array.RecordBuilder
+	index *indexBuilder // nil when no column is indexed
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func createFile(path string, schema *arrow.Schema, index string) (*fileOut, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %w", path, err)
+	}
+	o := &fileOut{tmp: path, f: f}
+	o.cw.w = f
+	o.fw, err = pqarrow.NewFileWriter(schema, &o.cw, writerProps(schema),
+		pqarrow.NewArrowWriterProperties(pqarrow.WithCompliantNestedTypes(true)))
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("new arrow writer: %w", err)
+	}
+	o.bld = array.NewRecordBuilder(memory.NewGoAllocator(), schema)
+	if index != "" {
+		o.index = &indexBuilder{column: index}
+	}
+	return o, nil
+}
+
+// writeGroup writes rows out as one row group.
+func writeGroup[T any](o *fileOut, t *table[T], rows []T) error {
+	var hashes []uint64
+	if o.index != nil {
+		hashes = make([]uint64, len(rows))
+	}
+	for i := range rows {
+		t.add(o.bld, &rows[i])
+		if hashes != nil {
+			hashes[i] = keyHash(t.indexKey(&rows[i]))
+		}
+	}
+	rec := o.bld.NewRecord()
+	defer rec.Release()
+	if err := o.fw.Write(rec); err != nil {
+		return err
+	}
+	if o.index != nil {
+		o.index.addGroup(hashes)
+	}
+	return nil
+}
+
+func (o *fileOut) close() error {
+	o.bld.Release()
+	err := o.fw.Close()
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abort gives up on the file.
+func (o *fileOut) abort() {
+	_ = o.fw.Close()
+	_ = o.f.Close()
+	_ = os.Remove(o.tmp)
+}
@@ -0,0 +1,259 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	decisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ratelimit_requests_total",
+		Help: "Rate limiter decisions by method and result",
+	}, []string{"method", "result"})
+
+	tokensSpent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_ratelimit_tokens_total",
+		Help: "Quota tokens consumed by method",
+	}, []string{"method"})
+
+	activeClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rpcv2_hist_ratelimit_clients",
+		Help: "Number of clients with a live token bucket",
+	})
+)
+
+// DefaultCosts weights methods by how expensive they are for the backend.
+// Signature scans fan out to every shard; block time is a point lookup.
+var DefaultCosts = map[string]float64{
+	"getsignaturesforaddress": 10,
+	"getblockswithlimit":      5,
+	"getblock":                2,
+	"gettransaction":          1,
+	"getblocktime":            1,
+	"gethealth":               1,
+	// an export scans a range in the background; polling it is cheap
+	"submitexport":   50,
+	"getexport":      1,
+	"downloadexport": 1,
+}
+
+// Config controls the per-client token buckets.
+type Config struct {
+	Enabled           bool
+	RequestsPerSecond float64  // token refill rate per client
+	Burst             float64  // bucket capacity
+	APIKeyHeader      string   // header carrying the client API key
+	APIKeys           []string // keys with their own bucket; any other is limited by IP
+	MethodCosts       map[string]float64
+	IdleTTL           time.Duration // buckets idle this long are dropped
+}
+
+// maxClients bounds the buckets kept; clients past it share one bucket
+// until idle ones are swept.
+const maxClients = 100_000
+
+const overflowKey = "overflow"
+
+// Limiter is a token-bucket rate limiter keyed by API key or client IP.
+type Limiter struct {
+	mu        sync.Mutex
+	cfg       Config
+	keys      map[string]bool
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter. A disabled limiter allows every request.
+func New(cfg Config) *Limiter {
+	l := &Limiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+	l.cfg, l.keys = normalize(cfg), keySet(cfg.APIKeys)
+	l.lastSweep = l.now()
+	return l
+}
+
+// Update swaps in a new config. Existing buckets keep their tokens, clamped
+// to the new burst on their next refill.
+func (l *Limiter) Update(cfg Config) {
+	cfg = normalize(cfg)
+	keys := keySet(cfg.APIKeys)
+	l.mu.Lock()
+	l.cfg, l.keys = cfg, keys
+	l.mu.Unlock()
+}
+
+func keySet(keys []string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set
+}
+
+func normalize(cfg Config) Config {
+	if cfg.Burst <= 0 {
+		cfg.Burst = cfg.RequestsPerSecond
+	}
+	if cfg.APIKeyHeader == "" {
+		cfg.APIKeyHeader = "X-API-Key"
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = 10 * time.Minute
+	}
+	costs := make(map[string]float64, len(DefaultCosts)+len(cfg.MethodCosts))
+	for m, c := range DefaultCosts {
+		costs[m] = c
+	}
+	for m, c := range cfg.MethodCosts {
+		costs[strings.ToLower(m)] = c
+	}
+	cfg.MethodCosts = costs
+	return cfg
+}
+
+// Cost returns the quota weight of a method; unknown methods cost 1. A
+// weight above the burst is capped to it, or the method could never run.
+func (l *Limiter) Cost(method string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cost(method)
+}
+
+func (l *Limiter) cost(method string) float64 {
+	if c, ok := l.cfg.MethodCosts[strings.ToLower(method)]; ok {
+		return min(c, l.cfg.Burst)
+	}
+	return min(1, l.cfg.Burst)
+}
+
+// label keeps client-chosen method names out of the metric labels.
+func (l *Limiter) label(method string) string {
+	name := strings.ToLower(method)
+	if _, ok := l.cfg.MethodCosts[name]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Allow consumes the method's cost from the client's bucket and reports
+// whether the request may proceed.
+func (l *Limiter) Allow(key, method string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.cfg.Enabled || l.cfg.RequestsPerSecond <= 0 {
+		return true
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxClients {
+		key = overflowKey
+		b, ok = l.buckets[key]
+	}
+	if !ok {
+		b = &bucket{tokens: l.cfg.Burst, last: now}
+		l.buckets[key] = b
+		activeClients.Set(float64(len(l.buckets)))
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.cfg.RequestsPerSecond
+	if b.tokens > l.cfg.Burst {
+		b.tokens = l.cfg.Burst
+	}
+	b.last = now
+
+	name := l.label(method)
+	cost := l.cost(method)
+	if b.tokens < cost {
+		decisions.WithLabelValues(name, "limited").Inc()
+		return false
+	}
+	b.tokens -= cost
+	decisions.WithLabelValues(name, "allowed").Inc()
+	tokensSpent.WithLabelValues(name).Add(cost)
+	return true
+}
+
+// RetryAfter estimates how long a client must wait before a request of the
+// given method fits in its bucket again.
+func (l *Limiter) RetryAfter(method string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.RequestsPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(l.cost(method) / l.cfg.RequestsPerSecond * float64(time.Second))
+}
+
+// Key identifies the caller: its API key if it is a configured one, else
+// the remote IP.
+func (l *Limiter) Key(r *http.Request) string {
+	l.mu.Lock()
+	hdr, keys := l.cfg.APIKeyHeader, l.keys
+	l.mu.Unlock()
+	if k := r.Header.Get(hdr); keys[k] {
+		return "key:" + k
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware rejects requests over quota with 429, charging the cost of the
+// named method.
+func (l *Limiter) Middleware(method string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(l.Key(r), method) {
+			WriteTooManyRequests(w, l.RetryAfter(method))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WriteTooManyRequests sets Retry-After and writes a bare 429.
+func WriteTooManyRequests(w http.ResponseWriter, retry time.Duration) {
+	SetRetryAfter(w, retry)
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// SetRetryAfter sets the Retry-After header, rounded up to whole seconds.
+func SetRetryAfter(w http.ResponseWriter, retry time.Duration) {
+	secs := int(retry.Seconds() + 0.999)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// sweep drops idle buckets; a fully refilled idle bucket is equivalent to none.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.IdleTTL {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= l.cfg.IdleTTL {
+			delete(l.buckets, k)
+		}
+	}
+	activeClients.Set(float64(len(l.buckets)))
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowWeightsMethods(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(Config{Enabled: true, RequestsPerSecond: 10, Burst: 20})
+	l.now = func() time.Time { return now }
+
+	// a signature scan costs 10, so two drain a burst of 20
+	require.True(t, l.Allow("k", "getSignaturesForAddress"))
+	require.True(t, l.Allow("k", "getSignaturesForAddress"))
+	require.False(t, l.Allow("k", "getBlockTime"))
+	// other clients have their own bucket
+	require.True(t, l.Allow("other", "getBlockTime"))
+
+	now = now.Add(100 * time.Millisecond)
+	require.True(t, l.Allow("k", "getBlockTime"))
+	require.False(t, l.Allow("k", "getBlock"))
+}
+
+func TestDisabledAllowsAll(t *testing.T) {
+	l := New(Config{RequestsPerSecond: 1, Burst: 1})
+	for i := 0; i < 100; i++ {
+		require.True(t, l.Allow("k", "getSignaturesForAddress"))
+	}
+}
+
+func TestKeyPrefersAPIKey(t *testing.T) {
+	l := New(Config{APIKeys: []string{"abc"}})
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4242"
+	require.Equal(t, "ip:10.0.0.1", l.Key(r))
+	r.Header.Set("X-API-Key", "abc")
+	require.Equal(t, "key:abc", l.Key(r))
+	r.Header.Set("X-API-Key", "made-up")
+	require.Equal(t, "ip:10.0.0.1", l.Key(r))
+}
+
+func TestRotatingKeysShareIPBucket(t *testing.T) {
+	l := New(Config{Enabled: true, RequestsPerSecond: 1, Burst: 3})
+	l.now = func() time.Time { return time.Unix(0, 0) }
+	var allowed int
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = "10.0.0.1:4242"
+		r.Header.Set("X-API-Key", fmt.Sprint("random-", i))
+		if l.Allow(l.Key(r), "getBlockTime") {
+			allowed++
+		}
+	}
+	require.Equal(t, 3, allowed)
+	require.Len(t, l.buckets, 1)
+}
+
+func TestClientsPastCapShareBucket(t *testing.T) {
+	l := New(Config{Enabled: true, RequestsPerSecond: 1, Burst: 1})
+	l.now = func() time.Time { return time.Unix(0, 0) }
+	for i := 0; i < maxClients; i++ {
+		l.buckets[fmt.Sprint("ip:", i)] = &bucket{last: l.now()}
+	}
+	require.True(t, l.Allow("ip:new", "getBlockTime"))
+	require.False(t, l.Allow("ip:other", "getBlockTime"))
+	require.Len(t, l.buckets, maxClients+1)
+}
+
+func TestCostCappedToBurst(t *testing.T) {
+	l := New(Config{Enabled: true, RequestsPerSecond: 1, Burst: 20})
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	require.Equal(t, 20.0, l.Cost("submitExport"))
+	require.True(t, l.Allow("k", "submitExport"))
+	require.False(t, l.Allow("k", "getBlockTime"))
+
+	require.True(t, l.Allow("k2", "noSuchMethod"))
+	require.Equal(t, 1.0, testutil.ToFloat64(decisions.WithLabelValues("unknown", "allowed")))
+}
@@ -0,0 +1,180 @@
+package reload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+)
+
+// Applier turns a validated config into running state. Prepare does all work
+// that can fail (opening backends, parsing levels) without touching live
+// state; the returned commit swaps everything in and must not fail.
+type Applier interface {
+	Prepare(old, next *config.Config) (commit func(), err error)
+}
+
+// Result describes the outcome of one reload attempt.
+type Result struct {
+	Time         time.Time `json:"time"`
+	Trigger      string    `json:"trigger"`
+	OK           bool      `json:"ok"`
+	Error        string    `json:"error,omitempty"`
+	Applied      []string  `json:"applied,omitempty"`
+	NeedsRestart []string  `json:"needsRestart,omitempty"`
+}
+
+// Reloader re-reads the config on SIGHUP, on config file changes and on
+// admin requests, and applies the reloadable subset.
+type Reloader struct {
+	load     func() (*config.Config, error)
+	apply    Applier
+	path     string
+	log      *zap.Logger
+	debounce time.Duration
+
+	mu      sync.Mutex // serialises reloads
+	current *config.Config
+	last    Result
+}
+
+type Option func(*Reloader)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(r *Reloader) { r.log = l }
+}
+
+// WithWatchFile reloads when the file at path changes; "" disables watching.
+func WithWatchFile(path string) Option {
+	return func(r *Reloader) { r.path = path }
+}
+
+func New(current *config.Config, load func() (*config.Config, error), apply Applier, opts ...Option) *Reloader {
+	r := &Reloader{
+		load:     load,
+		apply:    apply,
+		log:      zap.NewNop(),
+		debounce: 500 * time.Millisecond,
+		current:  current,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+// Reload loads, validates and applies the config. On any error the running
+// state is left untouched.
+func (r *Reloader) Reload(trigger string) Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := Result{Time: time.Now(), Trigger: trigger}
+	next, err := r.load()
+	if err == nil {
+		var commit func()
+		res.Applied, res.NeedsRestart = config.Diff(r.current, next)
+		if commit, err = r.apply.Prepare(r.current, next); err == nil {
+			commit()
+			r.current = next
+			res.OK = true
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.Applied = nil
+		r.log.Error("config reload failed", zap.String("trigger", trigger), zap.Error(err))
+	} else {
+		r.log.Info("config reloaded",
+			zap.String("trigger", trigger),
+			zap.Strings("applied", res.Applied),
+			zap.Strings("needsRestart", res.NeedsRestart),
+		)
+	}
+	r.last = res
+	return res
+}
+
+// Last returns the result of the most recent reload.
+func (r *Reloader) Last() Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Run reloads on SIGHUP and file changes until ctx is done.
+func (r *Reloader) Run(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	if r.path != "" {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("new watcher: %w", err)
+		}
+		defer w.Close()
+		// watch the directory: editors and Kubernetes ConfigMaps replace the
+		// file (or a symlink to it) rather than writing in place.
+		if err := w.Add(filepath.Dir(r.path)); err != nil {
+			return fmt.Errorf("watch %s: %w", r.path, err)
+		}
+		events = w.Events
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			r.Reload("sighup")
+		case ev := <-events:
+			if r.touches(ev) {
+				pending = time.After(r.debounce)
+			}
+		case <-pending:
+			pending = nil
+			r.Reload("file")
+		}
+	}
+}
+
+func (r *Reloader) touches(ev fsnotify.Event) bool {
+	if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+		return false
+	}
+	name := filepath.Base(ev.Name)
+	return name == filepath.Base(r.path) || name == "..data"
+}
+
+// ServeHTTP reports the last reload on GET and triggers one on POST.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var res Result
+	switch req.Method {
+	case http.MethodGet:
+		res = r.Last()
+	case http.MethodPost:
+		res = r.Reload("admin")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.OK && !res.Time.IsZero() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,173 @@
+package reload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/config"
+)
+
+type applier struct {
+	mu      sync.Mutex
+	err     error
+	applied []string // log levels committed
+}
+
+func (a *applier) Prepare(old, next *config.Config) (func(), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return nil, a.err
+	}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.applied = append(a.applied, next.LogLevel)
+	}, nil
+}
+
+func (a *applier) commits() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.applied)
+}
+
+// source serves whatever config it was last given.
+type source struct {
+	mu  sync.Mutex
+	cfg config.Config
+}
+
+func (s *source) set(cfg config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+func (s *source) load() (*config.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg := s.cfg
+	return &cfg, nil
+}
+
+func TestReload(t *testing.T) {
+	src := &source{cfg: config.Config{LogLevel: "info"}}
+	app := &applier{}
+	r := New(&config.Config{LogLevel: "info"}, src.load, app)
+
+	src.set(config.Config{LogLevel: "debug", GRPCListen: ":9999"})
+	res := r.Reload("test")
+	require.True(t, res.OK, res.Error)
+	require.Equal(t, []string{"LogLevel"}, res.Applied)
+	require.Equal(t, []string{"GRPCListen"}, res.NeedsRestart)
+	require.Equal(t, []string{"debug"}, app.applied)
+
+	// a failed prepare leaves the running config in place
+	app.err = errors.New("backend unreachable")
+	src.set(config.Config{LogLevel: "warn", GRPCListen: ":9999"})
+	res = r.Reload("test")
+	require.False(t, res.OK)
+	require.Equal(t, "backend unreachable", res.Error)
+	require.Empty(t, res.Applied)
+	require.Equal(t, res, r.Last())
+
+	app.err = nil
+	res = r.Reload("test")
+	require.True(t, res.OK, res.Error)
+	require.Equal(t, []string{"LogLevel"}, res.Applied, "diffed against the last applied config")
+	require.Equal(t, []string{"debug", "warn"}, app.applied)
+}
+
+func TestServeHTTP(t *testing.T) {
+	src := &source{cfg: config.Config{LogLevel: "debug"}}
+	app := &applier{}
+	r := New(&config.Config{LogLevel: "info"}, src.load, app)
+
+	do := func(method string) (int, Result) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, "/admin/reload", nil))
+		var res Result
+		if rec.Code != http.StatusMethodNotAllowed {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+
+	code, res := do(http.MethodGet)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, res.Time.IsZero(), "no reload yet")
+
+	code, res = do(http.MethodPost)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "admin", res.Trigger)
+	require.True(t, res.OK)
+
+	app.err = errors.New("bad level")
+	code, res = do(http.MethodPost)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.Equal(t, "bad level", res.Error)
+	code, _ = do(http.MethodGet)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = do(http.MethodPut)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+// TestRunWatchesConfigMap swaps the config the way the kubelet updates a
+// mounted ConfigMap: the file is a symlink through ..data, which is
+// replaced by renaming a new symlink over it.
+func TestRunWatchesConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion := func(name string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "config.yaml"), []byte(name), 0o644))
+	}
+	writeVersion("v1")
+	require.NoError(t, os.Symlink("v1", filepath.Join(dir, "..data")))
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), path))
+
+	app := &applier{}
+	load := func() (*config.Config, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &config.Config{LogLevel: string(b)}, nil
+	}
+	r := New(&config.Config{LogLevel: "v1"}, load, app, WithWatchFile(path))
+	r.debounce = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	time.Sleep(100 * time.Millisecond) // let the watch start
+
+	// unrelated files in the directory are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other"), nil, 0o644))
+
+	writeVersion("v2")
+	require.NoError(t, os.Symlink("v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+	require.Eventually(t, func() bool { return app.commits() > 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 1, app.commits(), "events within the debounce reload once")
+	res := r.Last()
+	require.Equal(t, "file", res.Trigger)
+	require.True(t, res.OK, res.Error)
+	require.Equal(t, []string{"LogLevel"}, res.Applied)
+
+	cancel()
+	require.NoError(t, <-done)
+}
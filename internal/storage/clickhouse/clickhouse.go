@@ -74,11 +74,16 @@ func (d *DB) Close() error {
 	return d.conn.Close()
 }
 
+// Reads at a commitment level include rows that have since been promoted
+// to a higher one, as a node's would. Tables are ReplacingMergeTree, so a
+// row written twice may exist twice until merged; reads take the newest.
 func (d *DB) GetBlock(ctx context.Context, slot uint64, commitment storage.Commitment) (*model.Block, error) {
 	row := d.conn.QueryRow(ctx, `
 		SELECT slot, blockhash, parent_slot, block_time, height, raw
 		FROM blocks
-		WHERE slot = ? AND commitment = ?
+		WHERE slot = ? AND commitment >= ?
+		ORDER BY commitment DESC, version DESC
+		LIMIT 1
 	`, slot, string(commitment))
 	var b model.Block
 	if err := row.Scan(&b.Slot, &b.Blockhash, &b.ParentSlot, &b.BlockTime, &b.Height, &b.Raw); err != nil {
@@ -89,9 +94,9 @@ func (d *DB) GetBlock(ctx context.Context, slot uint64, commitment storage.Commi
 
 func (d *DB) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commitment storage.Commitment) ([]uint64, error) {
 	rows, err := d.conn.Query(ctx, `
-		SELECT slot
+		SELECT DISTINCT slot
 		FROM blocks
-		WHERE slot >= ? AND commitment = ?
+		WHERE slot >= ? AND commitment >= ?
 		ORDER BY slot
 		LIMIT ?
 	`, start, string(commitment), limit)
@@ -111,7 +116,7 @@ func (d *DB) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commit
 }
 
 func (d *DB) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) {
-	row := d.conn.QueryRow(ctx, `SELECT block_time FROM blocks WHERE slot = ?`, slot)
+	row := d.conn.QueryRow(ctx, `SELECT block_time FROM blocks WHERE slot = ? ORDER BY version DESC LIMIT 1`, slot)
 	var t int64
 	if err := row.Scan(&t); err != nil {
 		return nil, err
@@ -124,7 +129,9 @@ func (d *DB) GetTransaction(ctx context.Context, signature string, commitment st
 	row := d.conn.QueryRow(ctx, `
 		SELECT signature, slot, tx_idx, block_time, signer, fee, compute_units, err, raw
 		FROM transactions
-		WHERE signature = ? AND commitment = ?
+		WHERE signature = ? AND commitment >= ?
+		ORDER BY commitment DESC, version DESC
+		LIMIT 1
 	`, signature, string(commitment))
 	var tx model.Transaction
 	if err := row.Scan(&tx.Signature, &tx.Slot, &tx.Index, &tx.BlockTime, &tx.Signer, &tx.Fee, &tx.ComputeUnits, &tx.Err, &tx.Raw); err != nil {
@@ -137,7 +144,7 @@ func (d *DB) GetSignaturesForAddress(ctx context.Context, addr string, opts stor
 	q := `
 		SELECT signature, slot, err, memo, block_time
 		FROM signatures
-		WHERE address = ? AND commitment = ?
+		WHERE address = ? AND commitment >= ?
 	`
 	args := []interface{}{addr, string(opts.Commitment)}
 	if opts.Before != nil {
@@ -148,7 +155,9 @@ func (d *DB) GetSignaturesForAddress(ctx context.Context, addr string, opts stor
 		q += ` AND slot > (SELECT slot FROM signatures WHERE signature = ? LIMIT 1)`
 		args = append(args, *opts.Until)
 	}
-	q += ` ORDER BY slot DESC LIMIT ?`
+	// replayed rows are only merged away eventually, and a slot being
+	// promoted briefly has rows at two levels
+	q += ` ORDER BY slot DESC, commitment DESC, version DESC LIMIT 1 BY signature LIMIT ?`
 	args = append(args, opts.Limit)
 
 	rows, err := d.conn.Query(ctx, q, args...)
@@ -167,4 +176,109 @@ func (d *DB) GetSignaturesForAddress(ctx context.Context, addr string, opts stor
 		out = append(out, si)
 	}
 	return out, rows.Err()
-}
\ No newline at end of file
+}
+
+// WriteBatch inserts the blocks, transactions and address index rows of b,
+// in that order, each as one native batch. Writing the same rows again is
+// harmless: the server assigns a newer version and merges keep only it.
+func (d *DB) WriteBatch(ctx context.Context, b storage.Batch) error {
+	c := string(b.Commitment)
+	if len(b.Blocks) > 0 {
+		batch, err := d.conn.PrepareBatch(ctx, `INSERT INTO blocks (slot, blockhash, parent_slot, block_time, height, commitment, raw)`)
+		if err != nil {
+			return fmt.Errorf("prepare blocks: %w", err)
+		}
+		for _, blk := range b.Blocks {
+			if err := batch.Append(blk.Slot, blk.Blockhash, blk.ParentSlot, blk.BlockTime, blk.Height, c, string(blk.Raw)); err != nil {
+				return fmt.Errorf("append block %d: %w", blk.Slot, err)
+			}
+		}
+		if err := batch.Send(); err != nil {
+			return fmt.Errorf("send blocks: %w", err)
+		}
+	}
+	if len(b.Transactions) > 0 {
+		batch, err := d.conn.PrepareBatch(ctx, `INSERT INTO transactions (signature, slot, tx_idx, block_time, signer, fee, compute_units, err, commitment, raw)`)
+		if err != nil {
+			return fmt.Errorf("prepare transactions: %w", err)
+		}
+		for _, tx := range b.Transactions {
+			if err := batch.Append(tx.Signature, tx.Slot, tx.Index, tx.BlockTime, tx.Signer, tx.Fee, tx.ComputeUnits, tx.Err, c, string(tx.Raw)); err != nil {
+				return fmt.Errorf("append tx %s: %w", tx.Signature, err)
+			}
+		}
+		if err := batch.Send(); err != nil {
+			return fmt.Errorf("send transactions: %w", err)
+		}
+	}
+	if len(b.Signatures) > 0 {
+		batch, err := d.conn.PrepareBatch(ctx, `INSERT INTO signatures (address, signature, slot, block_time, err, memo, commitment)`)
+		if err != nil {
+			return fmt.Errorf("prepare signatures: %w", err)
+		}
+		for _, r := range b.Signatures {
+			if err := batch.Append(r.Address, r.Signature, r.Slot, r.BlockTime, r.Err, r.Memo, c); err != nil {
+				return fmt.Errorf("append signature %s: %w", r.Signature, err)
+			}
+		}
+		if err := batch.Send(); err != nil {
+			return fmt.Errorf("send signatures: %w", err)
+		}
+	}
+	return nil
+}
+
+// rowTables are the tables holding per-slot ingested rows, with the columns
+// copied on promotion.
+var rowTables = []struct{ name, cols string }{
+	{"blocks", "slot, blockhash, parent_slot, block_time, height, raw"},
+	{"transactions", "signature, slot, tx_idx, block_time, signer, fee, compute_units, err, raw"},
+	{"signatures", "address, signature, slot, block_time, err, memo"},
+}
+
+// Promote copies the rows of slots to level to and then deletes them at
+// from. commitment is part of every sorting key, so rows cannot be updated
+// in place; readers dedupe while both copies exist.
+func (d *DB) Promote(ctx context.Context, slots []uint64, from, to storage.Commitment) error {
+	if len(slots) == 0 {
+		return nil
+	}
+	lo, hi := slotBounds(slots)
+	for _, t := range rowTables {
+		q := fmt.Sprintf(`INSERT INTO %s (%s, commitment) SELECT %s, ? FROM %s WHERE commitment = ? AND slot BETWEEN ? AND ? AND has(?, slot)`,
+			t.name, t.cols, t.cols, t.name)
+		if err := d.conn.Exec(ctx, q, string(to), string(from), lo, hi, slots); err != nil {
+			return fmt.Errorf("promote %s: %w", t.name, err)
+		}
+	}
+	return d.deleteSlots(ctx, slots, from)
+}
+
+// Rollback deletes the rows of slots at level c.
+func (d *DB) Rollback(ctx context.Context, slots []uint64, c storage.Commitment) error {
+	if len(slots) == 0 {
+		return nil
+	}
+	return d.deleteSlots(ctx, slots, c)
+}
+
+// deleteSlots uses lightweight deletes (ClickHouse 23.3+), which hide rows
+// immediately and purge them on merge.
+func (d *DB) deleteSlots(ctx context.Context, slots []uint64, c storage.Commitment) error {
+	lo, hi := slotBounds(slots)
+	for _, t := range rowTables {
+		q := fmt.Sprintf(`DELETE FROM %s WHERE commitment = ? AND slot BETWEEN ? AND ? AND has(?, slot)`, t.name)
+		if err := d.conn.Exec(ctx, q, string(c), lo, hi, slots); err != nil {
+			return fmt.Errorf("delete %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+func slotBounds(slots []uint64) (lo, hi uint64) {
+	lo, hi = slots[0], slots[0]
+	for _, s := range slots[1:] {
+		lo, hi = min(lo, s), max(hi, s)
+	}
+	return lo, hi
+}
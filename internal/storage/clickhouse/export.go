@@ -0,0 +1,63 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// exportAddressChunkSlots is the chunk of an export by address: only the
+// address's rows of the signatures table, ordered by address and slot,
+// are read, so a chunk can be as wide as a partition.
+const exportAddressChunkSlots = partitionSlots
+
+// ExportTransactions reads the range a chunk of slots at a time, after
+// narrowing it to the finalized blocks it holds, which also turns a time
+// range into slots.
+func (d *DB) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	fromSlot, toSlot := q.Slots()
+	fromTime, toTime := q.Times()
+	var (
+		n      uint64
+		lo, hi uint64
+	)
+	err := d.conn.QueryRow(ctx, `
+		SELECT count(), min(slot), max(slot)
+		FROM blocks
+		WHERE commitment = 'finalized' AND slot BETWEEN ? AND ? AND block_time BETWEEN ? AND ?
+	`, fromSlot, toSlot, fromTime, toTime).Scan(&n, &lo, &hi)
+	if err != nil {
+		return fmt.Errorf("export range: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	step := uint64(exportChunkSlots)
+	if q.Address != "" {
+		step = exportAddressChunkSlots
+	}
+	for from := lo; from <= hi; from += step {
+		to := min(from+step-1, hi)
+		query := `
+			SELECT signature, slot, tx_idx, block_time, signer, fee, compute_units, err, raw
+			FROM transactions FINAL
+			WHERE commitment = 'finalized' AND slot BETWEEN ? AND ? AND block_time BETWEEN ? AND ?`
+		args := []any{from, to, fromTime, toTime}
+		if q.Address != "" {
+			query += `
+				AND signature IN (
+					SELECT signature FROM signatures
+					WHERE commitment = 'finalized' AND address = ? AND slot BETWEEN ? AND ?
+				)`
+			args = append(args, q.Address, from, to)
+		}
+		query += `
+			ORDER BY slot, tx_idx`
+		if err := exportRows(ctx, d, query, args, scanTransaction, fn); err != nil {
+			return fmt.Errorf("export transactions: %w", err)
+		}
+	}
+	return nil
+}
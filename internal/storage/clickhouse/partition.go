@@ -0,0 +1,156 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// partitionSlots is the slot width of a partition, as in the
+// PARTITION BY intDiv(slot, 864000) of scripts/schema.sql.
+const partitionSlots = 864_000
+
+const (
+	// exportChunkSlots bounds the rows one export query sorts
+	exportChunkSlots = 1_000
+	exportBatchRows  = 10_000
+)
+
+// Partitions lists the partitions holding finalized blocks, oldest first,
+// with a count of the blocks in them not yet finalized.
+func (d *DB) Partitions(ctx context.Context) ([]storage.Partition, error) {
+	rows, err := d.conn.Query(ctx, `
+		SELECT intDiv(slot, ?) AS p,
+			minIf(slot, commitment = 'finalized'),
+			maxIf(slot, commitment = 'finalized'),
+			maxIf(block_time, commitment = 'finalized'),
+			uniqExactIf(slot, commitment = 'finalized') AS finalized,
+			uniqExactIf(slot, commitment != 'finalized')
+		FROM blocks
+		GROUP BY p
+		HAVING finalized > 0
+		ORDER BY p
+	`, partitionSlots)
+	if err != nil {
+		return nil, fmt.Errorf("query partitions: %w", err)
+	}
+	defer rows.Close()
+	var out []storage.Partition
+	for rows.Next() {
+		var p storage.Partition
+		if err := rows.Scan(&p.ID, &p.MinSlot, &p.MaxSlot, &p.MaxBlockTime, &p.Blocks, &p.Unfinalized); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// ExportPartition reads the partition a chunk of slots at a time. FINAL
+// merges rows written more than once, so every row is read once.
+func (d *DB) ExportPartition(ctx context.Context, p storage.Partition, fn func(storage.Batch) error) error {
+	for from := p.MinSlot; from <= p.MaxSlot; from += exportChunkSlots {
+		to := min(from+exportChunkSlots-1, p.MaxSlot)
+		err := exportRows(ctx, d, `
+			SELECT slot, blockhash, parent_slot, block_time, height, raw
+			FROM blocks FINAL
+			WHERE commitment = 'finalized' AND slot BETWEEN ? AND ?
+			ORDER BY slot
+		`, []any{from, to}, func(rows driver.Rows, b *model.Block) error {
+			return rows.Scan(&b.Slot, &b.Blockhash, &b.ParentSlot, &b.BlockTime, &b.Height, &b.Raw)
+		}, func(blocks []model.Block) error {
+			return fn(storage.Batch{Commitment: storage.CommitmentFinalized, Blocks: blocks})
+		})
+		if err != nil {
+			return fmt.Errorf("export blocks: %w", err)
+		}
+		err = exportRows(ctx, d, `
+			SELECT signature, slot, tx_idx, block_time, signer, fee, compute_units, err, raw
+			FROM transactions FINAL
+			WHERE commitment = 'finalized' AND slot BETWEEN ? AND ?
+			ORDER BY slot, tx_idx
+		`, []any{from, to}, scanTransaction, func(txs []model.Transaction) error {
+			return fn(storage.Batch{Commitment: storage.CommitmentFinalized, Transactions: txs})
+		})
+		if err != nil {
+			return fmt.Errorf("export transactions: %w", err)
+		}
+		err = exportRows(ctx, d, `
+			SELECT address, signature, slot, block_time, err, memo
+			FROM signatures FINAL
+			WHERE commitment = 'finalized' AND slot BETWEEN ? AND ?
+			ORDER BY slot
+		`, []any{from, to}, func(rows driver.Rows, r *model.SignatureRow) error {
+			return rows.Scan(&r.Address, &r.Signature, &r.Slot, &r.BlockTime, &r.Err, &r.Memo)
+		}, func(sigs []model.SignatureRow) error {
+			return fn(storage.Batch{Commitment: storage.CommitmentFinalized, Signatures: sigs})
+		})
+		if err != nil {
+			return fmt.Errorf("export signatures: %w", err)
+		}
+	}
+	return nil
+}
+
+func scanTransaction(rows driver.Rows, tx *model.Transaction) error {
+	return rows.Scan(&tx.Signature, &tx.Slot, &tx.Index, &tx.BlockTime, &tx.Signer, &tx.Fee, &tx.ComputeUnits, &tx.Err, &tx.Raw)
+}
+
+func exportRows[T any](ctx context.Context, d *DB, q string, args []any, scan func(driver.Rows, *T) error, emit func([]T) error) error {
+	rows, err := d.conn.Query(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	batch := make([]T, 0, exportBatchRows)
+	for rows.Next() {
+		var v T
+		if err := scan(rows, &v); err != nil {
+			return err
+		}
+		if batch = append(batch, v); len(batch) == exportBatchRows {
+			if err := emit(batch); err != nil {
+				return err
+			}
+			batch = make([]T, 0, exportBatchRows)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return emit(batch)
+	}
+	return nil
+}
+
+// DropPartition drops p from every row table, refusing while any of them
+// holds rows of p below finalized. The check runs just before the drops, but
+// a write landing between the two is still lost: backfills must not target
+// slots older than the tiering cutoff while the tier job runs. Partitions
+// larger than the server's max_partition_size_to_drop (50 GB by default)
+// cannot be dropped until it is raised.
+func (d *DB) DropPartition(ctx context.Context, p storage.Partition) error {
+	lo := p.ID * partitionSlots
+	hi := lo + partitionSlots - 1
+	for _, t := range rowTables {
+		var n uint64
+		row := d.conn.QueryRow(ctx, fmt.Sprintf(`SELECT count() FROM %s WHERE commitment != 'finalized' AND slot BETWEEN ? AND ?`, t.name), lo, hi)
+		if err := row.Scan(&n); err != nil {
+			return fmt.Errorf("count unfinalized %s: %w", t.name, err)
+		}
+		if n > 0 {
+			return fmt.Errorf("partition %d of %s holds %d rows not yet finalized", p.ID, t.name, n)
+		}
+	}
+	for _, t := range rowTables {
+		if err := d.conn.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s DROP PARTITION %d`, t.name, p.ID)); err != nil {
+			return fmt.Errorf("drop partition %d of %s: %w", p.ID, t.name, err)
+		}
+	}
+	return nil
+}
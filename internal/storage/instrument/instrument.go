@@ -0,0 +1,299 @@
+package instrument
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpcv2_hist_backend_query_duration_seconds",
+		Help:    "Duration of storage backend queries in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16), // 0.5 ms .. 16 s
+	}, []string{"backend", "method", "status"})
+
+	queryRows = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpcv2_hist_backend_query_rows",
+		Help:    "Rows returned by storage backend queries",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10), // 1 .. 262144
+	}, []string{"backend", "method"})
+
+	slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcv2_hist_backend_slow_queries_total",
+		Help: "Storage backend queries exceeding the slow-query threshold",
+	}, []string{"backend", "method"})
+)
+
+// Store decorates a HistoricalStore with a child span, latency and row-count
+// metrics, and a slow-query log entry per call. It forwards every optional
+// interface; use storage.As to find out which the wrapped store has.
+type Store struct {
+	next    storage.HistoricalStore
+	backend string
+	log     *zap.Logger
+	tracer  trace.Tracer
+	slow    time.Duration
+}
+
+type Option func(*Store)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Store) { s.log = l }
+}
+
+// WithSlowThreshold logs queries that take at least d; zero disables the log.
+func WithSlowThreshold(d time.Duration) Option {
+	return func(s *Store) { s.slow = d }
+}
+
+func New(next storage.HistoricalStore, backend string, opts ...Option) *Store {
+	s := &Store{
+		next:    next,
+		backend: backend,
+		log:     zap.NewNop(),
+		tracer:  otel.Tracer("storage"),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Unwrap returns the wrapped store.
+func (s *Store) Unwrap() storage.HistoricalStore {
+	return s.next
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return s.next.Ping(ctx)
+}
+
+func (s *Store) Close() error {
+	return s.next.Close()
+}
+
+func (s *Store) GetBlock(ctx context.Context, slot uint64, commitment storage.Commitment) (*model.Block, error) {
+	ctx, q := s.start(ctx, "getBlock",
+		attribute.Int64("solana.slot", int64(slot)),
+		attribute.String("solana.commitment", string(commitment)),
+	)
+	blk, err := s.next.GetBlock(ctx, slot, commitment)
+	q.end(err, rowsOf(blk != nil))
+	return blk, err
+}
+
+func (s *Store) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commitment storage.Commitment) ([]uint64, error) {
+	ctx, q := s.start(ctx, "getBlocksWithLimit",
+		attribute.Int64("solana.slot", int64(start)),
+		attribute.Int64("solana.limit", int64(limit)),
+		attribute.String("solana.commitment", string(commitment)),
+	)
+	slots, err := s.next.GetBlocksWithLimit(ctx, start, limit, commitment)
+	q.end(err, len(slots))
+	return slots, err
+}
+
+func (s *Store) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) {
+	ctx, q := s.start(ctx, "getBlockTime",
+		attribute.Int64("solana.slot", int64(slot)),
+	)
+	t, err := s.next.GetBlockTime(ctx, slot)
+	q.end(err, rowsOf(t != nil))
+	return t, err
+}
+
+func (s *Store) GetTransaction(ctx context.Context, signature string, commitment storage.Commitment) (*model.Transaction, error) {
+	ctx, q := s.start(ctx, "getTransaction",
+		attribute.String("solana.signature", signature),
+		attribute.String("solana.commitment", string(commitment)),
+	)
+	tx, err := s.next.GetTransaction(ctx, signature, commitment)
+	q.end(err, rowsOf(tx != nil))
+	return tx, err
+}
+
+func (s *Store) GetSignaturesForAddress(ctx context.Context, addr string, opts storage.SignatureOpts) ([]model.SignatureInfo, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("solana.address", addr),
+		attribute.Int64("solana.limit", int64(opts.Limit)),
+		attribute.String("solana.commitment", string(opts.Commitment)),
+	}
+	if opts.Before != nil {
+		attrs = append(attrs, attribute.String("solana.before", *opts.Before))
+	}
+	if opts.Until != nil {
+		attrs = append(attrs, attribute.String("solana.until", *opts.Until))
+	}
+	ctx, q := s.start(ctx, "getSignaturesForAddress", attrs...)
+	sigs, err := s.next.GetSignaturesForAddress(ctx, addr, opts)
+	q.end(err, len(sigs))
+	return sigs, err
+}
+
+// WriteBatch forwards to the wrapped store when it accepts writes.
+func (s *Store) WriteBatch(ctx context.Context, b storage.Batch) error {
+	w, ok := s.next.(storage.Writer)
+	if !ok {
+		return fmt.Errorf("%s backend does not accept writes", s.backend)
+	}
+	ctx, q := s.start(ctx, "writeBatch",
+		attribute.Int("solana.blocks", len(b.Blocks)),
+		attribute.String("solana.commitment", string(b.Commitment)),
+	)
+	err := w.WriteBatch(ctx, b)
+	q.end(err, len(b.Blocks)+len(b.Transactions)+len(b.Signatures))
+	return err
+}
+
+// Promote forwards to the wrapped store when it supports promotion.
+func (s *Store) Promote(ctx context.Context, slots []uint64, from, to storage.Commitment) error {
+	p, ok := s.next.(storage.Promoter)
+	if !ok {
+		return fmt.Errorf("%s backend does not support commitment promotion", s.backend)
+	}
+	ctx, q := s.start(ctx, "promote",
+		attribute.Int("solana.slots", len(slots)),
+		attribute.String("solana.commitment", string(to)),
+	)
+	err := p.Promote(ctx, slots, from, to)
+	q.end(err, len(slots))
+	return err
+}
+
+// Rollback forwards to the wrapped store when it supports promotion.
+func (s *Store) Rollback(ctx context.Context, slots []uint64, c storage.Commitment) error {
+	p, ok := s.next.(storage.Promoter)
+	if !ok {
+		return fmt.Errorf("%s backend does not support commitment promotion", s.backend)
+	}
+	ctx, q := s.start(ctx, "rollback",
+		attribute.Int("solana.slots", len(slots)),
+		attribute.String("solana.commitment", string(c)),
+	)
+	err := p.Rollback(ctx, slots, c)
+	q.end(err, len(slots))
+	return err
+}
+
+// Partitions forwards to the wrapped store when it has partitions.
+func (s *Store) Partitions(ctx context.Context) ([]storage.Partition, error) {
+	p, ok := s.next.(storage.Partitioner)
+	if !ok {
+		return nil, fmt.Errorf("%s backend has no partitions", s.backend)
+	}
+	ctx, q := s.start(ctx, "partitions")
+	parts, err := p.Partitions(ctx)
+	q.end(err, len(parts))
+	return parts, err
+}
+
+// ExportPartition forwards to the wrapped store when it has partitions.
+func (s *Store) ExportPartition(ctx context.Context, part storage.Partition, fn func(storage.Batch) error) error {
+	p, ok := s.next.(storage.Partitioner)
+	if !ok {
+		return fmt.Errorf("%s backend has no partitions", s.backend)
+	}
+	ctx, q := s.start(ctx, "exportPartition", attribute.Int64("solana.partition", int64(part.ID)))
+	var rows int
+	err := p.ExportPartition(ctx, part, func(b storage.Batch) error {
+		rows += len(b.Blocks) + len(b.Transactions) + len(b.Signatures)
+		return fn(b)
+	})
+	q.end(err, rows)
+	return err
+}
+
+// ExportTransactions forwards to the wrapped store when it can export.
+func (s *Store) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	e, ok := s.next.(storage.Exporter)
+	if !ok {
+		return fmt.Errorf("%s backend has no export", s.backend)
+	}
+	ctx, qr := s.start(ctx, "exportTransactions", attribute.Int64("solana.slot", int64(q.FromSlot)))
+	var rows int
+	err := e.ExportTransactions(ctx, q, func(txs []model.Transaction) error {
+		rows += len(txs)
+		return fn(txs)
+	})
+	qr.end(err, rows)
+	return err
+}
+
+// DropPartition forwards to the wrapped store when it has partitions.
+func (s *Store) DropPartition(ctx context.Context, part storage.Partition) error {
+	p, ok := s.next.(storage.Partitioner)
+	if !ok {
+		return fmt.Errorf("%s backend has no partitions", s.backend)
+	}
+	ctx, q := s.start(ctx, "dropPartition", attribute.Int64("solana.partition", int64(part.ID)))
+	err := p.DropPartition(ctx, part)
+	q.end(err, 0)
+	return err
+}
+
+// query tracks one in-flight backend call.
+type query struct {
+	s      *Store
+	method string
+	attrs  []attribute.KeyValue
+	span   trace.Span
+	start  time.Time
+}
+
+func (s *Store) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, *query) {
+	attrs = append(attrs, attribute.String("db.system", s.backend))
+	ctx, span := s.tracer.Start(ctx, "storage."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx, &query{s: s, method: method, attrs: attrs, span: span, start: time.Now()}
+}
+
+func (q *query) end(err error, rows int) {
+	dur := time.Since(q.start)
+	status := "ok"
+	if err != nil {
+		status = "error"
+		q.span.RecordError(err)
+		q.span.SetStatus(codes.Error, err.Error())
+	}
+	q.span.SetAttributes(attribute.Int("db.rows", rows))
+	q.span.End()
+
+	queryDuration.WithLabelValues(q.s.backend, q.method, status).Observe(dur.Seconds())
+	queryRows.WithLabelValues(q.s.backend, q.method).Observe(float64(rows))
+
+	if q.s.slow > 0 && dur >= q.s.slow {
+		slowQueries.WithLabelValues(q.s.backend, q.method).Inc()
+		fields := make([]zap.Field, 0, len(q.attrs)+4)
+		fields = append(fields,
+			zap.String("method", q.method),
+			zap.Duration("dur", dur),
+			zap.Int("rows", rows),
+			zap.Error(err),
+		)
+		for _, a := range q.attrs {
+			fields = append(fields, zap.String(string(a.Key), a.Value.Emit()))
+		}
+		q.s.log.Warn("slow query", fields...)
+	}
+}
+
+func rowsOf(found bool) int {
+	if found {
+		return 1
+	}
+	return 0
+}
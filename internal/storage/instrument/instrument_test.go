@@ -0,0 +1,88 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// readOnly implements only storage.HistoricalStore.
+type readOnly struct{}
+
+func (readOnly) Ping(context.Context) error { return nil }
+func (readOnly) Close() error               { return nil }
+func (readOnly) GetBlock(ctx context.Context, slot uint64, c storage.Commitment) (*model.Block, error) {
+	return nil, errors.New("unavailable")
+}
+func (readOnly) GetBlocksWithLimit(ctx context.Context, start, limit uint64, c storage.Commitment) ([]uint64, error) {
+	return []uint64{start, start + 1}, nil
+}
+func (readOnly) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) { return nil, nil }
+func (readOnly) GetTransaction(ctx context.Context, sig string, c storage.Commitment) (*model.Transaction, error) {
+	return nil, nil
+}
+func (readOnly) GetSignaturesForAddress(ctx context.Context, addr string, opts storage.SignatureOpts) ([]model.SignatureInfo, error) {
+	return nil, nil
+}
+
+type writable struct {
+	readOnly
+	batches []storage.Batch
+}
+
+func (w *writable) WriteBatch(ctx context.Context, b storage.Batch) error {
+	w.batches = append(w.batches, b)
+	return nil
+}
+
+func TestStoreCapabilities(t *testing.T) {
+	ro := New(readOnly{}, "ro")
+	_, ok := storage.As[storage.Writer](ro)
+	require.False(t, ok)
+	_, ok = storage.As[storage.Promoter](ro)
+	require.False(t, ok)
+	_, ok = storage.As[storage.Partitioner](ro)
+	require.False(t, ok)
+	_, ok = storage.As[storage.Exporter](ro)
+	require.False(t, ok)
+
+	next := &writable{}
+	st := New(next, "rw")
+	w, ok := storage.As[storage.Writer](st)
+	require.True(t, ok)
+	require.Same(t, st, w, "writes go through the decorator")
+	require.NoError(t, w.WriteBatch(context.Background(), storage.Batch{Blocks: []model.Block{{Slot: 1}}}))
+	require.Len(t, next.batches, 1)
+	_, ok = storage.As[storage.Promoter](st)
+	require.False(t, ok)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	st := New(readOnly{}, "metrics", WithSlowThreshold(time.Nanosecond))
+	ctx := context.Background()
+	slots, err := st.GetBlocksWithLimit(ctx, 10, 2, storage.CommitmentFinalized)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10, 11}, slots)
+	_, err = st.GetBlock(ctx, 10, storage.CommitmentFinalized)
+	require.Error(t, err)
+
+	require.EqualValues(t, 1, histogram(t, queryDuration, "metrics", "getBlocksWithLimit", "ok").GetSampleCount())
+	require.EqualValues(t, 1, histogram(t, queryDuration, "metrics", "getBlock", "error").GetSampleCount())
+	require.EqualValues(t, 2, histogram(t, queryRows, "metrics", "getBlocksWithLimit").GetSampleSum())
+	require.Equal(t, 1.0, testutil.ToFloat64(slowQueries.WithLabelValues("metrics", "getBlock")))
+}
+
+func histogram(t *testing.T, vec *prometheus.HistogramVec, labels ...string) *dto.Histogram {
+	var m dto.Metric
+	require.NoError(t, vec.WithLabelValues(labels...).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram()
+}
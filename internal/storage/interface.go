@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"math"
 	"time"
 
 	"github.com/lilythecat859/rpcv2-hist/internal/model"
@@ -26,6 +27,111 @@ type HistoricalStore interface {
 	GetSignaturesForAddress(ctx context.Context, addr string, opts SignatureOpts) ([]model.SignatureInfo, error)
 }
 
+// Unwrapper is implemented by stores that decorate another, forwarding
+// its optional interfaces whether or not it implements them.
+type Unwrapper interface {
+	Unwrap() HistoricalStore
+}
+
+// As returns s as a T, such as a Writer, if s and every store it decorates
+// implement T. A decorator's forwarding methods alone do not count: the
+// store at the bottom must implement T too.
+func As[T any](s HistoricalStore) (T, bool) {
+	t, ok := s.(T)
+	for ok {
+		u, isU := s.(Unwrapper)
+		if !isU {
+			return t, true
+		}
+		s = u.Unwrap()
+		_, ok = s.(T)
+	}
+	var zero T
+	return zero, false
+}
+
+// Writer is implemented by backends that accept ingested rows.
+type Writer interface {
+	WriteBatch(ctx context.Context, b Batch) error
+}
+
+// Batch is the set of rows the ingester derives from a run of blocks.
+type Batch struct {
+	Commitment   Commitment
+	Blocks       []model.Block
+	Transactions []model.Transaction
+	Signatures   []model.SignatureRow
+}
+
+// Promoter is implemented by backends that can move ingested rows between
+// commitment levels.
+type Promoter interface {
+	// Promote moves the rows of slots from one level to a higher one.
+	Promote(ctx context.Context, slots []uint64, from, to Commitment) error
+	// Rollback deletes the rows of slots at level c, for abandoned forks.
+	Rollback(ctx context.Context, slots []uint64, c Commitment) error
+}
+
+// Partitioner is implemented by backends whose rows can be moved out a
+// partition at a time.
+type Partitioner interface {
+	// Partitions lists the partitions holding finalized blocks, oldest first.
+	Partitions(ctx context.Context) ([]Partition, error)
+	// ExportPartition feeds fn the finalized rows of p in batches of one
+	// table's rows, in slot order.
+	ExportPartition(ctx context.Context, p Partition, fn func(Batch) error) error
+	// DropPartition deletes p. It fails if p holds rows below finalized,
+	// which ExportPartition does not archive.
+	DropPartition(ctx context.Context, p Partition) error
+}
+
+// Partition is a slot range a backend stores and drops as a unit.
+type Partition struct {
+	ID           uint64
+	MinSlot      uint64 // of the finalized blocks it holds
+	MaxSlot      uint64
+	MaxBlockTime int64
+	Blocks       uint64
+	Unfinalized  uint64 // blocks at lower commitment levels, not exported
+}
+
+// Exporter is implemented by backends that can stream every finalized
+// transaction of a slot range.
+type Exporter interface {
+	// ExportTransactions feeds fn the finalized transactions matching q in
+	// batches, in slot order.
+	ExportTransactions(ctx context.Context, q ExportQuery, fn func([]model.Transaction) error) error
+}
+
+// ExportQuery selects transactions by slot and block time, bounds
+// included; a zero upper bound leaves that end open.
+type ExportQuery struct {
+	FromSlot uint64
+	ToSlot   uint64
+	FromTime int64 // unix seconds
+	ToTime   int64
+	Address  string // when set, only transactions referencing it
+	// MaxRows, when set, lets a store fail a query matching more
+	// transactions rather than hold them all.
+	MaxRows int64
+}
+
+// Slots returns the slot bounds with an open end filled in.
+func (q ExportQuery) Slots() (uint64, uint64) {
+	if q.ToSlot == 0 {
+		return q.FromSlot, math.MaxUint64
+	}
+	return q.FromSlot, q.ToSlot
+}
+
+// Times returns the block time bounds with an open end filled in.
+func (q ExportQuery) Times() (int64, int64) {
+	if q.ToTime == 0 {
+		return q.FromTime, math.MaxInt64
+	}
+	return q.FromTime, q.ToTime
+}
+
 // Commitment level alias to avoid importing Solana SDK here.
 type Commitment string
 
@@ -0,0 +1,260 @@
+// Package parquet serves finalized history from a Parquet dataset, such as
+// the archive the tiering job moves old ClickHouse partitions into.
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/health"
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+type Config struct {
+	Dir string
+}
+
+// refreshInterval is how often the manifest is checked for files added
+// while the dataset is served.
+const refreshInterval = 5 * time.Second
+
+// Store answers reads from the dataset under Config.Dir. Every row in it is
+// finalized, so reads at any commitment level see all of it; lookups of
+// missing rows return nil.
+type Store struct {
+	dir    string
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	ds      *parquet.Dataset // nil until there is a manifest
+	modTime time.Time
+	checked time.Time
+	loaded  time.Time
+	err     error // of the last refresh
+}
+
+type Option func(*Store)
+
+func WithLogger(l *zap.Logger) Option {
+	return func(s *Store) { s.logger = l }
+}
+
+func New(ctx context.Context, cfg Config, opts ...Option) (*Store, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("parquet: Dir required")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	s := &Store{dir: cfg.Dir, logger: zap.NewNop()}
+	for _, o := range opts {
+		o(s)
+	}
+	if _, err := s.dataset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dataset returns the dataset as of its newest manifest.
+func (s *Store) dataset() (*parquet.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checked.IsZero() && time.Since(s.checked) < refreshInterval {
+		return s.ds, nil
+	}
+	s.checked = time.Now()
+	s.err = nil
+	fi, err := os.Stat(filepath.Join(s.dir, parquet.ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		s.err = err
+		return nil, err
+	}
+	if s.ds != nil && fi.ModTime().Equal(s.modTime) {
+		return s.ds, nil
+	}
+	ds, err := parquet.OpenDataset(s.dir)
+	if err != nil {
+		s.err = err
+		return nil, err
+	}
+	if s.ds != nil {
+		s.logger.Info("parquet manifest reloaded", zap.String("dir", s.dir))
+	}
+	s.ds, s.modTime, s.loaded = ds, fi.ModTime(), s.checked
+	return ds, nil
+}
+
+// CacheState reports the cached manifest. It refreshes it first if due,
+// so a manifest that stopped loading shows up without a query.
+func (s *Store) CacheState() health.CacheState {
+	_, _ = s.dataset()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := health.CacheState{LoadedAt: s.loaded, Err: s.err}
+	if s.ds != nil {
+		st.Entries = s.ds.Files()
+	}
+	return st
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) GetBlock(ctx context.Context, slot uint64, commitment storage.Commitment) (*model.Block, error) {
+	ds, err := s.dataset()
+	if ds == nil {
+		return nil, err
+	}
+	return ds.Block(ctx, slot)
+}
+
+func (s *Store) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commitment storage.Commitment) ([]uint64, error) {
+	ds, err := s.dataset()
+	if ds == nil {
+		return nil, err
+	}
+	return ds.BlockSlots(ctx, start, int(limit))
+}
+
+func (s *Store) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) {
+	blk, err := s.GetBlock(ctx, slot, storage.CommitmentFinalized)
+	if blk == nil {
+		return nil, err
+	}
+	t := time.Unix(blk.BlockTime, 0)
+	return &t, nil
+}
+
+func (s *Store) GetTransaction(ctx context.Context, signature string, commitment storage.Commitment) (*model.Transaction, error) {
+	ds, err := s.dataset()
+	if ds == nil {
+		return nil, err
+	}
+	return ds.Transaction(ctx, signature)
+}
+
+// GetSignaturesForAddress resolves before and until to the slots of their
+// transactions. A before signature the dataset does not hold sets no bound
+// and an until signature it does not hold matches nothing: either is newer
+// than everything archived, which holds only partitions older than the
+// live ones.
+func (s *Store) GetSignaturesForAddress(ctx context.Context, addr string, opts storage.SignatureOpts) ([]model.SignatureInfo, error) {
+	ds, err := s.dataset()
+	if ds == nil {
+		return nil, err
+	}
+	var before, until uint64
+	if opts.Before != nil {
+		tx, err := ds.Transaction(ctx, *opts.Before)
+		if err != nil {
+			return nil, err
+		}
+		if tx != nil {
+			before = tx.Slot
+		}
+	}
+	if opts.Until != nil {
+		tx, err := ds.Transaction(ctx, *opts.Until)
+		if tx == nil {
+			return nil, err
+		}
+		until = tx.Slot
+	}
+	// rows come newest first, so the ones at or below until are the last
+	rows, err := ds.Signatures(ctx, addr, before, int(opts.Limit))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]model.SignatureInfo, 0, len(rows))
+	for _, r := range rows {
+		if opts.Until != nil && r.Slot <= until {
+			break
+		}
+		out = append(out, model.SignatureInfo{
+			Signature: r.Signature,
+			Slot:      r.Slot,
+			Err:       r.Err,
+			Memo:      r.Memo,
+			BlockTime: time.Unix(r.BlockTime, 0),
+		})
+	}
+	return out, nil
+}
+
+// exportBatch is how many transactions ExportTransactions passes at a time.
+const exportBatch = 1000
+
+// ExportTransactions scans the transactions files overlapping the range.
+// With an address, the address index gives the signatures to keep, up to
+// q.MaxRows of them, and narrows the scan to the slots holding them.
+func (s *Store) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	ds, err := s.dataset()
+	if ds == nil {
+		return err
+	}
+	from, to := q.Slots()
+	fromTime, toTime := q.Times()
+	var keep map[string]bool
+	if q.Address != "" {
+		keep = make(map[string]bool)
+		lo, hi := to, from
+		err := ds.ScanSignatures(ctx, q.Address, from, to, func(r *model.SignatureRow) bool {
+			if r.BlockTime < fromTime || r.BlockTime > toTime {
+				return true
+			}
+			keep[r.Signature] = true
+			lo, hi = min(lo, r.Slot), max(hi, r.Slot)
+			return q.MaxRows <= 0 || int64(len(keep)) <= q.MaxRows
+		})
+		if err != nil {
+			return err
+		}
+		if q.MaxRows > 0 && int64(len(keep)) > q.MaxRows {
+			return fmt.Errorf("more than %d transactions match", q.MaxRows)
+		}
+		if len(keep) == 0 {
+			return nil
+		}
+		from, to = lo, hi
+	}
+	var (
+		batch []model.Transaction
+		ferr  error
+	)
+	err = ds.Transactions(ctx, from, to, fromTime, toTime, func(tx *model.Transaction) bool {
+		if keep != nil && !keep[tx.Signature] {
+			return true
+		}
+		if batch = append(batch, *tx); len(batch) < exportBatch {
+			return true
+		}
+		ferr, batch = fn(batch), nil
+		return ferr == nil
+	})
+	if err == nil {
+		err = ferr
+	}
+	if err == nil && len(batch) > 0 {
+		err = fn(batch)
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package telemetry
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// UnaryServerInterceptor records every unary gRPC call with its status code.
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		size := 0
+		if msg, ok := resp.(proto.Message); ok && err == nil {
+			size = proto.Size(msg)
+		}
+		m.RecordRequest(path.Base(info.FullMethod), status.Code(err).String(), time.Since(start).Seconds(), size)
+		return resp, err
+	}
+}
@@ -6,9 +6,16 @@ import (
 )
 
 func NewLogger(level string) (*zap.Logger, error) {
+	l, _, err := NewLeveledLogger(level)
+	return l, err
+}
+
+// NewLeveledLogger also returns the logger's AtomicLevel so the level can be
+// changed at runtime.
+func NewLeveledLogger(level string) (*zap.Logger, zap.AtomicLevel, error) {
 	var lvl zapcore.Level
 	if err := lvl.UnmarshalText([]byte(level)); err != nil {
-		return nil, err
+		return nil, zap.AtomicLevel{}, err
 	}
 	cfg := zap.NewProductionConfig()
 	cfg.Level = zap.NewAtomicLevelAt(lvl)
@@ -16,5 +23,6 @@ func NewLogger(level string) (*zap.Logger, error) {
 	cfg.ErrorOutputPaths = []string{"stderr"}
 	cfg.EncoderConfig.TimeKey = "ts"
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	return cfg.Build()
+	l, err := cfg.Build()
+	return l, cfg.Level, err
 }
\ No newline at end of file
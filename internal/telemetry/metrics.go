@@ -1,38 +1,49 @@
 package telemetry
 
 import (
-	"context"
-
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"go.opentelemetry.io/otel/metric"
 )
 
 var (
 	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "rpcv2_hist_request_duration_seconds",
 		Help: "Duration of RPC requests in seconds",
-	}, []string{"method", "status"})
+	}, []string{"api", "method", "status"})
 
 	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "rpcv2_hist_requests_total",
 		Help: "Total number of RPC requests",
-	}, []string{"method", "status"})
+	}, []string{"api", "method", "status"})
+
+	responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpcv2_hist_response_size_bytes",
+		Help:    "Size of RPC responses in bytes",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 10), // 64 B .. 16 MB
+	}, []string{"api", "method"})
 )
 
+// Metrics records request outcomes for one API surface (jsonrpc, rest,
+// grpc). A request may read several backends; their own latency is in the
+// rpcv2_hist_backend_* metrics.
 type Metrics struct {
+	api             string
 	requestDuration prometheus.ObserverVec
 	requestCount    *prometheus.CounterVec
+	responseSize    prometheus.ObserverVec
 }
 
-func NewMetrics() *Metrics {
+func NewMetrics(api string) *Metrics {
 	return &Metrics{
+		api:             api,
 		requestDuration: requestDuration,
 		requestCount:    requestCount,
+		responseSize:    responseSize,
 	}
 }
 
-func (m *Metrics) RecordRequest(method string, status string, duration float64) {
-	m.requestDuration.WithLabelValues(method, status).Observe(duration)
-	m.requestCount.WithLabelValues(method, status).Inc()
-}
\ No newline at end of file
+func (m *Metrics) RecordRequest(method string, status string, duration float64, size int) {
+	m.requestDuration.WithLabelValues(m.api, method, status).Observe(duration)
+	m.requestCount.WithLabelValues(m.api, method, status).Inc()
+	m.responseSize.WithLabelValues(m.api, method).Observe(float64(size))
+}
@@ -0,0 +1,80 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestInstrument(t *testing.T) {
+	m := NewMetrics("rest")
+	h := m.Instrument("getBlock", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	for _, p := range []string{"/ok", "/ok", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+
+	require.Equal(t, 2.0, testutil.ToFloat64(requestCount.WithLabelValues("rest", "getBlock", "200")))
+	require.Equal(t, 1.0, testutil.ToFloat64(requestCount.WithLabelValues("rest", "getBlock", "404")))
+	sizes := histogram(t, responseSize, "rest", "getBlock")
+	require.EqualValues(t, 3, sizes.GetSampleCount())
+	require.Equal(t, float64(2*len("hello")+len("not found\n")), sizes.GetSampleSum())
+	require.EqualValues(t, 2, histogram(t, requestDuration, "rest", "getBlock", "200").GetSampleCount())
+}
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewStatusRecorder(w)
+	require.Equal(t, http.StatusOK, rec.Status, "a handler that never calls WriteHeader sent 200")
+	rec.WriteHeader(http.StatusTeapot)
+	n, err := rec.Write([]byte("tea"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, http.StatusTeapot, rec.Status)
+	require.Equal(t, 3, rec.Bytes)
+	require.Equal(t, http.StatusTeapot, w.Code)
+	require.Same(t, w, rec.Unwrap())
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	intercept := NewMetrics("grpc").UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/rpcv2.Historical/GetTransaction"}
+	resp := wrapperspb.String("signature")
+
+	_, err := intercept(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return resp, nil
+	})
+	require.NoError(t, err)
+	_, err = intercept(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such transaction")
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	require.Equal(t, 1.0, testutil.ToFloat64(requestCount.WithLabelValues("grpc", "GetTransaction", "OK")))
+	require.Equal(t, 1.0, testutil.ToFloat64(requestCount.WithLabelValues("grpc", "GetTransaction", "NotFound")))
+	sizes := histogram(t, responseSize, "grpc", "GetTransaction")
+	require.EqualValues(t, 2, sizes.GetSampleCount())
+	require.Equal(t, float64(proto.Size(resp)), sizes.GetSampleSum(), "failed calls count no bytes")
+}
+
+func histogram(t *testing.T, vec *prometheus.HistogramVec, labels ...string) *dto.Histogram {
+	var m dto.Metric
+	require.NoError(t, vec.WithLabelValues(labels...).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram()
+}
@@ -0,0 +1,166 @@
+package tier
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+)
+
+// Store serves a hot backend whose old partitions a Job moves into an
+// archive: reads go to the hot backend first and to the archive for what
+// it does not hold. Archived slots are all older than the hot ones.
+type Store struct {
+	hot     storage.HistoricalStore
+	archive storage.HistoricalStore
+}
+
+func NewStore(hot, archive storage.HistoricalStore) *Store {
+	return &Store{hot: hot, archive: archive}
+}
+
+// missing reports whether the hot backend lacks a row: ClickHouse reports
+// a missing row as an error.
+func missing[T any](v *T, err error) bool {
+	return (v == nil && err == nil) || errors.Is(err, sql.ErrNoRows)
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return errors.Join(s.hot.Ping(ctx), s.archive.Ping(ctx))
+}
+
+// Close leaves both backends open: they are shared with other shards.
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) GetBlock(ctx context.Context, slot uint64, commitment storage.Commitment) (*model.Block, error) {
+	blk, err := s.hot.GetBlock(ctx, slot, commitment)
+	if missing(blk, err) {
+		return s.archive.GetBlock(ctx, slot, commitment)
+	}
+	return blk, err
+}
+
+func (s *Store) GetBlocksWithLimit(ctx context.Context, start, limit uint64, commitment storage.Commitment) ([]uint64, error) {
+	slots, err := s.archive.GetBlocksWithLimit(ctx, start, limit, commitment)
+	if err != nil || uint64(len(slots)) >= limit {
+		return slots, err
+	}
+	next := start
+	if len(slots) > 0 {
+		next = slots[len(slots)-1] + 1
+	}
+	hot, err := s.hot.GetBlocksWithLimit(ctx, next, limit-uint64(len(slots)), commitment)
+	if err != nil {
+		return nil, err
+	}
+	return append(slots, hot...), nil
+}
+
+func (s *Store) GetBlockTime(ctx context.Context, slot uint64) (*time.Time, error) {
+	t, err := s.hot.GetBlockTime(ctx, slot)
+	if missing(t, err) {
+		return s.archive.GetBlockTime(ctx, slot)
+	}
+	return t, err
+}
+
+func (s *Store) GetTransaction(ctx context.Context, signature string, commitment storage.Commitment) (*model.Transaction, error) {
+	tx, err := s.hot.GetTransaction(ctx, signature, commitment)
+	if missing(tx, err) {
+		return s.archive.GetTransaction(ctx, signature, commitment)
+	}
+	return tx, err
+}
+
+// GetSignaturesForAddress continues into the archive when the hot backend
+// returns fewer than the limit. A before or until signature found in the
+// archive is older than every hot row, which the hot backend cannot tell.
+func (s *Store) GetSignaturesForAddress(ctx context.Context, addr string, opts storage.SignatureOpts) ([]model.SignatureInfo, error) {
+	hotOpts := opts
+	var skipHot bool
+	if opts.Before != nil {
+		in, err := s.archived(ctx, *opts.Before, opts.Commitment)
+		if err != nil {
+			return nil, err
+		}
+		skipHot = in
+	}
+	if opts.Until != nil && !skipHot {
+		in, err := s.archived(ctx, *opts.Until, opts.Commitment)
+		if err != nil {
+			return nil, err
+		}
+		if in {
+			hotOpts.Until = nil
+		}
+	}
+	var sigs []model.SignatureInfo
+	if !skipHot {
+		var err error
+		sigs, err = s.hot.GetSignaturesForAddress(ctx, addr, hotOpts)
+		if err != nil || uint64(len(sigs)) >= opts.Limit {
+			return sigs, err
+		}
+	}
+	rest := opts
+	rest.Limit -= uint64(len(sigs))
+	old, err := s.archive.GetSignaturesForAddress(ctx, addr, rest)
+	if err != nil {
+		return nil, err
+	}
+	// a partition is in both while it is being moved
+	seen := make(map[string]bool, len(sigs))
+	for _, si := range sigs {
+		seen[si.Signature] = true
+	}
+	for _, si := range old {
+		if !seen[si.Signature] {
+			sigs = append(sigs, si)
+		}
+	}
+	return sigs, nil
+}
+
+func (s *Store) archived(ctx context.Context, sig string, c storage.Commitment) (bool, error) {
+	tx, err := s.archive.GetTransaction(ctx, sig, c)
+	return tx != nil, err
+}
+
+// ExportTransactions exports from the archive, then from the hot backend
+// past the last slot the archive had, so a partition in both while it is
+// being moved is exported once.
+func (s *Store) ExportTransactions(ctx context.Context, q storage.ExportQuery, fn func([]model.Transaction) error) error {
+	archive, ok := storage.As[storage.Exporter](s.archive)
+	if !ok {
+		return errors.New("tier: archive backend has no export")
+	}
+	hot, ok := storage.As[storage.Exporter](s.hot)
+	if !ok {
+		return errors.New("tier: hot backend has no export")
+	}
+	var (
+		last uint64
+		seen bool
+	)
+	err := archive.ExportTransactions(ctx, q, func(txs []model.Transaction) error {
+		for _, tx := range txs {
+			last, seen = max(last, tx.Slot), true
+		}
+		return fn(txs)
+	})
+	if err != nil {
+		return err
+	}
+	if seen {
+		if _, to := q.Slots(); last >= to {
+			return nil
+		}
+		q.FromSlot = max(q.FromSlot, last+1)
+	}
+	return hot.ExportTransactions(ctx, q, fn)
+}
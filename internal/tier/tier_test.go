@@ -0,0 +1,189 @@
+package tier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lilythecat859/rpcv2-hist/internal/model"
+	"github.com/lilythecat859/rpcv2-hist/internal/objstore"
+	"github.com/lilythecat859/rpcv2-hist/internal/parquet"
+	"github.com/lilythecat859/rpcv2-hist/internal/storage"
+	pqstore "github.com/lilythecat859/rpcv2-hist/internal/storage/parquet"
+)
+
+// fakeSource holds partitions of five blocks, each with one transaction
+// touching alice.
+type fakeSource struct {
+	parts    []storage.Partition
+	rows     map[uint64]storage.Batch
+	dropped  []uint64
+	failDrop map[uint64]bool
+	grow     map[uint64]bool // add a block while exporting
+}
+
+func (f *fakeSource) add(id uint64, blockTime int64) {
+	first := id * 864_000
+	var b storage.Batch
+	for slot := first; slot < first+5; slot++ {
+		sig := fmt.Sprint("sig", slot)
+		b.Blocks = append(b.Blocks, model.Block{Slot: slot, Blockhash: "hash", ParentSlot: slot - 1, BlockTime: blockTime, Raw: []byte(`{}`)})
+		b.Transactions = append(b.Transactions, model.Transaction{Signature: sig, Slot: slot, BlockTime: blockTime, Signer: "alice", Raw: []byte(`{}`)})
+		b.Signatures = append(b.Signatures, model.SignatureRow{Address: "alice", Signature: sig, Slot: slot, BlockTime: blockTime})
+	}
+	f.rows[id] = b
+	f.parts = append(f.parts, storage.Partition{ID: id, MinSlot: first, MaxSlot: first + 4, MaxBlockTime: blockTime, Blocks: 5})
+}
+
+func (f *fakeSource) Partitions(ctx context.Context) ([]storage.Partition, error) {
+	return slices.Clone(f.parts), nil
+}
+
+func (f *fakeSource) ExportPartition(ctx context.Context, p storage.Partition, fn func(storage.Batch) error) error {
+	b := f.rows[p.ID]
+	if f.grow[p.ID] {
+		delete(f.grow, p.ID)
+		grown := f.rows[p.ID]
+		last := grown.Blocks[len(grown.Blocks)-1]
+		last.Slot++
+		grown.Blocks = append(slices.Clip(grown.Blocks), last)
+		f.rows[p.ID] = grown
+		i := slices.IndexFunc(f.parts, func(q storage.Partition) bool { return q.ID == p.ID })
+		f.parts[i].MaxSlot, f.parts[i].Blocks = last.Slot, f.parts[i].Blocks+1
+	}
+	return errors.Join(fn(storage.Batch{Blocks: b.Blocks}), fn(storage.Batch{Transactions: b.Transactions}), fn(storage.Batch{Signatures: b.Signatures}))
+}
+
+func (f *fakeSource) DropPartition(ctx context.Context, p storage.Partition) error {
+	if f.failDrop[p.ID] {
+		delete(f.failDrop, p.ID)
+		return errors.New("too large to drop")
+	}
+	f.dropped = append(f.dropped, p.ID)
+	f.parts = slices.DeleteFunc(f.parts, func(q storage.Partition) bool { return q.ID == p.ID })
+	return nil
+}
+
+func TestJobMovesOldPartitions(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	old := now.Add(-48 * time.Hour).Unix()
+	src := &fakeSource{rows: map[uint64]storage.Batch{}, failDrop: map[uint64]bool{1: true}}
+	src.add(0, old)
+	src.add(1, old)
+	src.add(2, old) // newest, so it stays
+	root, bucket := t.TempDir(), objstore.Dir(t.TempDir())
+	j := New(src, root, bucket, WithRetention(24*time.Hour))
+	j.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	n, err := j.RunOnce(ctx)
+	require.ErrorContains(t, err, "too large to drop")
+	require.Equal(t, 1, n)
+	// partition 1 is archived but not dropped, and is moved again
+	n, err = j.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []uint64{0, 1}, src.dropped)
+	require.NoDirExists(t, filepath.Join(root, parquet.StagingDir, "1"))
+
+	m, err := parquet.ReadManifest(root)
+	require.NoError(t, err)
+	require.Len(t, m.Table("blocks", 0, ^uint64(0)), 2)
+	for _, f := range append(m.Files, parquet.FileInfo{Path: parquet.ManifestName}) {
+		_, err := bucket.Stat(ctx, f.Path)
+		require.NoError(t, err, f.Path)
+	}
+
+	archive, err := pqstore.New(ctx, pqstore.Config{Dir: root})
+	require.NoError(t, err)
+	tx, err := archive.GetTransaction(ctx, "sig864002", storage.CommitmentFinalized)
+	require.NoError(t, err)
+	require.Equal(t, uint64(864_002), tx.Slot)
+	sigs, err := archive.GetSignaturesForAddress(ctx, "alice", storage.SignatureOpts{Limit: 100})
+	require.NoError(t, err)
+	require.Len(t, sigs, 10)
+
+	// the read-through store serves partition 2 from the hot side and the
+	// rest from the archive
+	hotDir := t.TempDir()
+	w, err := parquet.NewWriter(hotDir)
+	require.NoError(t, err)
+	require.NoError(t, src.ExportPartition(ctx, src.parts[0], func(b storage.Batch) error {
+		return errors.Join(w.WriteBlocks(b.Blocks), w.WriteTransactions(b.Transactions), w.WriteSignatures(b.Signatures))
+	}))
+	require.NoError(t, w.Close())
+	hot, err := pqstore.New(ctx, pqstore.Config{Dir: hotDir})
+	require.NoError(t, err)
+	s := NewStore(hot, archive)
+
+	blk, err := s.GetBlock(ctx, 3, storage.CommitmentFinalized)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), blk.Slot)
+	slots, err := s.GetBlocksWithLimit(ctx, 864_003, 4, storage.CommitmentFinalized)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{864_003, 864_004, 1_728_000, 1_728_001}, slots)
+	before := "sig1728001"
+	sigs, err = s.GetSignaturesForAddress(ctx, "alice", storage.SignatureOpts{Limit: 3, Before: &before})
+	require.NoError(t, err)
+	require.Equal(t, []string{"sig1728000", "sig864004", "sig864003"}, []string{sigs[0].Signature, sigs[1].Signature, sigs[2].Signature})
+	until := "sig864003"
+	sigs, err = s.GetSignaturesForAddress(ctx, "alice", storage.SignatureOpts{Limit: 100, Until: &until})
+	require.NoError(t, err)
+	require.Len(t, sigs, 6)
+
+	// exports read the archive, then the hot side past it
+	var got []uint64
+	err = s.ExportTransactions(ctx, storage.ExportQuery{FromSlot: 3, Address: "alice"}, func(txs []model.Transaction) error {
+		for _, tx := range txs {
+			got = append(got, tx.Slot)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4, 864_000, 864_001, 864_002, 864_003, 864_004, 1_728_000, 1_728_001, 1_728_002, 1_728_003, 1_728_004}, got)
+	err = s.ExportTransactions(ctx, storage.ExportQuery{Address: "bob"}, func(txs []model.Transaction) error {
+		return fmt.Errorf("%d transactions for bob", len(txs))
+	})
+	require.NoError(t, err)
+}
+
+func TestJobKeepsPartitionWrittenDuringExport(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	old := now.Add(-48 * time.Hour).Unix()
+	src := &fakeSource{rows: map[uint64]storage.Batch{}, grow: map[uint64]bool{0: true}}
+	src.add(0, old)
+	src.add(1, old)
+	j := New(src, t.TempDir(), objstore.Dir(t.TempDir()), WithRetention(24*time.Hour))
+	j.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	_, err := j.RunOnce(ctx)
+	require.ErrorContains(t, err, "changed during export: 6 blocks")
+	require.Empty(t, src.dropped)
+
+	n, err := j.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []uint64{0}, src.dropped)
+}
+
+func TestJobKeepsPartitionWithUnfinalizedRows(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	old := now.Add(-48 * time.Hour).Unix()
+	src := &fakeSource{rows: map[uint64]storage.Batch{}}
+	src.add(0, old)
+	src.add(1, old)
+	src.parts[0].Unfinalized = 2
+	j := New(src, t.TempDir(), objstore.Dir(t.TempDir()), WithRetention(24*time.Hour))
+	j.now = func() time.Time { return now }
+
+	_, err := j.RunOnce(context.Background())
+	require.ErrorContains(t, err, "2 blocks not yet finalized")
+	require.Empty(t, src.dropped)
+}
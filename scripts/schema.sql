@@ -1,6 +1,9 @@
 -- AGPL-3.0
 -- ClickHouse schema for rpcv2-hist
 -- Keeps hot partitions on NVMe, cold on S3 via TTL+storage policy
+-- Row tables are ReplacingMergeTree: a row written again for the same
+-- sorting key (replays, backfills, reconnects) replaces the older one by
+-- version on merge; readers pick the newest version until then.
 
 CREATE DATABASE IF NOT EXISTS solana;
 
@@ -13,8 +16,9 @@ CREATE TABLE IF NOT EXISTS solana.blocks
     block_time  Int64,
     height      UInt64,
     commitment  Enum8('processed' = 1, 'confirmed' = 2, 'finalized' = 3),
-    raw         String CODEC(LZ4)
-) ENGINE = MergeTree
+    raw         String CODEC(LZ4),
+    version     UInt64 DEFAULT toUInt64(toUnixTimestamp64Nano(now64(9)))
+) ENGINE = ReplacingMergeTree(version)
 PARTITION BY intDiv(slot, 864000)     -- ~100k slots per partition
 ORDER BY (commitment, slot)
 TTL toDateTime(block_time) + INTERVAL 30 DAY TO VOLUME 'cold'
@@ -32,8 +36,9 @@ CREATE TABLE IF NOT EXISTS solana.transactions
     compute_units UInt64,
     err           Nullable(String),
     commitment    Enum8('processed' = 1, 'confirmed' = 2, 'finalized' = 3),
-    raw           String CODEC(LZ4)
-) ENGINE = MergeTree
+    raw           String CODEC(LZ4),
+    version       UInt64 DEFAULT toUInt64(toUnixTimestamp64Nano(now64(9)))
+) ENGINE = ReplacingMergeTree(version)
 PARTITION BY intDiv(slot, 864000)
 ORDER BY (commitment, signature)
 TTL toDateTime(block_time) + INTERVAL 30 DAY TO VOLUME 'cold'
@@ -48,8 +53,9 @@ address     String,
     block_time  Int64,
     err         Nullable(String),
     memo        Nullable(String),
-    commitment  Enum8('processed' = 1, 'confirmed' = 2, 'finalized' = 3)
-) ENGINE = MergeTree
+    commitment  Enum8('processed' = 1, 'confirmed' = 2, 'finalized' = 3),
+    version     UInt64 DEFAULT toUInt64(toUnixTimestamp64Nano(now64(9)))
+) ENGINE = ReplacingMergeTree(version)
 PARTITION BY intDiv(slot, 864000)
 ORDER BY (commitment, address, slot, signature)
 TTL toDateTime(block_time) + INTERVAL 30 DAY TO VOLUME 'cold'